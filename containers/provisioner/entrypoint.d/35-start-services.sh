@@ -4,5 +4,6 @@
 provisioner-mgmt \
     --api-port "$APIPORT" \
     --static-port "${WEBPORT}" \
+    --static-tls-port "${TLSWEBPORT}" \
     --tftp-port 69 \
     --file-root "$TFTPROOT" &
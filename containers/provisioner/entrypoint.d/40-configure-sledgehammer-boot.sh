@@ -60,6 +60,7 @@ SLEDGE_ARGS=("rootflags=loop"
             )
 cat > "$TFTPROOT/default.ipxe" <<EOF
 #!ipxe
+chain tftp://$PROV_IP/\${netX/mac}.ipxe && goto bail ||
 chain tftp://$PROV_IP/\${netX/ip}.ipxe && goto bail || goto sledgehammer
 :sledgehammer
 kernel tftp://$PROV_IP/vmlinuz0 ${SLEDGE_ARGS[@]} BOOTIF=01-\${netX/mac:hexhyp}
@@ -66,15 +66,30 @@ end
 # We keep this around to let local users add stuff to
 # DNS that Rebar will not manage.
 # We also create a named.conf.rebar if it does not exist to
-# keep bind happy before we start creating nodes.
-
-%w[local rebar].each do |z|
+# keep bind happy before we start creating nodes.  It includes
+# the other zone files, as they have to go inside views when
+# there are any.  A named.conf.rebar from before that is
+# missing those includes gets them added at the top, or bind
+# would lose the default and local zones until dns-mgmt next
+# rewrites it.
+
+%w[local consul].each do |z|
   bash "/etc/bind/named.conf.#{z}" do
     code "touch /etc/bind/named.conf.#{z}"
     not_if { ::File.exists? "/etc/bind/named.conf.#{z}" }
   end
 end
 
+rebar_conf = '/etc/bind/named.conf.rebar'
+ruby_block rebar_conf do
+  block do
+    old = ::File.exists?(rebar_conf) ? ::File.read(rebar_conf) : ''
+    includes = %w[default-zones local consul].map { |z| "include \"/etc/bind/named.conf.#{z}\";\n" }.join
+    ::File.open(rebar_conf, 'w') { |f| f.write(includes + old) }
+  end
+  not_if { ::File.exists?(rebar_conf) && ::File.read(rebar_conf).include?('named.conf.default-zones') }
+end
+
 # Rewrite our default configuration file
 template '/etc/named.conf' do
   source 'named.conf.erb'
@@ -55,7 +55,8 @@ class BarclampProvisioner::Service < Service
     payload = {'Name' => node.name,
                'Uuid' => node.uuid,
                'TenantId' => node.tenant_id,
-               'Address' => node.addresses(:v4_only)[0].addr,
+               'Address' => (node.addresses(:v4_only)[0].addr rescue nil),
+               'Macs' => node.hint['admin_macs'] || [],
                'BootEnv' => node.bootenv,
                'Params' => {}
               }
@@ -24,6 +24,13 @@ type keySaver interface {
 	RebuildRebarData() error
 }
 
+// liveThing is a keySaver with state that changes too often to be
+// saved, which is filled in whenever it is read through the API.
+type liveThing interface {
+	keySaver
+	live()
+}
+
 type storageBackend interface {
 	list(keySaver) [][]byte
 	save(keySaver, interface{}) error
@@ -2,16 +2,11 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
@@ -24,11 +19,12 @@ import (
 // RenderData is the struct that is passed to templates as a source of
 // parameters and useful methods.
 type RenderData struct {
-	Machine        *Machine // The Machine that the template is being rendered for.
-	Env            *BootEnv // The boot environment that provided the template.
-	ProvisionerURL string   // The URL to the provisioner that all files should be fetched from
-	CommandURL     string   // The URL of the API endpoint that this machine should talk to for command and control
-	TenantId       int      // The Tenant that this BootEnv belongs in
+	Machine             *Machine // The Machine that the template is being rendered for.
+	Env                 *BootEnv // The boot environment that provided the template.
+	ProvisionerURL      string   // The URL to the provisioner that all files should be fetched from
+	ProvisionerHTTPSURL string   // The URL to fetch files that should not go in the clear from, or empty if there is none
+	CommandURL          string   // The URL of the API endpoint that this machine should talk to for command and control
+	TenantId            int      // The Tenant that this BootEnv belongs in
 }
 
 // BootParams is a helper function that expands the BootParams
@@ -76,10 +72,17 @@ type TemplateInfo struct {
 	Path string // A template that specifies how to create
 	// the final path the template should be
 	// written to.
-	UUID      string // The UUID of the template that should be expanded.
-	pathTmpl  *template.Template
-	finalPath string
-	contents  *Template
+	UUID       string // The UUID of the template that should be expanded.
+	pathTmpl   *template.Template
+	finalPaths []*renderedPath
+	contents   *Template
+}
+
+// renderedPath is where a template is rendered to for a machine, along
+// with the machine as the template sees it.
+type renderedPath struct {
+	path    string
+	machine *Machine
 }
 
 type FileData struct {
@@ -117,6 +120,8 @@ type BootEnv struct {
 	BootParams     string          // A template that will be expanded to create the full list of boot parameters for the environment.
 	RequiredParams []string        // The list of extra required parameters for this bootstate. They should be present as Machine.Params when the bootenv is applied to the machine.
 	Available      bool
+	BootURIs       []*BootURI   // What DHCP servers should hand out for this environment to be booted over HTTP.  Filled in by the provisioner.
+	Progress       *IsoProgress `json:",omitempty"` // How far along extracting the ISO is, while it is being extracted or if it failed.
 	bootParamsTmpl *template.Template
 	TenantId       int
 	Errors         []string
@@ -140,8 +145,10 @@ func (b *BootEnv) Errorf(arg string, args ...interface{}) {
 // PathFor expands the partial paths for kernels and initrds into full
 // paths appropriate for specific protocols.
 //
-// proto can be one of 3 choices:
+// proto can be one of 4 choices:
 //    http: Will expand to the URL the file can be accessed over.
+//    https: Will expand to the URL the file can be accessed over with TLS,
+//           or over plain HTTP if the provisioner does not serve HTTPS.
 //    tftp: Will expand to the path the file can be accessed at via TFTP.
 //    disk: Will expand to the path of the file inside the provisioner container.
 func (b *BootEnv) PathFor(proto, f string) string {
@@ -156,6 +163,8 @@ func (b *BootEnv) PathFor(proto, f string) string {
 		return path.Join(res, f)
 	case "http":
 		return provisionerURL + "/" + path.Join(res, f)
+	case "https":
+		return secureURL() + "/" + path.Join(res, f)
 	default:
 		logger.Fatalf("Unknown protocol %v", proto)
 	}
@@ -240,37 +249,46 @@ func (b *BootEnv) newIsh() keySaver {
 }
 
 // RenderPaths renders the paths of the templates for this machine.
+// Paths are rendered once for each MAC address of the machine, and a
+// template is rendered to each of the different paths that come out.
+// A path that comes out empty is skipped, so templates can leave out
+// machines they have no way to name.
 func (b *BootEnv) RenderPaths(machine *Machine) error {
-	vars := &RenderData{
-		Machine:        machine,
-		Env:            b,
-		ProvisionerURL: provisionerURL,
-		CommandURL:     commandURL,
-		TenantId:       b.TenantId,
-	}
 	for _, templateParams := range b.Templates {
-		pathBuf := &bytes.Buffer{}
-		if err := templateParams.pathTmpl.Execute(pathBuf, vars); err != nil {
-			b.Errorf("template: Error rendering path %s (%s): %v",
-				templateParams.Name,
-				templateParams.Path,
-				err)
-			continue
+		templateParams.finalPaths = nil
+		seen := map[string]bool{}
+		for _, m := range machine.forEachMac() {
+			vars := &RenderData{
+				Machine:             m,
+				Env:                 b,
+				ProvisionerURL:      provisionerURL,
+				ProvisionerHTTPSURL: provisionerHTTPSURL,
+				CommandURL:          commandURL,
+				TenantId:            b.TenantId,
+			}
+			pathBuf := &bytes.Buffer{}
+			if err := templateParams.pathTmpl.Execute(pathBuf, vars); err != nil {
+				b.Errorf("template: Error rendering path %s (%s): %v",
+					templateParams.Name,
+					templateParams.Path,
+					err)
+				break
+			}
+			if pathBuf.Len() == 0 || seen[pathBuf.String()] {
+				continue
+			}
+			seen[pathBuf.String()] = true
+			templateParams.finalPaths = append(templateParams.finalPaths, &renderedPath{
+				path:    filepath.Join(fileRoot, pathBuf.String()),
+				machine: m,
+			})
 		}
-		templateParams.finalPath = filepath.Join(fileRoot, pathBuf.String())
 	}
 	return b.errorOrNil()
 }
 
 // RenderTemplates renders the templates in the bootenv with the data from the machine.
 func (b *BootEnv) RenderTemplates(machine *Machine) error {
-	vars := &RenderData{
-		Machine:        machine,
-		Env:            b,
-		ProvisionerURL: provisionerURL,
-		CommandURL:     commandURL,
-		TenantId:       b.TenantId,
-	}
 	b.parseTemplates()
 	b.RenderPaths(machine)
 	var missingParams []string
@@ -283,125 +301,55 @@ func (b *BootEnv) RenderTemplates(machine *Machine) error {
 		b.Errorf("bootenv: %s missing required machine params for %s:\n %v", b.Name, machine.Name, missingParams)
 	}
 	for _, templateParams := range b.Templates {
-		tmplPath := templateParams.finalPath
-		if err := os.MkdirAll(path.Dir(tmplPath), 0755); err != nil {
-			b.Errorf("template: Unable to create dir for %s: %v", tmplPath, err)
-			continue
-		}
-
-		tmplDest, err := os.Create(tmplPath)
-		if err != nil {
-			b.Errorf("template: Unable to create file %s: %v", tmplPath, err)
-			continue
-		}
-		defer tmplDest.Close()
-		if err := templateParams.contents.Render(tmplDest, vars); err != nil {
-			os.Remove(tmplPath)
-			b.Errorf("template: Error rendering template %s: %v\n---template---\n %s",
-				templateParams.Name,
-				err,
-				templateParams.contents.Contents)
-			continue
+		for _, final := range templateParams.finalPaths {
+			b.renderTemplate(templateParams, final)
 		}
-		tmplDest.Sync()
 	}
 	return b.errorOrNil()
 }
 
+func (b *BootEnv) renderTemplate(templateParams *TemplateInfo, final *renderedPath) {
+	vars := &RenderData{
+		Machine:             final.machine,
+		Env:                 b,
+		ProvisionerURL:      provisionerURL,
+		ProvisionerHTTPSURL: provisionerHTTPSURL,
+		CommandURL:          commandURL,
+		TenantId:            b.TenantId,
+	}
+	tmplPath := final.path
+	if err := os.MkdirAll(path.Dir(tmplPath), 0755); err != nil {
+		b.Errorf("template: Unable to create dir for %s: %v", tmplPath, err)
+		return
+	}
+
+	tmplDest, err := os.Create(tmplPath)
+	if err != nil {
+		b.Errorf("template: Unable to create file %s: %v", tmplPath, err)
+		return
+	}
+	defer tmplDest.Close()
+	if err := templateParams.contents.Render(tmplDest, vars); err != nil {
+		os.Remove(tmplPath)
+		b.Errorf("template: Error rendering template %s: %v\n---template---\n %s",
+			templateParams.Name,
+			err,
+			templateParams.contents.Contents)
+		return
+	}
+	tmplDest.Sync()
+}
+
 // DeleteRenderedTemplates deletes the templates that were rendered
 // for this bootenv/machine combination.
 func (b *BootEnv) DeleteRenderedTemplates(machine *Machine) {
 	b.parseTemplates()
 	b.RenderPaths(machine)
 	for _, tmpl := range b.Templates {
-		if tmpl.finalPath != "" {
-			os.Remove(tmpl.finalPath)
-		}
-	}
-}
-
-func (b *BootEnv) explodeIso() error {
-	// Only explode install things
-	if !strings.HasSuffix(b.Name, "-install") {
-		logger.Printf("Explode ISO: Skipping %s becausing not -install\n", b.Name)
-		return nil
-	}
-	// Only work on things that are requested.
-	if b.OS.IsoFile == "" {
-		logger.Printf("Explode ISO: Skipping %s becausing no iso image specified\n", b.Name)
-		return nil
-	}
-	// Have we already exploded this?  If file exists, then good!
-	canaryPath := b.PathFor("disk", "."+b.OS.Name+".rebar_canary")
-	if _, err := os.Stat(canaryPath); err == nil {
-		logger.Printf("Explode ISO: Skipping %s becausing canary file, %s, in place\n", b.Name, canaryPath)
-		return nil
-	}
-
-	isoPath := filepath.Join(fileRoot, "isos", b.OS.IsoFile)
-	if _, err := os.Stat(isoPath); os.IsNotExist(err) {
-		logger.Printf("Explode ISO: Skipping %s becausing iso doesn't exist: %s\n", b.Name, isoPath)
-		return nil
-	}
-
-	// Sha256sum iso for correctness
-	if b.OS.IsoSha256 != "" {
-		f, err := os.Open(isoPath)
-		if err != nil {
-			return fmt.Errorf("Explode ISO: For %s, failed to open iso file %s: %v", b.Name, isoPath, err)
-		} else {
-			defer f.Close()
-			hasher := sha256.New()
-			if _, err := io.Copy(hasher, f); err != nil {
-				return fmt.Errorf("Explode ISO: For %s, failed to read iso file %s: %v", b.Name, isoPath, err)
-			}
-			hash := hex.EncodeToString(hasher.Sum(nil))
-			if hash != b.OS.IsoSha256 {
-				return fmt.Errorf("iso: Iso checksum bad.  Re-download image: %s: actual: %v expected: %v", isoPath, hash, b.OS.IsoSha256)
-			}
+		for _, final := range tmpl.finalPaths {
+			os.Remove(final.path)
 		}
 	}
-
-	// Call extract script
-	// /explode_iso.sh b.OS.Name isoPath path.Dir(canaryPath)
-	cmdName := "/explode_iso.sh"
-	cmdArgs := []string{b.OS.Name, isoPath, path.Dir(canaryPath)}
-	if _, err := exec.Command(cmdName, cmdArgs...).Output(); err != nil {
-		return fmt.Errorf("Explode ISO: Exec command failed for %s: %s\n", b.Name, err)
-	}
-	return nil
-}
-
-func (b *BootEnv) getFile(f *FileData) error {
-	logger.Printf("Downloading file: %s\n", f.Name)
-	filePath := b.PathFor("disk", f.Name)
-	if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
-		return fmt.Errorf("file: Unable to create dir for %s: %v", filePath, err)
-	}
-
-	fileDest, err := os.Create(filePath)
-	if err != nil {
-		return err
-	}
-	defer fileDest.Close()
-
-	resp, err := http.Get(f.URL)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	_, err = io.Copy(fileDest, resp.Body)
-	return err
-}
-
-func (b *BootEnv) validateFile(f *FileData) error {
-	logger.Printf("Validating file: %s\n", f.Name)
-	filePath := b.PathFor("disk", f.Name)
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return fmt.Errorf("validate: File doesn't exist: %s\n", filePath)
-	}
-	return nil
 }
 
 func (b *BootEnv) onChange(oldThing interface{}) error {
@@ -431,27 +379,35 @@ func (b *BootEnv) onChange(oldThing interface{}) error {
 		}
 	}
 
+	// Make sure we have the ISO, fetching it if we know where from
+	if d, err := b.fetchIso(); err != nil {
+		b.Errorf("bootenv: Unable to download ISO %s: %v", b.OS.IsoFile, err)
+	} else if d != nil {
+		b.Errorf("bootenv: ISO %s is still being downloaded: %s", b.OS.IsoFile, d)
+	}
+
 	// Make sure the ISO is exploded
 	if b.OS.IsoFile != "" {
 		logger.Printf("Exploding ISO for %s\n", b.OS.Name)
-		if err := b.explodeIso(); err != nil {
+		progress, err := b.explodeIso()
+		b.Progress = progress
+		if err != nil {
 			b.Errorf("bootenv: Unable to expand ISO %s: %v", b.OS.IsoFile, err)
+		} else if progress != nil {
+			b.Errorf("bootenv: ISO %s is not ready yet, see Progress", b.OS.IsoFile)
 		}
 	}
 
 	// Make sure we download extra files
 	for _, f := range b.OS.Files {
-		if b.validateFile(f) != nil {
-			if err := b.getFile(f); err != nil {
-				b.Errorf("bootenv: Unable to download extra file %s: %v", f, err)
-				continue
-			}
-		}
-		if err := b.validateFile(f); err != nil {
-			b.Errorf("bootenv: Unable to validate extra file %s: %v", f, err)
+		if d, err := b.fetchFile(f); err != nil {
+			b.Errorf("bootenv: Unable to download extra file %s: %v", f.Name, err)
+		} else if d != nil {
+			b.Errorf("bootenv: Extra file %s is still being downloaded: %s", f.Name, d)
 		}
 	}
 	b.parseTemplates()
+	b.buildBootURIs()
 	if b.Kernel != "" {
 		kPath := b.PathFor("disk", b.Kernel)
 		kernelStat, err := os.Stat(kPath)
@@ -522,6 +478,9 @@ func (b *BootEnv) onDelete() error {
 			b.Errorf("Bootenv %s in use by Machine %s", b.Name, machine.Name)
 		}
 	}
+	if len(b.Errors) == 0 {
+		os.Remove(filepath.Join(fileRoot, b.chainScriptPath()))
+	}
 	return b.errorOrNil()
 }
 
@@ -25,6 +25,12 @@ func listThings(c *gin.Context, thing keySaver) {
 	things := backend.list(thing)
 	res := make([]interface{}, 0, len(things))
 	for _, obj := range things {
+		if lt, ok := thing.newIsh().(liveThing); ok {
+			if err := json.Unmarshal(obj, lt); err == nil {
+				lt.live()
+				obj, _ = json.Marshal(lt)
+			}
+		}
 		var buf interface{}
 		if err := json.Unmarshal(obj, &buf); err != nil {
 			c.JSON(http.StatusInternalServerError,
@@ -129,6 +135,9 @@ func getThing(c *gin.Context, thing keySaver) {
 		c.Data(http.StatusNotFound, gin.MIMEJSON, nil)
 		return
 	}
+	if lt, ok := thing.(liveThing); ok {
+		lt.live()
+	}
 
 	c.JSON(http.StatusOK, thing)
 }
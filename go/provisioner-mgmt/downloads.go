@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/digitalrebar/digitalrebar/go/common/multi-tenancy"
+	"github.com/gin-gonic/gin"
+)
+
+// How many times a download is tried before it is given up on, and
+// how long to wait after each failed try, times the tries so far.
+const (
+	downloadAttempts = 5
+	downloadBackoff  = 10 * time.Second
+)
+
+// How many downloads run at once.  The rest wait their turn.
+var downloadSlots = make(chan struct{}, 2)
+
+// downloadClient gives up on servers that take too long to connect or
+// answer, or that stop sending in the middle of a file, so that they
+// cannot hold on to a download slot.
+var downloadClient = newDownloadClient(30*time.Second, time.Minute, 2*time.Minute)
+
+// idleConn fails reads that wait longer than idle for data.
+type idleConn struct {
+	net.Conn
+	idle time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.idle)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func newDownloadClient(dial, header, idle time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: dial, KeepAlive: 30 * time.Second}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return &idleConn{Conn: conn, idle: idle}, nil
+			},
+			TLSHandshakeTimeout:   dial,
+			ResponseHeaderTimeout: header,
+			IdleConnTimeout:       idle,
+		},
+	}
+}
+
+// Download is a file the provisioner is fetching for boot environments.
+type Download struct {
+	URL              string    // Where the file is being fetched from
+	Path             string    // Where the file is being saved to, relative to the file root
+	ValidationURL    string    `json:",omitempty"` // Where the checksum or signature of the file is fetched from
+	ValidationMethod string    `json:",omitempty"` // sha256, sha512 or gpg
+	State            string    // queued, downloading, validating, done or failed
+	Bytes            int64     // Bytes fetched so far
+	TotalBytes       int64     // Bytes to fetch, or 0 if the server did not say
+	Attempts         int       // How many times fetching the file has been tried
+	Started          time.Time // When the download was asked for
+	Error            string    `json:",omitempty"` // Why the last try failed
+	BootEnvs         []string  // The boot environments waiting on the file
+	sha256           string
+	dest             string
+	tenants          map[string]int
+	reported         map[string]bool
+}
+
+func (d *Download) String() string {
+	if d.TotalBytes > 0 {
+		return fmt.Sprintf("%s, %d of %d bytes", d.State, d.Bytes, d.TotalBytes)
+	}
+	return fmt.Sprintf("%s, %d bytes", d.State, d.Bytes)
+}
+
+var downloads = struct {
+	sync.Mutex
+	byDest map[string]*Download
+}{byDest: map[string]*Download{}}
+
+func (d *Download) snapshot() *Download {
+	downloads.Lock()
+	defer downloads.Unlock()
+	res := *d
+	res.BootEnvs = make([]string, 0, len(d.tenants))
+	for name := range d.tenants {
+		res.BootEnvs = append(res.BootEnvs, name)
+	}
+	sort.Strings(res.BootEnvs)
+	return &res
+}
+
+func (d *Download) update(f func(d *Download)) {
+	downloads.Lock()
+	f(d)
+	downloads.Unlock()
+}
+
+// fetch makes sure dest is there, fetching it in the background if it
+// is not.  While it is being fetched the download is returned, along
+// with the error if fetching it failed.  A failed download is reported
+// once to each boot environment waiting on it, and is tried again the
+// next time one of them is saved.
+func (b *BootEnv) fetch(url, dest, validationURL, validationMethod, sum string) (*Download, error) {
+	if _, err := os.Stat(dest); err == nil {
+		return nil, nil
+	}
+	downloads.Lock()
+	d := downloads.byDest[dest]
+	if d != nil && d.State == "failed" {
+		if !d.reported[b.Name] {
+			d.reported[b.Name] = true
+			downloads.Unlock()
+			res := d.snapshot()
+			return res, fmt.Errorf("%s", res.Error)
+		}
+		d = nil
+	}
+	if d == nil || d.State == "done" {
+		rel, _ := filepath.Rel(fileRoot, dest)
+		d = &Download{
+			URL:              url,
+			Path:             rel,
+			ValidationURL:    validationURL,
+			ValidationMethod: validationMethod,
+			State:            "queued",
+			Started:          time.Now(),
+			sha256:           sum,
+			dest:             dest,
+			tenants:          map[string]int{},
+			reported:         map[string]bool{},
+		}
+		downloads.byDest[dest] = d
+		logger.Printf("Download: Fetching %s into %s for %s\n", url, dest, b.Name)
+		go d.run()
+	}
+	d.tenants[b.Name] = b.TenantId
+	downloads.Unlock()
+	return d.snapshot(), nil
+}
+
+// fetchIso fetches the ISO of the boot environment from IsoUrl if it
+// is missing.
+func (b *BootEnv) fetchIso() (*Download, error) {
+	if b.OS.IsoFile == "" || b.OS.IsoUrl == "" {
+		return nil, nil
+	}
+	dest := filepath.Join(fileRoot, "isos", path.Base(b.OS.IsoFile))
+	return b.fetch(b.OS.IsoUrl, dest, "", "", b.OS.IsoSha256)
+}
+
+// fetchFile fetches an extra file of the boot environment if it is
+// missing.  Files are only put in place once they have been
+// validated, so one that is there is good.
+func (b *BootEnv) fetchFile(f *FileData) (*Download, error) {
+	return b.fetch(f.URL, b.PathFor("disk", f.Name), f.ValidationURL, f.ValidationMethod, "")
+}
+
+// run fetches the file, trying again a few times if need be, and then
+// saves the boot environments waiting on it.
+func (d *Download) run() {
+	downloadSlots <- struct{}{}
+	var err error
+	for attempt := 1; attempt <= downloadAttempts; attempt++ {
+		d.update(func(d *Download) {
+			d.State = "downloading"
+			d.Attempts = attempt
+		})
+		if err = d.get(); err == nil {
+			d.update(func(d *Download) { d.State = "validating" })
+			if err = d.validate(); err == nil {
+				break
+			}
+			// Whatever we got is no good, so start again.
+			os.Remove(d.partPath())
+		}
+		logger.Printf("Download: Try %d of %s failed: %v\n", attempt, d.URL, err)
+		d.update(func(d *Download) { d.Error = err.Error() })
+		if attempt < downloadAttempts {
+			time.Sleep(time.Duration(attempt) * downloadBackoff)
+		}
+	}
+	if err == nil {
+		err = os.Rename(d.partPath(), d.dest)
+	}
+	<-downloadSlots
+	var names []string
+	d.update(func(d *Download) {
+		if err != nil {
+			d.State = "failed"
+			d.Error = err.Error()
+		} else {
+			d.State = "done"
+			d.Error = ""
+		}
+		for name := range d.tenants {
+			names = append(names, name)
+		}
+	})
+	if err == nil {
+		logger.Printf("Download: Fetched %s into %s\n", d.URL, d.dest)
+	}
+	saveBootEnvs(names)
+}
+
+// partPath is where the file is fetched to before it is validated.
+// It is the same place an ISO upload goes, so the two cannot clash.
+func (d *Download) partPath() string {
+	return filepath.Join(filepath.Dir(d.dest), fmt.Sprintf(".%s.part", filepath.Base(d.dest)))
+}
+
+// downloadWriter counts what is written through it towards the bytes
+// fetched.
+type downloadWriter struct {
+	d *Download
+}
+
+func (dw downloadWriter) Write(b []byte) (int, error) {
+	dw.d.update(func(d *Download) { d.Bytes += int64(len(b)) })
+	return len(b), nil
+}
+
+// get fetches the file into its part file, carrying on from where an
+// earlier try left off if the server lets us.
+func (d *Download) get() error {
+	part := d.partPath()
+	if err := os.MkdirAll(filepath.Dir(part), 0755); err != nil {
+		return err
+	}
+	var have int64
+	if fi, err := os.Stat(part); err == nil {
+		have = fi.Size()
+	}
+	req, err := http.NewRequest("GET", d.URL, nil)
+	if err != nil {
+		return err
+	}
+	if have > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", have))
+	}
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusOK:
+		have = 0
+		flags |= os.O_TRUNC
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+	case http.StatusRequestedRangeNotSatisfiable:
+		// What we have is no use to the server, so start again.
+		os.Remove(part)
+		return fmt.Errorf("%s: %s", d.URL, resp.Status)
+	default:
+		return fmt.Errorf("%s: %s", d.URL, resp.Status)
+	}
+	d.update(func(d *Download) {
+		d.Bytes = have
+		d.TotalBytes = 0
+		if resp.ContentLength > 0 {
+			d.TotalBytes = have + resp.ContentLength
+		}
+	})
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return err
+	}
+	copied, err := io.Copy(io.MultiWriter(f, downloadWriter{d}), resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if resp.ContentLength > 0 && copied != resp.ContentLength {
+		return fmt.Errorf("%s: got %d bytes, but expected %d", d.URL, copied, resp.ContentLength)
+	}
+	return nil
+}
+
+// validate checks the fetched file against the checksum we were given,
+// or against what ValidationURL points to.
+func (d *Download) validate() error {
+	part := d.partPath()
+	if d.sha256 != "" {
+		sum, err := fileSum(part, sha256.New())
+		if err != nil {
+			return err
+		}
+		if sum != d.sha256 {
+			return fmt.Errorf("checksum of %s is %s, but should be %s", d.URL, sum, d.sha256)
+		}
+	}
+	if d.ValidationURL == "" {
+		return nil
+	}
+	val, err := fetchValidation(d.ValidationURL)
+	if err != nil {
+		return err
+	}
+	var h hash.Hash
+	switch strings.ToLower(d.ValidationMethod) {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	case "gpg":
+		return gpgVerify(val, part)
+	default:
+		return fmt.Errorf("unknown validation method %q for %s", d.ValidationMethod, d.URL)
+	}
+	want, err := findSum(val, path.Base(d.URL), 2*h.Size())
+	if err != nil {
+		return fmt.Errorf("%s: %v", d.ValidationURL, err)
+	}
+	sum, err := fileSum(part, h)
+	if err != nil {
+		return err
+	}
+	if sum != want {
+		return fmt.Errorf("%s checksum of %s is %s, but should be %s", d.ValidationMethod, d.URL, sum, want)
+	}
+	return nil
+}
+
+func fetchValidation(url string) ([]byte, error) {
+	resp, err := downloadClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func fileSum(name string, h hash.Hash) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// findSum picks the checksum of the named file out of a checksum file,
+// in the format sha256sum and friends write.  A file with just one
+// checksum in it is taken to be for the named file.
+func findSum(sums []byte, name string, length int) (string, error) {
+	var found []string
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || len(fields[0]) != length {
+			continue
+		}
+		if _, err := hex.DecodeString(fields[0]); err != nil {
+			continue
+		}
+		if len(fields) > 1 && path.Base(strings.TrimPrefix(fields[1], "*")) == name {
+			return strings.ToLower(fields[0]), nil
+		}
+		found = append(found, strings.ToLower(fields[0]))
+	}
+	if len(found) == 1 {
+		return found[0], nil
+	}
+	return "", fmt.Errorf("no checksum for %s", name)
+}
+
+// gpgVerify checks a detached signature of the file against the keys
+// in the provisioner's keyring.
+func gpgVerify(sig []byte, name string) error {
+	sigFile, err := ioutil.TempFile("", "rebar-sig")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(sigFile.Name())
+	_, err = sigFile.Write(sig)
+	if cerr := sigFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if out, err := exec.Command("gpg", "--batch", "--verify", sigFile.Name(), name).CombinedOutput(); err != nil {
+		return fmt.Errorf("gpg signature check failed: %v\n%s", err, out)
+	}
+	return nil
+}
+
+// listDownloads returns the downloads for boot environments the caller
+// can see.
+func listDownloads(c *gin.Context) {
+	capMap, err := multitenancy.NewCapabilityMap(c.Request)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError,
+			NewError(fmt.Sprintf("list: failed to get the capmap: %v", err)))
+		return
+	}
+	downloads.Lock()
+	all := make([]*Download, 0, len(downloads.byDest))
+	for _, d := range downloads.byDest {
+		for _, tenant := range d.tenants {
+			if capMap.HasCapability(tenant, "BOOTENV_READ") {
+				all = append(all, d)
+				break
+			}
+		}
+	}
+	downloads.Unlock()
+	res := make([]*Download, 0, len(all))
+	for _, d := range all {
+		res = append(res, d.snapshot())
+	}
+	sort.Sort(downloadsByPath(res))
+	c.JSON(http.StatusOK, res)
+}
+
+type downloadsByPath []*Download
+
+func (d downloadsByPath) Len() int           { return len(d) }
+func (d downloadsByPath) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d downloadsByPath) Less(i, j int) bool { return d[i].Path < d[j].Path }
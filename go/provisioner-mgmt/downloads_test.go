@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindSum(t *testing.T) {
+	a := strings.Repeat("a", 64)
+	b := strings.Repeat("B", 64)
+	sums := []byte(a + "  images/boot.iso\n" +
+		b + " *other.iso\n" +
+		strings.Repeat("c", 128) + "  boot.iso\n" +
+		"not a checksum  boot.iso\n")
+
+	if sum, err := findSum(sums, "boot.iso", 64); sum != a || err != nil {
+		t.Errorf("Expected the checksum for boot.iso, but got %q %v", sum, err)
+	}
+	if sum, err := findSum(sums, "other.iso", 64); sum != strings.ToLower(b) || err != nil {
+		t.Errorf("Expected the lowercase checksum for a binary mode entry, but got %q %v", sum, err)
+	}
+	if sum, err := findSum(sums, "boot.iso", 128); sum != strings.Repeat("c", 128) || err != nil {
+		t.Errorf("Expected the checksum of the right length, but got %q %v", sum, err)
+	}
+	if _, err := findSum(sums, "missing.iso", 64); err == nil {
+		t.Error("Expected no checksum for a file that is not listed")
+	}
+	if sum, err := findSum([]byte(a+"\n"), "boot.iso", 64); sum != a || err != nil {
+		t.Errorf("Expected a lone checksum to be taken, but got %q %v", sum, err)
+	}
+}
+
+// testDownload returns a download of name from srv into a new
+// temporary directory.
+func testDownload(t *testing.T, srv *httptest.Server, name string) (*Download, func()) {
+	dir, err := ioutil.TempDir("", "provisioner-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Download{
+		URL:      srv.URL + "/" + name,
+		dest:     filepath.Join(dir, name),
+		tenants:  map[string]int{},
+		reported: map[string]bool{},
+	}
+	return d, func() { os.RemoveAll(dir) }
+}
+
+func TestDownloadResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	ranges := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ranges {
+			r.Header.Del("Range")
+		}
+		http.ServeContent(w, r, "boot.iso", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+	d, cleanup := testDownload(t, srv, "boot.iso")
+	defer cleanup()
+
+	check := func(what string) {
+		got, err := ioutil.ReadFile(d.partPath())
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%s: expected the whole file, but got %d bytes %v", what, len(got), err)
+		}
+		if d.Bytes != int64(len(content)) || d.TotalBytes != int64(len(content)) {
+			t.Errorf("%s: expected %d bytes counted, but got %d of %d", what, len(content), d.Bytes, d.TotalBytes)
+		}
+	}
+
+	// 200: a fresh download.
+	if err := d.get(); err != nil {
+		t.Fatal(err)
+	}
+	check("fresh")
+
+	// 206: carry on from what an earlier try left.
+	if err := ioutil.WriteFile(d.partPath(), content[:4000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.get(); err != nil {
+		t.Fatal(err)
+	}
+	check("resumed")
+
+	// 200 in answer to a range request: start again.
+	ranges = false
+	if err := ioutil.WriteFile(d.partPath(), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.get(); err != nil {
+		t.Fatal(err)
+	}
+	check("restarted")
+
+	// 416: what we have is longer than the file, so throw it away.
+	ranges = true
+	if err := ioutil.WriteFile(d.partPath(), append(content, 'x'), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.get(); err == nil || !strings.Contains(err.Error(), "416") {
+		t.Errorf("Expected an unsatisfiable range to fail, but got %v", err)
+	}
+	if _, err := os.Stat(d.partPath()); !os.IsNotExist(err) {
+		t.Errorf("Expected the part file to be removed, but got %v", err)
+	}
+}
+
+func TestDownloadStall(t *testing.T) {
+	stop := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.Write(make([]byte, 100))
+		w.(http.Flusher).Flush()
+		<-stop
+	}))
+	defer srv.Close()
+	defer close(stop)
+	d, cleanup := testDownload(t, srv, "boot.iso")
+	defer cleanup()
+
+	old := downloadClient
+	downloadClient = newDownloadClient(time.Second, time.Second, 100*time.Millisecond)
+	defer func() { downloadClient = old }()
+
+	done := make(chan error, 1)
+	go func() { done <- d.get() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected a stalled download to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a stalled download to give up")
+	}
+}
+
+func TestDownloadValidate(t *testing.T) {
+	content := []byte("the boot image")
+	sum256 := sha256.Sum256(content)
+	sum512 := sha512.Sum512(content)
+	sums := map[string]string{
+		"/SHA256SUMS": hex.EncodeToString(sum256[:]) + "  boot.iso\n" + strings.Repeat("0", 64) + "  other.iso\n",
+		"/SHA512SUMS": hex.EncodeToString(sum512[:]) + " *boot.iso\n",
+		"/BADSUMS":    strings.Repeat("0", 64) + "  boot.iso\n",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s, ok := sums[r.URL.Path]; ok {
+			fmt.Fprint(w, s)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	d, cleanup := testDownload(t, srv, "boot.iso")
+	defer cleanup()
+	if err := ioutil.WriteFile(d.partPath(), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url, method, sha256 string
+		ok                  bool
+	}{
+		{"", "", "", true},
+		{"", "", hex.EncodeToString(sum256[:]), true},
+		{"", "", strings.Repeat("0", 64), false},
+		{"/SHA256SUMS", "sha256", "", true},
+		{"/SHA512SUMS", "SHA512", "", true},
+		{"/BADSUMS", "sha256", "", false},
+		{"/SHA256SUMS", "sha512", "", false},
+		{"/SHA256SUMS", "md5", "", false},
+		{"/MISSING", "sha256", "", false},
+	}
+	for _, test := range tests {
+		d.ValidationURL, d.ValidationMethod, d.sha256 = "", test.method, test.sha256
+		if test.url != "" {
+			d.ValidationURL = srv.URL + test.url
+		}
+		if err := d.validate(); (err == nil) != test.ok {
+			t.Errorf("Validating with %s %s %s: expected ok to be %v, but got %v", test.url, test.method, test.sha256, test.ok, err)
+		}
+	}
+}
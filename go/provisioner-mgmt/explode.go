@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IsoProgress is how far along getting the install tree of a boot
+// environment out of its ISO is.
+type IsoProgress struct {
+	State      string    // checking, extracting or failed
+	Files      int       // Files extracted so far
+	TotalFiles int       // Files in the ISO
+	Bytes      int64     // Bytes checked or extracted so far
+	TotalBytes int64     // Bytes to check or extract
+	Started    time.Time // When the extraction started
+	Error      string    `json:",omitempty"` // Why it failed
+}
+
+// Files in the extraction directory that are not from the ISO.  The
+// checksums are kept in the install tree afterwards.
+const (
+	isoSumsFile   = ".rebar_sha256sums"
+	isoSourceFile = ".rebar_iso"
+)
+
+var rhelishRE = regexp.MustCompile(`^(redhat|centos|fedora)`)
+
+// isoJob extracts one ISO into one install tree.  Several bootenvs can
+// share an install tree, and they all wait on the same job.
+type isoJob struct {
+	sync.Mutex
+	osName   string
+	isoPath  string
+	sha256   string
+	dir      string
+	progress IsoProgress
+	err      error
+	finished bool
+	bootEnvs map[string]bool
+}
+
+var isoJobs = struct {
+	sync.Mutex
+	jobs map[string]*isoJob
+}{jobs: map[string]*isoJob{}}
+
+func (j *isoJob) snapshot() *IsoProgress {
+	j.Lock()
+	defer j.Unlock()
+	p := j.progress
+	return &p
+}
+
+func (j *isoJob) update(f func(p *IsoProgress)) {
+	j.Lock()
+	f(&j.progress)
+	j.Unlock()
+}
+
+// progressWriter counts what is written through it towards the bytes
+// done.
+type progressWriter struct {
+	job *isoJob
+}
+
+func (pw progressWriter) Write(b []byte) (int, error) {
+	pw.job.update(func(p *IsoProgress) { p.Bytes += int64(len(b)) })
+	return len(b), nil
+}
+
+// run extracts the ISO, and then saves the bootenvs waiting on it so
+// that they become available or show why they cannot.
+func (j *isoJob) run() {
+	err := j.extract()
+	if err != nil {
+		logger.Printf("Explode ISO: Failed to extract %s: %v", j.isoPath, err)
+	} else {
+		logger.Printf("Explode ISO: Extracted %s into %s", j.isoPath, j.dir)
+	}
+	j.Lock()
+	j.err = err
+	j.finished = true
+	if err != nil {
+		j.progress.State = "failed"
+		j.progress.Error = err.Error()
+	}
+	j.Unlock()
+	j.saveBootEnvs()
+}
+
+func (j *isoJob) saveBootEnvs() {
+	j.Lock()
+	names := make([]string, 0, len(j.bootEnvs))
+	for name := range j.bootEnvs {
+		names = append(names, name)
+	}
+	j.Unlock()
+	saveBootEnvs(names)
+}
+
+// saveBootEnvs saves the named bootenvs again, so that they pick up
+// what has changed about their files.
+func saveBootEnvs(names []string) {
+	sort.Strings(names)
+	for _, name := range names {
+		b := &BootEnv{Name: name}
+		if err := backend.load(b); err != nil {
+			continue
+		}
+		if err := backend.save(b, nil); err != nil {
+			logger.Printf("Bootenv %s: %v", name, err)
+		}
+	}
+}
+
+// extract checks the ISO and copies its files into the install tree.
+// It works in a directory next to the install tree, which it picks up
+// from where it left off if it was interrupted.
+func (j *isoJob) extract() error {
+	iso, err := os.Open(j.isoPath)
+	if err != nil {
+		return err
+	}
+	defer iso.Close()
+	fi, err := iso.Stat()
+	if err != nil {
+		return err
+	}
+
+	if j.sha256 != "" {
+		j.update(func(p *IsoProgress) {
+			p.State = "checking"
+			p.TotalBytes = fi.Size()
+		})
+		hasher := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(hasher, progressWriter{j}), iso); err != nil {
+			return fmt.Errorf("failed to read %s: %v", j.isoPath, err)
+		}
+		if sum := hex.EncodeToString(hasher.Sum(nil)); sum != j.sha256 {
+			return fmt.Errorf("checksum of %s is %s, but should be %s.  Download it again", j.isoPath, sum, j.sha256)
+		}
+	}
+
+	entries, err := readIso(iso, strings.HasPrefix(j.osName, "esxi"))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", j.isoPath, err)
+	}
+	var totalFiles int
+	var totalBytes int64
+	for _, e := range entries {
+		if !e.Dir && e.Link == "" {
+			totalFiles++
+			totalBytes += e.Size
+		}
+	}
+	j.update(func(p *IsoProgress) {
+		p.State = "extracting"
+		p.Bytes = 0
+		p.TotalFiles = totalFiles
+		p.TotalBytes = totalBytes
+	})
+
+	work := j.dir + ".extracting"
+	source := fmt.Sprintf("%s %d %d\n", filepath.Base(j.isoPath), fi.Size(), fi.ModTime().Unix())
+	if old, err := ioutil.ReadFile(filepath.Join(work, isoSourceFile)); err != nil || string(old) != source {
+		// Left over from some other ISO, so start again.
+		if err := os.RemoveAll(work); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(work, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(work, isoSourceFile), []byte(source), 0644); err != nil {
+		return err
+	}
+	sums, err := readIsoSums(filepath.Join(work, isoSumsFile))
+	if err != nil {
+		return err
+	}
+	sumsFile, err := os.OpenFile(filepath.Join(work, isoSumsFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer sumsFile.Close()
+
+	for _, e := range entries {
+		target := filepath.Join(work, filepath.FromSlash(e.Path))
+		switch {
+		case e.Dir:
+			// Keep directories writable so a retry can replace
+			// what is in them.
+			if err := os.MkdirAll(target, e.Mode|0700); err != nil {
+				return err
+			}
+		case e.Link != "":
+			os.Remove(target)
+			if err := os.Symlink(e.Link, target); err != nil {
+				return err
+			}
+		default:
+			if _, ok := sums[e.Path]; ok {
+				if st, err := os.Stat(target); err == nil && st.Size() == e.Size {
+					j.update(func(p *IsoProgress) {
+						p.Files++
+						p.Bytes += e.Size
+					})
+					continue
+				}
+			}
+			sum, err := j.extractFile(iso, e, target)
+			if err != nil {
+				return fmt.Errorf("failed to extract %s: %v", e.Path, err)
+			}
+			if _, err := fmt.Fprintf(sumsFile, "%s  %s\n", sum, e.Path); err != nil {
+				return err
+			}
+			j.update(func(p *IsoProgress) { p.Files++ })
+		}
+	}
+	// Directory times last, as filling them in changes them.
+	for i := len(entries) - 1; i >= 0; i-- {
+		if e := entries[i]; e.Dir {
+			os.Chtimes(filepath.Join(work, filepath.FromSlash(e.Path)), e.ModTime, e.ModTime)
+		}
+	}
+	if err := sumsFile.Close(); err != nil {
+		return err
+	}
+	return j.finish(work)
+}
+
+// extractFile copies one file out of the ISO, returning its checksum.
+func (j *isoJob) extractFile(iso io.ReaderAt, e *isoEntry, target string) (string, error) {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, e.Mode|0200)
+	if err != nil {
+		return "", err
+	}
+	var hasher hash.Hash = sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, hasher, progressWriter{j}), e.open(iso)); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	os.Chtimes(target, e.ModTime, e.ModTime)
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// readIsoSums reads the checksums of the files already extracted.
+func readIsoSums(name string) (map[string]string, error) {
+	res := map[string]string{}
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return res, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "  ", 2)
+		if len(parts) == 2 {
+			res[parts[1]] = parts[0]
+		}
+	}
+	return res, scanner.Err()
+}
+
+// runIn runs a command in dir, returning its output in the error if it
+// fails.
+func runIn(dir, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %v\n%s", name, err, out)
+	}
+	return nil
+}
+
+// finish does what some OSes need done to an extracted tree, and then
+// moves it into place.
+func (j *isoJob) finish(work string) error {
+	if rhelishRE.MatchString(j.osName) {
+		// Rewrite the local package metadata
+		groups, _ := filepath.Glob(filepath.Join(work, "repodata", "*comps*.xml"))
+		if len(groups) > 0 {
+			sort.Strings(groups)
+			rel, _ := filepath.Rel(work, groups[len(groups)-1])
+			if err := runIn(work, "createrepo", "-g", rel, "."); err != nil {
+				return err
+			}
+		}
+	}
+	canary := filepath.Join(work, "."+j.osName+".rebar_canary")
+	if err := ioutil.WriteFile(canary, nil, 0644); err != nil {
+		return err
+	}
+	os.Remove(filepath.Join(work, isoSourceFile))
+	if err := os.RemoveAll(j.dir); err != nil {
+		return err
+	}
+	if err := os.Rename(work, j.dir); err != nil {
+		return err
+	}
+
+	// ESXi needs an exact version of pxelinux, so add it.
+	pxelinux := filepath.Join(j.dir, "pxelinux.0")
+	if _, err := os.Stat(pxelinux); os.IsNotExist(err) {
+		cmd := exec.Command("tar", "xJf", "/tmp/syslinux-3.86.tar.xz", "syslinux-3.86/core/pxelinux.0", "-O")
+		if out, err := cmd.Output(); err == nil {
+			ioutil.WriteFile(pxelinux, out, 0644)
+		}
+	}
+	if exec.Command("selinuxenabled").Run() == nil {
+		if err := runIn(j.dir, "restorecon", "-R", "-F", fileRoot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// explodeIso makes sure the install tree of the bootenv has been
+// extracted from its ISO.  The extraction runs in the background, and
+// until it has finished the progress is returned, along with the error
+// if it failed.  A failed extraction is retried the next time the
+// bootenv is saved.
+func (b *BootEnv) explodeIso() (*IsoProgress, error) {
+	// Only explode install things
+	if !strings.HasSuffix(b.Name, "-install") {
+		logger.Printf("Explode ISO: Skipping %s becausing not -install\n", b.Name)
+		return nil, nil
+	}
+	// Only work on things that are requested.
+	if b.OS.IsoFile == "" {
+		logger.Printf("Explode ISO: Skipping %s becausing no iso image specified\n", b.Name)
+		return nil, nil
+	}
+	// Have we already exploded this?  If file exists, then good!
+	canaryPath := b.PathFor("disk", "."+b.OS.Name+".rebar_canary")
+	if _, err := os.Stat(canaryPath); err == nil {
+		return nil, nil
+	}
+
+	isoPath := filepath.Join(fileRoot, "isos", b.OS.IsoFile)
+	if _, err := os.Stat(isoPath); os.IsNotExist(err) {
+		logger.Printf("Explode ISO: Skipping %s becausing iso doesn't exist: %s\n", b.Name, isoPath)
+		return nil, nil
+	}
+
+	dir := path.Dir(canaryPath)
+	isoJobs.Lock()
+	defer isoJobs.Unlock()
+	job := isoJobs.jobs[dir]
+	if job == nil {
+		logger.Printf("Explode ISO: Extracting %s for %s into %s\n", isoPath, b.Name, dir)
+		job = &isoJob{
+			osName:   b.OS.Name,
+			isoPath:  isoPath,
+			sha256:   b.OS.IsoSha256,
+			dir:      dir,
+			progress: IsoProgress{State: "checking", Started: time.Now()},
+			bootEnvs: map[string]bool{},
+		}
+		isoJobs.jobs[dir] = job
+		go job.run()
+	}
+	job.Lock()
+	job.bootEnvs[b.Name] = true
+	finished, err := job.finished, job.err
+	job.Unlock()
+	if finished {
+		delete(isoJobs.jobs, dir)
+		if err == nil {
+			return nil, nil
+		}
+	}
+	return job.snapshot(), err
+}
+
+// live fills in how far along the extraction of the ISO is.  The
+// progress is only kept in memory while the extraction runs, and
+// is not saved until it has finished.
+func (b *BootEnv) live() {
+	if b.OS == nil || b.OS.IsoFile == "" {
+		return
+	}
+	isoJobs.Lock()
+	job := isoJobs.jobs[b.PathFor("disk", "")]
+	isoJobs.Unlock()
+	if job == nil {
+		return
+	}
+	job.Lock()
+	waiting := job.bootEnvs[b.Name]
+	job.Unlock()
+	if waiting {
+		b.Progress = job.snapshot()
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBootEnvLive(t *testing.T) {
+	defer withFileRoot(t)()
+	b := &BootEnv{Name: "test", OS: &OsInfo{Name: "test", IsoFile: "test.iso"}}
+	b.live()
+	if b.Progress != nil {
+		t.Errorf("Expected no progress without an extraction, but got %+v", b.Progress)
+	}
+
+	dir := b.PathFor("disk", "")
+	job := &isoJob{
+		dir:      dir,
+		progress: IsoProgress{State: "extracting", Files: 1, TotalFiles: 4, Started: time.Now()},
+		bootEnvs: map[string]bool{"test": true},
+	}
+	isoJobs.Lock()
+	isoJobs.jobs[dir] = job
+	isoJobs.Unlock()
+	defer func() {
+		isoJobs.Lock()
+		delete(isoJobs.jobs, dir)
+		isoJobs.Unlock()
+	}()
+
+	b.Progress = &IsoProgress{State: "checking"}
+	b.live()
+	if b.Progress == nil || b.Progress.State != "extracting" || b.Progress.Files != 1 {
+		t.Errorf("Expected the progress of the running extraction, but got %+v", b.Progress)
+	}
+	job.update(func(p *IsoProgress) { p.Files = 3 })
+	b.live()
+	if b.Progress.Files != 3 {
+		t.Errorf("Expected the progress to follow the extraction without a save, but got %+v", b.Progress)
+	}
+
+	other := &BootEnv{Name: "other", OS: &OsInfo{Name: "test", IsoFile: "test.iso"}}
+	other.live()
+	if other.Progress != nil {
+		t.Errorf("Expected no progress for a bootenv not waiting on the extraction, but got %+v", other.Progress)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The UEFI client architecture (DHCP option 93) that x86_64 machines
+// send when they boot over HTTP rather than PXE.
+const archX64Http = 16
+
+// The SHA256 fingerprint of the root certificate that the HTTPS file
+// server's certificate is signed with.  Empty when HTTPS is not
+// served.
+var caFingerprint string
+
+// DhcpOption is an option a DHCP server must send along with a boot
+// URI.
+type DhcpOption struct {
+	Code  int    // The option code.
+	Value string // The value, in the form rebar-dhcp takes it.
+}
+
+// BootURI is what a DHCP server hands to one kind of client so that it
+// boots a boot environment without TFTP.  The match fields mirror the
+// client classes of rebar-dhcp.
+type BootURI struct {
+	Name        string        // What kind of client this is for.
+	VendorClass string        `json:",omitempty"` // Matched as a prefix of option 60.
+	ClientArch  []uint16      `json:",omitempty"` // Matched against option 93.
+	UserClass   string        `json:",omitempty"` // Matched against option 77.
+	URI         string        // The boot file name (option 67) to hand out.
+	Options     []*DhcpOption `json:",omitempty"` // Other options the client needs.
+}
+
+// scriptPaths renders the path of the ipxe template the ways iPXE can
+// name a machine: by the MAC address it booted from, and by its IPv4
+// address, as machines without Macs have their scripts rendered.  The
+// addresses are left for iPXE to fill in, so the paths do for every
+// machine in the environment.  The second path is only returned if it
+// is different.
+func (b *BootEnv) scriptPaths() ([]string, error) {
+	for _, tmpl := range b.Templates {
+		if tmpl.Name != "ipxe" || tmpl.pathTmpl == nil {
+			continue
+		}
+		res := []string{}
+		for _, m := range []*Machine{
+			{Address: "${netX/ip}", mac: "${netX/mac}"},
+			{Address: "${netX/ip}"},
+		} {
+			buf := &bytes.Buffer{}
+			vars := &RenderData{
+				Machine:             m,
+				Env:                 b,
+				ProvisionerURL:      provisionerURL,
+				ProvisionerHTTPSURL: provisionerHTTPSURL,
+				CommandURL:          commandURL,
+				TenantId:            b.TenantId,
+			}
+			if err := tmpl.pathTmpl.Execute(buf, vars); err != nil {
+				return nil, fmt.Errorf("ipxe path %s must only use the machine addresses: %v", tmpl.Path, err)
+			}
+			p := strings.TrimPrefix(buf.String(), "/")
+			if p != "" && (len(res) == 0 || res[0] != p) {
+				res = append(res, p)
+			}
+		}
+		return res, nil
+	}
+	return nil, nil
+}
+
+// chainScriptPath is where the script that tries each of the
+// scriptPaths in turn is written, relative to fileRoot.
+func (b *BootEnv) chainScriptPath() string {
+	return path.Join("bootenvs", b.Name+".ipxe")
+}
+
+// ScriptURI returns the URI iPXE should fetch the boot script of the
+// environment from.  When the script is named differently for
+// machines with and without Macs, this is a chain script that tries
+// the MAC address and then the IPv4 address, like default.ipxe does
+// over TFTP.
+func (b *BootEnv) ScriptURI() (string, error) {
+	paths, err := b.scriptPaths()
+	switch {
+	case err != nil || len(paths) == 0:
+		return "", err
+	case len(paths) == 1:
+		return secureURL() + "/" + paths[0], nil
+	}
+	return secureURL() + "/" + b.chainScriptPath(), nil
+}
+
+// writeChainScript writes the chain script ScriptURI hands out, or
+// removes it if it is not needed.
+func (b *BootEnv) writeChainScript() error {
+	dest := filepath.Join(fileRoot, b.chainScriptPath())
+	paths, err := b.scriptPaths()
+	if err != nil || len(paths) < 2 {
+		os.Remove(dest)
+		return err
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString("#!ipxe\n")
+	for i, p := range paths {
+		fmt.Fprintf(buf, "chain %s/%s", secureURL(), p)
+		if i < len(paths)-1 {
+			buf.WriteString(" ||")
+		}
+		buf.WriteString("\n")
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dest, buf.Bytes(), 0644)
+}
+
+// secureURL returns the URL of the HTTPS file server, or of the plain
+// one if HTTPS is not being served.
+func secureURL() string {
+	if provisionerHTTPSURL != "" {
+		return provisionerHTTPSURL
+	}
+	return provisionerURL
+}
+
+// buildBootURIs fills in BootURIs for environments with an ipxe
+// template.  UEFI HTTP Boot firmware is handed iPXE over plain HTTP,
+// and iPXE then fetches the machine's script over HTTPS, trusting the
+// provisioner's root certificate through the iPXE trust setting
+// (encapsulated option 175, sub-option 90).
+func (b *BootEnv) buildBootURIs() {
+	b.BootURIs = nil
+	script, err := b.ScriptURI()
+	if err == nil {
+		err = b.writeChainScript()
+	}
+	if err != nil {
+		b.Errorf("bootenv: %s: %v", b.Name, err)
+		return
+	}
+	if script == "" {
+		return
+	}
+	b.BootURIs = append(b.BootURIs, &BootURI{
+		Name:        "uefi-http",
+		VendorClass: "HTTPClient",
+		ClientArch:  []uint16{archX64Http},
+		URI:         provisionerURL + "/ipxe.efi",
+		// The firmware ignores offers that do not say HTTPClient.
+		Options: []*DhcpOption{{Code: 60, Value: "HTTPClient"}},
+	})
+	ipxe := &BootURI{
+		Name:      "ipxe",
+		UserClass: "iPXE",
+		URI:       script,
+	}
+	if caFingerprint != "" {
+		ipxe.Options = append(ipxe.Options, &DhcpOption{Code: 175, Value: "90=" + caFingerprint})
+	}
+	b.BootURIs = append(b.BootURIs, ipxe)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+)
+
+// testEnv returns a bootenv with templates at the given paths, parsed
+// the way parseTemplates does without loading their contents.
+func testEnv(t *testing.T, paths map[string]string) *BootEnv {
+	b := &BootEnv{Name: "test", OS: &OsInfo{Name: "test"}}
+	for name, p := range paths {
+		tmpl, err := template.New(name).Parse(p)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", p, err)
+		}
+		b.Templates = append(b.Templates, &TemplateInfo{
+			Name:     name,
+			Path:     p,
+			pathTmpl: tmpl.Option("missingkey=error"),
+		})
+	}
+	return b
+}
+
+// withURLs sets the provisioner URLs and fingerprint, and returns a
+// function that puts them back.
+func withURLs(http, https, fingerprint string) func() {
+	oldHttp, oldHttps, oldFingerprint := provisionerURL, provisionerHTTPSURL, caFingerprint
+	provisionerURL, provisionerHTTPSURL, caFingerprint = http, https, fingerprint
+	return func() {
+		provisionerURL, provisionerHTTPSURL, caFingerprint = oldHttp, oldHttps, oldFingerprint
+	}
+}
+
+// withFileRoot points fileRoot at a new temporary directory, and
+// returns a function that removes it and puts fileRoot back.
+func withFileRoot(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "provisioner-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := fileRoot
+	fileRoot = dir
+	return func() {
+		fileRoot = old
+		os.RemoveAll(dir)
+	}
+}
+
+func TestScriptURI(t *testing.T) {
+	defer withURLs("http://10.0.0.1:8091", "https://10.0.0.1:8093", "")()
+
+	b := testEnv(t, map[string]string{"pxelinux": "pxelinux.cfg/{{.Machine.PxelinuxName}}"})
+	if uri, err := b.ScriptURI(); uri != "" || err != nil {
+		t.Errorf("Expected no script without an ipxe template, but got %q %v", uri, err)
+	}
+
+	b = testEnv(t, map[string]string{"ipxe": "/{{.Env.Name}}/{{.Machine.IpxeName}}.ipxe"})
+	if uri, err := b.ScriptURI(); uri != "https://10.0.0.1:8093/bootenvs/test.ipxe" || err != nil {
+		t.Errorf("Expected the chain script over HTTPS, but got %q %v", uri, err)
+	}
+	paths, _ := b.scriptPaths()
+	if len(paths) != 2 || paths[0] != "test/${netX/mac}.ipxe" || paths[1] != "test/${netX/ip}.ipxe" {
+		t.Errorf("Expected paths by MAC and by address, but got %v", paths)
+	}
+
+	b = testEnv(t, map[string]string{"ipxe": "{{.Env.Name}}.ipxe"})
+	if uri, err := b.ScriptURI(); uri != "https://10.0.0.1:8093/test.ipxe" || err != nil {
+		t.Errorf("Expected a path that is the same for every machine to be used as it is, but got %q %v", uri, err)
+	}
+
+	b = testEnv(t, map[string]string{"ipxe": "{{if .Machine.Mac}}{{.Machine.Mac}}.ipxe{{end}}"})
+	if uri, err := b.ScriptURI(); uri != "https://10.0.0.1:8093/${netX/mac}.ipxe" || err != nil {
+		t.Errorf("Expected an empty path to be left out, but got %q %v", uri, err)
+	}
+
+	b = testEnv(t, map[string]string{"ipxe": `{{.Param "foo"}}.ipxe`})
+	if _, err := b.ScriptURI(); err == nil {
+		t.Error("Expected a path using machine params to fail")
+	}
+
+	provisionerHTTPSURL, caFingerprint = "", ""
+	b = testEnv(t, map[string]string{"ipxe": "{{.Env.Name}}.ipxe"})
+	if uri, _ := b.ScriptURI(); uri != "http://10.0.0.1:8091/test.ipxe" {
+		t.Errorf("Expected the script over HTTP without HTTPS, but got %q", uri)
+	}
+}
+
+func TestBuildBootURIs(t *testing.T) {
+	defer withURLs("http://10.0.0.1:8091", "https://10.0.0.1:8093", "0123abcd")()
+	defer withFileRoot(t)()
+
+	b := testEnv(t, map[string]string{"ipxe": "{{.Machine.IpxeName}}.ipxe"})
+	b.buildBootURIs()
+	if len(b.BootURIs) != 2 {
+		t.Fatalf("Expected uefi-http and ipxe boot URIs, but got %v", b.BootURIs)
+	}
+	uefi, ipxe := b.BootURIs[0], b.BootURIs[1]
+	if uefi.Name != "uefi-http" || uefi.URI != "http://10.0.0.1:8091/ipxe.efi" || uefi.VendorClass != "HTTPClient" ||
+		len(uefi.ClientArch) != 1 || uefi.ClientArch[0] != archX64Http {
+		t.Errorf("Expected UEFI HTTP Boot to get iPXE over HTTP, but got %+v", uefi)
+	}
+	if len(uefi.Options) != 1 || uefi.Options[0].Code != 60 || uefi.Options[0].Value != "HTTPClient" {
+		t.Errorf("Expected UEFI HTTP Boot to be sent option 60, but got %+v", uefi.Options)
+	}
+	if ipxe.Name != "ipxe" || ipxe.UserClass != "iPXE" || ipxe.URI != "https://10.0.0.1:8093/bootenvs/test.ipxe" {
+		t.Errorf("Expected iPXE to get the chain script, but got %+v", ipxe)
+	}
+	chain := filepath.Join(fileRoot, "bootenvs", "test.ipxe")
+	script, err := ioutil.ReadFile(chain)
+	want := "#!ipxe\n" +
+		"chain https://10.0.0.1:8093/${netX/mac}.ipxe ||\n" +
+		"chain https://10.0.0.1:8093/${netX/ip}.ipxe\n"
+	if err != nil || string(script) != want {
+		t.Errorf("Expected the chain script to try the MAC and then the address, but got %q %v", script, err)
+	}
+	if len(ipxe.Options) != 1 || ipxe.Options[0].Code != 175 || ipxe.Options[0].Value != "90=0123abcd" {
+		t.Errorf("Expected iPXE to be told to trust the root certificate, but got %+v", ipxe.Options)
+	}
+
+	provisionerHTTPSURL, caFingerprint = "", ""
+	b.buildBootURIs()
+	if len(b.BootURIs) != 2 || len(b.BootURIs[1].Options) != 0 {
+		t.Errorf("Expected no trust setting without HTTPS, but got %+v", b.BootURIs)
+	}
+
+	b = testEnv(t, map[string]string{"pxelinux": "pxelinux.cfg/{{.Machine.PxelinuxName}}"})
+	b.BootURIs = []*BootURI{{Name: "stale"}}
+	b.buildBootURIs()
+	if b.BootURIs != nil {
+		t.Errorf("Expected no boot URIs without an ipxe template, but got %v", b.BootURIs)
+	}
+	if _, err := os.Stat(chain); !os.IsNotExist(err) {
+		t.Errorf("Expected the chain script to be removed, but got %v", err)
+	}
+
+	b = testEnv(t, map[string]string{"ipxe": `{{.Param "foo"}}.ipxe`})
+	b.buildBootURIs()
+	if b.BootURIs != nil || len(b.Errors) != 1 {
+		t.Errorf("Expected an error and no boot URIs, but got %v %v", b.BootURIs, b.Errors)
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// The parts of ISO9660 (ECMA-119) needed to get files off install
+// media, with the Rock Ridge and Joliet extensions for long names.
+// Images that keep their files in UDF instead are read by udf.go.
+
+const isoSectorSize = 2048
+
+// isoExtent is a run of bytes of a file in the image.
+type isoExtent struct {
+	Start int64 // Offset in the image, or -1 for zeros that are not recorded
+	Size  int64
+}
+
+// isoEntry is a file, directory or symlink in the image.
+type isoEntry struct {
+	Path    string // Relative to the root of the image, with / separators
+	Dir     bool
+	Link    string // Target of a symlink
+	Mode    os.FileMode
+	ModTime time.Time
+	Size    int64
+	Extents []isoExtent
+}
+
+// open returns the contents of a file.
+func (e *isoEntry) open(r io.ReaderAt) io.Reader {
+	readers := make([]io.Reader, len(e.Extents))
+	for i, ext := range e.Extents {
+		if ext.Start < 0 {
+			readers[i] = io.LimitReader(zeros{}, ext.Size)
+			continue
+		}
+		readers[i] = io.NewSectionReader(r, ext.Start, ext.Size)
+	}
+	return io.MultiReader(readers...)
+}
+
+// zeros reads as an endless run of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// isoDirRecord is a parsed directory record.
+type isoDirRecord struct {
+	extent  uint32
+	size    uint32
+	flags   byte
+	name    []byte
+	modTime time.Time
+	sua     []byte // System use area
+}
+
+const (
+	isoFlagDir         = 0x02
+	isoFlagMultiExtent = 0x80
+)
+
+func parseIsoDirRecord(b []byte) (*isoDirRecord, error) {
+	if len(b) < 34 || int(b[0]) > len(b) {
+		return nil, errors.New("short directory record")
+	}
+	b = b[:b[0]]
+	nameLen := int(b[32])
+	if 33+nameLen > len(b) {
+		return nil, errors.New("directory record name overruns record")
+	}
+	rec := &isoDirRecord{
+		extent: binary.LittleEndian.Uint32(b[2:6]),
+		size:   binary.LittleEndian.Uint32(b[10:14]),
+		flags:  b[25],
+		name:   b[33 : 33+nameLen],
+	}
+	d := b[18:25]
+	rec.modTime = time.Date(1900+int(d[0]), time.Month(d[1]), int(d[2]),
+		int(d[3]), int(d[4]), int(d[5]), 0,
+		time.FixedZone("", int(int8(d[6]))*15*60))
+	sua := 33 + nameLen
+	if nameLen%2 == 0 {
+		// Padding to keep the system use area even
+		sua++
+	}
+	if sua < len(b) {
+		rec.sua = b[sua:]
+	}
+	return rec, nil
+}
+
+// isoReader walks the directory tree of an image.
+type isoReader struct {
+	r         io.ReaderAt
+	joliet    bool
+	rockRidge bool
+	suspSkip  int
+	lowercase bool
+	seen      map[uint32]bool
+	entries   []*isoEntry
+}
+
+// readIso lists everything in the image.  Rock Ridge names are used if
+// the image has them, then Joliet names, and failing both the plain
+// ISO9660 names.  Images with only a UDF file system, or whose ISO9660
+// tree is just a placeholder for one, are read from UDF.  With
+// lowercase, names are lowercased, which plain ISO9660 images such as
+// ESXi's need.
+func readIso(r io.ReaderAt, lowercase bool) ([]*isoEntry, error) {
+	var primary, joliet []byte
+	sector := int64(16)
+	for ; ; sector++ {
+		vd := make([]byte, isoSectorSize)
+		if _, err := r.ReadAt(vd, sector*isoSectorSize); err != nil {
+			return nil, fmt.Errorf("reading volume descriptor %d: %v", sector, err)
+		}
+		if string(vd[1:6]) != "CD001" {
+			if isUdfDescriptor(vd) {
+				return readUdf(r, lowercase)
+			}
+			return nil, errors.New("no ISO9660 file system found")
+		}
+		switch vd[0] {
+		case 1:
+			primary = vd
+		case 2:
+			esc := string(vd[88:91])
+			if esc == "%/@" || esc == "%/C" || esc == "%/E" {
+				joliet = vd
+			}
+		}
+		if vd[0] == 255 {
+			break
+		}
+	}
+	if primary == nil {
+		return nil, errors.New("no primary volume descriptor")
+	}
+	if bs := binary.LittleEndian.Uint16(primary[128:130]); bs != isoSectorSize {
+		return nil, fmt.Errorf("unsupported logical block size %d", bs)
+	}
+
+	ir := &isoReader{r: r, lowercase: lowercase, seen: map[uint32]bool{}}
+	root, err := parseIsoDirRecord(primary[156:190])
+	if err != nil {
+		return nil, err
+	}
+	if err := ir.checkRockRidge(root); err != nil {
+		return nil, err
+	}
+	if !ir.rockRidge && joliet != nil {
+		ir.joliet = true
+		if root, err = parseIsoDirRecord(joliet[156:190]); err != nil {
+			return nil, err
+		}
+	}
+	if err := ir.readDir(root, ""); err != nil {
+		return nil, err
+	}
+	if hasUdf(r, sector+1) && !ir.hasDirs() {
+		// UDF bridge images such as Windows' put a placeholder in
+		// the ISO9660 tree, and the real files only in UDF.
+		return readUdf(r, lowercase)
+	}
+	return ir.entries, nil
+}
+
+// isUdfDescriptor says whether a volume descriptor is part of the
+// extended area that marks a UDF file system (ECMA-167).
+func isUdfDescriptor(vd []byte) bool {
+	switch string(vd[1:6]) {
+	case "BEA01", "NSR02", "NSR03", "TEA01":
+		return true
+	}
+	return false
+}
+
+// hasUdf looks for a UDF file system in the descriptors following the
+// ISO9660 ones, which start at sector.
+func hasUdf(r io.ReaderAt, sector int64) bool {
+	vd := make([]byte, isoSectorSize)
+	for ; ; sector++ {
+		if _, err := r.ReadAt(vd, sector*isoSectorSize); err != nil || !isUdfDescriptor(vd) {
+			return false
+		}
+		switch string(vd[1:6]) {
+		case "NSR02", "NSR03":
+			return true
+		case "TEA01":
+			return false
+		}
+	}
+}
+
+func (ir *isoReader) hasDirs() bool {
+	for _, e := range ir.entries {
+		if e.Dir {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRockRidge looks for the SUSP indicator in the first record of
+// the root directory.
+func (ir *isoReader) checkRockRidge(root *isoDirRecord) error {
+	sector := make([]byte, isoSectorSize)
+	if _, err := ir.r.ReadAt(sector, int64(root.extent)*isoSectorSize); err != nil {
+		return err
+	}
+	dot, err := parseIsoDirRecord(sector)
+	if err != nil {
+		return err
+	}
+	if len(dot.sua) >= 7 && string(dot.sua[0:2]) == "SP" && dot.sua[4] == 0xBE && dot.sua[5] == 0xEF {
+		ir.rockRidge = true
+		ir.suspSkip = int(dot.sua[6])
+	}
+	return nil
+}
+
+// suspEntries returns the system use entries of a record, following
+// continuation areas.
+func (ir *isoReader) suspEntries(rec *isoDirRecord) ([][]byte, error) {
+	res := [][]byte{}
+	if len(rec.sua) <= ir.suspSkip {
+		return res, nil
+	}
+	area := rec.sua[ir.suspSkip:]
+	for areas := 0; area != nil; areas++ {
+		if areas > 64 {
+			return nil, errors.New("too many continuation areas")
+		}
+		next := []byte(nil)
+		for len(area) >= 4 {
+			l := int(area[2])
+			if l < 4 || l > len(area) {
+				break
+			}
+			entry := area[:l]
+			area = area[l:]
+			switch string(entry[0:2]) {
+			case "ST":
+				area = nil
+			case "CE":
+				if len(entry) < 28 {
+					return nil, errors.New("short continuation entry")
+				}
+				block := binary.LittleEndian.Uint32(entry[4:8])
+				offset := binary.LittleEndian.Uint32(entry[12:16])
+				size := binary.LittleEndian.Uint32(entry[20:24])
+				next = make([]byte, size)
+				if _, err := ir.r.ReadAt(next, int64(block)*isoSectorSize+int64(offset)); err != nil {
+					return nil, err
+				}
+			default:
+				res = append(res, entry)
+			}
+		}
+		area = next
+	}
+	return res, nil
+}
+
+// rrInfo is what the Rock Ridge entries of a record say.
+type rrInfo struct {
+	name      string
+	hasName   bool
+	mode      uint32
+	hasMode   bool
+	link      string
+	linkJoin  bool   // The last link component continues in the next
+	childLink uint32 // Where a relocated directory really is
+	relocated bool   // This is the relocated copy, to be skipped
+}
+
+func parseRockRidge(entries [][]byte) *rrInfo {
+	info := &rrInfo{}
+	for _, e := range entries {
+		data := e[4:]
+		switch string(e[0:2]) {
+		case "NM":
+			if len(data) < 1 || data[0]&0x06 != 0 {
+				continue
+			}
+			info.name += string(data[1:])
+			info.hasName = true
+		case "PX":
+			if len(data) >= 4 {
+				info.mode = binary.LittleEndian.Uint32(data[0:4])
+				info.hasMode = true
+			}
+		case "SL":
+			if len(data) < 1 {
+				continue
+			}
+			comps := data[1:]
+			for len(comps) >= 2 {
+				flags, l := comps[0], int(comps[1])
+				if 2+l > len(comps) {
+					break
+				}
+				part := string(comps[2 : 2+l])
+				switch {
+				case flags&0x02 != 0:
+					part = "."
+				case flags&0x04 != 0:
+					part = ".."
+				}
+				if flags&0x08 != 0 {
+					info.link = "/"
+				} else {
+					if info.link != "" && info.link != "/" && !info.linkJoin {
+						info.link += "/"
+					}
+					info.link += part
+					info.linkJoin = flags&0x01 != 0
+				}
+				comps = comps[2+l:]
+			}
+		case "CL":
+			if len(data) >= 4 {
+				info.childLink = binary.LittleEndian.Uint32(data[0:4])
+			}
+		case "RE":
+			info.relocated = true
+		}
+	}
+	return info
+}
+
+// entryName turns the name of a record into a file name.
+func (ir *isoReader) entryName(rec *isoDirRecord, rr *rrInfo) string {
+	var name string
+	switch {
+	case rr != nil && rr.hasName:
+		name = rr.name
+	case ir.joliet:
+		u := make([]uint16, len(rec.name)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(rec.name[2*i:])
+		}
+		name = string(utf16.Decode(u))
+	default:
+		name = string(rec.name)
+	}
+	if rr == nil || !rr.hasName {
+		// Drop the version, and the dot of names without an
+		// extension.
+		if i := strings.LastIndex(name, ";"); i != -1 {
+			name = name[:i]
+		}
+		if !rec.isDir() {
+			name = strings.TrimSuffix(name, ".")
+		}
+	}
+	if ir.lowercase {
+		name = strings.ToLower(name)
+	}
+	return name
+}
+
+func (rec *isoDirRecord) isDir() bool {
+	return rec.flags&isoFlagDir != 0
+}
+
+// readDir adds the contents of a directory, and of every directory
+// below it.
+func (ir *isoReader) readDir(dir *isoDirRecord, dirPath string) error {
+	if ir.seen[dir.extent] {
+		return fmt.Errorf("directory %s loops", dirPath)
+	}
+	ir.seen[dir.extent] = true
+	data := make([]byte, dir.size)
+	if _, err := ir.r.ReadAt(data, int64(dir.extent)*isoSectorSize); err != nil {
+		return fmt.Errorf("reading directory %s: %v", dirPath, err)
+	}
+	var last *isoEntry
+	lastMulti := false
+	for off := 0; off < len(data); {
+		if data[off] == 0 {
+			// Records do not cross sectors, so the rest of this
+			// one is padding.
+			off = (off/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		rec, err := parseIsoDirRecord(data[off:])
+		if err != nil {
+			return fmt.Errorf("directory %s: %v", dirPath, err)
+		}
+		off += int(data[off])
+		if len(rec.name) == 1 && (rec.name[0] == 0 || rec.name[0] == 1) {
+			// . and ..
+			continue
+		}
+		var rr *rrInfo
+		if ir.rockRidge {
+			entries, err := ir.suspEntries(rec)
+			if err != nil {
+				return fmt.Errorf("directory %s: %v", dirPath, err)
+			}
+			rr = parseRockRidge(entries)
+			if rr.relocated {
+				continue
+			}
+		}
+		name := ir.entryName(rec, rr)
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return fmt.Errorf("directory %s has an invalid name %q", dirPath, name)
+		}
+		p := path.Join(dirPath, name)
+		if ir.rockRidge && dirPath == "" && rec.isDir() && (name == "rr_moved" || name == ".rr_moved") {
+			// Where deep directories are relocated to.
+			continue
+		}
+
+		if lastMulti && last != nil && last.Path == p {
+			// The next part of a file too big for one extent
+			last.Extents = append(last.Extents, isoExtent{int64(rec.extent) * isoSectorSize, int64(rec.size)})
+			last.Size += int64(rec.size)
+			lastMulti = rec.flags&isoFlagMultiExtent != 0
+			continue
+		}
+		entry := &isoEntry{Path: p, ModTime: rec.modTime, Dir: rec.isDir()}
+		if rr != nil && rr.childLink != 0 {
+			entry.Dir = true
+			rec = &isoDirRecord{extent: rr.childLink}
+			sector := make([]byte, isoSectorSize)
+			if _, err := ir.r.ReadAt(sector, int64(rr.childLink)*isoSectorSize); err != nil {
+				return fmt.Errorf("reading relocated directory %s: %v", p, err)
+			}
+			dot, err := parseIsoDirRecord(sector)
+			if err != nil {
+				return fmt.Errorf("relocated directory %s: %v", p, err)
+			}
+			rec.size = dot.size
+			rec.flags = isoFlagDir
+		}
+		switch {
+		case rr != nil && rr.hasMode:
+			entry.Mode = os.FileMode(rr.mode & 0777)
+			if rr.mode&0170000 == 0120000 {
+				entry.Link = rr.link
+			}
+		case entry.Dir:
+			entry.Mode = 0755
+		default:
+			entry.Mode = 0644
+		}
+		if !entry.Dir && entry.Link == "" {
+			entry.Size = int64(rec.size)
+			entry.Extents = []isoExtent{{int64(rec.extent) * isoSectorSize, int64(rec.size)}}
+		}
+		ir.entries = append(ir.entries, entry)
+		last, lastMulti = entry, rec.flags&isoFlagMultiExtent != 0
+		if entry.Dir {
+			if err := ir.readDir(rec, p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
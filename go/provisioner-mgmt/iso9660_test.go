@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The images in testdata were made with bsdtar from a tree holding
+// long names, symlinks and directories deep enough to be relocated:
+//
+//   bsdtar -cf rr.iso --format iso9660 --options rockridge,joliet -C src .
+//   bsdtar -cf joliet.iso --format iso9660 --options '!rockridge,joliet' -C src .
+
+// testdataIso reads a gzipped image from testdata.
+func testdataIso(t *testing.T, name string) *bytes.Reader {
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf)
+}
+
+// isoEntries reads an image, and returns its entries by path.
+func isoEntries(t *testing.T, r *bytes.Reader, lowercase bool) map[string]*isoEntry {
+	entries, err := readIso(r, lowercase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := map[string]*isoEntry{}
+	for _, e := range entries {
+		if res[e.Path] != nil {
+			t.Errorf("Expected %s to be listed once", e.Path)
+		}
+		res[e.Path] = e
+	}
+	return res
+}
+
+func isoContents(t *testing.T, r *bytes.Reader, e *isoEntry) string {
+	buf, err := ioutil.ReadAll(e.open(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func TestReadIsoRockRidge(t *testing.T) {
+	r := testdataIso(t, "rr.iso.gz")
+	entries := isoEntries(t, r, false)
+
+	// NM
+	if e := entries["A Long File Name With Spaces.txt"]; e == nil || isoContents(t, r, e) != "hello\n" {
+		t.Errorf("Expected the Rock Ridge name of the file, but got %v", entries)
+	}
+	if e := entries["Mixed/ReadMe"]; e == nil || isoContents(t, r, e) != "m\n" {
+		t.Errorf("Expected the case of Rock Ridge names to be kept, but got %v", entries)
+	}
+	// SL
+	if e := entries["target-link"]; e == nil || e.Link != "a/b/c" || len(e.Extents) != 0 {
+		t.Errorf("Expected a symlink to a/b/c, but got %+v", e)
+	}
+	if e := entries["a/rel-link"]; e == nil || e.Link != "../../x/./y" {
+		t.Errorf("Expected a symlink to ../../x/./y, but got %+v", e)
+	}
+	// CL and RE
+	deep := "a/b/c/d/e/f/g/h/i/j"
+	for p := deep; p != "."; p = filepath.Dir(p) {
+		if e := entries[p]; e == nil || !e.Dir {
+			t.Errorf("Expected %s to be a directory, but got %+v", p, e)
+		}
+	}
+	if e := entries[deep+"/deep.txt"]; e == nil || isoContents(t, r, e) != "deep\n" {
+		t.Errorf("Expected the file in the relocated directory, but got %+v", e)
+	}
+	for p := range entries {
+		if strings.Contains(strings.ToLower(p), "rr_moved") {
+			t.Errorf("Expected the relocated directories to be skipped, but got %s", p)
+		}
+	}
+	if len(entries) != 16 {
+		t.Errorf("Expected 16 entries, but got %d: %v", len(entries), entries)
+	}
+}
+
+func TestReadIsoJoliet(t *testing.T) {
+	r := testdataIso(t, "joliet.iso.gz")
+	entries := isoEntries(t, r, false)
+	for p, want := range map[string]string{
+		"A Long File Name With Spaces.txt": "hello\n",
+		"Mixed/ReadMe":                     "m\n",
+		"Mixed/Sub/Ünïcode.txt":            "s\n",
+	} {
+		if e := entries[p]; e == nil || isoContents(t, r, e) != want {
+			t.Errorf("Expected the Joliet name %s, but got %v", p, entries)
+		}
+	}
+	if e := entries["Mixed/Sub"]; e == nil || !e.Dir || e.Mode != 0755 {
+		t.Errorf("Expected a directory without Rock Ridge modes to be 0755, but got %+v", e)
+	}
+	if len(entries) != 5 {
+		t.Errorf("Expected 5 entries, but got %d: %v", len(entries), entries)
+	}
+}
+
+// testIso builds a plain ISO9660 image by hand, for what is hard to
+// get out of the tools that make them.
+type testIso struct {
+	buf []byte
+}
+
+// The sectors of a testIso.  The volume descriptors start at 16.
+const (
+	testIsoRoot = 20
+	testIsoSub  = 21
+	testIsoData = 22
+)
+
+func newTestIso() *testIso {
+	ti := &testIso{buf: make([]byte, 32*isoSectorSize)}
+	pvd := ti.descriptor(16, 1, "CD001")
+	binary.LittleEndian.PutUint16(pvd[128:130], isoSectorSize)
+	copy(pvd[156:190], isoRecord("\x00", testIsoRoot, isoSectorSize, isoFlagDir))
+	ti.descriptor(17, 255, "CD001")
+	return ti
+}
+
+func (ti *testIso) descriptor(sector int, kind byte, id string) []byte {
+	vd := ti.buf[sector*isoSectorSize : (sector+1)*isoSectorSize]
+	vd[0] = kind
+	copy(vd[1:6], id)
+	vd[6] = 1
+	return vd
+}
+
+// dir writes a directory at sector holding records after . and ..
+func (ti *testIso) dir(sector int, parent uint32, records ...[]byte) {
+	all := append([][]byte{
+		isoRecord("\x00", uint32(sector), isoSectorSize, isoFlagDir),
+		isoRecord("\x01", parent, isoSectorSize, isoFlagDir),
+	}, records...)
+	off := sector * isoSectorSize
+	for _, rec := range all {
+		off += copy(ti.buf[off:], rec)
+	}
+}
+
+func isoRecord(name string, extent, size uint32, flags byte) []byte {
+	l := 33 + len(name)
+	if len(name)%2 == 0 {
+		l++
+	}
+	rec := make([]byte, l)
+	rec[0] = byte(l)
+	binary.LittleEndian.PutUint32(rec[2:6], extent)
+	binary.BigEndian.PutUint32(rec[6:10], extent)
+	binary.LittleEndian.PutUint32(rec[10:14], size)
+	binary.BigEndian.PutUint32(rec[14:18], size)
+	copy(rec[18:25], []byte{116, 5, 1, 12, 0, 0, 0})
+	rec[25] = flags
+	rec[32] = byte(len(name))
+	copy(rec[33:], name)
+	return rec
+}
+
+func TestReadIsoMultiExtent(t *testing.T) {
+	ti := newTestIso()
+	ti.dir(testIsoRoot, testIsoRoot,
+		isoRecord("BIG.;1", testIsoData, isoSectorSize, isoFlagMultiExtent),
+		isoRecord("BIG.;1", testIsoData+2, 10, 0),
+		isoRecord("README.TXT;1", testIsoData+3, 5, 0))
+	copy(ti.buf[testIsoData*isoSectorSize:], bytes.Repeat([]byte("a"), isoSectorSize))
+	copy(ti.buf[(testIsoData+2)*isoSectorSize:], "bbbbbbbbbb")
+	copy(ti.buf[(testIsoData+3)*isoSectorSize:], "hello")
+	r := bytes.NewReader(ti.buf)
+
+	entries := isoEntries(t, r, true)
+	big := entries["big"]
+	if big == nil || big.Size != isoSectorSize+10 || len(big.Extents) != 2 {
+		t.Fatalf("Expected one file from both extents, but got %+v", entries)
+	}
+	if got := isoContents(t, r, big); got != strings.Repeat("a", isoSectorSize)+"bbbbbbbbbb" {
+		t.Errorf("Expected the contents of both extents, but got %d bytes", len(got))
+	}
+	if e := entries["readme.txt"]; e == nil || e.Mode != 0644 || isoContents(t, r, e) != "hello" {
+		t.Errorf("Expected the file after the multi-extent one, but got %+v", entries)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Expected 2 entries, but got %v", entries)
+	}
+}
+
+func TestReadIsoLoop(t *testing.T) {
+	ti := newTestIso()
+	ti.dir(testIsoRoot, testIsoRoot, isoRecord("SUB", testIsoSub, isoSectorSize, isoFlagDir))
+	ti.dir(testIsoSub, testIsoRoot, isoRecord("BACK", testIsoRoot, isoSectorSize, isoFlagDir))
+	_, err := readIso(bytes.NewReader(ti.buf), false)
+	if err == nil || !strings.Contains(err.Error(), "SUB/BACK loops") {
+		t.Errorf("Expected a directory pointing back at the root to fail, but got %v", err)
+	}
+}
+
+func TestReadIsoUdf(t *testing.T) {
+	bridge := func(setup func(ti *testIso)) *testUdf {
+		ti := newTestIso()
+		ti.descriptor(18, 0, "BEA01")
+		ti.descriptor(19, 0, "NSR02")
+		setup(ti)
+		tu := newTestUdf(ti.buf)
+		tu.root(tu.dir(testUdfFid("Setup.exe", 0, tu.file(udfFileTypeFile, 0644, []byte("setup")))))
+		return tu
+	}
+	readme := isoRecord("README.TXT;1", testIsoData+1, 5, 0)
+
+	tu := bridge(func(ti *testIso) {
+		ti.dir(testIsoRoot, testIsoRoot, readme)
+	})
+	entries := isoEntries(t, bytes.NewReader(tu.buf), false)
+	if len(entries) != 1 || entries["Setup.exe"] == nil {
+		t.Errorf("Expected the UDF tree behind a placeholder ISO9660 tree to be used, but got %v", entries)
+	}
+
+	tu = bridge(func(ti *testIso) {
+		ti.dir(testIsoRoot, testIsoRoot, readme, isoRecord("SUB", testIsoSub, isoSectorSize, isoFlagDir))
+		ti.dir(testIsoSub, testIsoRoot)
+	})
+	entries = isoEntries(t, bytes.NewReader(tu.buf), false)
+	if len(entries) != 2 || entries["README.TXT"] == nil || entries["SUB"] == nil {
+		t.Errorf("Expected a full ISO9660 tree next to UDF to be used, but got %v", entries)
+	}
+
+	tu = newTestUdfOnly()
+	tu.root(tu.dir(testUdfFid("Setup.exe", 0, tu.file(udfFileTypeFile, 0644, []byte("setup")))))
+	r := bytes.NewReader(tu.buf)
+	entries = isoEntries(t, r, false)
+	if e := entries["Setup.exe"]; len(entries) != 1 || e == nil || isoContents(t, r, e) != "setup" {
+		t.Errorf("Expected a UDF-only image to be read, but got %v", entries)
+	}
+}
@@ -4,8 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
 	"path"
 	"strings"
+
+	"github.com/digitalrebar/digitalrebar/go/common/multi-tenancy"
+	"github.com/gin-gonic/gin"
 )
 
 // Machine represents a single bare-metal system that the provisioner
@@ -13,18 +17,91 @@ import (
 type Machine struct {
 	Name     string                 // The FQDN of the machine.
 	Uuid     string                 // the UUID of the machine
-	Address  string                 // The IPv4 address that the machine PXE boots with.
+	Address  string                 // The IPv4 address that the machine PXE boots with, if known.
+	Macs     []string               // The MAC addresses of the NICs the machine can PXE boot from.
 	BootEnv  string                 // The boot environment that the machine should boot into.
 	Params   map[string]interface{} // Any additional parameters that may be needed for template expansion.
 	TenantId int
+	mac      string
 }
 
 // HexAddress returns Address in raw hexadecimal format, suitable for
 // pxelinux and elilo usage.
-func (n *Machine) HexAddress() string {
+func (n *Machine) HexAddress() (string, error) {
 	addr := net.ParseIP(n.Address).To4()
+	if addr == nil {
+		return "", fmt.Errorf("machine %s has no IPv4 address", n.Name)
+	}
 	hexIP := []byte(addr)
-	return fmt.Sprintf("%02X%02X%02X%02X", hexIP[0], hexIP[1], hexIP[2], hexIP[3])
+	return fmt.Sprintf("%02X%02X%02X%02X", hexIP[0], hexIP[1], hexIP[2], hexIP[3]), nil
+}
+
+// Mac returns the MAC address templates are being rendered for, in
+// the colon separated form iPXE uses for ${mac}.  Paths that use it
+// are rendered once for each of the machine's MAC addresses.
+func (n *Machine) Mac() string {
+	return n.mac
+}
+
+// HexMac returns Mac separated with hyphens, as pxelinux and iPXE's
+// ${mac:hexhyp} have it.
+func (n *Machine) HexMac() string {
+	return strings.Replace(n.mac, ":", "-", -1)
+}
+
+// PxelinuxName returns the name pxelinux looks up the config of the
+// machine by: 01-<mac> if the machine has MAC addresses, and the hex
+// address if it does not.
+func (n *Machine) PxelinuxName() (string, error) {
+	if n.mac != "" {
+		return "01-" + n.HexMac(), nil
+	}
+	return n.HexAddress()
+}
+
+// IpxeName returns the name iPXE looks up the script of the machine
+// by: ${mac} if the machine has MAC addresses, and ${ip} if it does
+// not.
+func (n *Machine) IpxeName() string {
+	if n.mac != "" {
+		return n.mac
+	}
+	return n.Address
+}
+
+// HasMac returns whether the machine has the MAC address.
+func (n *Machine) HasMac(mac string) bool {
+	for _, m := range n.Macs {
+		if m == mac {
+			return true
+		}
+	}
+	return false
+}
+
+// forEachMac returns a copy of the machine for each of its MAC
+// addresses, for templates to be rendered with.  A machine without MAC
+// addresses is returned as it is.
+func (n *Machine) forEachMac() []*Machine {
+	if len(n.Macs) == 0 {
+		return []*Machine{n}
+	}
+	res := make([]*Machine, len(n.Macs))
+	for i, mac := range n.Macs {
+		m := *n
+		m.mac = mac
+		res[i] = &m
+	}
+	return res
+}
+
+// normalizeMac returns mac in the form Macs are kept in.
+func normalizeMac(mac string) (string, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", err
+	}
+	return hw.String(), nil
 }
 
 func (n *Machine) ShortName() string {
@@ -90,12 +167,20 @@ func (n *Machine) onChange(oldThing interface{}) error {
 		}
 		oldBootEnv.DeleteRenderedTemplates(old)
 	}
-	addr := net.ParseIP(n.Address)
-	if addr != nil {
-		addr = addr.To4()
+	if n.Address == "" && len(n.Macs) == 0 {
+		return fmt.Errorf("machine: %s needs an IPv4 address or MAC addresses", n.Name)
 	}
-	if addr == nil {
-		return fmt.Errorf("machine: %s  is not a valid IPv4 address", n.Address)
+	if n.Address != "" {
+		addr := net.ParseIP(n.Address)
+		if addr != nil {
+			addr = addr.To4()
+		}
+		if addr == nil {
+			return fmt.Errorf("machine: %s  is not a valid IPv4 address", n.Address)
+		}
+	}
+	if err := n.checkMacs(); err != nil {
+		return err
 	}
 	bootEnv := &BootEnv{Name: n.BootEnv}
 	if err := backend.load(bootEnv); err != nil {
@@ -107,6 +192,43 @@ func (n *Machine) onChange(oldThing interface{}) error {
 	return nil
 }
 
+// checkMacs normalizes the MAC addresses of the machine, and makes
+// sure no other machine has them, as they would boot each other's
+// configs.
+func (n *Machine) checkMacs() error {
+	seen := map[string]bool{}
+	macs := make([]string, 0, len(n.Macs))
+	for _, mac := range n.Macs {
+		norm, err := normalizeMac(mac)
+		if err != nil {
+			return fmt.Errorf("machine: %s is not a valid MAC address", mac)
+		}
+		if !seen[norm] {
+			seen[norm] = true
+			macs = append(macs, norm)
+		}
+	}
+	n.Macs = macs
+	if len(macs) == 0 {
+		return nil
+	}
+	machines, err := n.List()
+	if err != nil {
+		return err
+	}
+	for _, other := range machines {
+		if other.UUID() == n.UUID() {
+			continue
+		}
+		for _, mac := range macs {
+			if other.HasMac(mac) {
+				return fmt.Errorf("machine: MAC address %s already belongs to %s", mac, other.Name)
+			}
+		}
+	}
+	return nil
+}
+
 func (n *Machine) onDelete() error {
 	bootEnv := &BootEnv{Name: n.BootEnv}
 	if err := backend.load(bootEnv); err != nil {
@@ -132,3 +254,34 @@ func (b *Machine) List() ([]*Machine, error) {
 func (b *Machine) RebuildRebarData() error {
 	return nil
 }
+
+// listMachinesByMac returns the machines with the MAC address that the
+// caller can see.
+func listMachinesByMac(c *gin.Context, mac string) {
+	norm, err := normalizeMac(mac)
+	if err != nil {
+		c.JSON(http.StatusBadRequest,
+			NewError(fmt.Sprintf("list: %s is not a valid MAC address", mac)))
+		return
+	}
+	capMap, err := multitenancy.NewCapabilityMap(c.Request)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError,
+			NewError(fmt.Sprintf("list: failed to get the capmap: %v", err)))
+		return
+	}
+	machine := &Machine{}
+	machines, err := machine.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError,
+			NewError(fmt.Sprintf("list: error listing machines: %v", err)))
+		return
+	}
+	res := []*Machine{}
+	for _, m := range machines {
+		if m.HasMac(norm) && capMap.HasCapability(m.TenantId, m.typeName()+"_READ") {
+			res = append(res, m)
+		}
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestMachineNames(t *testing.T) {
+	m := &Machine{Name: "node1.example.com", Address: "192.168.124.10"}
+	ms := m.forEachMac()
+	if len(ms) != 1 || ms[0] != m {
+		t.Errorf("Expected a machine without Macs to be used as it is, but got %v", ms)
+	}
+	if name, err := m.PxelinuxName(); name != "C0A87C0A" || err != nil {
+		t.Errorf("Expected the hex address without Macs, but got %q %v", name, err)
+	}
+	if name := m.IpxeName(); name != "192.168.124.10" {
+		t.Errorf("Expected the address without Macs, but got %q", name)
+	}
+
+	m.Macs = []string{"52:54:00:12:34:56", "52:54:00:ab:cd:ef"}
+	ms = m.forEachMac()
+	if len(ms) != 2 || ms[0].Mac() != "52:54:00:12:34:56" || ms[1].Mac() != "52:54:00:ab:cd:ef" {
+		t.Fatalf("Expected a machine for each MAC, but got %v", ms)
+	}
+	if m.Mac() != "" || ms[0].Address != m.Address || ms[0].Name != m.Name {
+		t.Errorf("Expected copies of the machine, but got %+v from %+v", ms[0], m)
+	}
+	if name, err := ms[1].PxelinuxName(); name != "01-52-54-00-ab-cd-ef" || err != nil {
+		t.Errorf("Expected the pxelinux MAC name, but got %q %v", name, err)
+	}
+	if name := ms[1].IpxeName(); name != "52:54:00:ab:cd:ef" {
+		t.Errorf("Expected the MAC, but got %q", name)
+	}
+
+	noAddr := &Machine{Name: "node2.example.com"}
+	if _, err := noAddr.PxelinuxName(); err == nil {
+		t.Error("Expected a machine with neither Macs nor an address to have no pxelinux name")
+	}
+}
+
+func TestRenderPaths(t *testing.T) {
+	defer withFileRoot(t)()
+	b := testEnv(t, map[string]string{
+		"ipxe":  "{{.Machine.IpxeName}}.ipxe",
+		"elilo": "{{if .Machine.Address}}{{.Machine.HexAddress}}.conf{{end}}",
+	})
+	paths := func(name string) []string {
+		res := []string{}
+		for _, tmpl := range b.Templates {
+			if tmpl.Name != name {
+				continue
+			}
+			for _, final := range tmpl.finalPaths {
+				rel, _ := filepath.Rel(fileRoot, final.path)
+				res = append(res, rel)
+			}
+		}
+		sort.Strings(res)
+		return res
+	}
+
+	m := &Machine{
+		Name:    "node1.example.com",
+		Address: "192.168.124.10",
+		Macs:    []string{"52:54:00:12:34:56", "52:54:00:ab:cd:ef"},
+	}
+	if err := b.RenderPaths(m); err != nil {
+		t.Fatal(err)
+	}
+	if p := paths("ipxe"); len(p) != 2 || p[0] != "52:54:00:12:34:56.ipxe" || p[1] != "52:54:00:ab:cd:ef.ipxe" {
+		t.Errorf("Expected a script for each MAC, but got %v", p)
+	}
+	if p := paths("elilo"); len(p) != 1 || p[0] != "C0A87C0A.conf" {
+		t.Errorf("Expected one config for the address, but got %v", p)
+	}
+
+	m.Address = ""
+	if err := b.RenderPaths(m); err != nil {
+		t.Fatal(err)
+	}
+	if p := paths("elilo"); len(p) != 0 {
+		t.Errorf("Expected no config without an address, but got %v", p)
+	}
+	if p := paths("ipxe"); len(p) != 2 {
+		t.Errorf("Expected the scripts to still be rendered, but got %v", p)
+	}
+}
+
+// withBackend points backend at a new file backend holding machines,
+// and returns a function that removes it and puts backend back.
+func withBackend(t *testing.T, machines ...*Machine) func() {
+	dir, err := ioutil.TempDir("", "provisioner-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := newFileBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range machines {
+		fb.mkThingPath(m)
+		buf, _ := json.Marshal(m)
+		if err := ioutil.WriteFile(fb.mkThingName(m), buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := backend
+	backend = fb
+	return func() {
+		backend = old
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCheckMacs(t *testing.T) {
+	other := &Machine{Name: "node2.example.com", Uuid: "node2", Macs: []string{"52:54:00:ab:cd:ef"}}
+	defer withBackend(t, other)()
+
+	m := &Machine{Name: "node1.example.com", Uuid: "node1", Macs: []string{"52-54-00-12-34-56", "52:54:00:12:34:56"}}
+	if err := m.checkMacs(); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Macs) != 1 || m.Macs[0] != "52:54:00:12:34:56" {
+		t.Errorf("Expected Macs to be normalized and deduplicated, but got %v", m.Macs)
+	}
+
+	m.Macs = []string{"52:54:00:12:34:56", "52:54:00:AB:CD:EF"}
+	if err := m.checkMacs(); err == nil {
+		t.Error("Expected a MAC belonging to another machine to be rejected")
+	}
+
+	other.Macs = append(other.Macs, "52:54:00:00:00:01")
+	if err := other.checkMacs(); err != nil {
+		t.Errorf("Expected a machine to keep its own Macs, but got %v", err)
+	}
+
+	m.Macs = []string{"not a mac"}
+	if err := m.checkMacs(); err == nil {
+		t.Error("Expected an invalid MAC to be rejected")
+	}
+}
@@ -16,9 +16,9 @@ import (
 	uuid "github.com/satori/go.uuid"
 )
 
-var machineKey, fileRoot, provisionerURL, commandURL string
+var machineKey, fileRoot, provisionerURL, provisionerHTTPSURL, commandURL string
 var backEndType string
-var apiPort, staticPort, tftpPort int
+var apiPort, staticPort, staticTLSPort, tftpPort int
 var backend storageBackend
 var rebarClient *api.Client
 var logger *log.Logger
@@ -56,6 +56,10 @@ func main() {
 		"static-port",
 		8091,
 		"Port the static HTTP file server should listen on")
+	flag.IntVar(&staticTLSPort,
+		"static-tls-port",
+		8093,
+		"Port the HTTPS static file server should listen on, 0 to not serve HTTPS")
 	flag.IntVar(&tftpPort,
 		"tftp-port",
 		69,
@@ -130,8 +134,25 @@ func main() {
 		true); err != nil {
 		log.Fatalf("Failed to register provisioner-tftp-service with Consul: %v", err)
 	}
+	if staticTLSPort != 0 {
+		if err = service.Register(consulClient,
+			&consul.AgentServiceRegistration{
+				Name: "provisioner-https-service",
+				Port: staticTLSPort,
+				// Consul would not trust our certificate, so
+				// check that the TLS port itself is listening.
+				Check: &consul.AgentServiceCheck{
+					TCP:      fmt.Sprintf("[::]:%d", staticTLSPort),
+					Interval: "10s",
+				},
+			},
+			true); err != nil {
+			log.Fatalf("Failed to register provisioner-https-service with Consul: %v", err)
+		}
+	}
 	// Figure out our service address
 
+	var ourAddress string
 	for {
 		svc, err := service.Find(consulClient, "provisioner", "")
 		if err != nil {
@@ -141,11 +162,20 @@ func main() {
 			continue
 		}
 
-		ourAddress, _ := service.Address(svc[0])
+		ourAddress, _ = service.Address(svc[0])
 		provisionerURL = fmt.Sprintf("http://%s:%d", ourAddress, staticPort)
 		break
 	}
 
+	// The HTTPS file server has to be up before the API, as the boot
+	// URIs of boot environments depend on it.
+	if staticTLSPort != 0 {
+		if err = serveStaticTLS(fmt.Sprintf(":%d", staticTLSPort), fileRoot, []string{ourAddress, "provisioner-service", "localhost"}); err != nil {
+			log.Fatalf("Error starting HTTPS static file server: %v", err)
+		}
+		provisionerHTTPSURL = fmt.Sprintf("https://%s:%d", ourAddress, staticTLSPort)
+	}
+
 	switch backEndType {
 	case "consul":
 		backend, err = newConsulBackend(machineKey)
@@ -183,6 +213,10 @@ func main() {
 	// machine methods
 	mgmtApi.GET("/machines",
 		func(c *gin.Context) {
+			if mac := c.Query("mac"); mac != "" {
+				listMachinesByMac(c, mac)
+				return
+			}
 			listThings(c, &Machine{})
 		})
 	mgmtApi.POST("/machines",
@@ -242,6 +276,9 @@ func main() {
 			deleteIso(c, fileRoot, c.Param(`name`))
 		})
 
+	// Download methods
+	mgmtApi.GET("/downloads", listDownloads)
+
 	s, err := cert.Server("internal", "provisioner-mgmt-service")
 	if err != nil {
 		log.Fatalf("Error creating trusted server: %v", err)
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"net"
 	"net/http"
+
+	"github.com/digitalrebar/digitalrebar/go/common/cert"
 )
 
 func serveStatic(listenAt, fsPath string) error {
@@ -14,3 +21,32 @@ func serveStatic(listenAt, fsPath string) error {
 	http.Handle("/", fs)
 	return http.Serve(conn, nil)
 }
+
+// serveStaticTLS serves the same files as serveStatic over HTTPS,
+// with a certificate for hosts from trust-me.  Unlike the API, it does
+// not ask clients for certificates, as firmware and iPXE have none.
+func serveStaticTLS(listenAt, fsPath string, hosts []string) error {
+	validator, certB, keyB, err := cert.GetKeysFor("internal", "provisioner-service", hosts)
+	if err != nil {
+		return err
+	}
+	keypair, err := tls.X509KeyPair(certB, keyB)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(validator)
+	if block == nil {
+		return errors.New("trust-me sent an invalid root certificate")
+	}
+	sum := sha256.Sum256(block.Bytes)
+	caFingerprint = hex.EncodeToString(sum[:])
+
+	conn, err := net.Listen("tcp", listenAt)
+	if err != nil {
+		return err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{keypair}}
+	s := &http.Server{Handler: http.FileServer(http.Dir(fsPath)), TLSConfig: cfg}
+	go s.Serve(tls.NewListener(conn, cfg))
+	return nil
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// The parts of UDF (ECMA-167, as OSTA profiles it) needed to get files
+// off install media that only keep them there, such as Windows'.
+// Logical volumes must use 2048 byte blocks and plain partition maps,
+// which rules out the metadata partitions of UDF 2.50 and later.
+
+// Descriptor tag identifiers.
+const (
+	udfTagAnchor            = 2
+	udfTagPointer           = 3
+	udfTagPartition         = 5
+	udfTagLogicalVolume     = 6
+	udfTagTerminating       = 8
+	udfTagFileSet           = 256
+	udfTagFileId            = 257
+	udfTagAllocationExt     = 258
+	udfTagFileEntry         = 261
+	udfTagExtendedFileEntry = 266
+)
+
+// File types in an ICB tag.
+const (
+	udfFileTypeDir     = 4
+	udfFileTypeFile    = 5
+	udfFileTypeSymlink = 12
+)
+
+// File characteristics of a file identifier.
+const (
+	udfFileDeleted = 0x04
+	udfFileParent  = 0x08
+)
+
+// udfAnchorSector is where the anchor volume descriptor pointer is.
+// UDF also puts copies at the end of the image, but mastering tools
+// always write this one.
+const udfAnchorSector = 256
+
+// udfLongAd points at an extent in a partition.
+type udfLongAd struct {
+	length    uint32
+	block     uint32
+	partition uint16
+}
+
+func parseUdfLongAd(b []byte) udfLongAd {
+	return udfLongAd{
+		length:    binary.LittleEndian.Uint32(b[0:4]),
+		block:     binary.LittleEndian.Uint32(b[4:8]),
+		partition: binary.LittleEndian.Uint16(b[8:10]),
+	}
+}
+
+// udfFile is a parsed file entry.
+type udfFile struct {
+	fileType byte
+	mode     os.FileMode
+	modTime  time.Time
+	size     int64
+	extents  []isoExtent
+}
+
+// udfReader walks the directory tree of a UDF file system.
+type udfReader struct {
+	r          io.ReaderAt
+	lowercase  bool
+	partitions []int64 // First sector of each partition, by reference number
+	seen       map[int64]bool
+	entries    []*isoEntry
+}
+
+// readUdf lists everything in the UDF file system of an image.  With
+// lowercase, names are lowercased as readIso does.
+func readUdf(r io.ReaderAt, lowercase bool) ([]*isoEntry, error) {
+	ur := &udfReader{r: r, lowercase: lowercase, seen: map[int64]bool{}}
+	anchor, err := ur.readTag(udfAnchorSector*isoSectorSize, udfTagAnchor)
+	if err != nil {
+		return nil, fmt.Errorf("UDF anchor: %v", err)
+	}
+	fileSet, err := ur.readVolume(binary.LittleEndian.Uint32(anchor[20:24]), binary.LittleEndian.Uint32(anchor[16:20]))
+	if err != nil {
+		return nil, err
+	}
+	off, err := ur.addr(fileSet)
+	if err != nil {
+		return nil, err
+	}
+	fsd, err := ur.readTag(off, udfTagFileSet)
+	if err != nil {
+		return nil, fmt.Errorf("UDF file set: %v", err)
+	}
+	rootIcb := parseUdfLongAd(fsd[400:416])
+	root, err := ur.readFile(rootIcb)
+	if err != nil {
+		return nil, fmt.Errorf("UDF root directory: %v", err)
+	}
+	if err := ur.readDir(rootIcb, root, ""); err != nil {
+		return nil, err
+	}
+	return ur.entries, nil
+}
+
+// readVolume reads the volume descriptor sequence at sector to find
+// the partitions of the logical volume, and returns where its file
+// set descriptor is.
+func (ur *udfReader) readVolume(sector, length uint32) (udfLongAd, error) {
+	var fileSet udfLongAd
+	var lvd []byte
+	var lvdSeq uint32
+	starts := map[uint16]int64{}
+	seqs := map[uint16]uint32{}
+	end := sector + length/isoSectorSize
+	for descriptors := 0; sector < end; descriptors++ {
+		if descriptors > 1024 {
+			return fileSet, errors.New("UDF volume descriptor sequence is too long")
+		}
+		vd, err := ur.readTag(int64(sector)*isoSectorSize, 0)
+		if err != nil {
+			return fileSet, fmt.Errorf("UDF volume descriptor %d: %v", sector, err)
+		}
+		sector++
+		seq := binary.LittleEndian.Uint32(vd[16:20])
+		switch binary.LittleEndian.Uint16(vd[0:2]) {
+		case udfTagPointer:
+			// The sequence carries on somewhere else.
+			length = binary.LittleEndian.Uint32(vd[20:24])
+			sector = binary.LittleEndian.Uint32(vd[24:28])
+			end = sector + length/isoSectorSize
+		case udfTagPartition:
+			// Of descriptors for the same thing, the one with the
+			// highest sequence number wins.
+			num := binary.LittleEndian.Uint16(vd[22:24])
+			if old, ok := seqs[num]; !ok || seq >= old {
+				starts[num] = int64(binary.LittleEndian.Uint32(vd[188:192]))
+				seqs[num] = seq
+			}
+		case udfTagLogicalVolume:
+			if lvd == nil || seq >= lvdSeq {
+				lvd, lvdSeq = vd, seq
+			}
+		case udfTagTerminating:
+			end = sector
+		}
+	}
+	if lvd == nil {
+		return fileSet, errors.New("no UDF logical volume")
+	}
+	if bs := binary.LittleEndian.Uint32(lvd[212:216]); bs != isoSectorSize {
+		return fileSet, fmt.Errorf("unsupported UDF logical block size %d", bs)
+	}
+	maps := lvd[440:]
+	if l := binary.LittleEndian.Uint32(lvd[264:268]); int(l) <= len(maps) {
+		maps = maps[:l]
+	}
+	for n := binary.LittleEndian.Uint32(lvd[268:272]); n > 0; n-- {
+		if len(maps) < 2 || int(maps[1]) < 2 || int(maps[1]) > len(maps) {
+			return fileSet, errors.New("UDF partition map overruns the logical volume")
+		}
+		pm := maps[:maps[1]]
+		maps = maps[maps[1]:]
+		if pm[0] != 1 || len(pm) < 6 {
+			id := ""
+			if len(pm) >= 28 {
+				id = strings.TrimRight(string(pm[5:28]), "\x00")
+			}
+			return fileSet, fmt.Errorf("unsupported UDF partition map %q", id)
+		}
+		num := binary.LittleEndian.Uint16(pm[4:6])
+		start, ok := starts[num]
+		if !ok {
+			return fileSet, fmt.Errorf("UDF partition %d is not described", num)
+		}
+		ur.partitions = append(ur.partitions, start)
+	}
+	return parseUdfLongAd(lvd[248:264]), nil
+}
+
+// addr returns the offset in the image of the block ad points at.
+func (ur *udfReader) addr(ad udfLongAd) (int64, error) {
+	if int(ad.partition) >= len(ur.partitions) {
+		return 0, fmt.Errorf("no UDF partition %d", ad.partition)
+	}
+	return (ur.partitions[ad.partition] + int64(ad.block)) * isoSectorSize, nil
+}
+
+// readTag reads the block at off, and checks that it starts with a
+// descriptor tag for want, or for anything if want is 0.
+func (ur *udfReader) readTag(off int64, want uint16) ([]byte, error) {
+	b := make([]byte, isoSectorSize)
+	if _, err := ur.r.ReadAt(b, off); err != nil {
+		return nil, err
+	}
+	if err := checkUdfTag(b, want); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func checkUdfTag(b []byte, want uint16) error {
+	if len(b) < 16 {
+		return errors.New("short descriptor")
+	}
+	var sum byte
+	for i := 0; i < 16; i++ {
+		if i != 4 {
+			sum += b[i]
+		}
+	}
+	if sum != b[4] {
+		return errors.New("bad descriptor tag checksum")
+	}
+	if id := binary.LittleEndian.Uint16(b[0:2]); want != 0 && id != want {
+		return fmt.Errorf("expected descriptor %d, but got %d", want, id)
+	}
+	return nil
+}
+
+// readFile reads the file entry at icb.
+func (ur *udfReader) readFile(icb udfLongAd) (*udfFile, error) {
+	off, err := ur.addr(icb)
+	if err != nil {
+		return nil, err
+	}
+	fe, err := ur.readTag(off, 0)
+	if err != nil {
+		return nil, err
+	}
+	f := &udfFile{
+		fileType: fe[27],
+		size:     int64(binary.LittleEndian.Uint64(fe[56:64])),
+	}
+	var eaLen, adLen uint32
+	var adStart int
+	switch binary.LittleEndian.Uint16(fe[0:2]) {
+	case udfTagFileEntry:
+		f.modTime = udfTime(fe[84:96])
+		eaLen = binary.LittleEndian.Uint32(fe[168:172])
+		adLen = binary.LittleEndian.Uint32(fe[172:176])
+		adStart = 176
+	case udfTagExtendedFileEntry:
+		f.modTime = udfTime(fe[92:104])
+		eaLen = binary.LittleEndian.Uint32(fe[208:212])
+		adLen = binary.LittleEndian.Uint32(fe[212:216])
+		adStart = 216
+	default:
+		return nil, fmt.Errorf("expected a file entry, but got descriptor %d", binary.LittleEndian.Uint16(fe[0:2]))
+	}
+	if uint64(adStart)+uint64(eaLen)+uint64(adLen) > uint64(len(fe)) {
+		return nil, errors.New("file entry overruns its block")
+	}
+	adStart += int(eaLen)
+	ads := fe[adStart : adStart+int(adLen)]
+
+	// Permissions are five bits each for others, group and owner, of
+	// which we keep read, write and execute.
+	p := binary.LittleEndian.Uint32(fe[44:48])
+	f.mode = os.FileMode(p&07 | (p>>5&07)<<3 | (p>>10&07)<<6)
+	if f.mode == 0 {
+		f.mode = 0644
+		if f.fileType == udfFileTypeDir {
+			f.mode = 0755
+		}
+	}
+
+	switch binary.LittleEndian.Uint16(fe[34:36]) & 7 {
+	case 0:
+		err = ur.readAds(f, icb, ads, 8)
+	case 1:
+		err = ur.readAds(f, icb, ads, 16)
+	case 3:
+		// The data is in the file entry itself.
+		if f.size > int64(len(ads)) {
+			return nil, errors.New("embedded data overruns its file entry")
+		}
+		f.extents = []isoExtent{{off + int64(adStart), f.size}}
+	default:
+		return nil, errors.New("unsupported allocation descriptors")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// readAds turns the short (8 byte) or long (16 byte) allocation
+// descriptors of a file entry at icb into its extents.
+func (ur *udfReader) readAds(f *udfFile, icb udfLongAd, ads []byte, adSize int) error {
+	left := f.size
+	for continued := 0; left > 0; {
+		if len(ads) < adSize {
+			return fmt.Errorf("file entry is missing %d bytes", left)
+		}
+		l := binary.LittleEndian.Uint32(ads[0:4])
+		length, kind := int64(l&0x3fffffff), l>>30
+		if length == 0 {
+			return fmt.Errorf("file entry is missing %d bytes", left)
+		}
+		ad := udfLongAd{block: binary.LittleEndian.Uint32(ads[4:8]), partition: icb.partition}
+		if adSize == 16 {
+			ad = parseUdfLongAd(ads)
+		}
+		ads = ads[adSize:]
+		off := int64(-1)
+		if kind == 0 || kind == 3 {
+			var err error
+			if off, err = ur.addr(ad); err != nil {
+				return err
+			}
+		}
+		if kind == 3 {
+			// The rest of the descriptors are in another block.
+			if continued++; continued > 1024 {
+				return errors.New("too many allocation extents")
+			}
+			ext, err := ur.readTag(off, udfTagAllocationExt)
+			if err != nil {
+				return err
+			}
+			n := binary.LittleEndian.Uint32(ext[20:24])
+			if uint64(n) > uint64(len(ext)-24) {
+				return errors.New("allocation extent overruns its block")
+			}
+			ads = ext[24 : 24+n]
+			continue
+		}
+		if length > left {
+			length = left
+		}
+		// Extents that are not recorded keep an offset of -1, and
+		// read as zeros.
+		f.extents = append(f.extents, isoExtent{off, length})
+		left -= length
+	}
+	return nil
+}
+
+// udfTime parses a timestamp.
+func udfTime(b []byte) time.Time {
+	loc := time.UTC
+	tz := int(binary.LittleEndian.Uint16(b[0:2]) & 0x0fff)
+	if tz&0x0800 != 0 {
+		tz -= 0x1000
+	}
+	if tz != -2047 {
+		loc = time.FixedZone("", tz*60)
+	}
+	usec := int(b[9])*10000 + int(b[10])*100 + int(b[11])
+	return time.Date(int(int16(binary.LittleEndian.Uint16(b[2:4]))), time.Month(b[4]), int(b[5]),
+		int(b[6]), int(b[7]), int(b[8]), usec*1000, loc)
+}
+
+// udfName decodes an OSTA compressed unicode name.
+func udfName(b []byte) (string, error) {
+	if len(b) == 0 {
+		return "", nil
+	}
+	switch b[0] {
+	case 8, 254:
+		r := make([]rune, len(b)-1)
+		for i, c := range b[1:] {
+			r[i] = rune(c)
+		}
+		return string(r), nil
+	case 16, 255:
+		u := make([]uint16, (len(b)-1)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(b[1+2*i:])
+		}
+		return string(utf16.Decode(u)), nil
+	}
+	return "", fmt.Errorf("unknown name compression %d", b[0])
+}
+
+// udfLink turns the path components of a symlink into its target.
+func udfLink(b []byte) (string, error) {
+	parts := []string{}
+	abs := false
+	for len(b) > 0 {
+		if len(b) < 4 || 4+int(b[1]) > len(b) {
+			return "", errors.New("symlink component overruns the link")
+		}
+		switch b[0] {
+		case 1, 2:
+			abs = true
+			parts = parts[:0]
+		case 3:
+			parts = append(parts, "..")
+		case 4:
+			parts = append(parts, ".")
+		case 5:
+			name, err := udfName(b[4 : 4+int(b[1])])
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, name)
+		}
+		b = b[4+int(b[1]):]
+	}
+	link := strings.Join(parts, "/")
+	if abs {
+		link = "/" + link
+	}
+	return link, nil
+}
+
+// contents reads all of a file.
+func (ur *udfReader) contents(f *udfFile) ([]byte, error) {
+	e := &isoEntry{Extents: f.extents}
+	return ioutil.ReadAll(e.open(ur.r))
+}
+
+// readDir adds the contents of the directory at icb, and of every
+// directory below it.
+func (ur *udfReader) readDir(icb udfLongAd, dir *udfFile, dirPath string) error {
+	key, err := ur.addr(icb)
+	if err != nil {
+		return err
+	}
+	if ur.seen[key] {
+		return fmt.Errorf("directory %s loops", dirPath)
+	}
+	ur.seen[key] = true
+	if dir.fileType != udfFileTypeDir {
+		return fmt.Errorf("%s is not a directory", dirPath)
+	}
+	data, err := ur.contents(dir)
+	if err != nil {
+		return fmt.Errorf("reading directory %s: %v", dirPath, err)
+	}
+	for off := 0; off < len(data); {
+		fid := data[off:]
+		if len(fid) < 38 {
+			return fmt.Errorf("directory %s: short file identifier", dirPath)
+		}
+		if err := checkUdfTag(fid, udfTagFileId); err != nil {
+			return fmt.Errorf("directory %s: %v", dirPath, err)
+		}
+		chars, nameLen := fid[18], int(fid[19])
+		iuLen := int(binary.LittleEndian.Uint16(fid[36:38]))
+		if 38+iuLen+nameLen > len(fid) {
+			return fmt.Errorf("directory %s: file identifier overruns the directory", dirPath)
+		}
+		rawName := fid[38+iuLen : 38+iuLen+nameLen]
+		childIcb := parseUdfLongAd(fid[20:36])
+		off += (38 + iuLen + nameLen + 3) &^ 3
+		if chars&(udfFileDeleted|udfFileParent) != 0 {
+			continue
+		}
+		name, err := udfName(rawName)
+		if err != nil {
+			return fmt.Errorf("directory %s: %v", dirPath, err)
+		}
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return fmt.Errorf("directory %s has an invalid name %q", dirPath, name)
+		}
+		if ur.lowercase {
+			name = strings.ToLower(name)
+		}
+		p := path.Join(dirPath, name)
+		f, err := ur.readFile(childIcb)
+		if err != nil {
+			return fmt.Errorf("reading %s: %v", p, err)
+		}
+		entry := &isoEntry{Path: p, Mode: f.mode, ModTime: f.modTime}
+		switch f.fileType {
+		case udfFileTypeDir:
+			entry.Dir = true
+		case udfFileTypeFile:
+			entry.Size = f.size
+			entry.Extents = f.extents
+		case udfFileTypeSymlink:
+			target, err := ur.contents(f)
+			if err == nil {
+				entry.Link, err = udfLink(target)
+			}
+			if err != nil {
+				return fmt.Errorf("reading symlink %s: %v", p, err)
+			}
+		default:
+			// Devices and the like have no place in an install tree.
+			continue
+		}
+		ur.entries = append(ur.entries, entry)
+		if entry.Dir {
+			if err := ur.readDir(childIcb, f, p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// testUdf builds a UDF file system by hand, with one partition that
+// starts just after the anchor.  Blocks are numbered from the start of
+// the partition.
+type testUdf struct {
+	buf  []byte
+	next uint32 // The next free block
+}
+
+const (
+	testUdfVds       = 32
+	testUdfPartition = udfAnchorSector + 1
+	testUdfBlocks    = 64
+)
+
+var testUdfTime = time.Date(2016, 5, 1, 12, 0, 0, 0, time.FixedZone("", 60*60))
+
+// newTestUdf adds a UDF file system to buf, which should already hold
+// the volume recognition sequence.
+func newTestUdf(buf []byte) *testUdf {
+	tu := &testUdf{buf: make([]byte, (testUdfPartition+testUdfBlocks)*isoSectorSize)}
+	copy(tu.buf, buf)
+	avdp := tu.sector(udfAnchorSector)
+	binary.LittleEndian.PutUint32(avdp[16:20], 3*isoSectorSize)
+	binary.LittleEndian.PutUint32(avdp[20:24], testUdfVds)
+	testUdfTag(avdp, udfTagAnchor, udfAnchorSector)
+
+	pd := tu.sector(testUdfVds)
+	binary.LittleEndian.PutUint32(pd[188:192], testUdfPartition)
+	binary.LittleEndian.PutUint32(pd[192:196], testUdfBlocks)
+	testUdfTag(pd, udfTagPartition, testUdfVds)
+
+	lvd := tu.sector(testUdfVds + 1)
+	binary.LittleEndian.PutUint32(lvd[212:216], isoSectorSize)
+	binary.LittleEndian.PutUint32(lvd[248:252], isoSectorSize) // File set at block 0
+	binary.LittleEndian.PutUint32(lvd[264:268], 6)
+	binary.LittleEndian.PutUint32(lvd[268:272], 1)
+	lvd[440], lvd[441] = 1, 6
+	testUdfTag(lvd, udfTagLogicalVolume, testUdfVds+1)
+
+	testUdfTag(tu.sector(testUdfVds+2), udfTagTerminating, testUdfVds+2)
+	tu.alloc(1)
+	return tu
+}
+
+// newTestUdfOnly makes an image with nothing but a UDF file system.
+func newTestUdfOnly() *testUdf {
+	buf := make([]byte, 32*isoSectorSize)
+	for i, id := range []string{"BEA01", "NSR02", "TEA01"} {
+		vd := buf[(16+i)*isoSectorSize:]
+		copy(vd[1:6], id)
+		vd[6] = 1
+	}
+	return newTestUdf(buf)
+}
+
+func (tu *testUdf) sector(n uint32) []byte {
+	return tu.buf[n*isoSectorSize : (n+1)*isoSectorSize]
+}
+
+func (tu *testUdf) block(n uint32) []byte {
+	return tu.sector(testUdfPartition + n)
+}
+
+func (tu *testUdf) alloc(n int) uint32 {
+	b := tu.next
+	tu.next += uint32(n)
+	return b
+}
+
+func testUdfTag(b []byte, id uint16, loc uint32) {
+	binary.LittleEndian.PutUint16(b[0:2], id)
+	binary.LittleEndian.PutUint16(b[2:4], 2)
+	binary.LittleEndian.PutUint32(b[12:16], loc)
+	b[4] = 0
+	for i := 0; i < 16; i++ {
+		if i != 4 {
+			b[4] += b[i]
+		}
+	}
+}
+
+// testUdfAd makes a long allocation descriptor.
+func testUdfAd(kind, length, block uint32) []byte {
+	ad := make([]byte, 16)
+	binary.LittleEndian.PutUint32(ad[0:4], kind<<30|length)
+	binary.LittleEndian.PutUint32(ad[4:8], block)
+	return ad
+}
+
+// testUdfName makes an OSTA compressed unicode name.
+func testUdfName(name string) []byte {
+	for _, r := range name {
+		if r > 0xff {
+			u := utf16.Encode([]rune(name))
+			b := make([]byte, 1+2*len(u))
+			b[0] = 16
+			for i, c := range u {
+				binary.BigEndian.PutUint16(b[1+2*i:], c)
+			}
+			return b
+		}
+	}
+	b := []byte{8}
+	for _, r := range name {
+		b = append(b, byte(r))
+	}
+	return b
+}
+
+// entry writes a file entry at block fe.  An adType of 3 embeds ads
+// in the entry as its data.
+func (tu *testUdf) entry(fe uint32, fileType byte, mode os.FileMode, size int, adType uint16, ads []byte) {
+	b := tu.block(fe)
+	b[27] = fileType
+	binary.LittleEndian.PutUint16(b[34:36], adType)
+	binary.LittleEndian.PutUint32(b[44:48], uint32(mode&07)|uint32(mode>>3&07)<<5|uint32(mode>>6&07)<<10)
+	binary.LittleEndian.PutUint64(b[56:64], uint64(size))
+	ts := b[84:96]
+	binary.LittleEndian.PutUint16(ts[0:2], 1<<12|60)
+	binary.LittleEndian.PutUint16(ts[2:4], 2016)
+	ts[4], ts[5], ts[6] = 5, 1, 12
+	binary.LittleEndian.PutUint32(b[172:176], uint32(len(ads)))
+	copy(b[176:], ads)
+	testUdfTag(b, udfTagFileEntry, fe)
+}
+
+// data writes contents to blocks of their own, and returns the first.
+func (tu *testUdf) data(contents []byte) uint32 {
+	start := tu.alloc((len(contents) + isoSectorSize - 1) / isoSectorSize)
+	copy(tu.buf[(testUdfPartition+start)*isoSectorSize:], contents)
+	return start
+}
+
+// file writes a file of fileType holding contents, and returns the
+// block of its file entry.
+func (tu *testUdf) file(fileType byte, mode os.FileMode, contents []byte) uint32 {
+	fe := tu.alloc(1)
+	tu.entry(fe, fileType, mode, len(contents), 1, testUdfAd(0, uint32(len(contents)), tu.data(contents)))
+	return fe
+}
+
+func testUdfFid(name string, chars byte, icb uint32) []byte {
+	enc := []byte{}
+	if name != "" {
+		enc = testUdfName(name)
+	}
+	b := make([]byte, (38+len(enc)+3)&^3)
+	b[18], b[19] = chars, byte(len(enc))
+	copy(b[20:36], testUdfAd(0, isoSectorSize, icb))
+	copy(b[38:], enc)
+	testUdfTag(b, udfTagFileId, 0)
+	return b
+}
+
+// dirAt writes a directory holding fids at block fe.
+func (tu *testUdf) dirAt(fe uint32, fids ...[]byte) {
+	contents := testUdfFid("", udfFileParent|0x02, 0)
+	for _, fid := range fids {
+		contents = append(contents, fid...)
+	}
+	tu.entry(fe, udfFileTypeDir, 0755, len(contents), 1, testUdfAd(0, uint32(len(contents)), tu.data(contents)))
+}
+
+func (tu *testUdf) dir(fids ...[]byte) uint32 {
+	fe := tu.alloc(1)
+	tu.dirAt(fe, fids...)
+	return fe
+}
+
+// root writes the file set descriptor for the root directory at fe.
+func (tu *testUdf) root(fe uint32) {
+	fsd := tu.block(0)
+	copy(fsd[400:416], testUdfAd(0, isoSectorSize, fe))
+	testUdfTag(fsd, udfTagFileSet, 0)
+}
+
+func TestReadUdf(t *testing.T) {
+	tu := newTestUdfOnly()
+	readme := tu.file(udfFileTypeFile, 0640, []byte("hello\n"))
+
+	// A file in three extents, with a hole, and with the descriptors
+	// of the last two in an allocation extent.
+	big := tu.alloc(1)
+	first := tu.data(bytes.Repeat([]byte("a"), isoSectorSize))
+	last := tu.data([]byte("bbbbbbbbbb"))
+	aed := tu.alloc(1)
+	ext := tu.block(aed)
+	binary.LittleEndian.PutUint32(ext[20:24], 32)
+	copy(ext[24:], testUdfAd(1, isoSectorSize, 0))
+	copy(ext[40:], testUdfAd(0, isoSectorSize, last))
+	testUdfTag(ext, udfTagAllocationExt, aed)
+	tu.entry(big, udfFileTypeFile, 0644, 2*isoSectorSize+10, 1,
+		append(testUdfAd(0, isoSectorSize, first), testUdfAd(3, isoSectorSize, aed)...))
+
+	tiny := tu.alloc(1)
+	tu.entry(tiny, udfFileTypeFile, 0644, 4, 3, []byte("tiny"))
+
+	// Path components for ../sources/Install.WIM
+	target := []byte{3, 0, 0, 0}
+	for _, name := range []string{"sources", "Install.WIM"} {
+		enc := testUdfName(name)
+		target = append(append(target, 5, byte(len(enc)), 0, 0), enc...)
+	}
+	link := tu.file(udfFileTypeSymlink, 0777, target)
+
+	sources := tu.dir(
+		testUdfFid("Install.WIM", 0, big),
+		testUdfFid("Ünïcode.txt", 0, readme),
+		testUdfFid("Ĉĥ.txt", 0, readme),
+		testUdfFid("again", 0, link),
+		testUdfFid("gone.txt", udfFileDeleted, readme))
+	tu.root(tu.dir(
+		testUdfFid("README.txt", 0, readme),
+		testUdfFid("sources", 0x02, sources),
+		testUdfFid("tiny.txt", 0, tiny)))
+
+	r := bytes.NewReader(tu.buf)
+	entries := isoEntries(t, r, false)
+	if e := entries["README.txt"]; e == nil || e.Mode != 0640 || !e.ModTime.Equal(testUdfTime) || isoContents(t, r, e) != "hello\n" {
+		t.Errorf("Expected README.txt with its mode and time, but got %+v", e)
+	}
+	if e := entries["sources"]; e == nil || !e.Dir || e.Mode != 0755 {
+		t.Errorf("Expected sources to be a directory, but got %+v", e)
+	}
+	want := strings.Repeat("a", isoSectorSize) + strings.Repeat("\x00", isoSectorSize) + "bbbbbbbbbb"
+	if e := entries["sources/Install.WIM"]; e == nil || e.Size != int64(len(want)) || isoContents(t, r, e) != want {
+		t.Errorf("Expected every extent of Install.WIM, but got %+v", e)
+	}
+	for _, p := range []string{"sources/Ünïcode.txt", "sources/Ĉĥ.txt"} {
+		if e := entries[p]; e == nil || isoContents(t, r, e) != "hello\n" {
+			t.Errorf("Expected %s, but got %v", p, entries)
+		}
+	}
+	if e := entries["tiny.txt"]; e == nil || isoContents(t, r, e) != "tiny" {
+		t.Errorf("Expected data embedded in the file entry, but got %+v", e)
+	}
+	if e := entries["sources/again"]; e == nil || e.Link != "../sources/Install.WIM" || len(e.Extents) != 0 {
+		t.Errorf("Expected a symlink to ../sources/Install.WIM, but got %+v", e)
+	}
+	if len(entries) != 7 {
+		t.Errorf("Expected 7 entries, but got %d: %v", len(entries), entries)
+	}
+
+	if entries := isoEntries(t, r, true); entries["sources/install.wim"] == nil {
+		t.Errorf("Expected lowercased names, but got %v", entries)
+	}
+}
+
+func TestReadUdfExtendedFileEntry(t *testing.T) {
+	tu := newTestUdfOnly()
+	fe := tu.alloc(1)
+	b := tu.block(fe)
+	b[27] = udfFileTypeFile
+	binary.LittleEndian.PutUint16(b[34:36], 3)
+	binary.LittleEndian.PutUint64(b[56:64], 5)
+	binary.LittleEndian.PutUint32(b[212:216], 5)
+	copy(b[216:], "hello")
+	testUdfTag(b, udfTagExtendedFileEntry, fe)
+	tu.root(tu.dir(testUdfFid("ext.txt", 0, fe)))
+
+	r := bytes.NewReader(tu.buf)
+	entries := isoEntries(t, r, false)
+	if e := entries["ext.txt"]; e == nil || e.Mode != 0644 || isoContents(t, r, e) != "hello" {
+		t.Errorf("Expected a file from an extended file entry, but got %+v", e)
+	}
+}
+
+func TestReadUdfBad(t *testing.T) {
+	tu := newTestUdfOnly()
+	root := tu.alloc(1)
+	tu.dirAt(root, testUdfFid("back", 0x02, root))
+	tu.root(root)
+	_, err := readIso(bytes.NewReader(tu.buf), false)
+	if err == nil || !strings.Contains(err.Error(), "back loops") {
+		t.Errorf("Expected a directory listing itself to fail, but got %v", err)
+	}
+
+	tu = newTestUdfOnly()
+	tu.root(tu.dir())
+	lvd := tu.sector(testUdfVds + 1)
+	binary.LittleEndian.PutUint32(lvd[264:268], 64)
+	lvd[440], lvd[441] = 2, 64
+	copy(lvd[445:], "*UDF Metadata Partition")
+	_, err = readIso(bytes.NewReader(tu.buf), false)
+	if err == nil || !strings.Contains(err.Error(), "Metadata Partition") {
+		t.Errorf("Expected a metadata partition to be refused, but got %v", err)
+	}
+
+	tu = newTestUdfOnly()
+	tu.root(tu.dir())
+	tu.sector(udfAnchorSector)[4]++
+	_, err = readIso(bytes.NewReader(tu.buf), false)
+	if err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("Expected a damaged anchor to fail, but got %v", err)
+	}
+}
@@ -20,3 +20,9 @@ type DhcpSubnet struct {
 	apiHelper
 	dhcpSrc
 }
+
+type DhcpOptionDef struct {
+	dhcp.OptionDef
+	apiHelper
+	dhcpSrc
+}
@@ -33,6 +33,12 @@ type ProvisionerMachine struct {
 	provisionerSrc
 }
 
+// ProvisionerDownload is a file the provisioner is fetching for its
+// boot environments.  They are listed with the downloads endpoint.
+type ProvisionerDownload struct {
+	provisioner.Download
+}
+
 type ProvisionerIso struct {
 	provisionerSrc
 }
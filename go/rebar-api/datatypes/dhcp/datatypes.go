@@ -1,7 +1,9 @@
 package dhcp
 
 import (
+	"fmt"
 	"net"
+	"strconv"
 	"time"
 )
 
@@ -17,28 +19,85 @@ type Lease struct {
 	Mac        string    `json:"mac"`
 	Valid      bool      `json:"valid"`
 	ExpireTime time.Time `json:"expire_time"`
+	Hostname   string    `json:"hostname,omitempty"`
 }
 
+// Conflict is an address that answered a ping before it was offered.
+// It will not be handed out until ExpireTime.
+type Conflict struct {
+	Ip         net.IP    `json:"ip"`
+	DetectedAt time.Time `json:"detected_at"`
+	ExpireTime time.Time `json:"expire_time"`
+}
+
+// Binding pins an IP address to a MAC address, a hex-encoded DHCP
+// client identifier (option 61), a hex-encoded DUID, or to the switch
+// port identified by an option 82 circuit id (and optional remote
+// id).  Bindings other than MAC ones are unbound using the key
+// client-<client id>, duid-<duid> or
+// circuit-<hex circuit id>[-<hex remote id>].  Hostname and Domain
+// are sent to the client in options 12 and 15.
 type Binding struct {
 	Ip         net.IP    `json:"ip"`
-	Mac        string    `json:"mac"`
+	Mac        string    `json:"mac,omitempty"`
+	ClientId   string    `json:"client_id,omitempty"`
+	Duid       string    `json:"duid,omitempty"`
+	CircuitId  string    `json:"circuit_id,omitempty"`
+	RemoteId   string    `json:"remote_id,omitempty"`
+	Hostname   string    `json:"hostname,omitempty"`
+	Domain     string    `json:"domain,omitempty"`
 	Options    []*Option `json:"options,omitempty"`
 	NextServer *string   `json:"next_server,omitempty"`
 }
 
+// Pool is an extra range of addresses on a subnet, optionally with
+// its own lease time and restricted to a set of client classes.
+type Pool struct {
+	Start     string   `json:"start"`
+	End       string   `json:"end"`
+	LeaseTime int      `json:"lease_time,omitempty"`
+	Classes   []string `json:"classes,omitempty"`
+}
+
+// ClientClass selects clients by vendor class (option 60), client
+// architecture (option 93), user class (option 77) or MAC prefix,
+// and gives them their own boot file, next-server, and options.
+type ClientClass struct {
+	Name        string    `json:"name"`
+	VendorClass string    `json:"vendor_class,omitempty"`
+	ClientArch  []uint16  `json:"client_arch,omitempty"`
+	UserClass   string    `json:"user_class,omitempty"`
+	MacPrefix   string    `json:"mac_prefix,omitempty"`
+	NextServer  *string   `json:"next_server,omitempty"`
+	BootFile    string    `json:"boot_file,omitempty"`
+	Options     []*Option `json:"options,omitempty"`
+}
+
+// DdnsConfig names the zones that rebar-dhcp publishes A (and
+// optionally PTR) records for its clients in.
+type DdnsConfig struct {
+	Zone        string `json:"zone"`
+	ReverseZone string `json:"reverse_zone,omitempty"`
+}
+
 type Subnet struct {
-	Name              string     `json:"name"`
-	Subnet            string     `json:"subnet"`
-	NextServer        string     `json:"next_server,omitempty"`
-	ActiveStart       string     `json:"active_start"`
-	ActiveEnd         string     `json:"active_end"`
-	ActiveLeaseTime   int        `json:"active_lease_time"`
-	ReservedLeaseTime int        `json:"reserved_lease_time"`
-	OnlyBoundLeases   bool       `json:"only_bound_leases"`
-	Leases            []*Lease   `json:"leases,omitempty"`
-	Bindings          []*Binding `json:"bindings,omitempty"`
-	Options           []*Option  `json:"options,omitempty"`
-	TenantId          int        `json:"tenant_id"`
+	Name              string         `json:"name"`
+	Subnet            string         `json:"subnet"`
+	NextServer        string         `json:"next_server,omitempty"`
+	ActiveStart       string         `json:"active_start"`
+	ActiveEnd         string         `json:"active_end"`
+	Pools             []*Pool        `json:"pools,omitempty"`
+	Exclusions        []string       `json:"exclusions,omitempty"`
+	ActiveLeaseTime   int            `json:"active_lease_time"`
+	ReservedLeaseTime int            `json:"reserved_lease_time"`
+	OnlyBoundLeases   bool           `json:"only_bound_leases"`
+	Leases            []*Lease       `json:"leases,omitempty"`
+	Bindings          []*Binding     `json:"bindings,omitempty"`
+	Conflicts         []*Conflict    `json:"conflicts,omitempty"`
+	Options           []*Option      `json:"options,omitempty"`
+	Classes           []*ClientClass `json:"classes,omitempty"`
+	Ddns              *DdnsConfig    `json:"ddns,omitempty"`
+	TenantId          int            `json:"tenant_id"`
 }
 
 func (s *Subnet) ApiName() string {
@@ -53,3 +112,33 @@ func (s *Subnet) SetId(name string) error {
 	s.Name = name
 	return nil
 }
+
+// OptionDef gives the type of a DHCP option, which controls how its
+// value is rendered.  Types are ip, ip-list, uint8, uint16, uint32,
+// int32, bool, string, hex, route-list, and vendor.  Vendor options
+// (like option 43) can give the types of their sub-options.
+type OptionDef struct {
+	Code       byte         `json:"code"`
+	Name       string       `json:"name,omitempty"`
+	Type       string       `json:"type"`
+	SubOptions []*OptionDef `json:"sub_options,omitempty"`
+	Builtin    bool         `json:"builtin,omitempty"`
+	TenantId   int          `json:"tenant_id"`
+}
+
+func (o *OptionDef) ApiName() string {
+	return "options"
+}
+
+func (o *OptionDef) Id() (string, error) {
+	return fmt.Sprintf("%d", o.Code), nil
+}
+
+func (o *OptionDef) SetId(code string) error {
+	c, err := strconv.ParseUint(code, 10, 8)
+	if err != nil {
+		return err
+	}
+	o.Code = byte(c)
+	return nil
+}
@@ -1,5 +1,7 @@
 package provisioner
 
+import "time"
+
 // TemplateInfo holds information on the templates in the boot
 // environment that will be expanded into files.
 
@@ -29,6 +31,51 @@ type OsInfo struct {
 	Files     []*FileData // A list of files to download along with an ISO.
 }
 
+// DhcpOption is an option a DHCP server must send along with a boot
+// URI.
+type DhcpOption struct {
+	Code  int    // The option code.
+	Value string // The value, in the form rebar-dhcp takes it.
+}
+
+// BootURI is what a DHCP server hands to one kind of client so that it
+// boots a boot environment without TFTP.
+type BootURI struct {
+	Name        string        // What kind of client this is for.
+	VendorClass string        `json:",omitempty"` // Matched as a prefix of option 60.
+	ClientArch  []uint16      `json:",omitempty"` // Matched against option 93.
+	UserClass   string        `json:",omitempty"` // Matched against option 77.
+	URI         string        // The boot file name (option 67) to hand out.
+	Options     []*DhcpOption `json:",omitempty"` // Other options the client needs.
+}
+
+// IsoProgress is how far along getting the install tree of a boot
+// environment out of its ISO is.
+type IsoProgress struct {
+	State      string    // checking, extracting or failed
+	Files      int       // Files extracted so far
+	TotalFiles int       // Files in the ISO
+	Bytes      int64     // Bytes checked or extracted so far
+	TotalBytes int64     // Bytes to check or extract
+	Started    time.Time // When the extraction started
+	Error      string    `json:",omitempty"` // Why it failed
+}
+
+// Download is a file the provisioner is fetching for boot environments.
+type Download struct {
+	URL              string    // Where the file is being fetched from
+	Path             string    // Where the file is being saved to, relative to the file root
+	ValidationURL    string    `json:",omitempty"` // Where the checksum or signature of the file is fetched from
+	ValidationMethod string    `json:",omitempty"` // sha256, sha512 or gpg
+	State            string    // queued, downloading, validating, done or failed
+	Bytes            int64     // Bytes fetched so far
+	TotalBytes       int64     // Bytes to fetch, or 0 if the server did not say
+	Attempts         int       // How many times fetching the file has been tried
+	Started          time.Time // When the download was asked for
+	Error            string    `json:",omitempty"` // Why the last try failed
+	BootEnvs         []string  // The boot environments waiting on the file
+}
+
 // BootEnv encapsulates the machine-agnostic information needed by the
 // provisioner to set up a boot environment.
 type BootEnv struct {
@@ -40,6 +87,8 @@ type BootEnv struct {
 	BootParams     string          // A template that will be expanded to create the full list of boot parameters for the environment.
 	RequiredParams []string        // The list of extra required parameters for this bootstate. They should be present as Machine.Params when the bootenv is applied to the machine.
 	Available      bool
+	BootURIs       []*BootURI   // What DHCP servers should hand out for this environment to be booted over HTTP.
+	Progress       *IsoProgress `json:",omitempty"` // How far along extracting the ISO is, while it is being extracted or if it failed.
 	TenantId       int
 	Errors         []string
 }
@@ -82,7 +131,8 @@ func (t *Template) ApiName() string {
 type Machine struct {
 	Name     string                 // The FQDN of the machine.
 	Uuid     string                 // the UUID of the machine
-	Address  string                 // The IPv4 address that the machine PXE boots with.
+	Address  string                 // The IPv4 address that the machine PXE boots with, if known.
+	Macs     []string               // The MAC addresses of the NICs the machine can PXE boot from.
 	BootEnv  string                 // The boot environment that the machine should boot into.
 	Params   map[string]interface{} // Any additional parameters that may be needed for template expansion.
 	TenantId int
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"strings"
@@ -98,6 +100,10 @@ func init() {
 	subnet.AddCommand(&cobra.Command{
 		Use:   "bind [name] to [binding-spec]",
 		Short: "Bind [binding-spec] JSON to the named subnet",
+		Long: `Bind [binding-spec] JSON to the named subnet.  The binding must
+have one of mac, client_id, duid or circuit_id to match clients on.
+client_id and duid are hex encoded.  It can also pin the hostname
+and domain the client is given.`,
 		Run: func(c *cobra.Command, args []string) {
 			if len(args) != 3 {
 				log.Fatalf("%v requires 2 arguments", c.UseLine())
@@ -125,8 +131,8 @@ func init() {
 		},
 	})
 	subnet.AddCommand(&cobra.Command{
-		Use:   "unbind [name] from [macaddr]",
-		Short: "Unbind address binding with [macaddr] from subnet [name]",
+		Use:   "unbind [name] from [macaddr|binding-key]",
+		Short: "Unbind address binding with [macaddr] or client-, duid- or circuit- binding key from subnet [name]",
 		Run: func(c *cobra.Command, args []string) {
 			if len(args) != 3 {
 				log.Fatalf("%v requires 2 args", c.UseLine())
@@ -150,6 +156,73 @@ func init() {
 			fmt.Printf("Deleted binding %s in %s", args[2], args[0])
 		},
 	})
+	subnet.AddCommand(&cobra.Command{
+		Use:   "import [name] from [isc|dnsmasq] [leasefile]",
+		Short: "Import leases from an ISC dhcpd or dnsmasq lease file into subnet [name]",
+		Run: func(c *cobra.Command, args []string) {
+			if len(args) != 4 {
+				log.Fatalf("%v requires 3 args", c.UseLine())
+			}
+			obj := &api.DhcpSubnet{}
+			if session.SetId(obj, args[0]) != nil {
+				log.Fatalf("Failed to parse ID %v for a dhcp subnet", args[0])
+			}
+			buf, err := ioutil.ReadFile(args[3])
+			if err != nil {
+				log.Fatalf("Failed to read lease file %s: %v", args[3], err)
+			}
+			req, err := http.NewRequest("POST", session.UrlTo(obj, "import")+"?format="+args[2], bytes.NewReader(buf))
+			if err != nil {
+				log.Fatalf("Failed to create HTTP request: %v", err)
+			}
+			req.Header.Set("Accept", "application/json")
+			resp, err := session.BasicRequest(req)
+			if err != nil {
+				log.Fatalf("Error importing leases into %s: %v", args[0], err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Fatalf("Error importing leases into %s: %s", args[0], resp.Status)
+			}
+			res, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				log.Fatalf("Error reading import results: %v", err)
+			}
+			fmt.Println(string(res))
+		},
+	})
+	subnet.AddCommand(&cobra.Command{
+		Use:   "simulate [name] with [client-spec]",
+		Short: "Show what subnet [name] would hand the client in [client-spec] JSON, without changing any leases",
+		Run: func(c *cobra.Command, args []string) {
+			if len(args) != 3 {
+				log.Fatalf("%v requires 2 arguments", c.UseLine())
+			}
+			obj := &api.DhcpSubnet{}
+			if session.SetId(obj, args[0]) != nil {
+				log.Fatalf("Failed to parse ID %v for a dhcp subnet", args[0])
+			}
+			req, err := http.NewRequest("POST", session.UrlTo(obj, "simulate"), strings.NewReader(args[2]))
+			if err != nil {
+				log.Fatalf("Failed to create HTTP request: %v", err)
+			}
+			req.Header.Set("Accept", "application/json")
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := session.BasicRequest(req)
+			if err != nil {
+				log.Fatalf("Error simulating client on %s: %v", args[0], err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Fatalf("Error simulating client on %s: %s", args[0], resp.Status)
+			}
+			res, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				log.Fatalf("Error reading simulation results: %v", err)
+			}
+			fmt.Println(string(res))
+		},
+	})
 	subnet.AddCommand(&cobra.Command{
 		Use:   "nextserver [name] is [address]",
 		Short: "Set the next-server parameter for subnet [name] to [address]",
@@ -176,4 +249,52 @@ func init() {
 			fmt.Printf("next-server updated %s in %s", args[2], args[0])
 		},
 	})
+	options := &cobra.Command{
+		Use:   "options",
+		Short: "Commands to manipulate dhcp option definitions",
+	}
+	dhcp.AddCommand(options)
+	options.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List all dhcp option definitions",
+		Run: func(c *cobra.Command, args []string) {
+			objs := []interface{}{}
+			obj := &api.DhcpOptionDef{}
+			if err := session.List(session.UrlPath(obj), &objs); err != nil {
+				log.Fatalf("Error listing dhcp option definitions: %v", err)
+			}
+			fmt.Println(prettyJSON(objs))
+		},
+	})
+	options.AddCommand(&cobra.Command{
+		Use:   "define [json]",
+		Short: "Define the type of a dhcp option with the passed-in JSON",
+		Run: func(c *cobra.Command, args []string) {
+			if len(args) != 1 {
+				log.Fatalf("%v requires 1 argument", c.UseLine())
+			}
+			obj := &api.DhcpOptionDef{}
+			if err := session.Import(obj, []byte(args[0])); err != nil {
+				log.Fatalf("Unable to define option: %v", err)
+			}
+			fmt.Println(prettyJSON(obj))
+		},
+	})
+	options.AddCommand(&cobra.Command{
+		Use:   "undefine [code]",
+		Short: "Remove the custom definition of dhcp option [code]",
+		Run: func(c *cobra.Command, args []string) {
+			if len(args) != 1 {
+				log.Fatalf("%v requires 1 argument", c.UseLine())
+			}
+			obj := &api.DhcpOptionDef{}
+			if session.SetId(obj, args[0]) != nil {
+				log.Fatalf("Failed to parse option code %v", args[0])
+			}
+			if err := session.Destroy(obj); err != nil {
+				log.Fatalf("Unable to remove definition of option %v: %v", args[0], err)
+			}
+			fmt.Printf("Deleted %v\n", args[0])
+		},
+	})
 }
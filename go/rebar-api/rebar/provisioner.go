@@ -245,6 +245,40 @@ func init() {
 			fmt.Println(prettyJSON(obj))
 		},
 	})
+	downloads := &cobra.Command{
+		Use:   "downloads",
+		Short: "Commands to watch the files the provisioner is downloading",
+	}
+	provisioner.AddCommand(downloads)
+	downloads.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the files the provisioner is downloading or has downloaded",
+		Run: func(c *cobra.Command, args []string) {
+			objs := []*api.ProvisionerDownload{}
+			obj := &api.ProvisionerIso{}
+			req, err := http.NewRequest("GET", session.UrlFor(obj, "downloads"), nil)
+			if err != nil {
+				log.Fatalf("Error creating HTTP request: %v", err)
+			}
+			req.Header.Set("Accept", "application/json")
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := session.BasicRequest(req)
+			if err != nil {
+				log.Fatalf("Error listing provisioner downloads: %v", err)
+			}
+
+			buf, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				log.Fatalf("Error listing provisioner downloads: %v", err)
+			}
+			err = json.Unmarshal(buf, &objs)
+			if err != nil {
+				log.Fatalf("Error listing provisioner downloads: %v", err)
+			}
+			resp.Body.Close()
+			fmt.Println(prettyJSON(objs))
+		},
+	})
 	isos := &cobra.Command{
 		Use:   "isos",
 		Short: "Commands to manage ISO files on the provisioner",
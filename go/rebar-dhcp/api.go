@@ -7,6 +7,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/VictorLowther/jsonpatch"
@@ -14,6 +15,7 @@ import (
 	"github.com/digitalrebar/digitalrebar/go/common/cert"
 	"github.com/digitalrebar/digitalrebar/go/common/multi-tenancy"
 	"github.com/digitalrebar/digitalrebar/go/common/store"
+	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
 )
 
 type NextServer struct {
@@ -247,7 +249,6 @@ func (fe *Frontend) BindSubnet(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
-	binding.Mac = strings.ToLower(binding.Mac)
 	fe.DhcpInfo.Lock()
 
 	subnet, found := fe.DhcpInfo.Subnets[subnetName]
@@ -271,6 +272,11 @@ func (fe *Frontend) BindSubnet(w rest.ResponseWriter, r *rest.Request) {
 		fe.DhcpInfo.Unlock()
 		return
 	}
+	if err := binding.validate(); err != nil {
+		fe.DhcpInfo.Unlock()
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	err, code := fe.DhcpInfo.AddBinding(subnetName, binding)
 	if err != nil {
@@ -366,6 +372,323 @@ func (fe *Frontend) NextServer(w rest.ResponseWriter, r *rest.Request) {
 	w.WriteJson(nextServer)
 }
 
+func (fe *Frontend) ClearConflict(w rest.ResponseWriter, r *rest.Request) {
+	subnetName := r.PathParam("id")
+	ip := net.ParseIP(r.PathParam("ip"))
+	fe.DhcpInfo.Lock()
+
+	subnet, found := fe.DhcpInfo.Subnets[subnetName]
+	if !found {
+		fe.DhcpInfo.Unlock()
+		rest.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	capMap, err := multitenancy.NewCapabilityMap(r.Request)
+	if err != nil {
+		fe.DhcpInfo.Unlock()
+		log.Printf("Failed to get capmap from request: %v\n", err)
+		rest.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !capMap.HasCapability(subnet.TenantId, "SUBNET_UPDATE") {
+		if !capMap.HasCapability(subnet.TenantId, "SUBNET_READ") {
+			rest.Error(w, "Not Found", http.StatusNotFound)
+		} else {
+			rest.Error(w, "Forbidden", http.StatusForbidden)
+		}
+		fe.DhcpInfo.Unlock()
+		return
+	}
+
+	err, code := fe.DhcpInfo.ClearConflict(subnetName, ip)
+	if err != nil {
+		fe.DhcpInfo.Unlock()
+		rest.Error(w, err.Error(), code)
+		return
+	}
+	fe.DhcpInfo.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+// ImportLeases takes the contents of an ISC dhcpd.leases or dnsmasq
+// lease file as the body, and imports the leases into the subnet.
+// The format is picked with the format query parameter.
+func (fe *Frontend) ImportLeases(w rest.ResponseWriter, r *rest.Request) {
+	subnetName := r.PathParam("id")
+	if r.Body == nil {
+		rest.Error(w, "Must have body", http.StatusBadRequest)
+		return
+	}
+	leases, err := parseLeases(r.URL.Query().Get("format"), r.Body)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fe.DhcpInfo.Lock()
+
+	subnet, found := fe.DhcpInfo.Subnets[subnetName]
+	if !found {
+		fe.DhcpInfo.Unlock()
+		rest.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	capMap, err := multitenancy.NewCapabilityMap(r.Request)
+	if err != nil {
+		fe.DhcpInfo.Unlock()
+		log.Printf("Failed to get capmap from request: %v\n", err)
+		rest.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !capMap.HasCapability(subnet.TenantId, "SUBNET_UPDATE") {
+		if !capMap.HasCapability(subnet.TenantId, "SUBNET_READ") {
+			rest.Error(w, "Not Found", http.StatusNotFound)
+		} else {
+			rest.Error(w, "Forbidden", http.StatusForbidden)
+		}
+		fe.DhcpInfo.Unlock()
+		return
+	}
+
+	res, err, code := fe.DhcpInfo.ImportLeases(subnetName, leases)
+	if err != nil {
+		fe.DhcpInfo.Unlock()
+		rest.Error(w, err.Error(), code)
+		return
+	}
+	fe.DhcpInfo.Unlock()
+	w.WriteJson(res)
+}
+
+// SimulateSubnet answers what the server would do for a made up
+// client without changing any leases.
+func (fe *Frontend) SimulateSubnet(w rest.ResponseWriter, r *rest.Request) {
+	subnetName := r.PathParam("id")
+	req := &SimulateRequest{}
+	if r.Body == nil {
+		rest.Error(w, "Must have body", http.StatusBadRequest)
+		return
+	}
+	if err := r.DecodeJsonPayload(req); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fe.DhcpInfo.Lock()
+
+	subnet, found := fe.DhcpInfo.Subnets[subnetName]
+	if !found {
+		fe.DhcpInfo.Unlock()
+		rest.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	capMap, err := multitenancy.NewCapabilityMap(r.Request)
+	if err != nil {
+		fe.DhcpInfo.Unlock()
+		log.Printf("Failed to get capmap from request: %v\n", err)
+		rest.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !capMap.HasCapability(subnet.TenantId, "SUBNET_READ") {
+		fe.DhcpInfo.Unlock()
+		rest.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	res, err, code := fe.DhcpInfo.Simulate(subnetName, req)
+	if err != nil {
+		fe.DhcpInfo.Unlock()
+		rest.Error(w, err.Error(), code)
+		return
+	}
+	// The client may land in some other subnet, which the caller
+	// may not be allowed to see.
+	if chosen := fe.DhcpInfo.Subnets[res.Subnet]; chosen != nil && !capMap.HasCapability(chosen.TenantId, "SUBNET_READ") {
+		fe.DhcpInfo.Unlock()
+		rest.Error(w, "Client would be served by a subnet you cannot read", http.StatusForbidden)
+		return
+	}
+	fe.DhcpInfo.Unlock()
+	w.WriteJson(res)
+}
+
+// GetOptionDefs lists the built-in option definitions and the custom
+// ones the caller can see.
+func (fe *Frontend) GetOptionDefs(w rest.ResponseWriter, r *rest.Request) {
+	capMap, err := multitenancy.NewCapabilityMap(r.Request)
+	if err != nil {
+		log.Printf("Failed to get capmap from request: %v\n", err)
+		rest.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	defs := make([]*OptionDef, 0)
+	for _, d := range optionDefs.All() {
+		if d.Builtin || capMap.HasCapability(d.TenantId, "SUBNET_READ") {
+			defs = append(defs, d)
+		}
+	}
+	w.WriteJson(defs)
+}
+
+// SetOptionDef registers the type of a custom option, or changes the
+// type of a built-in one.  The option registry is shared by every
+// tenant, so changing a built-in option needs SUBNET_UPDATE in the
+// system tenant.
+func (fe *Frontend) SetOptionDef(w rest.ResponseWriter, r *rest.Request) {
+	def := &OptionDef{}
+	if r.Body == nil {
+		rest.Error(w, "Must have body", http.StatusBadRequest)
+		return
+	}
+	if err := r.DecodeJsonPayload(def); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	capMap, err := multitenancy.NewCapabilityMap(r.Request)
+	if err != nil {
+		log.Printf("Failed to get capmap from request: %v\n", err)
+		rest.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if optionDefs.IsBuiltin(def.Code) && !capMap.HasCapability(systemTenant, "SUBNET_UPDATE") {
+		rest.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	fe.DhcpInfo.Lock()
+	if _, old := fe.DhcpInfo.findOptionDef(def.Code); old != nil && !capMap.HasCapability(old.TenantId, "SUBNET_UPDATE") {
+		fe.DhcpInfo.Unlock()
+		rest.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !capMap.HasCapability(def.TenantId, "SUBNET_CREATE") {
+		fe.DhcpInfo.Unlock()
+		rest.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err, code := fe.DhcpInfo.SetOptionDef(def); err != nil {
+		fe.DhcpInfo.Unlock()
+		rest.Error(w, err.Error(), code)
+		return
+	}
+	fe.DhcpInfo.Unlock()
+	w.WriteJson(def)
+}
+
+func (fe *Frontend) DeleteOptionDef(w rest.ResponseWriter, r *rest.Request) {
+	code, err := strconv.ParseUint(r.PathParam("code"), 10, 8)
+	if err != nil {
+		rest.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	capMap, err := multitenancy.NewCapabilityMap(r.Request)
+	if err != nil {
+		log.Printf("Failed to get capmap from request: %v\n", err)
+		rest.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	fe.DhcpInfo.Lock()
+	_, def := fe.DhcpInfo.findOptionDef(dhcp.OptionCode(code))
+	if def == nil {
+		fe.DhcpInfo.Unlock()
+		rest.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if !capMap.HasCapability(def.TenantId, "SUBNET_DESTROY") ||
+		(optionDefs.IsBuiltin(def.Code) && !capMap.HasCapability(systemTenant, "SUBNET_UPDATE")) {
+		if !capMap.HasCapability(def.TenantId, "SUBNET_READ") {
+			rest.Error(w, "Not Found", http.StatusNotFound)
+		} else {
+			rest.Error(w, "Forbidden", http.StatusForbidden)
+		}
+		fe.DhcpInfo.Unlock()
+		return
+	}
+	if err, code := fe.DhcpInfo.RemoveOptionDef(def.Code); err != nil {
+		fe.DhcpInfo.Unlock()
+		rest.Error(w, err.Error(), code)
+		return
+	}
+	fe.DhcpInfo.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetCaptures returns the captured DHCP packets as a pcap file.  Only
+// packets for subnets the caller can read are included.  Packets that
+// did not match a subnet need SUBNET_READ in the system tenant.  The
+// subnet query parameter limits the capture to a single subnet.
+func (fe *Frontend) GetCaptures(w rest.ResponseWriter, r *rest.Request) {
+	if packetCapture == nil {
+		rest.Error(w, "Packet capture is not enabled", http.StatusNotFound)
+		return
+	}
+	capMap, err := multitenancy.NewCapabilityMap(r.Request)
+	if err != nil {
+		log.Printf("Failed to get capmap from request: %v\n", err)
+		rest.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	only := r.URL.Query().Get("subnet")
+	fe.DhcpInfo.Lock()
+	packets := make([]*dhcp.CapturedPacket, 0)
+	for _, cp := range packetCapture.Packets() {
+		if only != "" && cp.Subnet != only {
+			continue
+		}
+		tenantId := systemTenant
+		if cp.Subnet != "" {
+			subnet := fe.DhcpInfo.Subnets[cp.Subnet]
+			if subnet == nil {
+				continue
+			}
+			tenantId = subnet.TenantId
+		}
+		if capMap.HasCapability(tenantId, "SUBNET_READ") {
+			packets = append(packets, cp)
+		}
+	}
+	fe.DhcpInfo.Unlock()
+	hw := w.(http.ResponseWriter)
+	hw.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	hw.Header().Set("Content-Disposition", "attachment; filename=rebar-dhcp.pcap")
+	if err := dhcp.WritePcap(hw, packets); err != nil {
+		log.Printf("Failed to write capture: %v", err)
+	}
+}
+
+// ClearCaptures throws away the captured packets.
+func (fe *Frontend) ClearCaptures(w rest.ResponseWriter, r *rest.Request) {
+	if packetCapture == nil {
+		rest.Error(w, "Packet capture is not enabled", http.StatusNotFound)
+		return
+	}
+	capMap, err := multitenancy.NewCapabilityMap(r.Request)
+	if err != nil {
+		log.Printf("Failed to get capmap from request: %v\n", err)
+		rest.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !capMap.HasCapability(systemTenant, "SUBNET_UPDATE") {
+		rest.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	packetCapture.Clear()
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetMetrics returns the server's counters along with pool and lease
+// gauges in the Prometheus text format.
+func (fe *Frontend) GetMetrics(w rest.ResponseWriter, r *rest.Request) {
+	capMap, err := multitenancy.NewCapabilityMap(r.Request)
+	if err != nil {
+		log.Printf("Failed to get capmap from request: %v\n", err)
+		rest.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	hw := w.(http.ResponseWriter)
+	hw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(hw, fe.DhcpInfo, func(s *Subnet) bool {
+		return capMap.HasCapability(s.TenantId, "SUBNET_READ")
+	})
+}
+
 func (fe *Frontend) RunServer(blocking bool) http.Handler {
 	api := rest.NewApi()
 	api.Use(&rest.AccessLogApacheMiddleware{},
@@ -387,6 +710,15 @@ func (fe *Frontend) RunServer(blocking bool) http.Handler {
 		rest.Post("/subnets/#id/bind", fe.BindSubnet),
 		rest.Delete("/subnets/#id/bind/#mac", fe.UnbindSubnet),
 		rest.Put("/subnets/#id/next_server/#ip", fe.NextServer),
+		rest.Post("/subnets/#id/import", fe.ImportLeases),
+		rest.Post("/subnets/#id/simulate", fe.SimulateSubnet),
+		rest.Delete("/subnets/#id/conflicts/#ip", fe.ClearConflict),
+		rest.Get("/metrics", fe.GetMetrics),
+		rest.Get("/captures", fe.GetCaptures),
+		rest.Delete("/captures", fe.ClearCaptures),
+		rest.Get("/options", fe.GetOptionDefs),
+		rest.Post("/options", fe.SetOptionDef),
+		rest.Delete("/options/#code", fe.DeleteOptionDef),
 	)
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+
+	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
+)
+
+// systemTenant is the tenant that owns packets that did not match a
+// subnet, and the definitions of built-in options.
+const systemTenant = 1
+
+// packetCapture holds the most recent packets received and sent.  It
+// is nil when capturing is turned off.
+var packetCapture *dhcp.Capture
+
+// capture records a request and the reply we made to it.  The DHCP
+// library does not hand us the addresses the packets actually came
+// from and went to, so they are worked out the same way the server
+// picks where to send replies.
+func (h *DHCPHandler) capture(req, reply dhcp.Packet, subnet string) {
+	if packetCapture == nil {
+		return
+	}
+	relayed := !req.GIAddr().Equal(net.IPv4zero)
+	src := &net.UDPAddr{IP: req.CIAddr(), Port: 68}
+	dst := &net.UDPAddr{IP: h.ip, Port: 67}
+	if relayed {
+		src = &net.UDPAddr{IP: req.GIAddr(), Port: 67}
+	} else if req.CIAddr().Equal(net.IPv4zero) {
+		dst = &net.UDPAddr{IP: net.IPv4bcast, Port: 67}
+	}
+	packetCapture.Record(src, dst, subnet, req)
+	if reply == nil {
+		return
+	}
+	dst = &net.UDPAddr{IP: req.CIAddr(), Port: 68}
+	if relayed {
+		dst = src
+	} else if req.CIAddr().Equal(net.IPv4zero) || req.Broadcast() {
+		dst = &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+	}
+	packetCapture.Record(&net.UDPAddr{IP: h.ip, Port: 67}, dst, subnet, reply)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
+)
+
+// ClientClass groups DHCP clients by what they tell us about
+// themselves, and lets us hand each group its own boot file,
+// next-server and options.
+//
+// Every match field that is set must match for a client to be in
+// the class.  A class with no match fields set matches everything,
+// which is handy as a fallback at the end of the list.
+type ClientClass struct {
+	Name string `json:"name"`
+	// VendorClass is matched as a prefix of option 60, so
+	// "PXEClient" matches "PXEClient:Arch:00007:UNDI:003016".
+	VendorClass string `json:"vendor_class,omitempty"`
+	// ClientArch matches if any of the architectures sent in
+	// option 93 is in the list. (0 is BIOS, 7 and 9 are x64 UEFI)
+	ClientArch []uint16 `json:"client_arch,omitempty"`
+	// UserClass matches if option 77 contains the string.
+	// iPXE sends "iPXE" here.
+	UserClass string `json:"user_class,omitempty"`
+	// MacPrefix is matched as a prefix of the lowercased MAC address.
+	MacPrefix  string    `json:"mac_prefix,omitempty"`
+	NextServer *string   `json:"next_server,omitempty"`
+	BootFile   string    `json:"boot_file,omitempty"`
+	Options    []*Option `json:"options,omitempty"`
+}
+
+func (c *ClientClass) validate() error {
+	if c.Name == "" {
+		return errors.New("Client class must have a name")
+	}
+	c.MacPrefix = strings.ToLower(c.MacPrefix)
+	if c.NextServer != nil && net.ParseIP(*c.NextServer).To4() == nil {
+		return fmt.Errorf("Client class %s has invalid next_server %s", c.Name, *c.NextServer)
+	}
+	return nil
+}
+
+func (c *ClientClass) matchArch(val []byte) bool {
+	for len(val) >= 2 {
+		arch := binary.BigEndian.Uint16(val)
+		for _, a := range c.ClientArch {
+			if a == arch {
+				return true
+			}
+		}
+		val = val[2:]
+	}
+	return false
+}
+
+// Matches returns true if the client with the given MAC address that
+// sent the given options belongs in this class.
+func (c *ClientClass) Matches(nic string, options dhcp.Options) bool {
+	if c.MacPrefix != "" && !strings.HasPrefix(nic, c.MacPrefix) {
+		return false
+	}
+	if c.VendorClass != "" &&
+		!strings.HasPrefix(string(options[dhcp.OptionVendorClassIdentifier]), c.VendorClass) {
+		return false
+	}
+	if c.UserClass != "" &&
+		!strings.Contains(string(options[dhcp.OptionUserClass]), c.UserClass) {
+		return false
+	}
+	if len(c.ClientArch) > 0 && !c.matchArch(options[dhcp.OptionClientArchitecture]) {
+		return false
+	}
+	return true
+}
+
+// findClass returns the first class in the subnet that matches the
+// client, or nil if none do.
+func (s *Subnet) findClass(nic string, options dhcp.Options) *ClientClass {
+	for _, c := range s.Classes {
+		if c.Matches(nic, options) {
+			return c
+		}
+	}
+	return nil
+}
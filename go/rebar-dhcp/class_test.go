@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassMatchEmpty(t *testing.T) {
+	c := &ClientClass{Name: "all"}
+
+	assert.True(t, c.Matches("aa:bb:cc:dd:ee:ff", dhcp.Options{}), "Empty class should match everything")
+}
+
+func TestClassMatchVendorClass(t *testing.T) {
+	c := &ClientClass{Name: "pxe", VendorClass: "PXEClient"}
+
+	opts := dhcp.Options{dhcp.OptionVendorClassIdentifier: []byte("PXEClient:Arch:00007:UNDI:003016")}
+	assert.True(t, c.Matches("aa:bb:cc:dd:ee:ff", opts), "PXEClient prefix should match")
+
+	opts = dhcp.Options{dhcp.OptionVendorClassIdentifier: []byte("HTTPClient:Arch:00016")}
+	assert.False(t, c.Matches("aa:bb:cc:dd:ee:ff", opts), "HTTPClient should not match")
+	assert.False(t, c.Matches("aa:bb:cc:dd:ee:ff", dhcp.Options{}), "Missing option 60 should not match")
+}
+
+func TestClassMatchClientArch(t *testing.T) {
+	c := &ClientClass{Name: "uefi", ClientArch: []uint16{7, 9}}
+
+	assert.True(t, c.Matches("aa:bb:cc:dd:ee:ff", dhcp.Options{dhcp.OptionClientArchitecture: []byte{0, 7}}), "Arch 7 should match")
+	assert.True(t, c.Matches("aa:bb:cc:dd:ee:ff", dhcp.Options{dhcp.OptionClientArchitecture: []byte{0, 0, 0, 9}}), "Arch 9 in a list should match")
+	assert.False(t, c.Matches("aa:bb:cc:dd:ee:ff", dhcp.Options{dhcp.OptionClientArchitecture: []byte{0, 0}}), "BIOS should not match")
+	assert.False(t, c.Matches("aa:bb:cc:dd:ee:ff", dhcp.Options{}), "Missing option 93 should not match")
+}
+
+func TestClassMatchUserClassAndMac(t *testing.T) {
+	c := &ClientClass{Name: "ipxe", UserClass: "iPXE", MacPrefix: "aa:bb:cc"}
+
+	opts := dhcp.Options{dhcp.OptionUserClass: []byte("iPXE")}
+	assert.True(t, c.Matches("aa:bb:cc:dd:ee:ff", opts), "iPXE on matching MAC should match")
+	assert.False(t, c.Matches("11:bb:cc:dd:ee:ff", opts), "iPXE on other MAC should not match")
+	assert.False(t, c.Matches("aa:bb:cc:dd:ee:ff", dhcp.Options{}), "Missing option 77 should not match")
+}
+
+func TestFindClassFirstWins(t *testing.T) {
+	_, s := simpleSetup()
+
+	s.Classes = []*ClientClass{
+		&ClientClass{Name: "ipxe", UserClass: "iPXE"},
+		&ClientClass{Name: "uefi", ClientArch: []uint16{7}},
+		&ClientClass{Name: "bios"},
+	}
+
+	c := s.findClass("aa:bb:cc:dd:ee:ff", dhcp.Options{
+		dhcp.OptionUserClass:          []byte("iPXE"),
+		dhcp.OptionClientArchitecture: []byte{0, 7},
+	})
+	assert.Equal(t, c.Name, "ipxe", "Class should be ipxe, but is %s", c.Name)
+
+	c = s.findClass("aa:bb:cc:dd:ee:ff", dhcp.Options{dhcp.OptionClientArchitecture: []byte{0, 7}})
+	assert.Equal(t, c.Name, "uefi", "Class should be uefi, but is %s", c.Name)
+
+	c = s.findClass("aa:bb:cc:dd:ee:ff", dhcp.Options{})
+	assert.Equal(t, c.Name, "bios", "Class should be bios, but is %s", c.Name)
+}
+
+func TestBuildOptionsClass(t *testing.T) {
+	_, s := simpleSetup()
+
+	s.Options = []*Option{&Option{dhcp.OptionBootFileName, "pxelinux.0"}}
+	class := &ClientClass{
+		Name:     "uefi",
+		BootFile: "bootx64.efi",
+		Options:  []*Option{&Option{dhcp.OptionDomainName, "uefi.example.com"}},
+	}
+	binding := &Binding{
+		Mac:     "aa:bb:cc:dd:ee:ff",
+		Options: []*Option{&Option{dhcp.OptionDomainName, "bound.example.com"}},
+	}
+	lease := &Lease{Ip: net.ParseIP("192.168.128.10").To4(), Mac: "aa:bb:cc:dd:ee:ff"}
+	p := dhcp.RequestPacket(dhcp.Discover, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}, nil, []byte{1, 2, 3, 4}, false, nil)
+
+	opts, _ := s.buildOptions(lease, nil, class, p)
+	assert.Equal(t, string(opts[dhcp.OptionBootFileName]), "bootx64.efi", "Class boot file should override subnet")
+	assert.Equal(t, string(opts[dhcp.OptionDomainName]), "uefi.example.com", "Class option should be present")
+
+	opts, _ = s.buildOptions(lease, binding, class, p)
+	assert.Equal(t, string(opts[dhcp.OptionDomainName]), "bound.example.com", "Binding option should override class")
+
+	opts, _ = s.buildOptions(lease, nil, nil, p)
+	assert.Equal(t, string(opts[dhcp.OptionBootFileName]), "pxelinux.0", "Subnet boot file should be used without a class")
+}
+
+func TestSubnetUnmarshalClasses(t *testing.T) {
+	s := &Subnet{}
+	err := json.Unmarshal([]byte(`{"name": "fred", "subnet": "192.168.128.0/24", "active_start": "192.168.128.5", "active_end": "192.168.128.25", "classes": [{"name": "uefi", "client_arch": [7, 9], "mac_prefix": "AA:BB", "boot_file": "bootx64.efi"}]}`), s)
+
+	assert.Nil(t, err, "Error should be nil")
+	assert.Equal(t, len(s.Classes), 1, "There should be one class")
+	assert.Equal(t, s.Classes[0].MacPrefix, "aa:bb", "MAC prefix should be lowercased")
+
+	s = &Subnet{}
+	err = json.Unmarshal([]byte(`{"name": "fred", "subnet": "192.168.128.0/24", "active_start": "192.168.128.5", "active_end": "192.168.128.25", "classes": [{"name": "uefi"}, {"name": "uefi"}]}`), s)
+	assert.NotNil(t, err, "Error should not be nil")
+	assert.Equal(t, err.Error(), "Duplicate client class uefi", "Error message should be 'Duplicate client class uefi', but was %s", err.Error())
+
+	s = &Subnet{}
+	err = json.Unmarshal([]byte(`{"name": "fred", "subnet": "192.168.128.0/24", "active_start": "192.168.128.5", "active_end": "192.168.128.25", "classes": [{"boot_file": "bootx64.efi"}]}`), s)
+	assert.NotNil(t, err, "Error should not be nil")
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
@@ -11,241 +12,400 @@ import (
 	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
 )
 
-func convertByteToOptionValue(code dhcp.OptionCode, b []byte) string {
-	switch code {
-	// Single IP-like address
-	case dhcp.OptionSubnetMask,
-		dhcp.OptionBroadcastAddress,
-		dhcp.OptionSwapServer,
-		dhcp.OptionRouterSolicitationAddress,
-		dhcp.OptionRequestedIPAddress,
-		dhcp.OptionServerIdentifier:
-		return net.IP(b).To4().String()
-
-	// Multiple IP-like address
-	case dhcp.OptionRouter,
-		dhcp.OptionTimeServer,
-		dhcp.OptionNameServer,
-		dhcp.OptionDomainNameServer,
-		dhcp.OptionLogServer,
-		dhcp.OptionCookieServer,
-		dhcp.OptionLPRServer,
-		dhcp.OptionImpressServer,
-		dhcp.OptionResourceLocationServer,
-		dhcp.OptionPolicyFilter, // This is special and could validate more (2Ips per)
-		dhcp.OptionStaticRoute,  // This is special and could validate more (2IPs per)
-		dhcp.OptionNetworkInformationServers,
-		dhcp.OptionNetworkTimeProtocolServers,
-		dhcp.OptionNetBIOSOverTCPIPNameServer,
-		dhcp.OptionNetBIOSOverTCPIPDatagramDistributionServer,
-		dhcp.OptionXWindowSystemFontServer,
-		dhcp.OptionXWindowSystemDisplayManager,
-		dhcp.OptionNetworkInformationServicePlusServers,
-		dhcp.OptionMobileIPHomeAgent,
-		dhcp.OptionSimpleMailTransportProtocol,
-		dhcp.OptionPostOfficeProtocolServer,
-		dhcp.OptionNetworkNewsTransportProtocol,
-		dhcp.OptionDefaultWorldWideWebServer,
-		dhcp.OptionDefaultFingerServer,
-		dhcp.OptionDefaultInternetRelayChatServer,
-		dhcp.OptionStreetTalkServer,
-		dhcp.OptionStreetTalkDirectoryAssistance:
-
-		addrs := make([]string, 0)
-		for len(b) > 0 {
-			addrs = append(addrs, net.IP(b[0:4]).To4().String())
-			b = b[4:]
-		}
-		return strings.Join(addrs, ",")
+// Option value types.  Values are always passed around as strings in
+// the API and rendered to bytes when a packet is built.
+const (
+	OptionTypeIP        = "ip"         // 10.0.0.1
+	OptionTypeIPList    = "ip-list"    // 10.0.0.1,10.0.0.2
+	OptionTypeUint8     = "uint8"      // 12
+	OptionTypeUint16    = "uint16"     // 1500
+	OptionTypeUint32    = "uint32"     // 3600
+	OptionTypeInt32     = "int32"      // -18000
+	OptionTypeBool      = "bool"       // true
+	OptionTypeString    = "string"     // pxelinux.0
+	OptionTypeHex       = "hex"        // 01:02:0a
+	OptionTypeRouteList = "route-list" // 10.0.0.0/8 192.168.1.1,0.0.0.0/0 192.168.1.1
+	OptionTypeVendor    = "vendor"     // 1=value;2=value
+)
 
-	// String like value
-	case dhcp.OptionHostName,
-		dhcp.OptionMeritDumpFile,
-		dhcp.OptionDomainName,
-		dhcp.OptionRootPath,
-		dhcp.OptionExtensionsPath,
-		dhcp.OptionNetworkInformationServiceDomain,
-		dhcp.OptionVendorSpecificInformation, // This is wrong, but ...
-		dhcp.OptionNetBIOSOverTCPIPScope,
-		dhcp.OptionNetworkInformationServicePlusDomain,
-		dhcp.OptionTFTPServerName,
-		dhcp.OptionBootFileName,
-		dhcp.OptionMessage,
-		dhcp.OptionVendorClassIdentifier,
-		dhcp.OptionClientIdentifier,
-		dhcp.OptionUserClass,
-		dhcp.OptionTZPOSIXString,
-		dhcp.OptionTZDatabaseString:
-		return string(b[:len(b)])
+type optionCodec struct {
+	encode func(def *OptionDef, value string) ([]byte, error)
+	decode func(def *OptionDef, b []byte) (string, bool)
+}
 
-	// 4 byte integer value
-	case dhcp.OptionTimeOffset,
-		dhcp.OptionPathMTUAgingTimeout,
-		dhcp.OptionARPCacheTimeout,
-		dhcp.OptionTCPKeepaliveInterval,
-		dhcp.OptionIPAddressLeaseTime,
-		dhcp.OptionRenewalTimeValue,
-		dhcp.OptionRebindingTimeValue:
-		return fmt.Sprint(binary.BigEndian.Uint32(b))
+// optionCodecs is filled in by init since the vendor codec refers back
+// to it for sub-options.
+var optionCodecs map[string]optionCodec
 
-	// 2 byte integer value
-	case dhcp.OptionBootFileSize,
-		dhcp.OptionMaximumDatagramReassemblySize,
-		dhcp.OptionInterfaceMTU,
-		dhcp.OptionMaximumDHCPMessageSize,
-		dhcp.OptionClientArchitecture:
-		return fmt.Sprint(binary.BigEndian.Uint16(b))
+func init() {
+	optionCodecs = map[string]optionCodec{
+		OptionTypeIP:        {encodeIP, decodeIP},
+		OptionTypeIPList:    {encodeIPList, decodeIPList},
+		OptionTypeUint8:     {encodeUint(1), decodeUint(1)},
+		OptionTypeUint16:    {encodeUint(2), decodeUint(2)},
+		OptionTypeUint32:    {encodeUint(4), decodeUint(4)},
+		OptionTypeInt32:     {encodeInt32, decodeInt32},
+		OptionTypeBool:      {encodeBool, decodeBool},
+		OptionTypeString:    {encodeString, decodeString},
+		OptionTypeHex:       {encodeHex, decodeHex},
+		OptionTypeRouteList: {encodeRouteList, decodeRouteList},
+		OptionTypeVendor:    {encodeVendor, decodeVendor},
+	}
+}
 
-	// 1 byte integer value
-	case dhcp.OptionIPForwardingEnableDisable,
-		dhcp.OptionNonLocalSourceRoutingEnableDisable,
-		dhcp.OptionDefaultIPTimeToLive,
-		dhcp.OptionAllSubnetsAreLocal,
-		dhcp.OptionPerformMaskDiscovery,
-		dhcp.OptionMaskSupplier,
-		dhcp.OptionPerformRouterDiscovery,
-		dhcp.OptionTrailerEncapsulation,
-		dhcp.OptionEthernetEncapsulation,
-		dhcp.OptionTCPDefaultTTL,
-		dhcp.OptionTCPKeepaliveGarbage,
-		dhcp.OptionNetBIOSOverTCPIPNodeType,
-		dhcp.OptionOverload,
-		dhcp.OptionDHCPMessageType:
-		return fmt.Sprint(b[0])
-
-		// Empty
-	case dhcp.Pad, dhcp.End:
-		return ""
+func parseIP4(value string) (net.IP, error) {
+	ip := net.ParseIP(strings.TrimSpace(value)).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid IPv4 address %s", value)
 	}
+	return ip, nil
+}
 
-	return ""
+func encodeIP(def *OptionDef, value string) ([]byte, error) {
+	ip, err := parseIP4(value)
+	return []byte(ip), err
 }
 
-func convertOptionValueToByte(code dhcp.OptionCode, value string) ([]byte, error) {
-	switch code {
-	// Single IP-like address
-	case dhcp.OptionSubnetMask,
-		dhcp.OptionBroadcastAddress,
-		dhcp.OptionSwapServer,
-		dhcp.OptionRouterSolicitationAddress,
-		dhcp.OptionRequestedIPAddress,
-		dhcp.OptionServerIdentifier:
-		return []byte(net.ParseIP(value).To4()), nil
+func decodeIP(def *OptionDef, b []byte) (string, bool) {
+	if len(b) != 4 {
+		return "", false
+	}
+	return net.IP(b).String(), true
+}
 
-	// Multiple IP-like address
-	case dhcp.OptionRouter,
-		dhcp.OptionTimeServer,
-		dhcp.OptionNameServer,
-		dhcp.OptionDomainNameServer,
-		dhcp.OptionLogServer,
-		dhcp.OptionCookieServer,
-		dhcp.OptionLPRServer,
-		dhcp.OptionImpressServer,
-		dhcp.OptionResourceLocationServer,
-		dhcp.OptionPolicyFilter, // This is special and could validate more (2Ips per)
-		dhcp.OptionStaticRoute,  // This is special and could validate more (2IPs per)
-		dhcp.OptionNetworkInformationServers,
-		dhcp.OptionNetworkTimeProtocolServers,
-		dhcp.OptionNetBIOSOverTCPIPNameServer,
-		dhcp.OptionNetBIOSOverTCPIPDatagramDistributionServer,
-		dhcp.OptionXWindowSystemFontServer,
-		dhcp.OptionXWindowSystemDisplayManager,
-		dhcp.OptionNetworkInformationServicePlusServers,
-		dhcp.OptionMobileIPHomeAgent,
-		dhcp.OptionSimpleMailTransportProtocol,
-		dhcp.OptionPostOfficeProtocolServer,
-		dhcp.OptionNetworkNewsTransportProtocol,
-		dhcp.OptionDefaultWorldWideWebServer,
-		dhcp.OptionDefaultFingerServer,
-		dhcp.OptionDefaultInternetRelayChatServer,
-		dhcp.OptionStreetTalkServer,
-		dhcp.OptionStreetTalkDirectoryAssistance:
-
-		addrs := make([]net.IP, 0)
-		alist := strings.Split(value, ",")
-		for i := range alist {
-			addrs = append(addrs, net.ParseIP(alist[i]).To4())
+func encodeIPList(def *OptionDef, value string) ([]byte, error) {
+	addrs := make([]net.IP, 0)
+	for _, a := range strings.Split(value, ",") {
+		ip, err := parseIP4(a)
+		if err != nil {
+			return nil, err
 		}
-		return dhcp.JoinIPs(addrs), nil
+		addrs = append(addrs, ip)
+	}
+	return dhcp.JoinIPs(addrs), nil
+}
 
-	// String like value
-	case dhcp.OptionHostName,
-		dhcp.OptionMeritDumpFile,
-		dhcp.OptionDomainName,
-		dhcp.OptionRootPath,
-		dhcp.OptionExtensionsPath,
-		dhcp.OptionNetworkInformationServiceDomain,
-		dhcp.OptionVendorSpecificInformation, // This is wrong, but ...
-		dhcp.OptionNetBIOSOverTCPIPScope,
-		dhcp.OptionNetworkInformationServicePlusDomain,
-		dhcp.OptionTFTPServerName,
-		dhcp.OptionBootFileName,
-		dhcp.OptionMessage,
-		dhcp.OptionVendorClassIdentifier,
-		dhcp.OptionClientIdentifier,
-		dhcp.OptionUserClass,
-		dhcp.OptionTZPOSIXString,
-		dhcp.OptionTZDatabaseString:
-		return []byte(value), nil
+func decodeIPList(def *OptionDef, b []byte) (string, bool) {
+	if len(b) == 0 || len(b)%4 != 0 {
+		return "", false
+	}
+	addrs := make([]string, 0)
+	for len(b) > 0 {
+		addrs = append(addrs, net.IP(b[0:4]).String())
+		b = b[4:]
+	}
+	return strings.Join(addrs, ","), true
+}
 
-	// 4 byte integer value
-	case dhcp.OptionTimeOffset,
-		dhcp.OptionPathMTUAgingTimeout,
-		dhcp.OptionARPCacheTimeout,
-		dhcp.OptionTCPKeepaliveInterval,
-		dhcp.OptionIPAddressLeaseTime,
-		dhcp.OptionRenewalTimeValue,
-		dhcp.OptionRebindingTimeValue:
-		answer := make([]byte, 4)
-		ival, err := strconv.Atoi(value)
+func encodeUint(size int) func(*OptionDef, string) ([]byte, error) {
+	return func(def *OptionDef, value string) ([]byte, error) {
+		ival, err := strconv.ParseUint(strings.TrimSpace(value), 10, size*8)
 		if err != nil {
 			return nil, err
 		}
-		binary.BigEndian.PutUint32(answer, uint32(ival))
-		return answer, nil
+		answer := make([]byte, 8)
+		binary.BigEndian.PutUint64(answer, ival)
+		return answer[8-size:], nil
+	}
+}
 
-	// 2 byte integer value
-	case dhcp.OptionBootFileSize,
-		dhcp.OptionMaximumDatagramReassemblySize,
-		dhcp.OptionInterfaceMTU,
-		dhcp.OptionMaximumDHCPMessageSize:
-		answer := make([]byte, 2)
-		ival, err := strconv.Atoi(value)
+func decodeUint(size int) func(*OptionDef, []byte) (string, bool) {
+	return func(def *OptionDef, b []byte) (string, bool) {
+		if len(b) != size {
+			return "", false
+		}
+		var ival uint64
+		for _, v := range b {
+			ival = ival<<8 | uint64(v)
+		}
+		return fmt.Sprint(ival), true
+	}
+}
+
+func encodeInt32(def *OptionDef, value string) ([]byte, error) {
+	ival, err := strconv.ParseInt(strings.TrimSpace(value), 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	answer := make([]byte, 4)
+	binary.BigEndian.PutUint32(answer, uint32(ival))
+	return answer, nil
+}
+
+func decodeInt32(def *OptionDef, b []byte) (string, bool) {
+	if len(b) != 4 {
+		return "", false
+	}
+	return fmt.Sprint(int32(binary.BigEndian.Uint32(b))), true
+}
+
+func encodeBool(def *OptionDef, value string) ([]byte, error) {
+	bval, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		return nil, err
+	}
+	if bval {
+		return []byte{1}, nil
+	}
+	return []byte{0}, nil
+}
+
+func decodeBool(def *OptionDef, b []byte) (string, bool) {
+	if len(b) != 1 {
+		return "", false
+	}
+	return fmt.Sprint(b[0] != 0), true
+}
+
+func encodeString(def *OptionDef, value string) ([]byte, error) {
+	return []byte(value), nil
+}
+
+func decodeString(def *OptionDef, b []byte) (string, bool) {
+	return string(b), true
+}
+
+func encodeHex(def *OptionDef, value string) ([]byte, error) {
+	return hex.DecodeString(strings.Replace(strings.TrimSpace(value), ":", "", -1))
+}
+
+func decodeHex(def *OptionDef, b []byte) (string, bool) {
+	parts := make([]string, len(b))
+	for i, v := range b {
+		parts[i] = fmt.Sprintf("%02x", v)
+	}
+	return strings.Join(parts, ":"), true
+}
+
+// encodeRouteList builds an RFC 3442 classless static route option.
+// Each route is "destination/prefix router", and routes are separated
+// by commas.
+func encodeRouteList(def *OptionDef, value string) ([]byte, error) {
+	res := []byte{}
+	for _, route := range strings.Split(value, ",") {
+		parts := strings.Fields(route)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid route %s", route)
+		}
+		_, dest, err := net.ParseCIDR(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		ones, bits := dest.Mask.Size()
+		if bits != 32 {
+			return nil, fmt.Errorf("Invalid IPv4 route %s", route)
+		}
+		router, err := parseIP4(parts[1])
 		if err != nil {
 			return nil, err
 		}
-		binary.BigEndian.PutUint16(answer, uint16(ival))
-		return answer, nil
+		res = append(res, byte(ones))
+		res = append(res, dest.IP.To4()[:(ones+7)/8]...)
+		res = append(res, router...)
+	}
+	return res, nil
+}
 
-	// 1 byte integer value
-	case dhcp.OptionIPForwardingEnableDisable,
-		dhcp.OptionNonLocalSourceRoutingEnableDisable,
-		dhcp.OptionDefaultIPTimeToLive,
-		dhcp.OptionAllSubnetsAreLocal,
-		dhcp.OptionPerformMaskDiscovery,
-		dhcp.OptionMaskSupplier,
-		dhcp.OptionPerformRouterDiscovery,
-		dhcp.OptionTrailerEncapsulation,
-		dhcp.OptionEthernetEncapsulation,
-		dhcp.OptionTCPDefaultTTL,
-		dhcp.OptionTCPKeepaliveGarbage,
-		dhcp.OptionNetBIOSOverTCPIPNodeType,
-		dhcp.OptionOverload,
-		dhcp.OptionDHCPMessageType:
-		answer := make([]byte, 1)
-		ival, err := strconv.Atoi(value)
+func decodeRouteList(def *OptionDef, b []byte) (string, bool) {
+	routes := []string{}
+	for len(b) > 0 {
+		ones := int(b[0])
+		width := (ones + 7) / 8
+		if ones > 32 || len(b) < 1+width+4 {
+			return "", false
+		}
+		dest := make(net.IP, 4)
+		copy(dest, b[1:1+width])
+		router := net.IP(b[1+width : 1+width+4])
+		routes = append(routes, fmt.Sprintf("%s/%d %s", dest, ones, router))
+		b = b[1+width+4:]
+	}
+	return strings.Join(routes, ","), true
+}
+
+// encodeVendor builds vendor encapsulated sub-options (option 43).
+// The value is a list of code=value pairs separated by semicolons.
+// Sub-options the definition knows about are rendered with their
+// type, and everything else is treated as hex.  Values that are not
+// in code=value form are sent as they are, which is how option 43
+// used to be handled.
+func encodeVendor(def *OptionDef, value string) ([]byte, error) {
+	res := []byte{}
+	for i, part := range strings.Split(value, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		code, err := strconv.ParseUint(strings.TrimSpace(kv[0]), 10, 8)
+		if len(kv) != 2 || err != nil {
+			if i == 0 {
+				return []byte(value), nil
+			}
+			return nil, fmt.Errorf("Invalid sub-option %s", part)
+		}
+		sub := def.subOption(dhcp.OptionCode(code))
+		b, err := sub.Encode(kv[1])
 		if err != nil {
 			return nil, err
 		}
-		answer[0] = byte(ival)
-		return answer, nil
+		if len(b) > 255 {
+			return nil, fmt.Errorf("Sub-option %d is too long", code)
+		}
+		res = append(res, byte(code), byte(len(b)))
+		res = append(res, b...)
+	}
+	return res, nil
+}
 
-		// Empty
-	case dhcp.Pad, dhcp.End:
-		return make([]byte, 0), nil
+func decodeVendor(def *OptionDef, b []byte) (string, bool) {
+	orig := b
+	parts := []string{}
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return string(orig), true
+		}
+		code, data := dhcp.OptionCode(b[0]), b[2:2+int(b[1])]
+		parts = append(parts, fmt.Sprintf("%d=%s", code, def.subOption(code).Decode(data)))
+		b = b[2+len(data):]
 	}
+	return strings.Join(parts, ";"), true
+}
 
-	return nil, errors.New("Invalid Option: " + code.String() + " " + value)
+// builtinOptionDefs are the types of the options from RFC 2132 and
+// friends that we know how to render.
+var builtinOptionDefs = map[dhcp.OptionCode]string{
+	// Single IP-like address
+	dhcp.OptionSubnetMask:                OptionTypeIP,
+	dhcp.OptionBroadcastAddress:          OptionTypeIP,
+	dhcp.OptionSwapServer:                OptionTypeIP,
+	dhcp.OptionRouterSolicitationAddress: OptionTypeIP,
+	dhcp.OptionRequestedIPAddress:        OptionTypeIP,
+	dhcp.OptionServerIdentifier:          OptionTypeIP,
+
+	// Multiple IP-like address
+	dhcp.OptionRouter:                                     OptionTypeIPList,
+	dhcp.OptionTimeServer:                                 OptionTypeIPList,
+	dhcp.OptionNameServer:                                 OptionTypeIPList,
+	dhcp.OptionDomainNameServer:                           OptionTypeIPList,
+	dhcp.OptionLogServer:                                  OptionTypeIPList,
+	dhcp.OptionCookieServer:                               OptionTypeIPList,
+	dhcp.OptionLPRServer:                                  OptionTypeIPList,
+	dhcp.OptionImpressServer:                              OptionTypeIPList,
+	dhcp.OptionResourceLocationServer:                     OptionTypeIPList,
+	dhcp.OptionPolicyFilter:                               OptionTypeIPList, // This is special and could validate more (2Ips per)
+	dhcp.OptionStaticRoute:                                OptionTypeIPList, // This is special and could validate more (2IPs per)
+	dhcp.OptionNetworkInformationServers:                  OptionTypeIPList,
+	dhcp.OptionNetworkTimeProtocolServers:                 OptionTypeIPList,
+	dhcp.OptionNetBIOSOverTCPIPNameServer:                 OptionTypeIPList,
+	dhcp.OptionNetBIOSOverTCPIPDatagramDistributionServer: OptionTypeIPList,
+	dhcp.OptionXWindowSystemFontServer:                    OptionTypeIPList,
+	dhcp.OptionXWindowSystemDisplayManager:                OptionTypeIPList,
+	dhcp.OptionNetworkInformationServicePlusServers:       OptionTypeIPList,
+	dhcp.OptionMobileIPHomeAgent:                          OptionTypeIPList,
+	dhcp.OptionSimpleMailTransportProtocol:                OptionTypeIPList,
+	dhcp.OptionPostOfficeProtocolServer:                   OptionTypeIPList,
+	dhcp.OptionNetworkNewsTransportProtocol:               OptionTypeIPList,
+	dhcp.OptionDefaultWorldWideWebServer:                  OptionTypeIPList,
+	dhcp.OptionDefaultFingerServer:                        OptionTypeIPList,
+	dhcp.OptionDefaultInternetRelayChatServer:             OptionTypeIPList,
+	dhcp.OptionStreetTalkServer:                           OptionTypeIPList,
+	dhcp.OptionStreetTalkDirectoryAssistance:              OptionTypeIPList,
+
+	// String like value
+	dhcp.OptionHostName:                            OptionTypeString,
+	dhcp.OptionMeritDumpFile:                       OptionTypeString,
+	dhcp.OptionDomainName:                          OptionTypeString,
+	dhcp.OptionRootPath:                            OptionTypeString,
+	dhcp.OptionExtensionsPath:                      OptionTypeString,
+	dhcp.OptionNetworkInformationServiceDomain:     OptionTypeString,
+	dhcp.OptionNetBIOSOverTCPIPScope:               OptionTypeString,
+	dhcp.OptionNetworkInformationServicePlusDomain: OptionTypeString,
+	dhcp.OptionTFTPServerName:                      OptionTypeString,
+	dhcp.OptionBootFileName:                        OptionTypeString,
+	dhcp.OptionMessage:                             OptionTypeString,
+	dhcp.OptionVendorClassIdentifier:               OptionTypeString,
+	dhcp.OptionClientIdentifier:                    OptionTypeString,
+	dhcp.OptionUserClass:                           OptionTypeString,
+	dhcp.OptionTZPOSIXString:                       OptionTypeString,
+	dhcp.OptionTZDatabaseString:                    OptionTypeString,
+
+	// Vendor encapsulated sub-options
+	dhcp.OptionVendorSpecificInformation: OptionTypeVendor,
+
+	// 4 byte integer value
+	dhcp.OptionTimeOffset:           OptionTypeInt32,
+	dhcp.OptionPathMTUAgingTimeout:  OptionTypeUint32,
+	dhcp.OptionARPCacheTimeout:      OptionTypeUint32,
+	dhcp.OptionTCPKeepaliveInterval: OptionTypeUint32,
+	dhcp.OptionIPAddressLeaseTime:   OptionTypeUint32,
+	dhcp.OptionRenewalTimeValue:     OptionTypeUint32,
+	dhcp.OptionRebindingTimeValue:   OptionTypeUint32,
+
+	// 2 byte integer value
+	dhcp.OptionBootFileSize:                  OptionTypeUint16,
+	dhcp.OptionMaximumDatagramReassemblySize: OptionTypeUint16,
+	dhcp.OptionInterfaceMTU:                  OptionTypeUint16,
+	dhcp.OptionMaximumDHCPMessageSize:        OptionTypeUint16,
+	dhcp.OptionClientArchitecture:            OptionTypeUint16,
+
+	// 1 byte integer value
+	dhcp.OptionIPForwardingEnableDisable:          OptionTypeUint8,
+	dhcp.OptionNonLocalSourceRoutingEnableDisable: OptionTypeUint8,
+	dhcp.OptionDefaultIPTimeToLive:                OptionTypeUint8,
+	dhcp.OptionAllSubnetsAreLocal:                 OptionTypeUint8,
+	dhcp.OptionPerformMaskDiscovery:               OptionTypeUint8,
+	dhcp.OptionMaskSupplier:                       OptionTypeUint8,
+	dhcp.OptionPerformRouterDiscovery:             OptionTypeUint8,
+	dhcp.OptionTrailerEncapsulation:               OptionTypeUint8,
+	dhcp.OptionEthernetEncapsulation:              OptionTypeUint8,
+	dhcp.OptionTCPDefaultTTL:                      OptionTypeUint8,
+	dhcp.OptionTCPKeepaliveGarbage:                OptionTypeUint8,
+	dhcp.OptionNetBIOSOverTCPIPNodeType:           OptionTypeUint8,
+	dhcp.OptionOverload:                           OptionTypeUint8,
+	dhcp.OptionDHCPMessageType:                    OptionTypeUint8,
+
+	// RFC 3442 classless static routes
+	dhcp.OptionClasslessRouteFormat: OptionTypeRouteList,
+}
+
+// OptionIPXE is where iPXE looks for its settings (Etherboot
+// encapsulated options).
+const OptionIPXE dhcp.OptionCode = 175
+
+// builtinEncapsulatedDefs are vendor options whose sub-options we
+// know the types of.  Sub-options not listed are rendered as hex.
+func builtinEncapsulatedDefs() []*OptionDef {
+	return []*OptionDef{
+		{
+			Code: OptionIPXE,
+			Name: "iPXE",
+			Type: OptionTypeVendor,
+			SubOptions: []*OptionDef{
+				// SHA256 fingerprints of the root certificates
+				// iPXE should trust.
+				{Code: 90, Name: "trust", Type: OptionTypeHex},
+			},
+		},
+	}
+}
+
+func convertByteToOptionValue(code dhcp.OptionCode, b []byte) string {
+	if code == dhcp.Pad || code == dhcp.End {
+		return ""
+	}
+	def := optionDefs.Find(code)
+	if def == nil {
+		def = &OptionDef{Code: code, Type: OptionTypeHex}
+	}
+	return def.Decode(b)
+}
+
+func convertOptionValueToByte(code dhcp.OptionCode, value string) ([]byte, error) {
+	if code == dhcp.Pad || code == dhcp.End {
+		return make([]byte, 0), nil
+	}
+	def := optionDefs.Find(code)
+	if def == nil {
+		return nil, errors.New("Invalid Option: " + code.String() + " " + value)
+	}
+	return def.Encode(value)
 }
 
 // Others in the dhcp library, but not likely needed for input.
@@ -256,4 +416,3 @@ func convertOptionValueToByte(code dhcp.OptionCode, value string) ([]byte, error
 //OptionParameterRequestList   OptionCode = 55
 // Complex See RFC 3046
 // OptionRelayAgentInformation OptionCode = 82
-// OptionClasslessRouteFormat OptionCode = 121
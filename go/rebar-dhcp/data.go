@@ -6,7 +6,9 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"reflect"
 	"sync"
+	"sync/atomic"
 
 	"github.com/digitalrebar/digitalrebar/go/common/store"
 )
@@ -14,7 +16,10 @@ import (
 type DataTracker struct {
 	sync.Mutex `json:"-"`
 	store      store.SimpleStore
+	known      atomic.Value       // *knownClients
+	dryRun     bool               // Set on copies made by dryRunCopy
 	Subnets    map[string]*Subnet // subnet -> SubnetData
+	OptionDefs []*OptionDef       // Custom option definitions
 }
 
 func NewDataTracker(store store.SimpleStore) *DataTracker {
@@ -65,6 +70,9 @@ func (dt *DataTracker) RemoveSubnet(subnetName string) (error, int) {
 	if lsubnet == nil {
 		return errors.New("Not Found"), http.StatusNotFound
 	}
+	for _, l := range lsubnet.Leases {
+		lsubnet.unpublishLease(l)
+	}
 	delete(dt.Subnets, subnetName)
 	dt.save_data()
 	return nil, http.StatusOK
@@ -76,9 +84,10 @@ func (dt *DataTracker) ReplaceSubnet(subnetName string, subnet *Subnet) (error,
 		return errors.New("Not Found"), http.StatusNotFound
 	}
 
-	// Take Leases and Bindings from old to new if nets match
+	// Take Leases, Bindings, and Conflicts from old to new if nets match
 	subnet.Leases = lsubnet.Leases
 	subnet.Bindings = lsubnet.Bindings
+	subnet.Conflicts = lsubnet.Conflicts
 
 	delete(dt.Subnets, lsubnet.Name)
 
@@ -89,6 +98,14 @@ func (dt *DataTracker) ReplaceSubnet(subnetName string, subnet *Subnet) (error,
 		return errors.New("Subnet overlaps with existing subnet"), http.StatusBadRequest
 	}
 
+	// Names published under the old DNS settings will be published
+	// again under the new ones when the leases renew.
+	if !reflect.DeepEqual(lsubnet.Ddns, subnet.Ddns) {
+		for _, l := range lsubnet.Leases {
+			lsubnet.unpublishLease(l)
+		}
+	}
+
 	dt.Subnets[subnet.Name] = subnet
 	dt.save_data()
 	return nil, http.StatusOK
@@ -134,9 +151,12 @@ func (dt *DataTracker) load_data() {
 	if err := json.Unmarshal(buf, &dt); err != nil {
 		log.Panicf("Unable to unmarshal data from backing store: %s", err)
 	}
+	optionDefs.SetCustom(dt.OptionDefs)
+	dt.updateKnownClients()
 }
 
 func (dt *DataTracker) save_data() {
+	dt.updateKnownClients()
 	buf, err := json.Marshal(dt)
 	if err != nil {
 		log.Panicf("Unable to marshal data to save to backing store: %s", err)
@@ -164,23 +184,23 @@ func (dt *DataTracker) AddBinding(subnetName string, binding Binding) (error, in
 		return errors.New("Not Found"), http.StatusNotFound
 	}
 
-	lsubnet.Bindings[binding.Mac] = &binding
+	lsubnet.Bindings[binding.key()] = &binding
 	dt.save_data()
 	return nil, http.StatusOK
 }
 
-func (dt *DataTracker) DeleteBinding(subnetName, mac string) (error, int) {
+func (dt *DataTracker) DeleteBinding(subnetName, key string) (error, int) {
 	lsubnet := dt.Subnets[subnetName]
 	if lsubnet == nil {
 		return errors.New("Subnet Not Found"), http.StatusNotFound
 	}
 
-	b := lsubnet.Bindings[mac]
+	b := lsubnet.Bindings[key]
 	if b == nil {
 		return errors.New("Binding Not Found"), http.StatusNotFound
 	}
 
-	delete(lsubnet.Bindings, mac)
+	delete(lsubnet.Bindings, key)
 	dt.save_data()
 	return nil, http.StatusOK
 }
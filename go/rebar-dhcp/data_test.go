@@ -10,7 +10,6 @@ import (
 	"github.com/digitalrebar/digitalrebar/go/common/store"
 	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
 	"github.com/stretchr/testify/assert"
-	"github.com/willf/bitset"
 )
 
 func newSubnet(dt *DataTracker, name, subnet string) (s *Subnet) {
@@ -20,7 +19,6 @@ func newSubnet(dt *DataTracker, name, subnet string) (s *Subnet) {
 	s.Subnet = &MyIPNet{theNet}
 	s.ActiveStart = dhcp.IPAdd(theNet.IP, 5)
 	s.ActiveEnd = dhcp.IPAdd(theNet.IP, 25)
-	s.ActiveBits = bitset.New(uint(dhcp.IPRange(s.ActiveStart, s.ActiveEnd)))
 	return
 }
 
@@ -262,7 +260,7 @@ func TestAddBindingMissing(t *testing.T) {
 func TestAddBinding(t *testing.T) {
 	dt, s := simpleSetup()
 
-	assert.Equal(t, s.ActiveBits.Any(), false, "No bits should be set")
+	assert.Equal(t, s.poolUsage(s.activePool()).Any(), false, "No bits should be set")
 
 	b := &Binding{}
 	b.Mac = "macit"
@@ -275,21 +273,21 @@ func TestAddBinding(t *testing.T) {
 	assert.NotNil(t, s.Bindings["macit"], "Binding should be not nil")
 	assert.Equal(t, s.Bindings["macit"], b, "Binding should be the same")
 	assert.Equal(t, s.Bindings["macit"].Ip.String(), "192.168.128.10", "Binding ip should be 192.168.128.10, but is %s", s.Bindings["macit"].Ip.String())
-	assert.Equal(t, s.ActiveBits.Count(), uint(1), "bit count should be 1, but is %d", s.ActiveBits.Count())
-	assert.Equal(t, s.ActiveBits.Test(5), true, "bit 5 should be set")
+	assert.Equal(t, s.poolUsage(s.activePool()).Count(), uint(1), "bit count should be 1, but is %d", s.poolUsage(s.activePool()).Count())
+	assert.Equal(t, s.poolUsage(s.activePool()).Test(5), true, "bit 5 should be set")
 }
 
 func TestAddBindingReplace(t *testing.T) {
 	dt, s := simpleSetup()
 
-	assert.Equal(t, s.ActiveBits.Any(), false, "No bits should be set")
+	assert.Equal(t, s.poolUsage(s.activePool()).Any(), false, "No bits should be set")
 
 	b := &Binding{}
 	b.Mac = "macit"
 	b.Ip = net.ParseIP("192.168.128.10")
 	dt.AddBinding("fred", *b)
 
-	assert.Equal(t, s.ActiveBits.Test(5), true, "bit 5 should be set")
+	assert.Equal(t, s.poolUsage(s.activePool()).Test(5), true, "bit 5 should be set")
 
 	b2 := &Binding{}
 	b2.Mac = "macit"
@@ -302,9 +300,9 @@ func TestAddBindingReplace(t *testing.T) {
 	assert.NotNil(t, s.Bindings["macit"], "Binding should be not nil")
 	assert.Equal(t, s.Bindings["macit"], b2, "Binding should be the same")
 	assert.Equal(t, s.Bindings["macit"].Ip.String(), "192.168.128.16", "Binding ip should be 192.168.128.16, but is %s", s.Bindings["macit"].Ip.String())
-	assert.Equal(t, s.ActiveBits.Count(), uint(1), "bit count should be 1, but is %d", s.ActiveBits.Count())
-	assert.Equal(t, s.ActiveBits.Test(5), false, "bit 5 should be false")
-	assert.Equal(t, s.ActiveBits.Test(11), true, "bit 11 should be true")
+	assert.Equal(t, s.poolUsage(s.activePool()).Count(), uint(1), "bit count should be 1, but is %d", s.poolUsage(s.activePool()).Count())
+	assert.Equal(t, s.poolUsage(s.activePool()).Test(5), false, "bit 5 should be false")
+	assert.Equal(t, s.poolUsage(s.activePool()).Test(11), true, "bit 11 should be true")
 }
 
 func TestDeleteBindingMissingSubnet(t *testing.T) {
@@ -321,8 +319,8 @@ func TestDeleteBindingMissingSubnet(t *testing.T) {
 	assert.NotNil(t, err, "Error should not be nil")
 	assert.Equal(t, err.Error(), "Subnet Not Found", "Error message should be 'Subnet Not Found', but was %s", err.Error())
 	assert.Equal(t, len(s.Bindings), 1, "There should be one binding")
-	assert.Equal(t, s.ActiveBits.Count(), uint(1), "bit count should be 1, but is %d", s.ActiveBits.Count())
-	assert.Equal(t, s.ActiveBits.Test(5), true, "bit 5 should be true")
+	assert.Equal(t, s.poolUsage(s.activePool()).Count(), uint(1), "bit count should be 1, but is %d", s.poolUsage(s.activePool()).Count())
+	assert.Equal(t, s.poolUsage(s.activePool()).Test(5), true, "bit 5 should be true")
 }
 
 func TestDeleteBindingMissingBinding(t *testing.T) {
@@ -339,8 +337,8 @@ func TestDeleteBindingMissingBinding(t *testing.T) {
 	assert.NotNil(t, err, "Error should not be nil")
 	assert.Equal(t, err.Error(), "Binding Not Found", "Error message should be 'Binding Not Found', but was %s", err.Error())
 	assert.Equal(t, len(s.Bindings), 1, "There should one binding")
-	assert.Equal(t, s.ActiveBits.Count(), uint(1), "bit count should be 1, but is %d", s.ActiveBits.Count())
-	assert.Equal(t, s.ActiveBits.Test(5), true, "bit 5 should be true")
+	assert.Equal(t, s.poolUsage(s.activePool()).Count(), uint(1), "bit count should be 1, but is %d", s.poolUsage(s.activePool()).Count())
+	assert.Equal(t, s.poolUsage(s.activePool()).Test(5), true, "bit 5 should be true")
 }
 
 func TestDeleteBinding(t *testing.T) {
@@ -356,8 +354,8 @@ func TestDeleteBinding(t *testing.T) {
 	assert.Nil(t, err, "Error should be nil")
 	assert.Equal(t, len(s.Bindings), 0, "There should not be any bindings")
 
-	assert.Equal(t, s.ActiveBits.Count(), uint(0), "bit count should be 0, but is %d", s.ActiveBits.Count())
-	assert.Equal(t, s.ActiveBits.Test(5), false, "bit 5 should be false")
+	assert.Equal(t, s.poolUsage(s.activePool()).Count(), uint(0), "bit count should be 0, but is %d", s.poolUsage(s.activePool()).Count())
+	assert.Equal(t, s.poolUsage(s.activePool()).Test(5), false, "bit 5 should be false")
 }
 
 func TestSetNextServerMissing(t *testing.T) {
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/digitalrebar/digitalrebar/go/common/cert"
+	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
+)
+
+// DdnsConfig tells rebar-dhcp where to publish the names of clients
+// that get leases on a subnet.  A records go in Zone.  If ReverseZone
+// is set, PTR records go there as well.
+type DdnsConfig struct {
+	Zone        string `json:"zone"`
+	ReverseZone string `json:"reverse_zone,omitempty"`
+}
+
+func (d *DdnsConfig) validate() error {
+	if d.Zone == "" {
+		return errors.New("DDNS config must have a zone")
+	}
+	d.Zone = strings.TrimSuffix(strings.ToLower(d.Zone), ".")
+	d.ReverseZone = strings.TrimSuffix(strings.ToLower(d.ReverseZone), ".")
+	return nil
+}
+
+// dnsRecord is the record change that rebar-dns-mgmt accepts on
+// PATCH /ddns/zones/:id.
+type dnsRecord struct {
+	ChangeType string `json:"changetype"`
+	Content    string `json:"content"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	TenantId   int    `json:"tenant_id"`
+}
+
+type dnsChange struct {
+	Zone   string
+	Record dnsRecord
+}
+
+// DnsUpdater sends record changes to a DNS server.
+type DnsUpdater interface {
+	Update(zone string, rec *dnsRecord) error
+}
+
+// DnsMgmtUpdater sends record changes to rebar-dns-mgmt.
+type DnsMgmtUpdater struct {
+	Url    string
+	client *http.Client
+}
+
+func NewDnsMgmtUpdater(url string) (*DnsMgmtUpdater, error) {
+	c, err := cert.Client("internal", "rebar-dhcp")
+	if err != nil {
+		return nil, err
+	}
+	return &DnsMgmtUpdater{Url: strings.TrimSuffix(url, "/"), client: c}, nil
+}
+
+func (u *DnsMgmtUpdater) Update(zone string, rec *dnsRecord) error {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	// The client certificate is what lets us change the zone, so this
+	// goes straight to dns-mgmt rather than through the rev proxy.
+	req, err := http.NewRequest("PATCH", u.Url+"/ddns/zones/"+zone, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s %s in %s: %s", rec.ChangeType, rec.Type, rec.Name, zone, resp.Status)
+	}
+	return nil
+}
+
+// dnsUpdater is nil when dynamic DNS is turned off.
+var dnsUpdater DnsUpdater
+
+// ddnsQueue hands changes to the goroutine started by startDdns so
+// that ServeDHCP never waits on the DNS server while holding the
+// DataTracker lock.  When it is nil changes are sent inline.
+var ddnsQueue chan []*dnsChange
+
+func applyDnsChanges(changes []*dnsChange) {
+	for _, c := range changes {
+		if err := dnsUpdater.Update(c.Zone, &c.Record); err != nil {
+			log.Printf("DDNS update failed: %v", err)
+		}
+	}
+}
+
+func queueDnsChanges(changes []*dnsChange) {
+	if dnsUpdater == nil || len(changes) == 0 {
+		return
+	}
+	if ddnsQueue == nil {
+		applyDnsChanges(changes)
+		return
+	}
+	select {
+	case ddnsQueue <- changes:
+	default:
+		log.Printf("DDNS queue full, dropping %d changes", len(changes))
+	}
+}
+
+// startDdns turns on dynamic DNS updates.  Expired leases are checked
+// every interval so their records can be removed even when nobody
+// asks for a new address.
+func startDdns(dt *DataTracker, u DnsUpdater, interval time.Duration) {
+	dnsUpdater = u
+	ddnsQueue = make(chan []*dnsChange, 1000)
+	go func() {
+		for changes := range ddnsQueue {
+			applyDnsChanges(changes)
+		}
+	}()
+	go func() {
+		for range time.Tick(interval) {
+			dt.Lock()
+			dt.expireDns()
+			dt.Unlock()
+		}
+	}()
+}
+
+// clientHostname picks the name to publish for a client.  A hostname
+// pinned on the binding wins, then a hostname option on the binding,
+// then the one the client sent.  Only the first label is used, since
+// the domain comes from the subnet.
+func clientHostname(binding *Binding, options dhcp.Options) string {
+	name := ""
+	if binding != nil {
+		for _, o := range binding.Options {
+			if o.Code == dhcp.OptionHostName {
+				name = o.Value
+			}
+		}
+		if binding.Hostname != "" {
+			name = binding.Hostname
+		}
+	}
+	if name == "" {
+		name = string(options[dhcp.OptionHostName])
+	}
+	name = strings.ToLower(strings.TrimSpace(name))
+	if i := strings.Index(name, "."); i != -1 {
+		name = name[:i]
+	}
+	if !validHostname(name) {
+		return ""
+	}
+	return name
+}
+
+// validHostname returns true if name is a single lowercase DNS label.
+func validHostname(name string) bool {
+	if name == "" || len(name) > 63 || name[0] == '-' || name[len(name)-1] == '-' {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// reverseName returns the name of the PTR record for ip relative to
+// zone, or "" if ip does not belong in zone.
+func reverseName(ip net.IP, zone string) string {
+	ip = ip.To4()
+	if ip == nil {
+		return ""
+	}
+	full := fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip[3], ip[2], ip[1], ip[0])
+	if !strings.HasSuffix(full, "."+zone) {
+		return ""
+	}
+	return strings.TrimSuffix(full, "."+zone)
+}
+
+func (s *Subnet) dnsChanges(changeType, name string, ip net.IP) []*dnsChange {
+	res := []*dnsChange{
+		&dnsChange{
+			Zone: s.Ddns.Zone,
+			Record: dnsRecord{
+				ChangeType: changeType,
+				Content:    ip.String(),
+				Name:       name,
+				Type:       "A",
+				TenantId:   s.TenantId,
+			},
+		},
+	}
+	if s.Ddns.ReverseZone == "" {
+		return res
+	}
+	rev := reverseName(ip, s.Ddns.ReverseZone)
+	if rev == "" {
+		log.Printf("%s is not in reverse zone %s, not updating PTR", ip, s.Ddns.ReverseZone)
+		return res
+	}
+	return append(res, &dnsChange{
+		Zone: s.Ddns.ReverseZone,
+		Record: dnsRecord{
+			ChangeType: changeType,
+			Content:    name + "." + s.Ddns.Zone + ".",
+			Name:       rev,
+			Type:       "PTR",
+			TenantId:   s.TenantId,
+		},
+	})
+}
+
+// publishLease makes name resolve to the lease's address, replacing
+// whatever name the lease had before.
+func (s *Subnet) publishLease(dt *DataTracker, lease *Lease, name string) {
+	if s.Ddns == nil || name == "" || lease.Hostname == name {
+		return
+	}
+	changes := []*dnsChange{}
+	if lease.Hostname != "" {
+		changes = append(changes, s.dnsChanges("REMOVE", lease.Hostname, lease.Ip)...)
+	}
+	changes = append(changes, s.dnsChanges("ADD", name, lease.Ip)...)
+	lease.Hostname = name
+	dt.save_data()
+	queueDnsChanges(changes)
+}
+
+// unpublishLease removes the records added by publishLease.  Callers
+// are responsible for saving the lease.
+func (s *Subnet) unpublishLease(lease *Lease) {
+	if lease == nil || lease.Hostname == "" {
+		return
+	}
+	if s.Ddns != nil {
+		queueDnsChanges(s.dnsChanges("REMOVE", lease.Hostname, lease.Ip))
+	}
+	lease.Hostname = ""
+}
+
+// expireDns removes the records of leases that have expired.
+func (dt *DataTracker) expireDns() {
+	saveMe := false
+	now := time.Now()
+	for _, s := range dt.Subnets {
+		for _, l := range s.Leases {
+			if l.Hostname != "" && now.After(l.ExpireTime) {
+				s.unpublishLease(l)
+				saveMe = true
+			}
+		}
+	}
+	if saveMe {
+		dt.save_data()
+	}
+}
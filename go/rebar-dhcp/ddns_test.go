@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeDnsUpdater struct {
+	changes []*dnsChange
+}
+
+func (f *fakeDnsUpdater) Update(zone string, rec *dnsRecord) error {
+	f.changes = append(f.changes, &dnsChange{Zone: zone, Record: *rec})
+	return nil
+}
+
+func withFakeDns() (*fakeDnsUpdater, func()) {
+	oldUpdater, oldQueue := dnsUpdater, ddnsQueue
+	f := &fakeDnsUpdater{}
+	dnsUpdater, ddnsQueue = f, nil
+	return f, func() { dnsUpdater, ddnsQueue = oldUpdater, oldQueue }
+}
+
+func TestClientHostname(t *testing.T) {
+	opts := dhcp.Options{dhcp.OptionHostName: []byte("Node1.example.com")}
+	assert.Equal(t, clientHostname(nil, opts), "node1", "Hostname should be node1")
+
+	b := &Binding{Options: []*Option{&Option{dhcp.OptionHostName, "bound"}}}
+	assert.Equal(t, clientHostname(b, opts), "bound", "Binding hostname should win")
+
+	b.Hostname = "pinned"
+	assert.Equal(t, clientHostname(b, opts), "pinned", "Pinned hostname should win")
+
+	assert.Equal(t, clientHostname(nil, dhcp.Options{}), "", "Missing hostname should be empty")
+	assert.Equal(t, clientHostname(nil, dhcp.Options{dhcp.OptionHostName: []byte("bad_name")}), "", "Invalid hostname should be empty")
+	assert.Equal(t, clientHostname(nil, dhcp.Options{dhcp.OptionHostName: []byte("-bad")}), "", "Invalid hostname should be empty")
+}
+
+func TestReverseName(t *testing.T) {
+	ip := net.ParseIP("192.168.128.10")
+	assert.Equal(t, reverseName(ip, "128.168.192.in-addr.arpa"), "10", "Reverse name should be 10")
+	assert.Equal(t, reverseName(ip, "168.192.in-addr.arpa"), "10.128", "Reverse name should be 10.128")
+	assert.Equal(t, reverseName(ip, "129.168.192.in-addr.arpa"), "", "Address outside the zone should be empty")
+}
+
+func TestPublishLease(t *testing.T) {
+	dt, s := simpleSetup()
+	f, restore := withFakeDns()
+	defer restore()
+
+	lease := &Lease{Ip: net.ParseIP("192.168.128.10").To4(), Mac: "aa:bb:cc:dd:ee:ff", ExpireTime: time.Now().Add(time.Hour)}
+	s.Leases[lease.Mac] = lease
+
+	s.publishLease(dt, lease, "node1")
+	assert.Equal(t, len(f.changes), 0, "No changes should be sent without a DDNS config")
+
+	s.Ddns = &DdnsConfig{Zone: "example.com", ReverseZone: "128.168.192.in-addr.arpa"}
+	s.publishLease(dt, lease, "node1")
+	assert.Equal(t, len(f.changes), 2, "A and PTR records should be added")
+	assert.Equal(t, f.changes[0].Zone, "example.com", "A record should go to the forward zone")
+	assert.Equal(t, f.changes[0].Record, dnsRecord{ChangeType: "ADD", Content: "192.168.128.10", Name: "node1", Type: "A"}, "A record is wrong")
+	assert.Equal(t, f.changes[1].Zone, "128.168.192.in-addr.arpa", "PTR record should go to the reverse zone")
+	assert.Equal(t, f.changes[1].Record, dnsRecord{ChangeType: "ADD", Content: "node1.example.com.", Name: "10", Type: "PTR"}, "PTR record is wrong")
+	assert.Equal(t, lease.Hostname, "node1", "Lease should remember its hostname")
+
+	// Renewing with the same name does nothing.
+	s.publishLease(dt, lease, "node1")
+	assert.Equal(t, len(f.changes), 2, "Renewal should not send changes")
+
+	// A new name replaces the old one.
+	f.changes = nil
+	s.publishLease(dt, lease, "node2")
+	assert.Equal(t, len(f.changes), 4, "Old records should be removed and new ones added")
+	assert.Equal(t, f.changes[0].Record.ChangeType, "REMOVE", "Old A record should be removed")
+	assert.Equal(t, f.changes[0].Record.Name, "node1", "Old A record should be removed")
+	assert.Equal(t, f.changes[2].Record.Name, "node2", "New A record should be added")
+
+	// Releasing the lease removes the records.
+	f.changes = nil
+	s.freeLease(dt, lease.Mac)
+	assert.Equal(t, len(f.changes), 2, "Release should remove A and PTR records")
+	assert.Equal(t, f.changes[0].Record.ChangeType, "REMOVE", "Release should remove records")
+}
+
+func TestExpireDns(t *testing.T) {
+	dt, s := simpleSetup()
+	f, restore := withFakeDns()
+	defer restore()
+
+	s.Ddns = &DdnsConfig{Zone: "example.com"}
+	s.Leases["aa:bb:cc:dd:ee:ff"] = &Lease{
+		Ip:         net.ParseIP("192.168.128.10").To4(),
+		Mac:        "aa:bb:cc:dd:ee:ff",
+		ExpireTime: time.Now().Add(-time.Minute),
+		Hostname:   "node1",
+	}
+	s.Leases["aa:bb:cc:dd:ee:00"] = &Lease{
+		Ip:         net.ParseIP("192.168.128.11").To4(),
+		Mac:        "aa:bb:cc:dd:ee:00",
+		ExpireTime: time.Now().Add(time.Hour),
+		Hostname:   "node2",
+	}
+
+	dt.expireDns()
+	assert.Equal(t, len(f.changes), 1, "Only the expired lease should be removed")
+	assert.Equal(t, f.changes[0].Record, dnsRecord{ChangeType: "REMOVE", Content: "192.168.128.10", Name: "node1", Type: "A"}, "A record is wrong")
+	assert.Equal(t, s.Leases["aa:bb:cc:dd:ee:ff"].Hostname, "", "Expired lease should forget its hostname")
+
+	dt.expireDns()
+	assert.Equal(t, len(f.changes), 1, "Records should only be removed once")
+}
+
+func TestSubnetUnmarshalDdns(t *testing.T) {
+	s := &Subnet{}
+	err := json.Unmarshal([]byte(`{"name": "fred", "subnet": "192.168.128.0/24", "active_start": "192.168.128.5", "active_end": "192.168.128.25", "ddns": {"zone": "Example.COM.", "reverse_zone": "128.168.192.in-addr.arpa"}}`), s)
+	assert.Nil(t, err, "Error should be nil")
+	assert.Equal(t, s.Ddns.Zone, "example.com", "Zone should be normalized, but is %s", s.Ddns.Zone)
+
+	s = &Subnet{}
+	err = json.Unmarshal([]byte(`{"name": "fred", "subnet": "192.168.128.0/24", "active_start": "192.168.128.5", "active_end": "192.168.128.25", "ddns": {"reverse_zone": "128.168.192.in-addr.arpa"}}`), s)
+	assert.NotNil(t, err, "DDNS config without a zone should fail")
+}
@@ -141,7 +141,12 @@ func findSubnet(h *DHCPHandler, p dhcp.Packet) *Subnet {
 }
 
 func (h *DHCPHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) (d dhcp.Packet) {
-
+	start := time.Now()
+	// Dry runs from Simulate leave metrics, rate limits and captures
+	// alone.
+	if !h.info.dryRun {
+		receivedPackets.Inc(messageTypeLabel(msgType))
+	}
 	log.Printf("Recieved DHCP packet: type %s %s ciaddr %s yiaddr %s giaddr %s chaddr %s",
 		msgType.String(),
 		xid(p),
@@ -149,21 +154,40 @@ func (h *DHCPHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 		p.YIAddr(),
 		p.GIAddr(),
 		p.CHAddr().String())
+	// Dropped packets are counted rather than logged, since logging
+	// them would let a flood of packets fill the logs instead.
+	if !h.info.dryRun && !h.admit(p, options) {
+		return nil
+	}
 	log.Printf("%s: Starting processing: %s", xid(p), time.Now())
 	h.info.Lock()
 	defer h.info.Unlock()
 	log.Printf("%s: Config lock acquired: %s", xid(p), time.Now())
 	subnet := findSubnet(h, p)
+	subnetName := ""
+	if subnet != nil {
+		subnetName = subnet.Name
+	}
+	defer func() {
+		if !h.info.dryRun {
+			h.capture(p, d, subnetName)
+			observe(subnetName, d, start)
+		}
+	}()
 	if subnet == nil {
 		log.Printf("%s %s: No subnet for leases", msgType.String(), xid(p))
 		return nil
 	}
 	log.Printf("%s %s: found subnet %v", msgType.String(), xid(p), subnet.Subnet)
 	nic := strings.ToLower(p.CHAddr().String())
+	class := subnet.findClass(nic, options)
+	if class != nil {
+		log.Printf("%s: %s is in client class %s", xid(p), nic, class.Name)
+	}
 	switch msgType {
 
 	case dhcp.Discover:
-		lease, binding := subnet.findOrGetInfo(h.info, nic, p.CIAddr())
+		lease, binding := subnet.findOrGetInfo(h.info, nic, p.CIAddr(), class, options)
 		if lease == nil {
 			log.Printf("%s: Discovery out of IPs for %s, ignoring %v", xid(p), subnet.Name, nic)
 			return dhcp.ReplyPacket(p, dhcp.NAK, h.ip, nil, 0, nil)
@@ -176,12 +200,13 @@ func (h *DHCPHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 			return nil
 		}
 
-		options, leaseTime := subnet.buildOptions(lease, binding, p)
+		options, leaseTime := subnet.buildOptions(lease, binding, class, p)
 		reply := dhcp.ReplyPacket(p, dhcp.Offer,
 			h.ip,
 			lease.Ip,
 			leaseTime,
 			options.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
+		subnet.setBootServer(reply, binding, class)
 
 		log.Printf("%s: Discovery handing out: %s to %s", xid(p),
 			reply.YIAddr(),
@@ -209,7 +234,7 @@ func (h *DHCPHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 			return dhcp.ReplyPacket(p, dhcp.NAK, h.ip, nil, 0, nil)
 		}
 
-		lease, binding := subnet.findInfo(h.info, nic)
+		lease, binding := subnet.findInfo(h.info, nic, options)
 		// Ignore unknown MAC address
 		if ignoreAnonymus && binding == nil {
 			log.Printf("%s: Request ignoring request from unknown MAC address %s",
@@ -244,20 +269,18 @@ func (h *DHCPHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 			return dhcp.ReplyPacket(p, dhcp.NAK, h.ip, nil, 0, nil)
 		}
 
-		options, leaseTime := subnet.buildOptions(lease, binding, p)
+		hostname := clientHostname(binding, options)
+		options, leaseTime := subnet.buildOptions(lease, binding, class, p)
 
 		subnet.updateLeaseTime(h.info, lease, leaseTime)
+		subnet.publishLease(h.info, lease, hostname)
 
 		reply := dhcp.ReplyPacket(p, dhcp.ACK,
 			h.ip,
 			lease.Ip,
 			leaseTime,
 			options.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
-		if binding != nil && binding.NextServer != nil {
-			reply.SetSIAddr(net.ParseIP(*binding.NextServer))
-		} else if subnet.NextServer != nil {
-			reply.SetSIAddr(*subnet.NextServer)
-		}
+		subnet.setBootServer(reply, binding, class)
 		log.Printf("%s: Request handing out %s to %s",
 			xid(p),
 			reply.YIAddr(),
@@ -0,0 +1,195 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// CapturedPacket is a DHCP packet that was received or sent, along
+// with where it came from and where it was going.
+type CapturedPacket struct {
+	Time   time.Time
+	Src    *net.UDPAddr
+	Dst    *net.UDPAddr
+	Subnet string // Name of the subnet that handled the packet, if any
+	Packet Packet
+}
+
+// Capture is a fixed size ring buffer of captured packets.  Once it
+// is full the oldest packets are overwritten.
+type Capture struct {
+	sync.Mutex
+	packets []*CapturedPacket
+	next    int
+	full    bool
+}
+
+func NewCapture(size int) *Capture {
+	return &Capture{packets: make([]*CapturedPacket, size)}
+}
+
+// Record adds a copy of p to the capture.
+func (c *Capture) Record(src, dst *net.UDPAddr, subnet string, p Packet) {
+	if c == nil || len(c.packets) == 0 || p == nil {
+		return
+	}
+	cp := &CapturedPacket{
+		Time:   time.Now(),
+		Src:    src,
+		Dst:    dst,
+		Subnet: subnet,
+		Packet: append(Packet(nil), p...),
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.packets[c.next] = cp
+	c.next++
+	if c.next == len(c.packets) {
+		c.next = 0
+		c.full = true
+	}
+}
+
+// Packets returns the captured packets, oldest first.
+func (c *Capture) Packets() []*CapturedPacket {
+	c.Lock()
+	defer c.Unlock()
+	res := make([]*CapturedPacket, 0, len(c.packets))
+	if c.full {
+		res = append(res, c.packets[c.next:]...)
+	}
+	return append(res, c.packets[:c.next]...)
+}
+
+// Clear throws away everything that has been captured.
+func (c *Capture) Clear() {
+	c.Lock()
+	defer c.Unlock()
+	c.packets = make([]*CapturedPacket, len(c.packets))
+	c.next = 0
+	c.full = false
+}
+
+const (
+	pcapMagic     = 0xa1b2c3d4
+	pcapLinkRaw   = 101 // LINKTYPE_RAW, packets start with the IP header
+	pcapSnapLen   = 65535
+	ipv4HeaderLen = 20
+	udpHeaderLen  = 8
+)
+
+func ipChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// WritePcap writes packets to w in pcap format.  Each packet is
+// wrapped in made up IPv4 and UDP headers so that tools like
+// wireshark and tcpdump can decode it.
+func WritePcap(w io.Writer, packets []*CapturedPacket) error {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkRaw)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	for _, cp := range packets {
+		l := ipv4HeaderLen + udpHeaderLen + len(cp.Packet)
+		buf := make([]byte, 16+l)
+		binary.LittleEndian.PutUint32(buf[0:], uint32(cp.Time.Unix()))
+		binary.LittleEndian.PutUint32(buf[4:], uint32(cp.Time.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(buf[8:], uint32(l))
+		binary.LittleEndian.PutUint32(buf[12:], uint32(l))
+		ip := buf[16:]
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(l))
+		ip[8] = 64
+		ip[9] = 17 // UDP
+		copy(ip[12:16], cp.Src.IP.To4())
+		copy(ip[16:20], cp.Dst.IP.To4())
+		binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip[:ipv4HeaderLen]))
+		udp := ip[ipv4HeaderLen:]
+		binary.BigEndian.PutUint16(udp[0:], uint16(cp.Src.Port))
+		binary.BigEndian.PutUint16(udp[2:], uint16(cp.Dst.Port))
+		binary.BigEndian.PutUint16(udp[4:], uint16(udpHeaderLen+len(cp.Packet)))
+		copy(udp[udpHeaderLen:], cp.Packet)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadPcap reads the UDP packets in a pcap file written by WritePcap
+// or by tcpdump.  Raw IP and Ethernet link types are supported.
+func ReadPcap(r io.Reader) ([]*CapturedPacket, error) {
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch {
+	case binary.LittleEndian.Uint32(hdr) == pcapMagic:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr) == pcapMagic:
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("Not a pcap file")
+	}
+	linkType := order.Uint32(hdr[20:])
+	if linkType != pcapLinkRaw && linkType != 1 {
+		return nil, fmt.Errorf("Unsupported pcap link type %d", linkType)
+	}
+	res := []*CapturedPacket{}
+	rec := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, rec); err == io.EOF {
+			return res, nil
+		} else if err != nil {
+			return nil, err
+		}
+		data := make([]byte, order.Uint32(rec[8:]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if linkType == 1 {
+			// Ethernet, skip the MAC header if this is IPv4.
+			if len(data) < 14 || binary.BigEndian.Uint16(data[12:]) != 0x0800 {
+				continue
+			}
+			data = data[14:]
+		}
+		if len(data) < ipv4HeaderLen || data[0]>>4 != 4 || data[9] != 17 {
+			continue
+		}
+		ihl := int(data[0]&0x0f) * 4
+		if len(data) < ihl+udpHeaderLen {
+			continue
+		}
+		udp := data[ihl:]
+		// Ethernet frames can be padded past the end of the UDP data.
+		if ul := int(binary.BigEndian.Uint16(udp[4:])); ul >= udpHeaderLen && ul <= len(udp) {
+			udp = udp[:ul]
+		}
+		res = append(res, &CapturedPacket{
+			Time:   time.Unix(int64(order.Uint32(rec[0:])), int64(order.Uint32(rec[4:]))*1000),
+			Src:    &net.UDPAddr{IP: net.IP(append([]byte(nil), data[12:16]...)), Port: int(binary.BigEndian.Uint16(udp[0:]))},
+			Dst:    &net.UDPAddr{IP: net.IP(append([]byte(nil), data[16:20]...)), Port: int(binary.BigEndian.Uint16(udp[2:]))},
+			Packet: Packet(append([]byte(nil), udp[udpHeaderLen:]...)),
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package dhcp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestCaptureRing(t *testing.T) {
+	c := NewCapture(3)
+	for i := 0; i < 5; i++ {
+		p := NewPacket(BootRequest)
+		p.SetHops(byte(i))
+		c.Record(&net.UDPAddr{IP: net.IPv4zero, Port: 68}, &net.UDPAddr{IP: net.IPv4bcast, Port: 67}, "", p)
+	}
+	packets := c.Packets()
+	if len(packets) != 3 {
+		t.Fatalf("Expected 3 packets, got %d", len(packets))
+	}
+	for i, cp := range packets {
+		if cp.Packet.Hops() != byte(i+2) {
+			t.Fatalf("Packet %d: expected hops %d, got %d", i, i+2, cp.Packet.Hops())
+		}
+	}
+	c.Clear()
+	if len(c.Packets()) != 0 {
+		t.Fatalf("Expected no packets after clear")
+	}
+
+	// A nil capture does nothing.
+	var nc *Capture
+	nc.Record(nil, nil, "", NewPacket(BootRequest))
+}
+
+func TestCaptureRecordCopies(t *testing.T) {
+	c := NewCapture(1)
+	p := NewPacket(BootRequest)
+	c.Record(&net.UDPAddr{IP: net.IPv4zero, Port: 68}, &net.UDPAddr{IP: net.IPv4bcast, Port: 67}, "", p)
+	p.SetHops(7)
+	if c.Packets()[0].Packet.Hops() != 0 {
+		t.Fatalf("Capture should keep a copy of the packet")
+	}
+}
+
+func TestPcapRoundTrip(t *testing.T) {
+	var tests = []struct {
+		src, dst *net.UDPAddr
+		mt       MessageType
+	}{
+		{
+			src: &net.UDPAddr{IP: net.IPv4zero.To4(), Port: 68},
+			dst: &net.UDPAddr{IP: net.IPv4bcast.To4(), Port: 67},
+			mt:  Discover,
+		},
+		{
+			src: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 67},
+			dst: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 254).To4(), Port: 67},
+			mt:  Offer,
+		},
+	}
+	c := NewCapture(10)
+	for _, tt := range tests {
+		p := RequestPacket(tt.mt, net.HardwareAddr{1, 2, 3, 4, 5, 6}, nil, []byte{1, 2, 3, 4}, false, nil)
+		c.Record(tt.src, tt.dst, "", p)
+	}
+	buf := &bytes.Buffer{}
+	if err := WritePcap(buf, c.Packets()); err != nil {
+		t.Fatalf("WritePcap failed: %v", err)
+	}
+	packets, err := ReadPcap(buf)
+	if err != nil {
+		t.Fatalf("ReadPcap failed: %v", err)
+	}
+	if len(packets) != len(tests) {
+		t.Fatalf("Expected %d packets, got %d", len(tests), len(packets))
+	}
+	for i, tt := range tests {
+		cp := packets[i]
+		if !cp.Src.IP.Equal(tt.src.IP) || cp.Src.Port != tt.src.Port {
+			t.Fatalf("Packet %d: expected source %v, got %v", i, tt.src, cp.Src)
+		}
+		if !cp.Dst.IP.Equal(tt.dst.IP) || cp.Dst.Port != tt.dst.Port {
+			t.Fatalf("Packet %d: expected destination %v, got %v", i, tt.dst, cp.Dst)
+		}
+		if !bytes.Equal(cp.Packet, c.Packets()[i].Packet) {
+			t.Fatalf("Packet %d: payload does not match", i)
+		}
+		if cp.Time.Unix() != c.Packets()[i].Time.Unix() {
+			t.Fatalf("Packet %d: time does not match", i)
+		}
+	}
+}
+
+func TestReadPcapBad(t *testing.T) {
+	if _, err := ReadPcap(bytes.NewReader([]byte("not a pcap file at all!!"))); err == nil {
+		t.Fatalf("Expected an error reading a bad file")
+	}
+}
@@ -167,7 +167,9 @@ func RequestPacket(mt MessageType, chAddr net.HardwareAddr, cIAddr net.IP, xId [
 
 // ReplyPacket creates a reply packet that a Server would send to a client.
 // It uses the req Packet param to copy across common/necessary fields to
-// associate the reply the request.
+// associate the reply the request.  If the request had a Relay Agent
+// Information option it is copied into the reply as the last option,
+// as required by RFC 3046.
 func ReplyPacket(req Packet, mt MessageType, serverId, yIAddr net.IP, leaseDuration time.Duration, options []Option) Packet {
 	p := NewPacket(BootReply)
 	p.SetXId(req.XId())
@@ -180,8 +182,14 @@ func ReplyPacket(req Packet, mt MessageType, serverId, yIAddr net.IP, leaseDurat
 	p.AddOption(OptionServerIdentifier, []byte(serverId))
 	p.AddOption(OptionIPAddressLeaseTime, OptionsLeaseTime(leaseDuration))
 	for _, o := range options {
+		if o.Code == OptionRelayAgentInformation {
+			continue
+		}
 		p.AddOption(o.Code, o.Value)
 	}
+	if rai, ok := req.ParseOptions()[OptionRelayAgentInformation]; ok {
+		p.AddOption(OptionRelayAgentInformation, rai)
+	}
 	p.PadToMinSize()
 	return p
 }
@@ -0,0 +1,34 @@
+package dhcp
+
+// Relay Agent Information sub-option codes from RFC 3046
+const (
+	RelayAgentCircuitId byte = 1
+	RelayAgentRemoteId  byte = 2
+)
+
+// RelayAgentInformation is the set of sub-options carried in a
+// Relay Agent Information option (82).
+type RelayAgentInformation map[byte][]byte
+
+// ParseRelayAgentInformation parses the value of an option 82 into
+// its sub-options.  Truncated sub-options are ignored.
+func ParseRelayAgentInformation(b []byte) RelayAgentInformation {
+	info := make(RelayAgentInformation)
+	for len(b) >= 2 {
+		size := int(b[1])
+		if len(b) < 2+size {
+			break
+		}
+		info[b[0]] = b[2 : 2+size]
+		b = b[2+size:]
+	}
+	return info
+}
+
+// CircuitId returns the agent circuit id (sub-option 1), which
+// usually identifies the switch port the request came in on.
+func (r RelayAgentInformation) CircuitId() []byte { return r[RelayAgentCircuitId] }
+
+// RemoteId returns the agent remote id (sub-option 2), which
+// usually identifies the relay agent itself.
+func (r RelayAgentInformation) RemoteId() []byte { return r[RelayAgentRemoteId] }
@@ -0,0 +1,72 @@
+package dhcp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseRelayAgentInformation(t *testing.T) {
+	var tests = []struct {
+		description string
+		value       []byte
+		circuitId   []byte
+		remoteId    []byte
+	}{
+		{
+			description: "empty",
+			value:       []byte{},
+		},
+		{
+			description: "circuit id only",
+			value:       []byte{1, 3, 'g', '0', '1'},
+			circuitId:   []byte("g01"),
+		},
+		{
+			description: "circuit and remote id",
+			value:       []byte{1, 2, 0, 5, 2, 6, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+			circuitId:   []byte{0, 5},
+			remoteId:    []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+		},
+		{
+			description: "truncated remote id",
+			value:       []byte{1, 1, 7, 2, 6, 0xaa},
+			circuitId:   []byte{7},
+		},
+	}
+
+	for i, tt := range tests {
+		info := ParseRelayAgentInformation(tt.value)
+		if want, got := tt.circuitId, info.CircuitId(); !bytes.Equal(want, got) {
+			t.Fatalf("%02d: ParseRelayAgentInformation(), test %q, unexpected circuit id: %v != %v",
+				i, tt.description, want, got)
+		}
+		if want, got := tt.remoteId, info.RemoteId(); !bytes.Equal(want, got) {
+			t.Fatalf("%02d: ParseRelayAgentInformation(), test %q, unexpected remote id: %v != %v",
+				i, tt.description, want, got)
+		}
+	}
+}
+
+// Verify that option 82 is echoed back as the last option in replies.
+func TestReplyPacketRelayAgentInformation(t *testing.T) {
+	rai := []byte{1, 3, 'g', '0', '1'}
+	req := RequestPacket(Discover, net.HardwareAddr{1, 2, 3, 4, 5, 6}, nil, []byte{1, 2, 3, 4}, false,
+		[]Option{{Code: OptionRelayAgentInformation, Value: rai}})
+	reply := ReplyPacket(req, Offer, []byte{192, 168, 1, 1}, []byte{192, 168, 1, 2}, 60*time.Second, oneOptionSlice)
+
+	if got := reply.ParseOptions()[OptionRelayAgentInformation]; !bytes.Equal(rai, got) {
+		t.Fatalf("ReplyPacket(), option 82 not echoed: %v != %v", rai, got)
+	}
+
+	opts := reply.Options()
+	var last OptionCode
+	for len(opts) >= 2 && OptionCode(opts[0]) != End {
+		last = OptionCode(opts[0])
+		opts = opts[2+int(opts[1]):]
+	}
+	if last != OptionRelayAgentInformation {
+		t.Fatalf("ReplyPacket(), option 82 should be last, but %v was", last)
+	}
+}
@@ -17,10 +17,99 @@ type ServeConn interface {
 	WriteTo(b []byte, addr net.Addr) (n int, err error)
 }
 
+// maxInFlight is how many packets are handled at once.  A handler may
+// block, for instance while it checks that an address is free before
+// offering it, so every packet is handled in its own goroutine rather
+// than holding up the ones behind it.  Once this many are being
+// handled, reading waits for one of them to finish.
+const maxInFlight = 64
+
+// parseRequest returns a copy of a packet read into a reused buffer,
+// along with its options and type, if it looks like a DHCP request.
+func parseRequest(b []byte) (Packet, Options, MessageType, bool) {
+	if len(b) < 240 { // Packet too small to be DHCP
+		return nil, nil, 0, false
+	}
+	req := Packet(append([]byte(nil), b...))
+	if req.HLen() > 16 { // Invalid size
+		return nil, nil, 0, false
+	}
+	options := req.ParseOptions()
+	t := options[OptionDHCPMessageType]
+	if len(t) != 1 {
+		return nil, nil, 0, false
+	}
+	reqType := MessageType(t[0])
+	if reqType < Discover || reqType > Inform {
+		return nil, nil, 0, false
+	}
+	return req, options, reqType, true
+}
+
+// replyTo passes a request that came from addr to handler, and writes
+// back its reply, if it has one.
+func replyTo(handler Handler, req Packet, reqType MessageType, options Options, addr net.Addr, write func([]byte, net.Addr) (int, error)) error {
+	res := handler.ServeDHCP(req, reqType, options)
+	if res == nil {
+		return nil
+	}
+	// If IP not available, broadcast
+	ipStr, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(ipStr).Equal(net.IPv4zero) || req.Broadcast() {
+		port, _ := strconv.Atoi(portStr)
+		addr = &net.UDPAddr{IP: net.IPv4bcast, Port: port}
+	}
+	_, err = write(res, addr)
+	return err
+}
+
+// inFlight tracks the packets being handled by a server.
+type inFlight struct {
+	slots  chan struct{}
+	failed chan error
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{
+		slots:  make(chan struct{}, maxInFlight),
+		failed: make(chan error, 1),
+	}
+}
+
+// run calls fn in a goroutine once fewer than maxInFlight are running.
+// The first error fn returns is kept for err.
+func (f *inFlight) run(fn func() error) {
+	f.slots <- struct{}{}
+	go func() {
+		defer func() { <-f.slots }()
+		if err := fn(); err != nil {
+			select {
+			case f.failed <- err:
+			default:
+			}
+		}
+	}()
+}
+
+// err returns an error from a packet that has been handled, if any.
+func (f *inFlight) err() error {
+	select {
+	case err := <-f.failed:
+		return err
+	default:
+		return nil
+	}
+}
+
 // Serve takes a ServeConn (such as a net.PacketConn) that it uses for both
 // reading and writing DHCP packets. Every packet is passed to the handler,
 // which processes it and optionally return a response packet for writing back
-// to the network.
+// to the network.  Packets are handled concurrently, so the handler must be
+// safe to call from several goroutines.  If a reply cannot be written, Serve
+// returns the error once the next packet has been read.
 //
 // To capture limited broadcast packets (sent to 255.255.255.255), you must
 // listen on a socket bound to IP_ADDRANY (0.0.0.0). This means that broadcast
@@ -32,43 +121,22 @@ type ServeConn interface {
 // or using ServeIf() can provide a workaround to this problem.
 func Serve(conn ServeConn, handler Handler) error {
 	buffer := make([]byte, 1500)
+	handling := newInFlight()
 	for {
 		n, addr, err := conn.ReadFrom(buffer)
 		if err != nil {
 			return err
 		}
-		if n < 240 { // Packet too small to be DHCP
-			continue
-		}
-		req := Packet(buffer[:n])
-		if req.HLen() > 16 { // Invalid size
-			continue
+		if err := handling.err(); err != nil {
+			return err
 		}
-		options := req.ParseOptions()
-		var reqType MessageType
-		if t := options[OptionDHCPMessageType]; len(t) != 1 {
+		req, options, reqType, ok := parseRequest(buffer[:n])
+		if !ok {
 			continue
-		} else {
-			reqType = MessageType(t[0])
-			if reqType < Discover || reqType > Inform {
-				continue
-			}
-		}
-		if res := handler.ServeDHCP(req, reqType, options); res != nil {
-			// If IP not available, broadcast
-			ipStr, portStr, err := net.SplitHostPort(addr.String())
-			if err != nil {
-				return err
-			}
-
-			if net.ParseIP(ipStr).Equal(net.IPv4zero) || req.Broadcast() {
-				port, _ := strconv.Atoi(portStr)
-				addr = &net.UDPAddr{IP: net.IPv4bcast, Port: port}
-			}
-			if _, e := conn.WriteTo(res, addr); e != nil {
-				return e
-			}
 		}
+		handling.run(func() error {
+			return replyTo(handler, req, reqType, options, addr, conn.WriteTo)
+		})
 	}
 }
 
@@ -0,0 +1,65 @@
+package dhcp
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// chanConn hands Serve the packets sent on in, and drops replies.
+type chanConn struct {
+	in chan []byte
+}
+
+func (c *chanConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	p, ok := <-c.in
+	if !ok {
+		return 0, nil, errors.New("closed")
+	}
+	return copy(b, p), &net.UDPAddr{IP: net.IPv4zero, Port: 68}, nil
+}
+
+func (c *chanConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return len(b), nil
+}
+
+// blockingHandler holds up packets from one client until released.
+type blockingHandler struct {
+	slow    net.HardwareAddr
+	release chan struct{}
+	done    chan string
+}
+
+func (h *blockingHandler) ServeDHCP(req Packet, msgType MessageType, options Options) Packet {
+	if req.CHAddr().String() == h.slow.String() {
+		<-h.release
+	}
+	h.done <- req.CHAddr().String()
+	return ReplyPacket(req, Offer, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, time.Hour, nil)
+}
+
+func TestServeConcurrent(t *testing.T) {
+	slow := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	fast := net.HardwareAddr{1, 2, 3, 4, 5, 7}
+	h := &blockingHandler{slow: slow, release: make(chan struct{}), done: make(chan string, 2)}
+	conn := &chanConn{in: make(chan []byte)}
+	go Serve(conn, h)
+
+	discover := []Option{{Code: OptionDHCPMessageType, Value: []byte{byte(Discover)}}}
+	conn.in <- RequestPacket(Discover, slow, nil, []byte{1, 1, 1, 1}, true, discover)
+	conn.in <- RequestPacket(Discover, fast, nil, []byte{2, 2, 2, 2}, true, discover)
+	select {
+	case mac := <-h.done:
+		if mac != fast.String() {
+			t.Errorf("Expected %s to be answered first, but got %s", fast, mac)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a packet to be handled while another one is blocked")
+	}
+	close(h.release)
+	if mac := <-h.done; mac != slow.String() {
+		t.Errorf("Expected %s to be answered once released, but got %s", slow, mac)
+	}
+	close(conn.in)
+}
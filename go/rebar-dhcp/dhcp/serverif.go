@@ -2,7 +2,6 @@ package dhcp
 
 import (
 	"net"
-	"strconv"
 
 	"golang.org/x/net/ipv4"
 )
@@ -10,83 +9,53 @@ import (
 type serveIfConn struct {
 	handlers map[int]Handler
 	conn     *ipv4.PacketConn
-	cm       *ipv4.ControlMessage
 }
 
-func (s *serveIfConn) ReadFrom(b []byte) (n int, addr net.Addr, handler Handler, err error) {
-	n, s.cm, addr, err = s.conn.ReadFrom(b)
-	if s.cm != nil {
-		var ok bool
-		handler, ok = s.handlers[s.cm.IfIndex]
-		if !ok {
-			n = 0 // Packets < 240 are filtered in Serve().
-		}
+// ReadFrom reads a packet, and returns the handler for the interface
+// it came in on along with the control message to reply with.
+func (s *serveIfConn) ReadFrom(b []byte) (n int, addr net.Addr, handler Handler, cm *ipv4.ControlMessage, err error) {
+	n, cm, addr, err = s.conn.ReadFrom(b)
+	if cm != nil {
+		handler = s.handlers[cm.IfIndex]
+	}
+	if handler == nil {
+		n = 0 // Packets < 240 are filtered in ServeIf2().
 	}
 	return
 }
 
-func (s *serveIfConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+func (s *serveIfConn) WriteTo(b []byte, cm *ipv4.ControlMessage, addr net.Addr) (n int, err error) {
 
 	// ipv4 docs state that Src is "specify only", however testing by tfheen
 	// shows that Src IS populated.  Therefore, to reuse the control message,
 	// we set Src to nil to avoid the error "write udp4: invalid argument"
-	s.cm.Src = nil
+	cm.Src = nil
 
-	return s.conn.WriteTo(b, s.cm, addr)
+	return s.conn.WriteTo(b, cm, addr)
 }
 
-// Serve takes a ServeConn (such as a net.PacketConn) that it uses for both
-// reading and writing DHCP packets. Every packet is passed to the handler,
-// which processes it and optionally return a response packet for writing back
-// to the network.
-//
-// To capture limited broadcast packets (sent to 255.255.255.255), you must
-// listen on a socket bound to IP_ADDRANY (0.0.0.0). This means that broadcast
-// packets sent to any interface on the system may be delivered to this
-// socket.  See: https://code.google.com/p/go/issues/detail?id=7106
-//
-// Additionally, response packets may not return to the same
-// interface that the request was received from.  Writing a custom ServeConn,
-// or using ServeIf() can provide a workaround to this problem.
+// ServeIf2 is Serve for a serveIfConn, handing each packet to the
+// handler for the interface it came in on.
 func ServeIf2(conn *serveIfConn) error {
 	buffer := make([]byte, 1500)
+	handling := newInFlight()
 	for {
-		n, addr, handler, err := conn.ReadFrom(buffer)
+		n, addr, handler, cm, err := conn.ReadFrom(buffer)
 		if err != nil {
 			return err
 		}
-		if n < 240 { // Packet too small to be DHCP
-			continue
-		}
-		req := Packet(buffer[:n])
-		if req.HLen() > 16 { // Invalid size
-			continue
+		if err := handling.err(); err != nil {
+			return err
 		}
-		options := req.ParseOptions()
-		var reqType MessageType
-		if t := options[OptionDHCPMessageType]; len(t) != 1 {
+		req, options, reqType, ok := parseRequest(buffer[:n])
+		if !ok {
 			continue
-		} else {
-			reqType = MessageType(t[0])
-			if reqType < Discover || reqType > Inform {
-				continue
-			}
-		}
-		if res := handler.ServeDHCP(req, reqType, options); res != nil {
-			// If IP not available, broadcast
-			ipStr, portStr, err := net.SplitHostPort(addr.String())
-			if err != nil {
-				return err
-			}
-
-			if net.ParseIP(ipStr).Equal(net.IPv4zero) || req.Broadcast() {
-				port, _ := strconv.Atoi(portStr)
-				addr = &net.UDPAddr{IP: net.IPv4bcast, Port: port}
-			}
-			if _, e := conn.WriteTo(res, addr); e != nil {
-				return e
-			}
 		}
+		handling.run(func() error {
+			return replyTo(handler, req, reqType, options, addr, func(b []byte, addr net.Addr) (int, error) {
+				return conn.WriteTo(b, cm, addr)
+			})
+		})
 	}
 }
 
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// importedLease is a lease read from another DHCP server's lease
+// file.  Reservations are imported as bindings.
+type importedLease struct {
+	Ip         net.IP
+	Mac        string
+	ExpireTime time.Time
+	Static     bool
+}
+
+// ImportResult reports what happened when importing a lease file.
+type ImportResult struct {
+	Leases    int      `json:"leases"`
+	Bindings  int      `json:"bindings"`
+	Expired   int      `json:"expired"`
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+// parseLeases reads a lease file in the passed format.  Supported
+// formats are "isc" (dhcpd.leases) and "dnsmasq".
+func parseLeases(format string, r io.Reader) ([]*importedLease, error) {
+	switch format {
+	case "isc", "":
+		return parseIscLeases(r)
+	case "dnsmasq":
+		return parseDnsmasqLeases(r)
+	}
+	return nil, fmt.Errorf("Unknown lease file format %s", format)
+}
+
+// leaseNever is the expire time given to dynamic leases that never
+// end.  They are kept until the client asks for the address again, and
+// then get the subnet's lease time like any other.
+var leaseNever = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+
+// parseIscTime parses the time part of a starts/ends statement.
+// dhcpd writes either "W YYYY/MM/DD HH:MM:SS" in UTC, "epoch N", or
+// "never".
+func parseIscTime(fields []string) (time.Time, bool, error) {
+	switch {
+	case len(fields) == 1 && fields[0] == "never":
+		return time.Time{}, true, nil
+	case len(fields) == 2 && fields[0] == "epoch":
+		secs, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		return time.Unix(secs, 0), false, nil
+	case len(fields) == 3:
+		t, err := time.Parse("2006/01/02 15:04:05", fields[1]+" "+fields[2])
+		return t, false, err
+	}
+	return time.Time{}, false, fmt.Errorf("Invalid time %s", strings.Join(fields, " "))
+}
+
+// parseIscLeases reads an ISC dhcpd.leases file.  The file is a log,
+// so later entries for an address replace earlier ones.  Only leases
+// whose binding state is active (or unset) are returned.  Leases
+// marked reserved are static; the rest are dynamic, even if they never
+// end.
+func parseIscLeases(r io.Reader) ([]*importedLease, error) {
+	res := []*importedLease{}
+	byIp := map[string]int{}
+	var cur *importedLease
+	active := true
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i != -1 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		if cur == nil {
+			fields := strings.Fields(text)
+			if len(fields) == 3 && fields[0] == "lease" && fields[2] == "{" {
+				ip := net.ParseIP(fields[1]).To4()
+				if ip == nil {
+					return nil, fmt.Errorf("Line %d: invalid lease address %s", line, fields[1])
+				}
+				cur = &importedLease{Ip: ip}
+				active = true
+			}
+			continue
+		}
+		if text == "}" {
+			if active && cur.Mac != "" {
+				if i, found := byIp[cur.Ip.String()]; found {
+					res[i] = cur
+				} else {
+					byIp[cur.Ip.String()] = len(res)
+					res = append(res, cur)
+				}
+			} else if i, found := byIp[cur.Ip.String()]; found && !active {
+				// A later entry freed the address.
+				res[i] = nil
+				delete(byIp, cur.Ip.String())
+			}
+			cur = nil
+			continue
+		}
+		fields := strings.Fields(strings.TrimSuffix(text, ";"))
+		if len(fields) == 0 {
+			continue
+		}
+		switch {
+		case fields[0] == "ends":
+			t, never, err := parseIscTime(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: %v", line, err)
+			}
+			if never {
+				t = leaseNever
+			}
+			cur.ExpireTime = t
+		case fields[0] == "reserved" && len(fields) == 1:
+			cur.Static = true
+		case fields[0] == "hardware" && len(fields) == 3:
+			mac, err := net.ParseMAC(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: %v", line, err)
+			}
+			cur.Mac = strings.ToLower(mac.String())
+		case fields[0] == "binding" && len(fields) == 3 && fields[1] == "state":
+			active = fields[2] == "active"
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if cur != nil {
+		return nil, errors.New("Unterminated lease block")
+	}
+	leases := make([]*importedLease, 0, len(res))
+	for _, l := range res {
+		if l != nil {
+			leases = append(leases, l)
+		}
+	}
+	return leases, nil
+}
+
+// parseDnsmasqLeases reads a dnsmasq.leases file, which has one lease
+// per line: expiry mac ip hostname client-id.  An expiry of 0 means
+// the lease never expires.
+func parseDnsmasqLeases(r io.Reader) ([]*importedLease, error) {
+	res := []*importedLease{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		// dnsmasq also writes DHCPv6 leases and a duid line to the
+		// same file.  We only care about IPv4.
+		if len(fields) < 3 || fields[0] == "duid" {
+			continue
+		}
+		ip := net.ParseIP(fields[2]).To4()
+		if ip == nil {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: invalid expiry %s", line, fields[0])
+		}
+		mac, err := net.ParseMAC(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", line, err)
+		}
+		l := &importedLease{
+			Ip:  ip,
+			Mac: strings.ToLower(mac.String()),
+		}
+		if expiry == 0 {
+			l.Static = true
+		} else {
+			l.ExpireTime = time.Unix(expiry, 0)
+		}
+		res = append(res, l)
+	}
+	return res, scanner.Err()
+}
+
+// ImportLeases adds leases read from another DHCP server to the named
+// subnet.  Static leases become bindings.  Leases that are
+// outside the subnet, that are dynamic but outside the subnet's pools,
+// or that would take an address already in use are skipped and
+// reported as conflicts.
+func (dt *DataTracker) ImportLeases(subnetName string, leases []*importedLease) (*ImportResult, error, int) {
+	lsubnet := dt.Subnets[subnetName]
+	if lsubnet == nil {
+		return nil, errors.New("Not Found"), http.StatusNotFound
+	}
+	res := &ImportResult{Conflicts: []string{}}
+	inUse := func(ip net.IP, mac string) bool {
+		for k, l := range lsubnet.Leases {
+			if l.Ip.Equal(ip) && k != mac {
+				return true
+			}
+		}
+		for _, b := range lsubnet.Bindings {
+			if b.Ip.Equal(ip) && b.Mac != mac {
+				return true
+			}
+		}
+		return false
+	}
+	for _, l := range leases {
+		switch {
+		case !lsubnet.Subnet.Contains(l.Ip):
+			res.Conflicts = append(res.Conflicts,
+				fmt.Sprintf("%s (%s) is not in subnet %s", l.Ip, l.Mac, lsubnet.Subnet))
+			continue
+		case !l.Static && time.Now().After(l.ExpireTime):
+			res.Expired++
+			continue
+		case !l.Static && !lsubnet.InRange(l.Ip):
+			res.Conflicts = append(res.Conflicts,
+				fmt.Sprintf("%s (%s) is outside the active range %s - %s", l.Ip, l.Mac, lsubnet.ActiveStart, lsubnet.ActiveEnd))
+			continue
+		case inUse(l.Ip, l.Mac):
+			res.Conflicts = append(res.Conflicts,
+				fmt.Sprintf("%s (%s) is already in use", l.Ip, l.Mac))
+			continue
+		}
+		if l.Static {
+			lsubnet.Bindings[l.Mac] = &Binding{Ip: l.Ip, Mac: l.Mac}
+			res.Bindings++
+			continue
+		}
+		lsubnet.Leases[l.Mac] = &Lease{
+			Ip:         l.Ip,
+			Mac:        l.Mac,
+			Valid:      true,
+			ExpireTime: l.ExpireTime,
+		}
+		res.Leases++
+	}
+	dt.save_data()
+	return res, nil, http.StatusOK
+}
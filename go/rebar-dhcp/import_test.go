@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const iscLeases = `# The format of this file is documented in the dhcpd.leases(5) manual page.
+# This lease file was written by isc-dhcp-4.3.3
+
+lease 192.168.128.10 {
+  starts 4 2016/09/01 12:00:00;
+  ends 4 2016/09/01 13:00:00;
+  binding state active;
+  hardware ethernet 00:11:22:33:44:55;
+}
+lease 192.168.128.11 {
+  starts 4 2016/09/01 12:00:00;
+  ends never;
+  binding state active;
+  next binding state free;
+  hardware ethernet 00:11:22:33:44:66;
+  client-hostname "static";
+}
+lease 192.168.128.12 {
+  starts 4 2016/09/01 12:00:00;
+  ends epoch 4102444800; # Fri Jan 01 00:00:00 2100
+  binding state active;
+  hardware ethernet 00:11:22:33:44:77;
+}
+lease 192.168.128.12 {
+  starts 4 2016/09/01 12:30:00;
+  ends epoch 4102444800;
+  binding state free;
+  hardware ethernet 00:11:22:33:44:77;
+}
+lease 192.168.128.13 {
+  starts 4 2016/09/01 12:00:00;
+  ends 5 2099/12/31 23:00:00;
+  binding state active;
+  hardware ethernet 00:11:22:33:44:88;
+}
+lease 192.168.128.14 {
+  starts 4 2016/09/01 12:00:00;
+  ends never;
+  ;
+  binding state active;
+  hardware ethernet 00:11:22:33:44:99;
+  reserved;
+}
+`
+
+const dnsmasqLeases = `4102444800 00:11:22:33:44:55 192.168.128.10 node1 01:00:11:22:33:44:55
+0 00:11:22:33:44:66 192.168.128.200 node2 *
+1472731200 00:11:22:33:44:77 192.168.128.12 * *
+duid 00:01:00:01:1f:2e:3d:4c:00:11:22:33:44:55
+4102444800 1234 00:11:22:33:44:99 fe80::1 node3 00:01:00:01
+`
+
+func TestParseIscLeases(t *testing.T) {
+	leases, err := parseLeases("isc", strings.NewReader(iscLeases))
+
+	assert.Nil(t, err, "Error should be nil")
+	assert.Equal(t, len(leases), 4, "There should be 4 leases, but there are %d", len(leases))
+
+	assert.Equal(t, leases[0].Ip.String(), "192.168.128.10", "First lease should be 192.168.128.10")
+	assert.Equal(t, leases[0].Mac, "00:11:22:33:44:55", "First lease mac should be 00:11:22:33:44:55")
+	assert.Equal(t, leases[0].ExpireTime, time.Date(2016, 9, 1, 13, 0, 0, 0, time.UTC), "First lease expire time should be preserved")
+	assert.False(t, leases[0].Static, "First lease should not be static")
+
+	assert.Equal(t, leases[1].Ip.String(), "192.168.128.11", "Second lease should be 192.168.128.11")
+	assert.False(t, leases[1].Static, "Dynamic lease that never ends should not be static")
+	assert.Equal(t, leases[1].ExpireTime, leaseNever, "Lease that never ends should not expire")
+
+	assert.Equal(t, leases[2].Ip.String(), "192.168.128.13", "Freed lease should be dropped")
+
+	assert.Equal(t, leases[3].Ip.String(), "192.168.128.14", "Fourth lease should be 192.168.128.14")
+	assert.True(t, leases[3].Static, "Reserved lease should be static")
+}
+
+func TestParseIscLeasesBad(t *testing.T) {
+	_, err := parseLeases("isc", strings.NewReader("lease 192.168.128.10 {\n  ends 4 2016/09/01;\n}\n"))
+	assert.NotNil(t, err, "Bad time should fail")
+
+	_, err = parseLeases("isc", strings.NewReader("lease 192.168.128.10 {\n  hardware ethernet 00:11:22:33:44:55;\n"))
+	assert.NotNil(t, err, "Unterminated block should fail")
+
+	_, err = parseLeases("dhcpcd", strings.NewReader(""))
+	assert.NotNil(t, err, "Unknown format should fail")
+}
+
+func TestParseDnsmasqLeases(t *testing.T) {
+	leases, err := parseLeases("dnsmasq", strings.NewReader(dnsmasqLeases))
+
+	assert.Nil(t, err, "Error should be nil")
+	assert.Equal(t, len(leases), 3, "There should be 3 leases, but there are %d", len(leases))
+	assert.Equal(t, leases[0].ExpireTime, time.Unix(4102444800, 0), "Expire time should be preserved")
+	assert.True(t, leases[1].Static, "Lease with expiry 0 should be static")
+	assert.Equal(t, leases[2].Mac, "00:11:22:33:44:77", "Third lease mac should be 00:11:22:33:44:77")
+}
+
+func TestImportLeasesMissing(t *testing.T) {
+	dt, _ := simpleSetup()
+
+	_, err, code := dt.ImportLeases("fred2", nil)
+	assert.Equal(t, code, http.StatusNotFound, "Return code should be not found, but is %d", code)
+	assert.NotNil(t, err, "Error should not be nil")
+}
+
+func TestImportLeases(t *testing.T) {
+	dt, s := simpleSetup()
+
+	s.Leases["00:11:22:33:44:aa"] = &Lease{
+		Ip:         net.ParseIP("192.168.128.20").To4(),
+		Mac:        "00:11:22:33:44:aa",
+		Valid:      true,
+		ExpireTime: time.Now().Add(time.Hour),
+	}
+	future := time.Now().Add(time.Hour)
+	leases := []*importedLease{
+		{Ip: net.ParseIP("192.168.128.10").To4(), Mac: "00:11:22:33:44:55", ExpireTime: future},
+		{Ip: net.ParseIP("192.168.128.200").To4(), Mac: "00:11:22:33:44:66", Static: true},
+		{Ip: net.ParseIP("192.168.128.11").To4(), Mac: "00:11:22:33:44:77", ExpireTime: time.Now().Add(-time.Hour)},
+		{Ip: net.ParseIP("192.168.128.100").To4(), Mac: "00:11:22:33:44:88", ExpireTime: future},
+		{Ip: net.ParseIP("192.168.129.10").To4(), Mac: "00:11:22:33:44:99", ExpireTime: future},
+		{Ip: net.ParseIP("192.168.128.20").To4(), Mac: "00:11:22:33:44:bb", ExpireTime: future},
+		{Ip: net.ParseIP("192.168.128.12").To4(), Mac: "00:11:22:33:44:cc", ExpireTime: leaseNever},
+	}
+
+	res, err, code := dt.ImportLeases("fred", leases)
+	assert.Nil(t, err, "Error should be nil")
+	assert.Equal(t, code, http.StatusOK, "Return code should be ok, but is %d", code)
+	assert.Equal(t, res.Leases, 2, "Two leases should be imported")
+	assert.Equal(t, res.Bindings, 1, "One binding should be imported")
+	assert.Equal(t, res.Expired, 1, "One lease should have expired")
+	assert.Equal(t, len(res.Conflicts), 3, "There should be 3 conflicts: %v", res.Conflicts)
+
+	assert.Equal(t, s.Leases["00:11:22:33:44:55"].ExpireTime, future, "Expire time should be preserved")
+	assert.NotNil(t, s.Bindings["00:11:22:33:44:66"], "Static lease should be a binding")
+	assert.NotNil(t, s.Leases["00:11:22:33:44:cc"], "Lease that never ends should be a lease")
+	assert.Nil(t, s.Bindings["00:11:22:33:44:cc"], "Lease that never ends should not be a binding")
+	assert.Nil(t, s.Leases["00:11:22:33:44:88"], "Lease outside the active range should be skipped")
+	assert.Nil(t, s.Leases["00:11:22:33:44:bb"], "Lease on an address in use should be skipped")
+}
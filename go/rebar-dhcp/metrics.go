@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
+)
+
+// labelString renders label names and values as {name="value",...}.
+func labelString(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i := range names {
+		parts[i] = fmt.Sprintf("%s=%q", names[i], values[i])
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+type counter struct {
+	values []string
+	n      uint64
+}
+
+// counterVec is a set of counters that share a name and are told
+// apart by the values of their labels.  It is written out in the
+// Prometheus text format.
+type counterVec struct {
+	sync.RWMutex
+	name     string
+	help     string
+	labels   []string
+	counters map[string]*counter
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:     name,
+		help:     help,
+		labels:   labels,
+		counters: make(map[string]*counter),
+	}
+}
+
+// with returns the counter for values, creating it if needed.
+func (c *counterVec) with(values ...string) *counter {
+	key := strings.Join(values, "\xff")
+	c.RLock()
+	cnt := c.counters[key]
+	c.RUnlock()
+	if cnt != nil {
+		return cnt
+	}
+	c.Lock()
+	defer c.Unlock()
+	if cnt = c.counters[key]; cnt == nil {
+		cnt = &counter{values: values}
+		c.counters[key] = cnt
+	}
+	return cnt
+}
+
+func (c *counterVec) Inc(values ...string) {
+	atomic.AddUint64(&c.with(values...).n, 1)
+}
+
+func (c *counterVec) Get(values ...string) uint64 {
+	c.RLock()
+	defer c.RUnlock()
+	if cnt := c.counters[strings.Join(values, "\xff")]; cnt != nil {
+		return atomic.LoadUint64(&cnt.n)
+	}
+	return 0
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.writeMatching(w, func([]string) bool { return true })
+}
+
+// writeMatching writes the counters whose label values keep accepts.
+func (c *counterVec) writeMatching(w io.Writer, keep func(values []string) bool) {
+	c.RLock()
+	defer c.RUnlock()
+	keys := make([]string, 0, len(c.counters))
+	for k, cnt := range c.counters {
+		if keep(cnt.values) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, k := range keys {
+		cnt := c.counters[k]
+		fmt.Fprintf(w, "%s%s %d\n", c.name, labelString(c.labels, cnt.values), atomic.LoadUint64(&cnt.n))
+	}
+}
+
+// histogram counts observations into buckets by their upper bound.
+type histogram struct {
+	sync.Mutex
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(name, help string, buckets ...float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, b, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", h.name, h.sum, h.name, h.count)
+}
+
+// gaugeVec is a set of gauges that is filled in each time metrics are
+// written out.
+type gaugeVec struct {
+	name    string
+	help    string
+	labels  []string
+	samples []*gaugeSample
+}
+
+type gaugeSample struct {
+	values []string
+	v      float64
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	return &gaugeVec{name: name, help: help, labels: labels}
+}
+
+func (g *gaugeVec) Set(v float64, values ...string) {
+	g.samples = append(g.samples, &gaugeSample{values: values, v: v})
+}
+
+func (g *gaugeVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, s := range g.samples {
+		fmt.Fprintf(w, "%s%s %g\n", g.name, labelString(g.labels, s.values), s.v)
+	}
+}
+
+var droppedPackets = func() *counterVec {
+	c := newCounterVec("rebar_dhcp_dropped_packets_total",
+		"DHCP packets dropped before they were processed.",
+		"reason")
+	for _, r := range []string{"unknown_client", "relay_rate", "mac_rate"} {
+		c.with(r)
+	}
+	return c
+}()
+
+var receivedPackets = newCounterVec("rebar_dhcp_packets_total",
+	"DHCP packets received, by message type.",
+	"type")
+
+var sentReplies = newCounterVec("rebar_dhcp_replies_total",
+	"DHCP replies sent, by subnet and message type.",
+	"subnet", "type")
+
+var handlerLatency = newHistogram("rebar_dhcp_handler_seconds",
+	"Time taken to handle a DHCP packet, including waiting for the config lock.",
+	.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1)
+
+// Lease states reported by rebar_dhcp_leases.
+const (
+	leaseActive   = "active"
+	leaseExpired  = "expired"
+	leaseInvalid  = "invalid"
+	leaseDeclined = "declined"
+)
+
+func (l *Lease) state(now time.Time) string {
+	switch {
+	case l.Phantom():
+		return leaseDeclined
+	case now.After(l.ExpireTime):
+		return leaseExpired
+	case !l.Valid:
+		return leaseInvalid
+	default:
+		return leaseActive
+	}
+}
+
+func messageTypeLabel(t dhcp.MessageType) string {
+	return strings.ToLower(t.String())
+}
+
+// observe records what happened to a packet that ServeDHCP processed.
+func observe(subnet string, reply dhcp.Packet, start time.Time) {
+	handlerLatency.Observe(time.Since(start).Seconds())
+	if reply == nil {
+		return
+	}
+	if t := reply.ParseOptions()[dhcp.OptionDHCPMessageType]; len(t) == 1 {
+		sentReplies.Inc(subnet, messageTypeLabel(dhcp.MessageType(t[0])))
+	}
+}
+
+// subnetGauges works out the pool and lease gauges from the readable
+// subnets.  The caller must hold the DataTracker lock.
+func (dt *DataTracker) subnetGauges(readable map[string]bool) []*gaugeVec {
+	poolSize := newGaugeVec("rebar_dhcp_pool_addresses",
+		"Addresses in each pool.",
+		"subnet", "pool")
+	poolUsed := newGaugeVec("rebar_dhcp_pool_used_addresses",
+		"Addresses in each pool that are leased, bound, excluded or quarantined.",
+		"subnet", "pool")
+	leases := newGaugeVec("rebar_dhcp_leases",
+		"Leases by subnet and state.",
+		"subnet", "state")
+	names := make([]string, 0, len(dt.Subnets))
+	for name := range dt.Subnets {
+		if readable[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	now := time.Now()
+	for _, name := range names {
+		s := dt.Subnets[name]
+		for _, p := range s.allPools() {
+			label := p.Start.String() + "-" + p.End.String()
+			poolSize.Set(float64(dhcp.IPRange(p.Start, p.End)), name, label)
+			poolUsed.Set(float64(s.poolUsage(p).Count()), name, label)
+		}
+		counts := map[string]int{}
+		for _, l := range s.Leases {
+			counts[l.state(now)]++
+		}
+		for _, state := range []string{leaseActive, leaseExpired, leaseInvalid, leaseDeclined} {
+			leases.Set(float64(counts[state]), name, state)
+		}
+	}
+	return []*gaugeVec{poolSize, poolUsed, leases}
+}
+
+// writeMetrics writes all of the metrics we keep.  Metrics about a
+// subnet are only written if canRead allows it, so that tenants only
+// see their own subnets.  Replies counted against subnets that have
+// since been deleted are left out, as their tenant is not known.
+func writeMetrics(w io.Writer, dt *DataTracker, canRead func(*Subnet) bool) {
+	dt.Lock()
+	readable := map[string]bool{}
+	for name, s := range dt.Subnets {
+		readable[name] = canRead(s)
+	}
+	gauges := dt.subnetGauges(readable)
+	dt.Unlock()
+	receivedPackets.write(w)
+	droppedPackets.write(w)
+	sentReplies.writeMatching(w, func(values []string) bool {
+		return values[0] == "" || readable[values[0]]
+	})
+	handlerLatency.write(w)
+	for _, g := range gauges {
+		g.write(w)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterVecWrite(t *testing.T) {
+	c := newCounterVec("test_total", "A test counter.", "subnet", "type")
+	c.Inc("fred", "offer")
+	c.Inc("fred", "offer")
+	c.Inc("bob", "nak")
+	buf := &bytes.Buffer{}
+	c.write(buf)
+	assert.Equal(t, buf.String(), `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{subnet="bob",type="nak"} 1
+test_total{subnet="fred",type="offer"} 2
+`)
+}
+
+func TestHistogramWrite(t *testing.T) {
+	h := newHistogram("test_seconds", "A test histogram.", .1, 1)
+	h.Observe(.05)
+	h.Observe(.5)
+	h.Observe(2)
+	buf := &bytes.Buffer{}
+	h.write(buf)
+	assert.Equal(t, buf.String(), `# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 2.55
+test_seconds_count 3
+`)
+}
+
+func readAll(*Subnet) bool { return true }
+
+func TestServeDHCPMetrics(t *testing.T) {
+	dt, s := simpleSetup()
+	s.ActiveLeaseTime = time.Minute
+	h := &DHCPHandler{ip: net.ParseIP("192.168.128.1").To4(), info: dt}
+	s.Leases["00:53:00:00:00:01"] = &Lease{
+		Ip:         net.ParseIP("192.168.128.20").To4(),
+		Mac:        "00:53:00:00:00:01",
+		ExpireTime: time.Now().Add(30 * time.Second),
+	}
+	s.Leases["aa:bb:cc:dd:ee:01"] = &Lease{
+		Ip:         net.ParseIP("192.168.128.21").To4(),
+		Mac:        "aa:bb:cc:dd:ee:01",
+		Valid:      true,
+		ExpireTime: time.Now().Add(-time.Second),
+	}
+
+	discovers := receivedPackets.Get("discover")
+	offers := sentReplies.Get("fred", "offer")
+	p := dhcp.RequestPacket(dhcp.Discover, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}, nil, []byte{1, 2, 3, 4}, false, nil)
+	p.SetGIAddr(net.ParseIP("192.168.128.254"))
+	reply := h.ServeDHCP(p, dhcp.Discover, p.ParseOptions())
+	assert.NotNil(t, reply, "Discover should get an offer")
+	assert.Equal(t, receivedPackets.Get("discover"), discovers+1, "Discover should be counted")
+	assert.Equal(t, sentReplies.Get("fred", "offer"), offers+1, "Offer should be counted against fred")
+
+	buf := &bytes.Buffer{}
+	writeMetrics(buf, dt, readAll)
+	out := buf.String()
+	for _, line := range []string{
+		`rebar_dhcp_pool_addresses{subnet="fred",pool="192.168.128.5-192.168.128.25"} 21`,
+		// The new lease and the declined one.  The expired lease
+		// could be handed out again.
+		`rebar_dhcp_pool_used_addresses{subnet="fred",pool="192.168.128.5-192.168.128.25"} 2`,
+		`rebar_dhcp_leases{subnet="fred",state="active"} 1`,
+		`rebar_dhcp_leases{subnet="fred",state="declined"} 1`,
+		`rebar_dhcp_leases{subnet="fred",state="invalid"} 0`,
+		`rebar_dhcp_handler_seconds_count `,
+	} {
+		assert.True(t, strings.Contains(out, line), "Metrics should contain %s:\n%s", line, out)
+	}
+}
+
+func TestMetricsTenants(t *testing.T) {
+	dt, s := simpleSetup()
+	other := &Subnet{Name: "bob", TenantId: 2}
+	dt.Subnets["bob"] = other
+	s.TenantId = 1
+	sentReplies.Inc("fred", "offer")
+	sentReplies.Inc("bob", "offer")
+	sentReplies.Inc("gone", "offer")
+
+	buf := &bytes.Buffer{}
+	writeMetrics(buf, dt, func(s *Subnet) bool { return s.TenantId == 1 })
+	out := buf.String()
+	assert.True(t, strings.Contains(out, `rebar_dhcp_replies_total{subnet="fred",type="offer"}`), "Readable subnet should be shown:\n%s", out)
+	assert.True(t, strings.Contains(out, `rebar_dhcp_leases{subnet="fred",state="active"}`), "Readable subnet gauges should be shown:\n%s", out)
+	assert.False(t, strings.Contains(out, `subnet="bob"`), "Other tenant's subnet should be hidden:\n%s", out)
+	assert.False(t, strings.Contains(out, `subnet="gone"`), "Deleted subnet should be hidden:\n%s", out)
+	assert.True(t, strings.Contains(out, `rebar_dhcp_packets_total`), "Packet counters should be shown:\n%s", out)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
+)
+
+// OptionDef says how to render the value of a DHCP option.  Vendor
+// options can define the types of their sub-options.
+type OptionDef struct {
+	Code       dhcp.OptionCode `json:"code"`
+	Name       string          `json:"name,omitempty"`
+	Type       string          `json:"type"`
+	SubOptions []*OptionDef    `json:"sub_options,omitempty"`
+	Builtin    bool            `json:"builtin,omitempty"`
+	TenantId   int             `json:"tenant_id"`
+}
+
+// Options that the server fills in itself and that cannot be
+// redefined.
+var reservedOptions = map[dhcp.OptionCode]bool{
+	dhcp.Pad:                         true,
+	dhcp.End:                         true,
+	dhcp.OptionIPAddressLeaseTime:    true,
+	dhcp.OptionDHCPMessageType:       true,
+	dhcp.OptionServerIdentifier:      true,
+	dhcp.OptionParameterRequestList:  true,
+	dhcp.OptionRenewalTimeValue:      true,
+	dhcp.OptionRebindingTimeValue:    true,
+	dhcp.OptionRelayAgentInformation: true,
+}
+
+func (d *OptionDef) validate(sub bool) error {
+	if _, ok := optionCodecs[d.Type]; !ok {
+		return fmt.Errorf("Option %d: unknown type %s", d.Code, d.Type)
+	}
+	if sub {
+		if d.Type == OptionTypeVendor {
+			return fmt.Errorf("Sub-option %d cannot be a vendor option", d.Code)
+		}
+		return nil
+	}
+	if reservedOptions[d.Code] {
+		return fmt.Errorf("Option %d is managed by the server and cannot be redefined", d.Code)
+	}
+	if len(d.SubOptions) > 0 && d.Type != OptionTypeVendor {
+		return fmt.Errorf("Option %d: only vendor options can have sub-options", d.Code)
+	}
+	seen := map[dhcp.OptionCode]bool{}
+	for _, s := range d.SubOptions {
+		if seen[s.Code] {
+			return fmt.Errorf("Option %d: duplicate sub-option %d", d.Code, s.Code)
+		}
+		seen[s.Code] = true
+		if err := s.validate(true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *OptionDef) subOption(code dhcp.OptionCode) *OptionDef {
+	for _, s := range d.SubOptions {
+		if s.Code == code {
+			return s
+		}
+	}
+	return &OptionDef{Code: code, Type: OptionTypeHex}
+}
+
+// Encode renders value to the bytes that go in a packet.
+func (d *OptionDef) Encode(value string) ([]byte, error) {
+	codec, ok := optionCodecs[d.Type]
+	if !ok {
+		return nil, fmt.Errorf("Option %d: unknown type %s", d.Code, d.Type)
+	}
+	b, err := codec.encode(d, value)
+	if err != nil {
+		return nil, fmt.Errorf("Option %d: %v", d.Code, err)
+	}
+	return b, nil
+}
+
+// Decode renders bytes from a packet as a string.  Values that do not
+// fit the type are rendered as hex.
+func (d *OptionDef) Decode(b []byte) string {
+	if codec, ok := optionCodecs[d.Type]; ok {
+		if s, ok := codec.decode(d, b); ok {
+			return s
+		}
+	}
+	s, _ := decodeHex(d, b)
+	return s
+}
+
+// OptionRegistry holds the built-in option definitions along with
+// any custom ones registered through the API.  Custom definitions
+// win over built-in ones.
+type OptionRegistry struct {
+	sync.RWMutex
+	builtin map[dhcp.OptionCode]*OptionDef
+	custom  map[dhcp.OptionCode]*OptionDef
+}
+
+func NewOptionRegistry() *OptionRegistry {
+	r := &OptionRegistry{
+		builtin: make(map[dhcp.OptionCode]*OptionDef),
+		custom:  make(map[dhcp.OptionCode]*OptionDef),
+	}
+	for code, t := range builtinOptionDefs {
+		r.builtin[code] = &OptionDef{Code: code, Name: code.String(), Type: t, Builtin: true}
+	}
+	for _, d := range builtinEncapsulatedDefs() {
+		d.Builtin = true
+		r.builtin[d.Code] = d
+	}
+	return r
+}
+
+var optionDefs = NewOptionRegistry()
+
+func (r *OptionRegistry) Find(code dhcp.OptionCode) *OptionDef {
+	r.RLock()
+	defer r.RUnlock()
+	if d := r.custom[code]; d != nil {
+		return d
+	}
+	return r.builtin[code]
+}
+
+// IsBuiltin says whether the server has its own definition of code.
+// Redefining it changes how every tenant's subnets encode the option.
+func (r *OptionRegistry) IsBuiltin(code dhcp.OptionCode) bool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.builtin[code] != nil
+}
+
+// SetCustom replaces all of the custom definitions.
+func (r *OptionRegistry) SetCustom(defs []*OptionDef) {
+	r.Lock()
+	defer r.Unlock()
+	r.custom = make(map[dhcp.OptionCode]*OptionDef)
+	for _, d := range defs {
+		r.custom[d.Code] = d
+	}
+}
+
+// All returns every definition in code order.
+func (r *OptionRegistry) All() []*OptionDef {
+	r.RLock()
+	defer r.RUnlock()
+	res := make([]*OptionDef, 0, len(r.builtin)+len(r.custom))
+	for code, d := range r.builtin {
+		if _, found := r.custom[code]; !found {
+			res = append(res, d)
+		}
+	}
+	for _, d := range r.custom {
+		res = append(res, d)
+	}
+	sort.Sort(optionDefsByCode(res))
+	return res
+}
+
+type optionDefsByCode []*OptionDef
+
+func (o optionDefsByCode) Len() int           { return len(o) }
+func (o optionDefsByCode) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+func (o optionDefsByCode) Less(i, j int) bool { return o[i].Code < o[j].Code }
+
+func (dt *DataTracker) findOptionDef(code dhcp.OptionCode) (int, *OptionDef) {
+	for i, d := range dt.OptionDefs {
+		if d.Code == code {
+			return i, d
+		}
+	}
+	return -1, nil
+}
+
+// SetOptionDef adds or replaces a custom option definition.
+func (dt *DataTracker) SetOptionDef(def *OptionDef) (error, int) {
+	if err := def.validate(false); err != nil {
+		return err, http.StatusBadRequest
+	}
+	def.Builtin = false
+	if i, _ := dt.findOptionDef(def.Code); i != -1 {
+		dt.OptionDefs[i] = def
+	} else {
+		dt.OptionDefs = append(dt.OptionDefs, def)
+	}
+	sort.Sort(optionDefsByCode(dt.OptionDefs))
+	optionDefs.SetCustom(dt.OptionDefs)
+	dt.save_data()
+	return nil, http.StatusOK
+}
+
+// RemoveOptionDef removes a custom option definition.  Built-in
+// options go back to their built-in type.
+func (dt *DataTracker) RemoveOptionDef(code dhcp.OptionCode) (error, int) {
+	i, _ := dt.findOptionDef(code)
+	if i == -1 {
+		return errors.New("Not Found"), http.StatusNotFound
+	}
+	dt.OptionDefs = append(dt.OptionDefs[:i], dt.OptionDefs[i+1:]...)
+	optionDefs.SetCustom(dt.OptionDefs)
+	dt.save_data()
+	return nil, http.StatusOK
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptionTypesRoundTrip(t *testing.T) {
+	tests := []struct {
+		typ   string
+		value string
+		bytes []byte
+	}{
+		{OptionTypeIP, "10.0.0.1", []byte{10, 0, 0, 1}},
+		{OptionTypeIPList, "10.0.0.1,10.0.0.2", []byte{10, 0, 0, 1, 10, 0, 0, 2}},
+		{OptionTypeUint8, "12", []byte{12}},
+		{OptionTypeUint16, "1500", []byte{0x05, 0xdc}},
+		{OptionTypeUint32, "3600", []byte{0, 0, 0x0e, 0x10}},
+		{OptionTypeInt32, "-1", []byte{0xff, 0xff, 0xff, 0xff}},
+		{OptionTypeBool, "true", []byte{1}},
+		{OptionTypeBool, "false", []byte{0}},
+		{OptionTypeString, "pxelinux.0", []byte("pxelinux.0")},
+		{OptionTypeHex, "01:02:0a", []byte{1, 2, 10}},
+		{OptionTypeRouteList, "10.0.0.0/8 192.168.1.1,0.0.0.0/0 192.168.1.254",
+			[]byte{8, 10, 192, 168, 1, 1, 0, 192, 168, 1, 254}},
+		{OptionTypeRouteList, "192.168.128.0/17 10.0.0.1", []byte{17, 192, 168, 128, 10, 0, 0, 1}},
+	}
+	for _, test := range tests {
+		def := &OptionDef{Code: 224, Type: test.typ}
+		b, err := def.Encode(test.value)
+		assert.Nil(t, err, "%s %s should encode: %v", test.typ, test.value, err)
+		assert.Equal(t, b, test.bytes, "%s %s encoded wrong", test.typ, test.value)
+		assert.Equal(t, def.Decode(test.bytes), test.value, "%s %s decoded wrong", test.typ, test.value)
+	}
+}
+
+func TestOptionTypesBad(t *testing.T) {
+	tests := []struct {
+		typ   string
+		value string
+	}{
+		{OptionTypeIP, "10.0.0"},
+		{OptionTypeIPList, "10.0.0.1,fred"},
+		{OptionTypeUint8, "256"},
+		{OptionTypeUint16, "-1"},
+		{OptionTypeBool, "maybe"},
+		{OptionTypeHex, "0g"},
+		{OptionTypeRouteList, "10.0.0.0/8"},
+		{OptionTypeRouteList, "10.0.0.0/8 fred"},
+		{OptionTypeVendor, "1=01;fred"},
+	}
+	for _, test := range tests {
+		def := &OptionDef{Code: 224, Type: test.typ}
+		_, err := def.Encode(test.value)
+		assert.NotNil(t, err, "%s %s should fail to encode", test.typ, test.value)
+	}
+	def := &OptionDef{Code: 224, Type: OptionTypeIP}
+	assert.Equal(t, def.Decode([]byte{1, 2}), "01:02", "Short IP should decode as hex")
+}
+
+func TestVendorOption(t *testing.T) {
+	def := &OptionDef{
+		Code: dhcp.OptionVendorSpecificInformation,
+		Type: OptionTypeVendor,
+		SubOptions: []*OptionDef{
+			&OptionDef{Code: 1, Type: OptionTypeString},
+			&OptionDef{Code: 2, Type: OptionTypeIP},
+		},
+	}
+	b, err := def.Encode("1=acme;2=10.0.0.1;3=ff")
+	assert.Nil(t, err, "Error should be nil")
+	assert.Equal(t, b, []byte{1, 4, 'a', 'c', 'm', 'e', 2, 4, 10, 0, 0, 1, 3, 1, 0xff}, "Vendor option encoded wrong")
+	assert.Equal(t, def.Decode(b), "1=acme;2=10.0.0.1;3=ff", "Vendor option decoded wrong")
+
+	// Old style values are sent as they are.
+	b, err = def.Encode("raw vendor data")
+	assert.Nil(t, err, "Error should be nil")
+	assert.Equal(t, string(b), "raw vendor data", "Raw value should be sent as is")
+	assert.Equal(t, def.Decode(b), "raw vendor data", "Raw value should decode as a string")
+}
+
+func TestIPXETrustOption(t *testing.T) {
+	fingerprint := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	b, err := convertOptionValueToByte(OptionIPXE, "90="+fingerprint)
+	assert.Nil(t, err, "Error should be nil: %v", err)
+	assert.Equal(t, len(b), 34, "Trust should be sent as 32 raw bytes, but got %d bytes", len(b))
+	assert.Equal(t, b[:3], []byte{90, 32, 0x01}, "Trust sub-option encoded wrong")
+	decoded := strings.Replace(convertByteToOptionValue(OptionIPXE, b), ":", "", -1)
+	assert.Equal(t, decoded, "90="+fingerprint, "Trust sub-option decoded wrong")
+	assert.True(t, optionDefs.Find(OptionIPXE).Builtin, "Option 175 should be builtin")
+}
+
+func TestOptionDefValidate(t *testing.T) {
+	assert.Nil(t, (&OptionDef{Code: 224, Type: OptionTypeHex}).validate(false), "Hex option should be valid")
+	assert.NotNil(t, (&OptionDef{Code: 224, Type: "float"}).validate(false), "Unknown type should fail")
+	assert.NotNil(t, (&OptionDef{Code: dhcp.OptionDHCPMessageType, Type: OptionTypeUint8}).validate(false), "Reserved option should fail")
+	assert.NotNil(t, (&OptionDef{Code: 224, Type: OptionTypeHex, SubOptions: []*OptionDef{&OptionDef{Code: 1, Type: OptionTypeHex}}}).validate(false), "Sub-options on a non-vendor option should fail")
+	assert.NotNil(t, (&OptionDef{Code: 224, Type: OptionTypeVendor, SubOptions: []*OptionDef{
+		&OptionDef{Code: 1, Type: OptionTypeHex},
+		&OptionDef{Code: 1, Type: OptionTypeString},
+	}}).validate(false), "Duplicate sub-options should fail")
+}
+
+func TestSetOptionDef(t *testing.T) {
+	dt, _ := simpleSetup()
+	defer optionDefs.SetCustom(nil)
+
+	_, err := convertOptionValueToByte(224, "01:02")
+	assert.NotNil(t, err, "Unregistered option should fail to encode")
+
+	err, code := dt.SetOptionDef(&OptionDef{Code: 224, Type: "float"})
+	assert.NotNil(t, err, "Bad definition should fail")
+	assert.Equal(t, code, http.StatusBadRequest, "Return code should be bad request, but is %d", code)
+
+	err, code = dt.SetOptionDef(&OptionDef{Code: 224, Type: OptionTypeHex})
+	assert.Nil(t, err, "Error should be nil")
+	assert.Equal(t, code, http.StatusOK, "Return code should be ok, but is %d", code)
+	b, err := convertOptionValueToByte(224, "01:02")
+	assert.Nil(t, err, "Registered option should encode")
+	assert.Equal(t, b, []byte{1, 2}, "Registered option encoded wrong")
+
+	// Custom definitions override built-in ones.
+	dt.SetOptionDef(&OptionDef{Code: dhcp.OptionDomainName, Type: OptionTypeHex})
+	assert.Equal(t, convertByteToOptionValue(dhcp.OptionDomainName, []byte("a")), "61", "Override should be used")
+	err, code = dt.RemoveOptionDef(dhcp.OptionDomainName)
+	assert.Nil(t, err, "Error should be nil")
+	assert.Equal(t, convertByteToOptionValue(dhcp.OptionDomainName, []byte("a")), "a", "Built-in should be used again")
+
+	err, code = dt.RemoveOptionDef(dhcp.OptionDomainName)
+	assert.NotNil(t, err, "Removing a missing definition should fail")
+	assert.Equal(t, code, http.StatusNotFound, "Return code should be not found, but is %d", code)
+}
+
+func TestSetOptionDefBuiltin(t *testing.T) {
+	_, handler := getFrontend()
+	defer optionDefs.SetCustom(nil)
+	tenant := `{"2":{"parent":0,"capabilities":["SUBNET_CREATE","SUBNET_UPDATE","SUBNET_DESTROY","SUBNET_READ"]}}`
+	system := `{"1":{"parent":0,"capabilities":["SUBNET_CREATE","SUBNET_UPDATE","SUBNET_DESTROY","SUBNET_READ"]}}`
+	request := func(method, path, caps, body string) int {
+		req, err := http.NewRequest(method, baseUrl(path), strings.NewReader(body))
+		assert.Nil(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Authenticated-Capability", caps)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	code := request("POST", "/options", tenant, `{"code":3,"type":"hex","tenant_id":2}`)
+	assert.Equal(t, code, http.StatusForbidden, "Tenant should not redefine a built-in option, but got %d", code)
+	code = request("POST", "/options", tenant, `{"code":175,"type":"hex","tenant_id":2}`)
+	assert.Equal(t, code, http.StatusForbidden, "Tenant should not redefine option 175, but got %d", code)
+	assert.Equal(t, optionDefs.Find(dhcp.OptionRouter).Type, OptionTypeIPList, "Router should still be a list of addresses")
+
+	code = request("POST", "/options", tenant, `{"code":224,"type":"hex","tenant_id":2}`)
+	assert.Equal(t, code, http.StatusOK, "Tenant should define a custom option, but got %d", code)
+
+	code = request("POST", "/options", system, `{"code":3,"type":"hex","tenant_id":1}`)
+	assert.Equal(t, code, http.StatusOK, "System tenant should redefine a built-in option, but got %d", code)
+	code = request("DELETE", "/options/3", tenant, "")
+	assert.Equal(t, code, http.StatusNotFound, "Tenant should not see the system override, but got %d", code)
+	code = request("DELETE", "/options/3", system, "")
+	assert.Equal(t, code, http.StatusOK, "System tenant should remove the override, but got %d", code)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
+)
+
+// Pool is an extra range of addresses a subnet can hand out in
+// addition to ActiveStart - ActiveEnd.  A pool can have its own lease
+// time, and can be restricted to clients in specific client classes.
+type Pool struct {
+	Start     net.IP
+	End       net.IP
+	LeaseTime time.Duration // 0 means use the subnet ActiveLeaseTime
+	Classes   []string      // empty means any client can use the pool
+}
+
+type apiPool struct {
+	Start     string   `json:"start"`
+	End       string   `json:"end"`
+	LeaseTime int      `json:"lease_time,omitempty"`
+	Classes   []string `json:"classes,omitempty"`
+}
+
+func (p *Pool) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&apiPool{
+		Start:     p.Start.String(),
+		End:       p.End.String(),
+		LeaseTime: int(p.LeaseTime.Seconds()),
+		Classes:   p.Classes,
+	})
+}
+
+func (p *Pool) UnmarshalJSON(data []byte) error {
+	ap := &apiPool{}
+	if err := json.Unmarshal(data, ap); err != nil {
+		return err
+	}
+	p.Start = net.ParseIP(ap.Start).To4()
+	p.End = net.ParseIP(ap.End).To4()
+	if p.Start == nil || p.End == nil {
+		return fmt.Errorf("Invalid pool %s - %s", ap.Start, ap.End)
+	}
+	p.LeaseTime = time.Duration(ap.LeaseTime) * time.Second
+	p.Classes = ap.Classes
+	return nil
+}
+
+func (p *Pool) InRange(addr net.IP) bool {
+	addr = addr.To4()
+	return bytes.Compare(addr, p.Start) >= 0 &&
+		bytes.Compare(addr, p.End) <= 0
+}
+
+func (p *Pool) overlaps(o *Pool) bool {
+	return p.InRange(o.Start) || p.InRange(o.End) || o.InRange(p.Start)
+}
+
+// Admits returns true if a client in the passed class may get an
+// address from this pool.
+func (p *Pool) Admits(class *ClientClass) bool {
+	if len(p.Classes) == 0 {
+		return true
+	}
+	if class == nil {
+		return false
+	}
+	for _, name := range p.Classes {
+		if name == class.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// activePool returns the ActiveStart - ActiveEnd range as a Pool.
+func (s *Subnet) activePool() *Pool {
+	return &Pool{
+		Start:     s.ActiveStart,
+		End:       s.ActiveEnd,
+		LeaseTime: s.ActiveLeaseTime,
+	}
+}
+
+// allPools returns the extra pools followed by the active range.
+func (s *Subnet) allPools() []*Pool {
+	res := make([]*Pool, 0, len(s.Pools)+1)
+	res = append(res, s.Pools...)
+	return append(res, s.activePool())
+}
+
+// poolsFor returns the pools a client in the passed class may get
+// addresses from, in the order they should be tried.
+func (s *Subnet) poolsFor(class *ClientClass) []*Pool {
+	res := []*Pool{}
+	for _, p := range s.allPools() {
+		if p.Admits(class) {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// findPool returns the pool that addr is in, or nil if it is not in
+// any of them.
+func (s *Subnet) findPool(addr net.IP) *Pool {
+	for _, p := range s.allPools() {
+		if p.InRange(addr) {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *Subnet) excluded(addr net.IP) bool {
+	for _, e := range s.Exclusions {
+		if e.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// leaseTime returns the lease time for dynamic leases on addr.
+func (s *Subnet) leaseTime(addr net.IP) time.Duration {
+	if p := s.findPool(addr); p != nil && p.LeaseTime != 0 {
+		return p.LeaseTime
+	}
+	return s.ActiveLeaseTime
+}
+
+// validatePools makes sure that all the pools and exclusions are
+// in the subnet, and that none of the pools overlap.
+func (s *Subnet) validatePools() error {
+	pools := s.allPools()
+	for i, p := range pools {
+		if !s.Subnet.Contains(p.Start) || !s.Subnet.Contains(p.End) {
+			return fmt.Errorf("Pool %s - %s not in Subnet", p.Start, p.End)
+		}
+		if dhcp.IPLess(p.End, p.Start) {
+			return fmt.Errorf("Pool %s - %s ends before it starts", p.Start, p.End)
+		}
+		for _, o := range pools[i+1:] {
+			if p.overlaps(o) {
+				return fmt.Errorf("Pool %s - %s overlaps pool %s - %s", p.Start, p.End, o.Start, o.End)
+			}
+		}
+	}
+	for _, e := range s.Exclusions {
+		if e == nil || !s.Subnet.Contains(e) {
+			return errors.New("Exclusion not in Subnet")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolAdmits(t *testing.T) {
+	open := &Pool{}
+	restricted := &Pool{Classes: []string{"uefi"}}
+
+	assert.True(t, open.Admits(nil), "Open pool should admit classless clients")
+	assert.True(t, open.Admits(&ClientClass{Name: "bios"}), "Open pool should admit any class")
+	assert.False(t, restricted.Admits(nil), "Restricted pool should not admit classless clients")
+	assert.False(t, restricted.Admits(&ClientClass{Name: "bios"}), "Restricted pool should not admit other classes")
+	assert.True(t, restricted.Admits(&ClientClass{Name: "uefi"}), "Restricted pool should admit its class")
+}
+
+func TestGetFreeIPSkipsExclusions(t *testing.T) {
+	_, s := simpleSetup()
+
+	s.Exclusions = []net.IP{net.ParseIP("192.168.128.5").To4(), net.ParseIP("192.168.128.6").To4()}
+
+	ip, _ := s.getFreeIP(nil)
+	assert.NotNil(t, ip, "IP should not be nil")
+	assert.Equal(t, ip.String(), "192.168.128.7", "IP should be 192.168.128.7, but is %s", ip.String())
+	assert.False(t, s.InRange(net.ParseIP("192.168.128.5")), "Excluded address should not be in range")
+}
+
+func TestGetFreeIPPools(t *testing.T) {
+	dt, s := simpleSetup()
+
+	s.ActiveLeaseTime = time.Minute
+	s.Pools = []*Pool{
+		&Pool{
+			Start:     net.ParseIP("192.168.128.100").To4(),
+			End:       net.ParseIP("192.168.128.101").To4(),
+			LeaseTime: time.Hour,
+			Classes:   []string{"uefi"},
+		},
+	}
+	uefi := &ClientClass{Name: "uefi"}
+
+	ip, _ := s.getFreeIP(nil)
+	assert.Equal(t, ip.String(), "192.168.128.5", "Classless client should get the active range, but got %s", ip.String())
+
+	l, _ := s.findOrGetInfo(dt, "uefi1", nil, uefi, nil)
+	assert.Equal(t, l.Ip.String(), "192.168.128.100", "UEFI client should get the pool, but got %s", l.Ip.String())
+	assert.Equal(t, s.leaseTime(l.Ip), time.Hour, "Pool lease time should be used")
+	l, _ = s.findOrGetInfo(dt, "uefi2", nil, uefi, nil)
+	assert.Equal(t, l.Ip.String(), "192.168.128.101", "UEFI client should get the pool, but got %s", l.Ip.String())
+
+	// Pool is full, fall back to the active range.
+	l, _ = s.findOrGetInfo(dt, "uefi3", nil, uefi, nil)
+	assert.Equal(t, l.Ip.String(), "192.168.128.5", "UEFI client should fall back to the active range, but got %s", l.Ip.String())
+	assert.Equal(t, s.leaseTime(l.Ip), s.ActiveLeaseTime, "Active lease time should be used")
+}
+
+func TestSubnetUnmarshalPools(t *testing.T) {
+	s := &Subnet{}
+	err := json.Unmarshal([]byte(`{"name": "fred", "subnet": "192.168.128.0/24", "active_start": "192.168.128.5", "active_end": "192.168.128.25", "pools": [{"start": "192.168.128.100", "end": "192.168.128.200", "lease_time": 60}], "exclusions": ["192.168.128.1"]}`), s)
+	assert.Nil(t, err, "Error should be nil")
+	assert.Equal(t, len(s.Pools), 1, "There should be one pool")
+	assert.Equal(t, s.Pools[0].LeaseTime, time.Minute, "Pool lease time should be a minute")
+	assert.Equal(t, len(s.Exclusions), 1, "There should be one exclusion")
+
+	s = &Subnet{}
+	err = json.Unmarshal([]byte(`{"name": "fred", "subnet": "192.168.128.0/24", "active_start": "192.168.128.5", "active_end": "192.168.128.25", "pools": [{"start": "192.168.128.20", "end": "192.168.128.30"}]}`), s)
+	assert.NotNil(t, err, "Overlapping pool should fail")
+
+	s = &Subnet{}
+	err = json.Unmarshal([]byte(`{"name": "fred", "subnet": "192.168.128.0/24", "active_start": "192.168.128.5", "active_end": "192.168.128.25", "pools": [{"start": "192.168.128.100", "end": "192.168.128.200"}, {"start": "192.168.128.150", "end": "192.168.128.160"}]}`), s)
+	assert.NotNil(t, err, "Pool inside another pool should fail")
+
+	s = &Subnet{}
+	err = json.Unmarshal([]byte(`{"name": "fred", "subnet": "192.168.128.0/24", "active_start": "192.168.128.5", "active_end": "192.168.128.25", "pools": [{"start": "192.168.129.100", "end": "192.168.129.200"}]}`), s)
+	assert.NotNil(t, err, "Pool outside the subnet should fail")
+
+	s = &Subnet{}
+	err = json.Unmarshal([]byte(`{"name": "fred", "subnet": "192.168.128.0/24", "active_start": "192.168.128.5", "active_end": "192.168.128.25", "exclusions": ["10.0.0.1"]}`), s)
+	assert.NotNil(t, err, "Exclusion outside the subnet should fail")
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// How many candidate addresses we will probe for a single client
+// before giving up on it.
+const maxProbes = 5
+
+// Conflict records an address that answered a probe before we handed
+// it out.  The address will not be offered again until ExpireTime.
+type Conflict struct {
+	Ip         net.IP    `json:"ip"`
+	DetectedAt time.Time `json:"detected_at"`
+	ExpireTime time.Time `json:"expire_time"`
+}
+
+// probeAddress returns true if something answers at ip within
+// timeout.  It is a variable so that tests can replace it.
+var probeAddress = probe
+
+// probe checks ip with ARP if it is on one of our own links, since
+// hosts that drop pings still answer ARP.  Addresses behind a relay,
+// or that we cannot ARP for, are pinged instead.
+func probe(ip net.IP, timeout time.Duration) bool {
+	if intf := onLinkInterface(ip); intf != nil {
+		inUse, err := arpProbe(intf, ip, timeout)
+		if err == nil {
+			return inUse
+		}
+		log.Printf("Unable to ARP for %s on %s, pinging it instead: %v", ip, intf.Name, err)
+	}
+	return icmpProbe(ip, timeout)
+}
+
+// onLinkInterface returns the interface with an address in the same
+// network as ip, or nil if ip is not on any of our links.
+func onLinkInterface(ip net.IP) *net.Interface {
+	intfs, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for i := range intfs {
+		intf := &intfs[i]
+		if intf.Flags&net.FlagUp == 0 || intf.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := intf.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil && ipnet.Contains(ip) {
+				return intf
+			}
+		}
+	}
+	return nil
+}
+
+// arpRequest builds an ARP probe for ip from hw, as in RFC 5227.  The
+// sender address is left as 0.0.0.0 so that the probe does not change
+// what anybody has cached for us.
+func arpRequest(hw net.HardwareAddr, ip net.IP) []byte {
+	buf := make([]byte, 28)
+	binary.BigEndian.PutUint16(buf[0:2], 1)      // Ethernet
+	binary.BigEndian.PutUint16(buf[2:4], 0x0800) // IPv4
+	buf[4] = 6
+	buf[5] = 4
+	binary.BigEndian.PutUint16(buf[6:8], 1) // Request
+	copy(buf[8:14], hw)
+	copy(buf[24:28], ip.To4())
+	return buf
+}
+
+// arpFrom returns true if buf is an ARP packet sent by ip, which is
+// either an answer to our probe or ip claiming its address itself.
+func arpFrom(buf []byte, ip net.IP) bool {
+	if len(buf) < 28 || binary.BigEndian.Uint16(buf[2:4]) != 0x0800 || buf[4] != 6 || buf[5] != 4 {
+		return false
+	}
+	return net.IP(buf[14:18]).Equal(ip)
+}
+
+// icmpProbe sends an ICMP echo request to ip and waits for a reply.
+// It needs a raw socket, so if we are not allowed to open one we log
+// it and assume the address is free.
+func icmpProbe(ip net.IP, timeout time.Duration) bool {
+	c, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		log.Printf("Unable to probe %s: %v", ip, err)
+		return false
+	}
+	defer c.Close()
+	id := os.Getpid() & 0xffff
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Code: 0,
+		Body: &icmp.Echo{ID: id, Seq: 1, Data: []byte("rebar-dhcp")},
+	}
+	buf, err := msg.Marshal(nil)
+	if err != nil {
+		log.Printf("Unable to probe %s: %v", ip, err)
+		return false
+	}
+	if _, err := c.WriteTo(buf, &net.IPAddr{IP: ip}); err != nil {
+		log.Printf("Unable to probe %s: %v", ip, err)
+		return false
+	}
+	if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		log.Printf("Unable to probe %s: %v", ip, err)
+		return false
+	}
+	rb := make([]byte, 1500)
+	for {
+		n, peer, err := c.ReadFrom(rb)
+		if err != nil {
+			// Timed out, nobody home.
+			return false
+		}
+		if addr, ok := peer.(*net.IPAddr); !ok || !addr.IP.Equal(ip) {
+			continue
+		}
+		rm, err := icmp.ParseMessage(1, rb[:n])
+		if err != nil || rm.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		if echo, ok := rm.Body.(*icmp.Echo); ok && echo.ID == id {
+			return true
+		}
+	}
+}
+
+// probeUnlocked probes addr if probing is turned on, returning true
+// if something answers.  The caller must hold the tracker lock, which
+// is released while the probe waits for an answer.  dhcp.Serve
+// handles each packet in its own goroutine, so this lets packets from
+// other clients be answered in the meantime.  Anything the caller
+// looked up before calling may have changed by the time it returns.
+func (dt *DataTracker) probeUnlocked(addr net.IP) bool {
+	if probeTimeout <= 0 || dt.dryRun {
+		return false
+	}
+	dt.Unlock()
+	defer dt.Lock()
+	return probeAddress(addr, probeTimeout)
+}
+
+// quarantine keeps addr from being handed out until quarantineTime
+// has passed.
+func (s *Subnet) quarantine(addr net.IP) {
+	log.Printf("Address %s in subnet %s is already in use, quarantining it for %v", addr, s.Name, quarantineTime)
+	now := time.Now()
+	s.Conflicts[addr.String()] = &Conflict{
+		Ip:         addr,
+		DetectedAt: now,
+		ExpireTime: now.Add(quarantineTime),
+	}
+}
+
+// addressTaken returns true if addr has been leased, bound or
+// quarantined.
+func (s *Subnet) addressTaken(addr net.IP) bool {
+	if s.boundIP(addr) || s.Conflicts[addr.String()] != nil {
+		return true
+	}
+	now := time.Now()
+	for _, l := range s.Leases {
+		if l.Ip.Equal(addr) && !now.After(l.ExpireTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClearConflict lets an address that was quarantined be handed out
+// again before its quarantine expires.
+func (dt *DataTracker) ClearConflict(subnetName string, ip net.IP) (error, int) {
+	lsubnet := dt.Subnets[subnetName]
+	if lsubnet == nil {
+		return errors.New("Subnet Not Found"), http.StatusNotFound
+	}
+	if ip == nil || lsubnet.Conflicts[ip.String()] == nil {
+		return errors.New("Conflict Not Found"), http.StatusNotFound
+	}
+	delete(lsubnet.Conflicts, ip.String())
+	dt.save_data()
+	return nil, http.StatusOK
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// htons puts a protocol number in network byte order for AF_PACKET.
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// arpProbe broadcasts an ARP probe for ip on intf and waits up to
+// timeout for ip to answer.  It needs a packet socket, so it fails
+// when we are not allowed to open one.
+func arpProbe(intf *net.Interface, ip net.IP, timeout time.Duration) (bool, error) {
+	if len(intf.HardwareAddr) != 6 {
+		return false, errors.New("not an Ethernet interface")
+	}
+	proto := htons(syscall.ETH_P_ARP)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(proto))
+	if err != nil {
+		return false, err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: proto, Ifindex: intf.Index}); err != nil {
+		return false, err
+	}
+	to := &syscall.SockaddrLinklayer{
+		Protocol: proto,
+		Ifindex:  intf.Index,
+		Halen:    6,
+		Addr:     [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+	if err := syscall.Sendto(fd, arpRequest(intf.HardwareAddr, ip), 0, to); err != nil {
+		return false, err
+	}
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for {
+		left := deadline.Sub(time.Now())
+		if left <= 0 {
+			// Timed out, nobody home.
+			return false, nil
+		}
+		// A zero receive timeout would wait forever.
+		if left < time.Millisecond {
+			left = time.Millisecond
+		}
+		tv := syscall.NsecToTimeval(left.Nanoseconds())
+		if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			return false, err
+		}
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if arpFrom(buf[:n], ip) {
+			return true, nil
+		}
+	}
+}
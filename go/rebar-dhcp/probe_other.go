@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// arpProbe needs Linux packet sockets, so elsewhere addresses are
+// always pinged.
+func arpProbe(intf *net.Interface, ip net.IP, timeout time.Duration) (bool, error) {
+	return false, errors.New("ARP probes are only supported on Linux")
+}
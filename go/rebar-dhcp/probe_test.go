@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindOrGetInfoProbe(t *testing.T) {
+	dt, s := simpleSetup()
+
+	s.ActiveLeaseTime = time.Minute
+	oldProbe, oldTimeout := probeAddress, probeTimeout
+	defer func() { probeAddress, probeTimeout = oldProbe, oldTimeout }()
+	probeTimeout = time.Millisecond
+	probeAddress = func(ip net.IP, timeout time.Duration) bool {
+		return ip.Equal(net.ParseIP("192.168.128.5"))
+	}
+
+	dt.Lock()
+	l, _ := s.findOrGetInfo(dt, "aa:bb:cc:dd:ee:ff", nil, nil, nil)
+	dt.Unlock()
+	assert.NotNil(t, l, "Lease should not be nil")
+	assert.Equal(t, l.Ip.String(), "192.168.128.6", "Lease should skip the conflict, but is %s", l.Ip.String())
+	assert.NotNil(t, s.Conflicts["192.168.128.5"], "Conflict should be recorded")
+
+	// Quarantined addresses are skipped without probing again.
+	probeAddress = func(ip net.IP, timeout time.Duration) bool { return false }
+	ip, _ := s.getFreeIP(nil)
+	assert.Equal(t, ip.String(), "192.168.128.7", "Quarantined address should be skipped, but got %s", ip.String())
+
+	// Expired conflicts are released.
+	s.Conflicts["192.168.128.5"].ExpireTime = time.Now().Add(-time.Minute)
+	ip, _ = s.getFreeIP(nil)
+	assert.Equal(t, ip.String(), "192.168.128.5", "Expired conflict should be released, but got %s", ip.String())
+	assert.Nil(t, s.Conflicts["192.168.128.5"], "Expired conflict should be removed")
+}
+
+func TestFindOrGetInfoProbeGivesUp(t *testing.T) {
+	dt, s := simpleSetup()
+
+	oldProbe, oldTimeout := probeAddress, probeTimeout
+	defer func() { probeAddress, probeTimeout = oldProbe, oldTimeout }()
+	probeTimeout = time.Millisecond
+	probeAddress = func(ip net.IP, timeout time.Duration) bool { return true }
+
+	dt.Lock()
+	l, _ := s.findOrGetInfo(dt, "aa:bb:cc:dd:ee:ff", nil, nil, nil)
+	dt.Unlock()
+	assert.Nil(t, l, "Lease should be nil when every probe answers")
+	assert.Equal(t, len(s.Conflicts), maxProbes, "There should be %d conflicts, but there are %d", maxProbes, len(s.Conflicts))
+}
+
+// lockSoon locks dt, failing if that takes long enough that someone
+// must be holding it.
+func lockSoon(t *testing.T, dt *DataTracker) {
+	locked := make(chan struct{})
+	go func() {
+		dt.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("The data lock is held")
+	}
+}
+
+func TestFindOrGetInfoProbeUnlocked(t *testing.T) {
+	dt, s := simpleSetup()
+
+	s.ActiveLeaseTime = time.Minute
+	oldProbe, oldTimeout := probeAddress, probeTimeout
+	defer func() { probeAddress, probeTimeout = oldProbe, oldTimeout }()
+	probeTimeout = time.Millisecond
+	// While the first client's probe of .5 is outstanding, a second
+	// client gets a lease for the same address.
+	probeAddress = func(ip net.IP, timeout time.Duration) bool {
+		lockSoon(t, dt)
+		defer dt.Unlock()
+		if ip.Equal(net.ParseIP("192.168.128.5")) && s.Leases["aa:bb:cc:dd:ee:02"] == nil {
+			s.Leases["aa:bb:cc:dd:ee:02"] = &Lease{
+				Ip:         ip,
+				Mac:        "aa:bb:cc:dd:ee:02",
+				Valid:      true,
+				ExpireTime: time.Now().Add(time.Minute),
+			}
+		}
+		return false
+	}
+
+	dt.Lock()
+	l, _ := s.findOrGetInfo(dt, "aa:bb:cc:dd:ee:01", nil, nil, nil)
+	dt.Unlock()
+	assert.NotNil(t, l, "Lease should not be nil")
+	assert.Equal(t, l.Ip.String(), "192.168.128.6", "Lease should skip the address taken during the probe, but is %s", l.Ip.String())
+	assert.Equal(t, len(s.Conflicts), 0, "No conflicts should be recorded")
+
+	// A client whose lease appeared during the probe keeps it.
+	probeAddress = func(ip net.IP, timeout time.Duration) bool {
+		lockSoon(t, dt)
+		defer dt.Unlock()
+		s.Leases["aa:bb:cc:dd:ee:03"] = &Lease{
+			Ip:         net.ParseIP("192.168.128.20").To4(),
+			Mac:        "aa:bb:cc:dd:ee:03",
+			Valid:      true,
+			ExpireTime: time.Now().Add(time.Minute),
+		}
+		return false
+	}
+	dt.Lock()
+	l, _ = s.findOrGetInfo(dt, "aa:bb:cc:dd:ee:03", nil, nil, nil)
+	dt.Unlock()
+	assert.NotNil(t, l, "Lease should not be nil")
+	assert.Equal(t, l.Ip.String(), "192.168.128.20", "Lease made during the probe should win, but is %s", l.Ip.String())
+}
+
+func TestClearConflict(t *testing.T) {
+	dt, s := simpleSetup()
+
+	s.Conflicts["192.168.128.5"] = &Conflict{
+		Ip:         net.ParseIP("192.168.128.5").To4(),
+		ExpireTime: time.Now().Add(time.Hour),
+	}
+
+	err, code := dt.ClearConflict("fred2", net.ParseIP("192.168.128.5"))
+	assert.NotNil(t, err, "Error should not be nil")
+	assert.Equal(t, code, http.StatusNotFound, "Return code should be not found, but is %d", code)
+
+	err, code = dt.ClearConflict("fred", net.ParseIP("192.168.128.6"))
+	assert.NotNil(t, err, "Error should not be nil")
+	assert.Equal(t, code, http.StatusNotFound, "Return code should be not found, but is %d", code)
+
+	err, code = dt.ClearConflict("fred", net.ParseIP("192.168.128.5"))
+	assert.Nil(t, err, "Error should be nil")
+	assert.Equal(t, code, http.StatusOK, "Return code should be ok, but is %d", code)
+	assert.Equal(t, len(s.Conflicts), 0, "Conflict should be cleared")
+}
+
+func TestArpProbePacket(t *testing.T) {
+	hw := net.HardwareAddr{0, 0x16, 0x3e, 1, 2, 3}
+	ip := net.ParseIP("192.168.128.5")
+	req := arpRequest(hw, ip)
+	assert.Equal(t, len(req), 28, "ARP probe should be 28 bytes, but is %d", len(req))
+	assert.Equal(t, net.HardwareAddr(req[8:14]).String(), hw.String(), "ARP probe should be sent from our address")
+	assert.True(t, net.IP(req[14:18]).Equal(net.IPv4zero), "ARP probe should not claim an address, but claims %s", net.IP(req[14:18]))
+	assert.True(t, net.IP(req[24:28]).Equal(ip), "ARP probe should ask for %s, but asks for %s", ip, net.IP(req[24:28]))
+	assert.False(t, arpFrom(req, ip), "Our own probe should not count as an answer")
+
+	// An answer comes from the address we asked about.
+	reply := arpRequest(net.HardwareAddr{0, 0x16, 0x3e, 4, 5, 6}, net.IPv4zero)
+	reply[7] = 2
+	copy(reply[14:18], ip.To4())
+	assert.True(t, arpFrom(reply, ip), "ARP reply from %s should count as an answer", ip)
+	assert.False(t, arpFrom(reply, net.ParseIP("192.168.128.6")), "ARP reply from %s should not count for another address", ip)
+	assert.False(t, arpFrom(reply[:20], ip), "Short ARP packet should be ignored")
+}
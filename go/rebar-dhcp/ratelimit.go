@@ -0,0 +1,150 @@
+package main
+
+import (
+	"container/list"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
+)
+
+// How many buckets a limiter keeps.  When it is full, the bucket that
+// has gone longest without a packet is thrown away to make room.
+const maxBuckets = 4096
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket per key.  Each key may send burst
+// packets at once, and rate packets per second after that.  A rate of
+// 0 turns limiting off.
+//
+// Buckets are kept in least recently used order, so a flood of packets
+// from spoofed keys costs O(1) per packet and can only push out keys
+// that have gone quiet.  An evicted key starts again with a full
+// bucket, which is no more than it would have had by waiting.
+type rateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (l *rateLimiter) Allow(key string, now time.Time) bool {
+	if l == nil || l.rate <= 0 {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+	var b *bucket
+	if e := l.buckets[key]; e != nil {
+		l.lru.MoveToFront(e)
+		b = e.Value.(*bucket)
+	} else {
+		if l.lru.Len() >= maxBuckets {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*bucket).key)
+		}
+		b = &bucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+var macLimiter, relayLimiter *rateLimiter
+
+// knownClients is a snapshot of the clients that have bindings, so
+// that when ignoreAnonymus is set Discovers from everybody else can be
+// dropped without taking the DataTracker lock.
+type knownClients struct {
+	keys     map[string]struct{} // Binding keys other than circuit ones
+	circuits bool                // Some binding matches on option 82
+}
+
+func (k *knownClients) known(nic string, options dhcp.Options) bool {
+	if _, found := k.keys[nic]; found {
+		return true
+	}
+	for _, key := range clientIdKeys(options) {
+		if _, found := k.keys[key]; found {
+			return true
+		}
+	}
+	_, relayed := options[dhcp.OptionRelayAgentInformation]
+	return k.circuits && relayed
+}
+
+// updateKnownClients rebuilds the snapshot used by admit.  It must be
+// called with the DataTracker locked whenever bindings change.
+func (dt *DataTracker) updateKnownClients() {
+	k := &knownClients{keys: make(map[string]struct{})}
+	for _, s := range dt.Subnets {
+		for key, b := range s.Bindings {
+			if b.Mac != "" || b.ClientId != "" || b.Duid != "" {
+				k.keys[key] = struct{}{}
+			} else if b.CircuitId != "" {
+				k.circuits = true
+			}
+		}
+	}
+	dt.known.Store(k)
+}
+
+func (dt *DataTracker) knownClients() *knownClients {
+	if k, ok := dt.known.Load().(*knownClients); ok {
+		return k
+	}
+	return &knownClients{}
+}
+
+// admit decides whether a packet is worth taking the DataTracker lock
+// for.  Packets that are dropped are counted by reason.  Only
+// Discovers from unknown clients are dropped here, as a Request from a
+// client whose binding was removed still has to be NAKed.
+func (h *DHCPHandler) admit(p dhcp.Packet, options dhcp.Options) bool {
+	nic := strings.ToLower(p.CHAddr().String())
+	t := options[dhcp.OptionDHCPMessageType]
+	discover := len(t) == 1 && dhcp.MessageType(t[0]) == dhcp.Discover
+	if ignoreAnonymus && discover && !h.info.knownClients().known(nic, options) {
+		droppedPackets.Inc("unknown_client")
+		return false
+	}
+	now := time.Now()
+	if giaddr := p.GIAddr(); !giaddr.Equal(net.IPv4zero) && !relayLimiter.Allow(giaddr.String(), now) {
+		droppedPackets.Inc("relay_rate")
+		return false
+	}
+	if !macLimiter.Allow(nic, now) {
+		droppedPackets.Inc("mac_rate")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1, 2)
+	now := time.Now()
+
+	assert.True(t, l.Allow("a", now), "First packet should be allowed")
+	assert.True(t, l.Allow("a", now), "Second packet should be allowed by the burst")
+	assert.False(t, l.Allow("a", now), "Third packet should be dropped")
+	assert.True(t, l.Allow("b", now), "Other keys should have their own bucket")
+	assert.True(t, l.Allow("a", now.Add(time.Second)), "Bucket should refill")
+	assert.False(t, l.Allow("a", now.Add(time.Second)), "Bucket should only refill at the rate")
+
+	var off *rateLimiter
+	assert.True(t, off.Allow("a", now), "Nil limiter should allow everything")
+	assert.True(t, newRateLimiter(0, 1).Allow("a", now), "Zero rate should allow everything")
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	l := newRateLimiter(1, 1)
+	now := time.Now()
+	assert.True(t, l.Allow("busy", now), "First packet should be allowed")
+	for i := 0; i < maxBuckets*2; i++ {
+		l.Allow(fmt.Sprintf("spoof-%d", i), now)
+		if i%100 == 0 {
+			l.Allow("busy", now)
+		}
+	}
+	assert.Equal(t, len(l.buckets), maxBuckets, "Buckets should be capped at %d, but there are %d", maxBuckets, len(l.buckets))
+	assert.Equal(t, l.lru.Len(), maxBuckets, "LRU list should match the bucket map")
+	assert.False(t, l.Allow("busy", now), "Active key should keep its empty bucket")
+	_, found := l.buckets["spoof-0"]
+	assert.False(t, found, "Least recently used key should have been evicted")
+}
+
+func TestAdmit(t *testing.T) {
+	dt, s := simpleSetup()
+	h := &DHCPHandler{ip: net.ParseIP("192.168.128.1").To4(), info: dt}
+	s.Bindings["aa:bb:cc:dd:ee:ff"] = &Binding{Ip: net.ParseIP("192.168.128.10").To4(), Mac: "aa:bb:cc:dd:ee:ff"}
+	dt.updateKnownClients()
+
+	oldIgnore, oldMac, oldRelay := ignoreAnonymus, macLimiter, relayLimiter
+	defer func() { ignoreAnonymus, macLimiter, relayLimiter = oldIgnore, oldMac, oldRelay }()
+	ignoreAnonymus = true
+	macLimiter = newRateLimiter(1, 1)
+	relayLimiter = nil
+
+	known := dhcp.RequestPacket(dhcp.Discover, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}, nil, []byte{1, 2, 3, 4}, false, nil)
+	unknown := dhcp.RequestPacket(dhcp.Discover, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x00}, nil, []byte{1, 2, 3, 4}, false, nil)
+
+	dropped := droppedPackets.Get("unknown_client")
+	assert.False(t, h.admit(unknown, unknown.ParseOptions()), "Unknown client should be dropped")
+	assert.Equal(t, droppedPackets.Get("unknown_client"), dropped+1, "Unknown client drop should be counted")
+
+	request := dhcp.RequestPacket(dhcp.Request, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x00}, nil, []byte{1, 2, 3, 4}, false, nil)
+	assert.True(t, h.admit(request, request.ParseOptions()), "Request from an unknown client should be admitted to be NAKed")
+
+	dropped = droppedPackets.Get("mac_rate")
+	assert.True(t, h.admit(known, known.ParseOptions()), "Known client should be admitted")
+	assert.False(t, h.admit(known, known.ParseOptions()), "Known client over its rate should be dropped")
+	assert.Equal(t, droppedPackets.Get("mac_rate"), dropped+1, "Rate limited drop should be counted")
+
+	// Circuit bindings let relayed packets through to be looked up.
+	s.Bindings["circuit-01"] = &Binding{Ip: net.ParseIP("192.168.128.11").To4(), CircuitId: "01"}
+	dt.updateKnownClients()
+	relayed := dhcp.RequestPacket(dhcp.Discover, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}, nil, []byte{1, 2, 3, 4}, false,
+		[]dhcp.Option{{Code: dhcp.OptionRelayAgentInformation, Value: []byte{1, 1, 1}}})
+	assert.True(t, h.admit(relayed, relayed.ParseOptions()), "Relayed packet should be admitted when circuit bindings exist")
+}
+
+func TestAdmitRelayRate(t *testing.T) {
+	dt, _ := simpleSetup()
+	h := &DHCPHandler{ip: net.ParseIP("192.168.128.1").To4(), info: dt}
+
+	oldMac, oldRelay := macLimiter, relayLimiter
+	defer func() { macLimiter, relayLimiter = oldMac, oldRelay }()
+	macLimiter = nil
+	relayLimiter = newRateLimiter(1, 1)
+
+	p := dhcp.RequestPacket(dhcp.Discover, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}, nil, []byte{1, 2, 3, 4}, false, nil)
+	p.SetGIAddr(net.ParseIP("192.168.128.254"))
+	dropped := droppedPackets.Get("relay_rate")
+	assert.True(t, h.admit(p, p.ParseOptions()), "First relayed packet should be admitted")
+	assert.False(t, h.admit(p, p.ParseOptions()), "Relay over its rate should be dropped")
+	assert.Equal(t, droppedPackets.Get("relay_rate"), dropped+1, "Relay drop should be counted")
+
+	buf := &bytes.Buffer{}
+	writeMetrics(buf, dt, readAll)
+	assert.True(t, strings.Contains(buf.String(), `rebar_dhcp_dropped_packets_total{reason="relay_rate"}`), "Metrics should include relay drops: %s", buf.String())
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"flag"
 	"log"
+	"time"
 
 	"github.com/digitalrebar/digitalrebar/go/common/store"
 	"github.com/digitalrebar/digitalrebar/go/common/version"
+	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
 	consul "github.com/hashicorp/consul/api"
 )
 
@@ -16,6 +18,12 @@ var serverIp string
 var hostString string
 var serverPort int
 var versionFlag bool
+var probeTimeout time.Duration
+var quarantineTime time.Duration
+var dnsMgmtUrl string
+var captureSize int
+var macRate, relayRate float64
+var macBurst, relayBurst int
 
 func init() {
 	flag.BoolVar(&versionFlag, "version", false, "Print version and exit")
@@ -25,6 +33,14 @@ func init() {
 	flag.BoolVar(&ignoreAnonymus, "ignoreAnonymus", false, "Ignore unknown MAC addresses")
 	flag.StringVar(&hostString, "host", "dhcp,dhcp-mgmt,localhost,127.0.0.1", "Comma separated list of hosts to put in certificate")
 	flag.IntVar(&serverPort, "port", 6755, "Management access port")
+	flag.DurationVar(&probeTimeout, "probeTimeout", 0, "How long to wait for an answer to an ARP probe, or an ICMP echo for addresses behind a relay, before offering an address (0 disables probing)")
+	flag.DurationVar(&quarantineTime, "quarantineTime", time.Hour, "How long to keep addresses that answered a probe out of use")
+	flag.Float64Var(&macRate, "macRate", 0, "Packets per second to accept from a single MAC address (0 disables limiting)")
+	flag.IntVar(&macBurst, "macBurst", 10, "Packets to accept from a single MAC address before macRate applies")
+	flag.Float64Var(&relayRate, "relayRate", 0, "Packets per second to accept from a single relay agent (0 disables limiting)")
+	flag.IntVar(&relayBurst, "relayBurst", 200, "Packets to accept from a single relay agent before relayRate applies")
+	flag.IntVar(&captureSize, "captureSize", 0, "Number of DHCP packets to keep for GET /captures (0 disables capturing)")
+	flag.StringVar(&dnsMgmtUrl, "dnsMgmt", "", "URL of rebar-dns-mgmt to publish lease hostnames to (e.g. https://dns-mgmt:6754)")
 }
 
 func main() {
@@ -57,6 +73,21 @@ func main() {
 
 	fe := NewFrontend(bs)
 
+	macLimiter = newRateLimiter(macRate, macBurst)
+	relayLimiter = newRateLimiter(relayRate, relayBurst)
+
+	if captureSize > 0 {
+		packetCapture = dhcp.NewCapture(captureSize)
+	}
+
+	if dnsMgmtUrl != "" {
+		u, err := NewDnsMgmtUpdater(dnsMgmtUrl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		startDdns(fe.DhcpInfo, u, time.Minute)
+	}
+
 	if err := StartDhcpHandlers(fe.DhcpInfo, serverIp); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/digitalrebar/digitalrebar/go/common/store"
+	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
+)
+
+// ReplayResult is a captured request along with the reply the handler
+// made to it when it was replayed and the reply that was captured.
+// Either reply may be nil.
+type ReplayResult struct {
+	Request  dhcp.Packet
+	Reply    dhcp.Packet
+	Captured dhcp.Packet
+}
+
+// NewReplayHandler builds a DHCPHandler that answers as serverIp out
+// of an in-memory DataTracker loaded from db, which is the same JSON
+// rebar-dhcp saves to its backing store.
+func NewReplayHandler(serverIp net.IP, db []byte) *DHCPHandler {
+	ms := store.NewSimpleMemoryStore()
+	ms.Save("subnets", db)
+	dt := NewDataTracker(ms)
+	dt.Lock()
+	dt.load_data()
+	dt.Unlock()
+	return &DHCPHandler{ip: serverIp.To4(), info: dt}
+}
+
+// Replay feeds the requests in packets to h in order.  Each request is
+// paired with the first reply in the capture that has the same
+// transaction id.
+func Replay(h dhcp.Handler, packets []*dhcp.CapturedPacket) []*ReplayResult {
+	res := []*ReplayResult{}
+	for i, cp := range packets {
+		req := cp.Packet
+		if len(req) < 240 || req.OpCode() != dhcp.BootRequest {
+			continue
+		}
+		options := req.ParseOptions()
+		t := options[dhcp.OptionDHCPMessageType]
+		if len(t) != 1 {
+			continue
+		}
+		rr := &ReplayResult{Request: req}
+		for _, next := range packets[i+1:] {
+			if len(next.Packet) < 240 || !bytes.Equal(next.Packet.XId(), req.XId()) {
+				continue
+			}
+			if next.Packet.OpCode() == dhcp.BootRequest {
+				break
+			}
+			rr.Captured = next.Packet
+			break
+		}
+		rr.Reply = h.ServeDHCP(req, dhcp.MessageType(t[0]), options)
+		res = append(res, rr)
+	}
+	return res
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
+	"github.com/stretchr/testify/assert"
+)
+
+func replyType(p dhcp.Packet) string {
+	if p == nil {
+		return "none"
+	}
+	t := p.ParseOptions()[dhcp.OptionDHCPMessageType]
+	if len(t) != 1 {
+		return "unknown"
+	}
+	return dhcp.MessageType(t[0]).String()
+}
+
+// Each test/replay/<name>.pcap is replayed against the subnets in
+// test/replay/<name>.json, and the replies must match the ones that
+// were captured.  To turn a reported problem into a regression test,
+// save the output of GET /captures and the subnet there.
+func TestReplayCaptures(t *testing.T) {
+	files, err := filepath.Glob("test/replay/*.pcap")
+	assert.Nil(t, err, "Error should be nil")
+	assert.NotEqual(t, len(files), 0, "There should be captures to replay")
+	for _, file := range files {
+		db, err := ioutil.ReadFile(strings.TrimSuffix(file, ".pcap") + ".json")
+		assert.Nil(t, err, "%s: missing subnet data: %v", file, err)
+		f, err := os.Open(file)
+		assert.Nil(t, err, "%s: %v", file, err)
+		packets, err := dhcp.ReadPcap(f)
+		f.Close()
+		assert.Nil(t, err, "%s: %v", file, err)
+
+		// Answer as the server that made the captured replies.
+		var h *DHCPHandler
+		for _, cp := range packets {
+			if cp.Packet.OpCode() == dhcp.BootReply {
+				h = NewReplayHandler(cp.Src.IP, db)
+				break
+			}
+		}
+		assert.NotNil(t, h, "%s: no replies in capture", file)
+
+		for i, rr := range Replay(h, packets) {
+			assert.Equal(t, replyType(rr.Reply), replyType(rr.Captured),
+				"%s: request %d (%s) got the wrong reply", file, i, replyType(rr.Request))
+			if rr.Reply != nil && rr.Captured != nil {
+				assert.Equal(t, rr.Reply.YIAddr().String(), rr.Captured.YIAddr().String(),
+					"%s: request %d (%s) got the wrong address", file, i, replyType(rr.Request))
+			}
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/digitalrebar/digitalrebar/go/common/store"
+	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
+)
+
+// SimulateRequest describes a made up client to run through the
+// server.  Options are the options the client sends, in the same form
+// as subnet options.
+type SimulateRequest struct {
+	Mac         string    `json:"mac"`
+	GIAddr      net.IP    `json:"giaddr,omitempty"`
+	VendorClass string    `json:"vendor_class,omitempty"`
+	Options     []*Option `json:"options,omitempty"`
+}
+
+// SimulatedReply is a reply the server would have sent, decoded.
+type SimulatedReply struct {
+	Type       string    `json:"type"`
+	Ip         net.IP    `json:"ip,omitempty"`
+	NextServer net.IP    `json:"next_server,omitempty"`
+	BootFile   string    `json:"boot_file,omitempty"`
+	Options    []*Option `json:"options,omitempty"`
+}
+
+// SimulateResult is what the server would answer to a DISCOVER from
+// the client and then to a REQUEST for the address it was offered.
+// A nil reply means the server would not answer at all.
+type SimulateResult struct {
+	Subnet   string          `json:"subnet,omitempty"`
+	Class    string          `json:"class,omitempty"`
+	Discover *SimulatedReply `json:"discover,omitempty"`
+	Request  *SimulatedReply `json:"request,omitempty"`
+}
+
+// dryRunCopy returns a copy of the tracker that can be handed packets
+// without anything leaving it.  The copy is kept in memory, does not
+// probe addresses, and does not publish to DNS.  The caller must hold
+// the lock.
+func (dt *DataTracker) dryRunCopy() (*DataTracker, error) {
+	buf, err := json.Marshal(dt)
+	if err != nil {
+		return nil, err
+	}
+	res := NewDataTracker(store.NewSimpleMemoryStore())
+	if err := json.Unmarshal(buf, res); err != nil {
+		return nil, err
+	}
+	res.dryRun = true
+	for _, s := range res.Subnets {
+		s.Ddns = nil
+	}
+	res.updateKnownClients()
+	return res, nil
+}
+
+type optionsByCode []*Option
+
+func (o optionsByCode) Len() int           { return len(o) }
+func (o optionsByCode) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+func (o optionsByCode) Less(i, j int) bool { return o[i].Code < o[j].Code }
+
+func decodeReply(p dhcp.Packet) *SimulatedReply {
+	if p == nil {
+		return nil
+	}
+	options := p.ParseOptions()
+	res := &SimulatedReply{Options: []*Option{}}
+	if t := options[dhcp.OptionDHCPMessageType]; len(t) == 1 {
+		res.Type = messageTypeLabel(dhcp.MessageType(t[0]))
+	}
+	if ip := p.YIAddr(); !ip.Equal(net.IPv4zero) {
+		res.Ip = append(net.IP(nil), ip...)
+	}
+	if ip := p.SIAddr(); !ip.Equal(net.IPv4zero) {
+		res.NextServer = append(net.IP(nil), ip...)
+	}
+	res.BootFile = string(p.File())
+	for code, v := range options {
+		res.Options = append(res.Options, &Option{Code: code, Value: convertByteToOptionValue(code, v)})
+	}
+	sort.Sort(optionsByCode(res.Options))
+	return res
+}
+
+// Simulate runs a DISCOVER and a REQUEST from a made up client through
+// a dry run copy of the tracker.  Clients without a giaddr are treated
+// as if they were relayed from the first address in the named subnet,
+// which is also used as the server address.  The caller must hold the
+// lock.
+func (dt *DataTracker) Simulate(subnetName string, req *SimulateRequest) (*SimulateResult, error, int) {
+	lsubnet := dt.Subnets[subnetName]
+	if lsubnet == nil {
+		return nil, errors.New("Not Found"), http.StatusNotFound
+	}
+	mac, err := net.ParseMAC(req.Mac)
+	if err != nil {
+		return nil, err, http.StatusBadRequest
+	}
+	serverIp := dhcp.IPAdd(lsubnet.Subnet.IP.To4(), 1)
+	giaddr := req.GIAddr.To4()
+	if giaddr == nil {
+		giaddr = serverIp
+	}
+	sent := []dhcp.Option{}
+	if req.VendorClass != "" {
+		sent = append(sent, dhcp.Option{Code: dhcp.OptionVendorClassIdentifier, Value: []byte(req.VendorClass)})
+	}
+	for _, o := range req.Options {
+		v, err := convertOptionValueToByte(o.Code, o.Value)
+		if err != nil {
+			return nil, err, http.StatusBadRequest
+		}
+		sent = append(sent, dhcp.Option{Code: o.Code, Value: v})
+	}
+
+	sim, err := dt.dryRunCopy()
+	if err != nil {
+		return nil, err, http.StatusInternalServerError
+	}
+	h := &DHCPHandler{ip: serverIp, info: sim}
+	xid := []byte{0x52, 0x45, 0x42, 0x52}
+
+	p := dhcp.RequestPacket(dhcp.Discover, mac, nil, xid, false, sent)
+	p.SetGIAddr(giaddr)
+	res := &SimulateResult{}
+	if subnet := findSubnet(h, p); subnet != nil {
+		res.Subnet = subnet.Name
+		if class := subnet.findClass(strings.ToLower(mac.String()), p.ParseOptions()); class != nil {
+			res.Class = class.Name
+		}
+	}
+	offer := h.ServeDHCP(p, dhcp.Discover, p.ParseOptions())
+	res.Discover = decodeReply(offer)
+	if res.Discover == nil || res.Discover.Type != messageTypeLabel(dhcp.Offer) {
+		return res, nil, http.StatusOK
+	}
+
+	requested := append(sent, dhcp.Option{Code: dhcp.OptionRequestedIPAddress, Value: []byte(res.Discover.Ip.To4())})
+	p = dhcp.RequestPacket(dhcp.Request, mac, nil, xid, false, requested)
+	p.SetGIAddr(giaddr)
+	res.Request = decodeReply(h.ServeDHCP(p, dhcp.Request, p.ParseOptions()))
+	return res, nil, http.StatusOK
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimulate(t *testing.T) {
+	dt, s := simpleSetup()
+	s.ActiveLeaseTime = time.Minute
+	s.ReservedLeaseTime = time.Hour
+	s.Options = []*Option{&Option{dhcp.OptionRouter, "192.168.128.1"}}
+	next := "192.168.128.2"
+	s.Classes = []*ClientClass{&ClientClass{Name: "pxe", VendorClass: "PXEClient", NextServer: &next, BootFile: "lpxelinux.0"}}
+	s.Ddns = &DdnsConfig{Zone: "example.com"}
+	f, restore := withFakeDns()
+	defer restore()
+
+	res, err, code := dt.Simulate("fred", &SimulateRequest{
+		Mac:         "aa:bb:cc:dd:ee:ff",
+		VendorClass: "PXEClient:Arch:00000:UNDI:002001",
+		Options:     []*Option{&Option{dhcp.OptionHostName, "node1"}},
+	})
+	assert.Nil(t, err, "Simulate should not fail: %v", err)
+	assert.Equal(t, code, 200, "Code should be 200, but is %d", code)
+	assert.Equal(t, res.Subnet, "fred", "Subnet should be fred, but is %s", res.Subnet)
+	assert.Equal(t, res.Class, "pxe", "Class should be pxe, but is %s", res.Class)
+	assert.Equal(t, res.Discover.Type, "offer", "Discover should get an offer, but got %s", res.Discover.Type)
+	assert.Equal(t, res.Discover.Ip.String(), "192.168.128.5", "Offer should be 192.168.128.5, but is %s", res.Discover.Ip)
+	assert.Equal(t, res.Discover.NextServer.String(), next, "Offer next server should be %s, but is %s", next, res.Discover.NextServer)
+	assert.Equal(t, res.Discover.BootFile, "lpxelinux.0", "Offer boot file should be lpxelinux.0, but is %s", res.Discover.BootFile)
+	assert.Equal(t, res.Request.Type, "ack", "Request should get an ack, but got %s", res.Request.Type)
+	assert.Equal(t, res.Request.NextServer.String(), next, "Next server should be %s, but is %s", next, res.Request.NextServer)
+	assert.Equal(t, res.Request.BootFile, "lpxelinux.0", "Boot file should be lpxelinux.0, but is %s", res.Request.BootFile)
+	found := false
+	for _, o := range res.Request.Options {
+		if o.Code == dhcp.OptionRouter {
+			found = true
+			assert.Equal(t, o.Value, "192.168.128.1", "Router should be rendered, but is %s", o.Value)
+		}
+	}
+	assert.True(t, found, "Router option should be in the ack")
+
+	assert.Equal(t, len(s.Leases), 0, "Simulate should not create leases")
+	assert.Equal(t, len(f.changes), 0, "Simulate should not publish to DNS")
+}
+
+func TestSimulateBinding(t *testing.T) {
+	dt, s := simpleSetup()
+	next := "192.168.128.3"
+	dt.AddBinding("fred", Binding{Ip: net.ParseIP("192.168.128.50"), Mac: "aa:bb:cc:dd:ee:ff", NextServer: &next})
+
+	res, err, _ := dt.Simulate("fred", &SimulateRequest{Mac: "aa:bb:cc:dd:ee:ff"})
+	assert.Nil(t, err, "Simulate should not fail: %v", err)
+	assert.Equal(t, res.Request.Ip.String(), "192.168.128.50", "Bound address should be handed out, but got %s", res.Request.Ip)
+	assert.Equal(t, res.Discover.NextServer.String(), next, "Binding next server should be offered, but got %s", res.Discover.NextServer)
+	assert.Equal(t, res.Request.NextServer.String(), next, "Binding next server should be used, but got %s", res.Request.NextServer)
+	assert.Equal(t, len(s.Leases), 0, "Simulate should not create leases")
+}
+
+func TestSimulateErrors(t *testing.T) {
+	dt, _ := simpleSetup()
+
+	_, err, code := dt.Simulate("bob", &SimulateRequest{Mac: "aa:bb:cc:dd:ee:ff"})
+	assert.NotNil(t, err, "Missing subnet should fail")
+	assert.Equal(t, code, 404, "Code should be 404, but is %d", code)
+
+	_, err, code = dt.Simulate("fred", &SimulateRequest{Mac: "nope"})
+	assert.NotNil(t, err, "Bad MAC should fail")
+	assert.Equal(t, code, 400, "Code should be 400, but is %d", code)
+
+	res, err, _ := dt.Simulate("fred", &SimulateRequest{Mac: "aa:bb:cc:dd:ee:ff", GIAddr: net.ParseIP("10.0.0.1")})
+	assert.Nil(t, err, "Simulate should not fail: %v", err)
+	assert.Equal(t, res.Subnet, "", "Relay outside every subnet should not find one")
+	assert.Nil(t, res.Discover, "There should be no reply")
+}
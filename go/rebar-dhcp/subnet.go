@@ -5,10 +5,13 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net"
+	"strings"
 	"text/template"
 	"time"
 
@@ -42,6 +45,7 @@ type Lease struct {
 	Mac        string    `json:"mac"`
 	Valid      bool      `json:"valid"`
 	ExpireTime time.Time `json:"expire_time"`
+	Hostname   string    `json:"hostname,omitempty"` // Name published in DNS
 }
 
 func (l *Lease) Phantom() bool {
@@ -49,49 +53,157 @@ func (l *Lease) Phantom() bool {
 	return addr[0] == 00 && addr[1] == 0x53
 }
 
+// Binding pins an address to a client.  Clients are matched by their
+// DHCP client identifier (option 61), by the DUID in an RFC 4361
+// client identifier, by MAC address, or for relayed requests by the
+// switch port they are plugged into (option 82 circuit id, optionally
+// qualified by the remote id of the relay agent).  Client ids and
+// DUIDs are hex-encoded.  Circuit and remote ids are matched either
+// as raw strings or as hex-encoded bytes.
+//
+// A binding can also pin the hostname and domain name the client is
+// given in options 12 and 15.
 type Binding struct {
 	Ip         net.IP    `json:"ip"`
-	Mac        string    `json:"mac"`
+	Mac        string    `json:"mac,omitempty"`
+	ClientId   string    `json:"client_id,omitempty"`
+	Duid       string    `json:"duid,omitempty"`
+	CircuitId  string    `json:"circuit_id,omitempty"`
+	RemoteId   string    `json:"remote_id,omitempty"`
+	Hostname   string    `json:"hostname,omitempty"`
+	Domain     string    `json:"domain,omitempty"`
 	Options    []*Option `json:"options,omitempty"`
 	NextServer *string   `json:"next_server,omitempty"`
 }
 
+// normalizeHex lowercases a hex string and strips the separators
+// people like to put in them.
+func normalizeHex(s string) (string, error) {
+	s = strings.ToLower(strings.NewReplacer(":", "", "-", "", " ", "").Replace(s))
+	if _, err := hex.DecodeString(s); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// validate checks that the binding has something to match clients on
+// and puts its keys in canonical form.
+func (b *Binding) validate() error {
+	var err error
+	b.Mac = strings.ToLower(b.Mac)
+	if b.ClientId, err = normalizeHex(b.ClientId); err != nil {
+		return fmt.Errorf("Invalid client_id: %v", err)
+	}
+	if b.Duid, err = normalizeHex(b.Duid); err != nil {
+		return fmt.Errorf("Invalid duid: %v", err)
+	}
+	if b.Mac == "" && b.ClientId == "" && b.Duid == "" && b.CircuitId == "" {
+		return errors.New("Binding must have a mac, client_id, duid or circuit_id")
+	}
+	if b.Hostname != "" {
+		b.Hostname = strings.ToLower(b.Hostname)
+		if !validHostname(b.Hostname) {
+			return fmt.Errorf("Invalid hostname %s", b.Hostname)
+		}
+	}
+	b.Domain = strings.TrimSuffix(strings.ToLower(b.Domain), ".")
+	return nil
+}
+
+// key returns the key the binding is stored under in Subnet.Bindings.
+// It is also what needs to be passed to unbind it.
+func (b *Binding) key() string {
+	switch {
+	case b.Mac != "":
+		return b.Mac
+	case b.ClientId != "":
+		return "client-" + b.ClientId
+	case b.Duid != "":
+		return "duid-" + b.Duid
+	}
+	k := "circuit-" + hex.EncodeToString([]byte(b.CircuitId))
+	if b.RemoteId != "" {
+		k += "-" + hex.EncodeToString([]byte(b.RemoteId))
+	}
+	return k
+}
+
+// clientIdKeys returns the binding keys that the client identifier
+// in options can match, most specific first.
+func clientIdKeys(options dhcp.Options) []string {
+	id := options[dhcp.OptionClientIdentifier]
+	if len(id) == 0 {
+		return nil
+	}
+	res := []string{"client-" + hex.EncodeToString(id)}
+	// RFC 4361: type 255, then a 4 byte IAID, then the DUID.
+	if id[0] == 255 && len(id) > 5 {
+		res = append(res, "duid-"+hex.EncodeToString(id[5:]))
+	}
+	return res
+}
+
+func relayIdMatches(want string, got []byte) bool {
+	return want == string(got) || strings.EqualFold(want, hex.EncodeToString(got))
+}
+
+// matchesRelay returns true if this is a circuit binding for the
+// switch port in the relay agent information.
+func (b *Binding) matchesRelay(rai dhcp.RelayAgentInformation) bool {
+	if b.CircuitId == "" || !relayIdMatches(b.CircuitId, rai.CircuitId()) {
+		return false
+	}
+	return b.RemoteId == "" || relayIdMatches(b.RemoteId, rai.RemoteId())
+}
+
 type Subnet struct {
 	Name              string
 	Subnet            *MyIPNet
 	NextServer        *net.IP `json:",omitempty"`
 	ActiveStart       net.IP
 	ActiveEnd         net.IP
+	Pools             []*Pool  // Extra address pools beyond ActiveStart - ActiveEnd
+	Exclusions        []net.IP // Addresses never to hand out
 	ActiveLeaseTime   time.Duration
 	ReservedLeaseTime time.Duration
 	OnlyBoundLeases   bool
 	Leases            map[string]*Lease
 	Bindings          map[string]*Binding
-	Options           []*Option // Options to send to DHCP Clients
+	Conflicts         map[string]*Conflict // Addresses that answered a probe
+	Options           []*Option            // Options to send to DHCP Clients
+	Classes           []*ClientClass
+	Ddns              *DdnsConfig // Where to publish client names
 	TenantId          int
 }
 
 func NewSubnet() *Subnet {
 	return &Subnet{
-		Leases:   make(map[string]*Lease),
-		Bindings: make(map[string]*Binding),
-		Options:  make([]*Option, 0),
+		Leases:    make(map[string]*Lease),
+		Bindings:  make(map[string]*Binding),
+		Conflicts: make(map[string]*Conflict),
+		Options:   make([]*Option, 0),
+		Classes:   make([]*ClientClass, 0),
 	}
 }
 
 type apiSubnet struct {
-	Name              string     `json:"name"`
-	Subnet            string     `json:"subnet"`
-	NextServer        *string    `json:"next_server,omitempty"`
-	ActiveStart       string     `json:"active_start"`
-	ActiveEnd         string     `json:"active_end"`
-	ActiveLeaseTime   int        `json:"active_lease_time"`
-	ReservedLeaseTime int        `json:"reserved_lease_time"`
-	OnlyBoundLeases   bool       `json:"only_bound_leases"`
-	Leases            []*Lease   `json:"leases,omitempty"`
-	Bindings          []*Binding `json:"bindings,omitempty"`
-	Options           []*Option  `json:"options,omitempty"`
-	TenantId          int        `json:"tenant_id"`
+	Name              string         `json:"name"`
+	Subnet            string         `json:"subnet"`
+	NextServer        *string        `json:"next_server,omitempty"`
+	ActiveStart       string         `json:"active_start"`
+	ActiveEnd         string         `json:"active_end"`
+	Pools             []*Pool        `json:"pools,omitempty"`
+	Exclusions        []net.IP       `json:"exclusions,omitempty"`
+	ActiveLeaseTime   int            `json:"active_lease_time"`
+	ReservedLeaseTime int            `json:"reserved_lease_time"`
+	OnlyBoundLeases   bool           `json:"only_bound_leases"`
+	Leases            []*Lease       `json:"leases,omitempty"`
+	Bindings          []*Binding     `json:"bindings,omitempty"`
+	Conflicts         []*Conflict    `json:"conflicts,omitempty"`
+	Options           []*Option      `json:"options,omitempty"`
+	Classes           []*ClientClass `json:"classes,omitempty"`
+	Ddns              *DdnsConfig    `json:"ddns,omitempty"`
+	TenantId          int            `json:"tenant_id"`
 }
 
 func (s *Subnet) MarshalJSON() ([]byte, error) {
@@ -100,11 +212,16 @@ func (s *Subnet) MarshalJSON() ([]byte, error) {
 		Subnet:            s.Subnet.String(),
 		ActiveStart:       s.ActiveStart.String(),
 		ActiveEnd:         s.ActiveEnd.String(),
+		Pools:             s.Pools,
+		Exclusions:        s.Exclusions,
 		ActiveLeaseTime:   int(s.ActiveLeaseTime.Seconds()),
 		ReservedLeaseTime: int(s.ReservedLeaseTime.Seconds()),
 		Options:           s.Options,
+		Classes:           s.Classes,
+		Ddns:              s.Ddns,
 		Leases:            make([]*Lease, len(s.Leases)),
 		Bindings:          make([]*Binding, len(s.Bindings)),
+		Conflicts:         make([]*Conflict, 0, len(s.Conflicts)),
 		TenantId:          s.TenantId,
 	}
 	if s.NextServer != nil {
@@ -121,6 +238,9 @@ func (s *Subnet) MarshalJSON() ([]byte, error) {
 		as.Bindings[i] = binding
 		i++
 	}
+	for _, conflict := range s.Conflicts {
+		as.Conflicts = append(as.Conflicts, conflict)
+	}
 	return json.Marshal(as)
 }
 
@@ -146,6 +266,15 @@ func (s *Subnet) UnmarshalJSON(data []byte) error {
 		return errors.New("ActiveEnd not in Subnet")
 	}
 
+	s.Pools = as.Pools
+	s.Exclusions = make([]net.IP, len(as.Exclusions))
+	for i, e := range as.Exclusions {
+		s.Exclusions[i] = e.To4()
+	}
+	if err := s.validatePools(); err != nil {
+		return err
+	}
+
 	s.ActiveLeaseTime = time.Duration(as.ActiveLeaseTime) * time.Second
 	s.ReservedLeaseTime = time.Duration(as.ReservedLeaseTime) * time.Second
 	if as.NextServer != nil {
@@ -171,10 +300,35 @@ func (s *Subnet) UnmarshalJSON(data []byte) error {
 	}
 
 	for _, v := range as.Bindings {
-		s.Bindings[v.Mac] = v
+		s.Bindings[v.key()] = v
+	}
+
+	if s.Conflicts == nil {
+		s.Conflicts = map[string]*Conflict{}
+	}
+
+	for _, v := range as.Conflicts {
+		s.Conflicts[v.Ip.String()] = v
 	}
 
 	s.Options = as.Options
+	classNames := map[string]struct{}{}
+	for _, c := range as.Classes {
+		if err := c.validate(); err != nil {
+			return err
+		}
+		if _, found := classNames[c.Name]; found {
+			return errors.New("Duplicate client class " + c.Name)
+		}
+		classNames[c.Name] = struct{}{}
+	}
+	s.Classes = as.Classes
+	if as.Ddns != nil {
+		if err := as.Ddns.validate(); err != nil {
+			return err
+		}
+	}
+	s.Ddns = as.Ddns
 	s.TenantId = as.TenantId
 	mask := net.IP([]byte(net.IP(netdata.Mask).To4()))
 	bcastBits := binary.BigEndian.Uint32(netdata.IP) | ^binary.BigEndian.Uint32(mask)
@@ -188,37 +342,107 @@ func (s *Subnet) UnmarshalJSON(data []byte) error {
 func (subnet *Subnet) freeLease(dt *DataTracker, nic string) {
 	lease := subnet.Leases[nic]
 	if lease != nil {
+		subnet.unpublishLease(lease)
 		delete(subnet.Leases, nic)
 		dt.save_data()
 	}
 }
 
+// InRange returns true if addr is in one of the subnet's pools and
+// has not been excluded.
 func (s *Subnet) InRange(addr net.IP) bool {
-	return bytes.Compare(addr, s.ActiveStart) >= 0 &&
-		bytes.Compare(addr, s.ActiveEnd) <= 0
+	return s.findPool(addr) != nil && !s.excluded(addr)
+}
+
+// findBinding returns the binding for the client, looking first by
+// client identifier, then by MAC address and then by the relay agent
+// information in options.  Bindings that name a remote id win over
+// ones that do not.
+func (subnet *Subnet) findBinding(nic string, options dhcp.Options) *Binding {
+	for _, k := range clientIdKeys(options) {
+		if b := subnet.Bindings[k]; b != nil {
+			return b
+		}
+	}
+	if b := subnet.Bindings[nic]; b != nil {
+		return b
+	}
+	raw, ok := options[dhcp.OptionRelayAgentInformation]
+	if !ok {
+		return nil
+	}
+	rai := dhcp.ParseRelayAgentInformation(raw)
+	var res *Binding
+	for _, b := range subnet.Bindings {
+		if b.matchesRelay(rai) && (res == nil || res.RemoteId == "") {
+			res = b
+		}
+	}
+	return res
 }
 
-func (subnet *Subnet) findInfo(dt *DataTracker, nic string) (*Lease, *Binding) {
+func (subnet *Subnet) boundIP(ip net.IP) bool {
+	for _, b := range subnet.Bindings {
+		if b.Ip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (subnet *Subnet) findInfo(dt *DataTracker, nic string, options dhcp.Options) (*Lease, *Binding) {
 	l := subnet.Leases[nic]
-	b := subnet.Bindings[nic]
+	b := subnet.findBinding(nic, options)
 	return l, b
 }
 
+// poolUsage returns a bitset with a bit set for every address in
+// pool that cannot be handed out because it is leased, bound,
+// excluded or quarantined.  Expired leases do not count, since
+// getFreeIP reclaims them.
+func (subnet *Subnet) poolUsage(pool *Pool) *bitset.BitSet {
+	used := bitset.New(uint(dhcp.IPRange(pool.Start, pool.End)))
+	now := time.Now()
+	for _, v := range subnet.Leases {
+		if pool.InRange(v.Ip) && !now.After(v.ExpireTime) {
+			used.Set(uint(dhcp.IPRange(pool.Start, v.Ip) - 1))
+		}
+	}
+	// Make sure that any static bindings in our range are masked out.
+	for _, v := range subnet.Bindings {
+		if pool.InRange(v.Ip) {
+			used.Set(uint(dhcp.IPRange(pool.Start, v.Ip) - 1))
+		}
+	}
+	// As are any addresses we have been told to stay away from.
+	for _, v := range subnet.Exclusions {
+		if pool.InRange(v) {
+			used.Set(uint(dhcp.IPRange(pool.Start, v) - 1))
+		}
+	}
+	for _, v := range subnet.Conflicts {
+		if pool.InRange(v.Ip) {
+			used.Set(uint(dhcp.IPRange(pool.Start, v.Ip) - 1))
+		}
+	}
+	return used
+}
+
 // This will need to be updated to be more efficient with larger
 // subnets.  Class C and below should be fine, however.
-func (subnet *Subnet) getFreeIP() (*net.IP, bool) {
+func (subnet *Subnet) getFreeIP(class *ClientClass) (*net.IP, bool) {
 	// Free invalid or expired leases
-	used := bitset.New(uint(dhcp.IPRange(subnet.ActiveStart, subnet.ActiveEnd)))
 	saveMe := false
 	for k, v := range subnet.Leases {
 		// If the lease has expired, whack it.
 		if time.Now().After(v.ExpireTime) {
+			subnet.unpublishLease(v)
 			delete(subnet.Leases, k)
 			saveMe = true
 			continue
 		}
 		if !subnet.InRange(v.Ip) {
-			if _, found := subnet.Bindings[k]; found {
+			if _, found := subnet.Bindings[k]; found || subnet.boundIP(v.Ip) {
 				// Lease is out of range, but we have a static binding for
 				// it that matches.  Leave it alone.
 				continue
@@ -242,31 +466,62 @@ func (subnet *Subnet) getFreeIP() (*net.IP, bool) {
 			v.Valid = true
 			saveMe = true
 		}
-		used.Set(uint(dhcp.IPRange(subnet.ActiveStart, v.Ip) - 1))
 	}
-	// Make sure that any static bindings in our range are masked out.
-	for _, v := range subnet.Bindings {
-		if subnet.InRange(v.Ip) {
-			used.Set(uint(dhcp.IPRange(subnet.ActiveStart, v.Ip) - 1))
+	for k, v := range subnet.Conflicts {
+		if time.Now().After(v.ExpireTime) {
+			delete(subnet.Conflicts, k)
+			saveMe = true
 		}
 	}
-	used = used.Complement()
-	bit, success := used.NextSet(0)
-	if success || used.Len() == 0 {
-		ip := dhcp.IPAdd(subnet.ActiveStart, int(bit))
-		return &ip, true
+	for _, pool := range subnet.poolsFor(class) {
+		used := subnet.poolUsage(pool)
+		used = used.Complement()
+		bit, success := used.NextSet(0)
+		if success || used.Len() == 0 {
+			ip := dhcp.IPAdd(pool.Start, int(bit))
+			return &ip, true
+		}
 	}
 	return nil, saveMe
 }
 
-func (subnet *Subnet) findOrGetInfo(dt *DataTracker, nic string, suggest net.IP) (*Lease, *Binding) {
-	binding := subnet.Bindings[nic]
+func (subnet *Subnet) findOrGetInfo(dt *DataTracker, nic string, suggest net.IP, class *ClientClass, options dhcp.Options) (*Lease, *Binding) {
+	binding := subnet.findBinding(nic, options)
 	lease := subnet.Leases[nic]
 
 	if binding == nil {
 		if lease == nil {
 			// We have neither a lease nor a binding, create a lease.
-			theip, saveMe := subnet.getFreeIP()
+			var theip *net.IP
+			saveMe := false
+			for i := 0; i < maxProbes; i++ {
+				var freed bool
+				theip, freed = subnet.getFreeIP(class)
+				saveMe = saveMe || freed
+				if theip == nil {
+					break
+				}
+				inUse := dt.probeUnlocked(*theip)
+				// The tracker was unlocked while we probed, so make
+				// sure the world is still the way we left it.
+				if dt.Subnets[subnet.Name] != subnet {
+					return nil, nil
+				}
+				if lease = subnet.Leases[nic]; lease != nil {
+					// Another packet from this client got in first.
+					if saveMe {
+						dt.save_data()
+					}
+					return lease, nil
+				}
+				if inUse {
+					subnet.quarantine(*theip)
+					saveMe = true
+				} else if !subnet.addressTaken(*theip) {
+					break
+				}
+				theip = nil
+			}
 			if theip == nil {
 				if saveMe {
 					dt.save_data()
@@ -277,7 +532,7 @@ func (subnet *Subnet) findOrGetInfo(dt *DataTracker, nic string, suggest net.IP)
 				Ip:         *theip,
 				Mac:        nic,
 				Valid:      true,
-				ExpireTime: time.Now().Add(subnet.ActiveLeaseTime),
+				ExpireTime: time.Now().Add(subnet.leaseTime(*theip)),
 			}
 			subnet.Leases[nic] = lease
 			dt.save_data()
@@ -288,6 +543,16 @@ func (subnet *Subnet) findOrGetInfo(dt *DataTracker, nic string, suggest net.IP)
 	if lease != nil && lease.Ip.Equal(binding.Ip) {
 		return lease, binding
 	}
+	subnet.unpublishLease(lease)
+	// The binding now belongs to this client, so any other client still
+	// holding its address (such as the server this one replaced in a
+	// circuit binding) loses its lease.
+	for k, v := range subnet.Leases {
+		if k != nic && v.Ip.Equal(binding.Ip) {
+			subnet.unpublishLease(v)
+			delete(subnet.Leases, k)
+		}
+	}
 	lease = &Lease{
 		Ip:         binding.Ip,
 		Mac:        nic,
@@ -305,7 +570,7 @@ func (s *Subnet) updateLeaseTime(dt *DataTracker, lease *Lease, d time.Duration)
 }
 
 func (s *Subnet) phantomLease(dt *DataTracker, nic string) {
-	lease, _ := s.findInfo(dt, nic)
+	lease, _ := s.findInfo(dt, nic, nil)
 	if lease == nil {
 		return
 	}
@@ -317,6 +582,7 @@ func (s *Subnet) phantomLease(dt *DataTracker, nic string) {
 	// We use it to ensure that we don't collide with real mac address ranges.
 	addr[0] = 0x00
 	addr[1] = 0x53
+	s.unpublishLease(lease)
 	lease.Valid = false
 	// Phantom leases expire in 30 seconds.  This allows getFreeIP to cycle through
 	// address ranges when a client NAKs a lease.
@@ -327,10 +593,26 @@ func (s *Subnet) phantomLease(dt *DataTracker, nic string) {
 	dt.save_data()
 }
 
-func (s *Subnet) buildOptions(lease *Lease, binding *Binding, p dhcp.Packet) (dhcp.Options, time.Duration) {
+// setBootServer fills in the siaddr and file fields of an offer or
+// ack.  A binding's next server wins over its class's, which wins over
+// the subnet's.
+func (s *Subnet) setBootServer(reply dhcp.Packet, binding *Binding, class *ClientClass) {
+	if binding != nil && binding.NextServer != nil {
+		reply.SetSIAddr(net.ParseIP(*binding.NextServer))
+	} else if class != nil && class.NextServer != nil {
+		reply.SetSIAddr(net.ParseIP(*class.NextServer))
+	} else if s.NextServer != nil {
+		reply.SetSIAddr(*s.NextServer)
+	}
+	if class != nil && class.BootFile != "" {
+		reply.SetFile([]byte(class.BootFile))
+	}
+}
+
+func (s *Subnet) buildOptions(lease *Lease, binding *Binding, class *ClientClass, p dhcp.Packet) (dhcp.Options, time.Duration) {
 	var lt time.Duration
 	if binding == nil {
-		lt = s.ActiveLeaseTime
+		lt = s.leaseTime(lease.Ip)
 	} else {
 		lt = s.ReservedLeaseTime
 	}
@@ -360,6 +642,21 @@ func (s *Subnet) buildOptions(lease *Lease, binding *Binding, p dhcp.Packet) (dh
 		opts[c] = v
 	}
 
+	// fold in client class options
+	if class != nil {
+		if class.BootFile != "" {
+			opts[dhcp.OptionBootFileName] = []byte(class.BootFile)
+		}
+		for _, opt := range class.Options {
+			c, v, err := opt.RenderToDHCP(srcOpts)
+			if err != nil {
+				log.Printf("Failed to render option %v: %v, %v\n", opt.Code, opt.Value, err)
+				continue
+			}
+			opts[c] = v
+		}
+	}
+
 	// fold in binding options
 	if binding != nil {
 		for _, opt := range binding.Options {
@@ -370,6 +667,12 @@ func (s *Subnet) buildOptions(lease *Lease, binding *Binding, p dhcp.Packet) (dh
 			}
 			opts[c] = v
 		}
+		if binding.Hostname != "" {
+			opts[dhcp.OptionHostName] = []byte(binding.Hostname)
+		}
+		if binding.Domain != "" {
+			opts[dhcp.OptionDomainName] = []byte(binding.Domain)
+		}
 	}
 
 	return opts, lt
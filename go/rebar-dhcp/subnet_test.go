@@ -6,8 +6,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/digitalrebar/digitalrebar/go/rebar-dhcp/dhcp"
 	"github.com/stretchr/testify/assert"
-	"github.com/willf/bitset"
 )
 
 func TestNewSubnet(t *testing.T) {
@@ -16,7 +16,7 @@ func TestNewSubnet(t *testing.T) {
 	assert.NotNil(t, subnet.Leases, "Leases must not be nil")
 	assert.NotNil(t, subnet.Bindings, "Bindings must not be nil")
 	assert.NotNil(t, subnet.Options, "Options must not be nil")
-	assert.NotNil(t, subnet.ActiveBits, "ActiveBits must not be nil")
+	assert.NotNil(t, subnet.Conflicts, "Conflicts must not be nil")
 }
 
 func TestFreeLeaseNoMatch(t *testing.T) {
@@ -30,27 +30,28 @@ func TestFreeLeaseNoMatch(t *testing.T) {
 	assert.Nil(t, s.Leases["two"], "Lease two should be nil")
 }
 
-// Freeing a lease should clear a set ActiveBit if in range
+// Freeing a lease should free its address in the pool
 func TestFreeLeaseMatch(t *testing.T) {
 	dt, s := simpleSetup()
 
 	s.Leases["one"] = &Lease{}
 	s.Leases["two"] = &Lease{
-		Ip: s.ActiveStart,
+		Ip:         s.ActiveStart,
+		ExpireTime: time.Now().Add(time.Hour),
 	}
-	s.ActiveBits.Set(0)
+	assert.True(t, s.poolUsage(s.activePool()).Test(0), "First bit should be true")
 
 	s.freeLease(dt, "two")
 
 	assert.NotNil(t, s.Leases["one"], "Lease one should not be nil")
 	assert.Nil(t, s.Leases["two"], "Lease two should be nil")
-	assert.False(t, s.ActiveBits.Test(0), "First bit should be false")
+	assert.False(t, s.poolUsage(s.activePool()).Test(0), "First bit should be false")
 }
 
 func TestFindInfoNothing(t *testing.T) {
 	dt, s := simpleSetup()
 
-	l, b := s.findInfo(dt, "fred")
+	l, b := s.findInfo(dt, "fred", nil)
 
 	assert.Nil(t, l, "Lease should be nil")
 	assert.Nil(t, b, "Binding should be nil")
@@ -61,7 +62,7 @@ func TestFindInfoLeaseButNotBinding(t *testing.T) {
 
 	s.Leases["fred"] = &Lease{}
 
-	l, b := s.findInfo(dt, "fred")
+	l, b := s.findInfo(dt, "fred", nil)
 
 	assert.NotNil(t, l, "Lease should not be nil")
 	assert.Nil(t, b, "Binding should be nil")
@@ -72,7 +73,7 @@ func TestFindInfoBindingButNoLease(t *testing.T) {
 
 	s.Bindings["fred"] = &Binding{}
 
-	l, b := s.findInfo(dt, "fred")
+	l, b := s.findInfo(dt, "fred", nil)
 
 	assert.Nil(t, l, "Lease should be nil")
 	assert.NotNil(t, b, "Binding should not be nil")
@@ -84,40 +85,57 @@ func TestFindInfoLeaseAndBinding(t *testing.T) {
 	s.Leases["fred"] = &Lease{}
 	s.Bindings["fred"] = &Binding{}
 
-	l, b := s.findInfo(dt, "fred")
+	l, b := s.findInfo(dt, "fred", nil)
 
 	assert.NotNil(t, l, "Lease should not be nil")
 	assert.NotNil(t, b, "Binding should not be nil")
 }
 
-func TestFirstClearBitNothing(t *testing.T) {
-	bs := bitset.New(2)
+// useAddresses leases the addresses in the active range whose offsets
+// are passed.
+func useAddresses(s *Subnet, offsets ...int) {
+	for _, i := range offsets {
+		s.Leases[fmt.Sprintf("used%d", i)] = &Lease{
+			Ip:         dhcp.IPAdd(s.ActiveStart, i),
+			Valid:      true,
+			ExpireTime: time.Now().Add(time.Hour),
+		}
+	}
+}
+
+func TestGetFreeIPNothingUsed(t *testing.T) {
+	_, s := simpleSetup()
 
-	i, s := firstClearBit(bs)
-	assert.Equal(t, i, uint(0), "First bit should be 0")
-	assert.True(t, s, "Success should be true")
+	ip, _ := s.getFreeIP(nil)
+	assert.NotNil(t, ip, "There should be a free address")
+	assert.Equal(t, ip.String(), s.ActiveStart.String(), "First address should be free")
 }
 
-func TestFirstClearBitAllSet(t *testing.T) {
-	bs := bitset.New(2)
+func TestGetFreeIPAllUsed(t *testing.T) {
+	_, s := simpleSetup()
 
-	bs.Set(0)
-	bs.Set(1)
+	offsets := []int{}
+	for i := 0; i < dhcp.IPRange(s.ActiveStart, s.ActiveEnd); i++ {
+		offsets = append(offsets, i)
+	}
+	useAddresses(s, offsets...)
 
-	i, s := firstClearBit(bs)
-	assert.Equal(t, i, uint(0), "First bit should be 0")
-	assert.False(t, s, "Success should be false")
+	ip, _ := s.getFreeIP(nil)
+	assert.Nil(t, ip, "There should be no free address")
 }
 
-func TestFirstClearBitLastBit(t *testing.T) {
-	bs := bitset.New(3)
+func TestGetFreeIPLastAddress(t *testing.T) {
+	_, s := simpleSetup()
 
-	bs.Set(0)
-	bs.Set(1)
+	offsets := []int{}
+	for i := 0; i < dhcp.IPRange(s.ActiveStart, s.ActiveEnd)-1; i++ {
+		offsets = append(offsets, i)
+	}
+	useAddresses(s, offsets...)
 
-	i, s := firstClearBit(bs)
-	assert.Equal(t, i, uint(2), "First bit should be 2")
-	assert.True(t, s, "Success should be true")
+	ip, _ := s.getFreeIP(nil)
+	assert.NotNil(t, ip, "There should be a free address")
+	assert.Equal(t, ip.String(), s.ActiveEnd.String(), "Last address should be free")
 }
 
 func TestRunOutOfIps(t *testing.T) {
@@ -125,14 +143,14 @@ func TestRunOutOfIps(t *testing.T) {
 
 	for i := 5; i <= 25; i++ {
 		id := fmt.Sprintf("fred%d", i)
-		l, b := s.findOrGetInfo(dt, id, net.ParseIP("0.0.0.0"))
+		l, b := s.findOrGetInfo(dt, id, net.ParseIP("0.0.0.0"), nil, nil)
 
 		assert.NotNil(t, l, "Lease should not be nil")
 		assert.Nil(t, b, "Binding should not be nil")
 
 		s.updateLeaseTime(dt, l, 360*time.Second)
 	}
-	l, b := s.findOrGetInfo(dt, "fred26", net.ParseIP("0.0.0.0"))
+	l, b := s.findOrGetInfo(dt, "fred26", net.ParseIP("0.0.0.0"), nil, nil)
 	assert.Nil(t, l, "Lease should not be nil")
 	assert.Nil(t, b, "Binding should not be nil")
 }
@@ -142,7 +160,7 @@ func TestReleaseIp(t *testing.T) {
 
 	for i := 5; i <= 25; i++ {
 		id := fmt.Sprintf("fred%d", i)
-		l, b := s.findOrGetInfo(dt, id, net.ParseIP("0.0.0.0"))
+		l, b := s.findOrGetInfo(dt, id, net.ParseIP("0.0.0.0"), nil, nil)
 
 		assert.NotNil(t, l, "Lease should not be nil")
 		assert.Nil(t, b, "Binding should not be nil")
@@ -152,7 +170,119 @@ func TestReleaseIp(t *testing.T) {
 
 	s.freeLease(dt, "fred10")
 
-	l, b := s.findOrGetInfo(dt, "fred26", net.ParseIP("0.0.0.0"))
+	l, b := s.findOrGetInfo(dt, "fred26", net.ParseIP("0.0.0.0"), nil, nil)
 	assert.NotNil(t, l, "Lease should not be nil")
 	assert.Nil(t, b, "Binding should not be nil")
 }
+
+func TestFindBindingByCircuit(t *testing.T) {
+	dt, s := simpleSetup()
+
+	dt.AddBinding("fred", Binding{Ip: net.ParseIP("192.168.128.50"), CircuitId: "Gi1/0/1"})
+	dt.AddBinding("fred", Binding{Ip: net.ParseIP("192.168.128.51"), CircuitId: "Gi1/0/1", RemoteId: "0a0b0c0d0e0f"})
+
+	assert.NotNil(t, s.Bindings["circuit-4769312f302f31"], "Circuit binding should be keyed by hex circuit id")
+	assert.NotNil(t, s.Bindings["circuit-4769312f302f31-306130623063306430653066"], "Circuit binding should be keyed by hex circuit and remote id")
+
+	options := dhcp.Options{dhcp.OptionRelayAgentInformation: []byte{1, 7, 'G', 'i', '1', '/', '0', '/', '1'}}
+	b := s.findBinding("aa:bb:cc:dd:ee:ff", options)
+	assert.NotNil(t, b, "Binding should not be nil")
+	assert.Equal(t, b.Ip.String(), "192.168.128.50", "Binding ip should be 192.168.128.50, but is %s", b.Ip.String())
+
+	options = dhcp.Options{dhcp.OptionRelayAgentInformation: []byte{1, 7, 'G', 'i', '1', '/', '0', '/', '1', 2, 6, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}}
+	b = s.findBinding("aa:bb:cc:dd:ee:ff", options)
+	assert.NotNil(t, b, "Binding should not be nil")
+	assert.Equal(t, b.Ip.String(), "192.168.128.51", "Binding with matching remote id should win, but got %s", b.Ip.String())
+
+	options = dhcp.Options{dhcp.OptionRelayAgentInformation: []byte{1, 7, 'G', 'i', '1', '/', '0', '/', '2'}}
+	assert.Nil(t, s.findBinding("aa:bb:cc:dd:ee:ff", options), "Other port should not match")
+	assert.Nil(t, s.findBinding("aa:bb:cc:dd:ee:ff", nil), "No relay info should not match")
+}
+
+func TestFindOrGetInfoCircuitReplacement(t *testing.T) {
+	dt, s := simpleSetup()
+
+	dt.AddBinding("fred", Binding{Ip: net.ParseIP("192.168.128.50"), CircuitId: "port1"})
+	options := dhcp.Options{dhcp.OptionRelayAgentInformation: []byte{1, 5, 'p', 'o', 'r', 't', '1'}}
+
+	l, b := s.findOrGetInfo(dt, "aa:bb:cc:dd:ee:01", nil, nil, options)
+	assert.NotNil(t, b, "Binding should not be nil")
+	assert.Equal(t, l.Ip.String(), "192.168.128.50", "Lease ip should be 192.168.128.50, but is %s", l.Ip.String())
+
+	// The server in port1 was replaced, new MAC gets the same address.
+	l, b = s.findOrGetInfo(dt, "aa:bb:cc:dd:ee:02", nil, nil, options)
+	assert.NotNil(t, b, "Binding should not be nil")
+	assert.Equal(t, l.Ip.String(), "192.168.128.50", "Lease ip should be 192.168.128.50, but is %s", l.Ip.String())
+	assert.Nil(t, s.Leases["aa:bb:cc:dd:ee:01"], "Old server's lease should be gone")
+	assert.Equal(t, len(s.Leases), 1, "There should be one lease")
+}
+
+func TestFindOrGetInfoCircuitReplacementUnpublishes(t *testing.T) {
+	dt, s := simpleSetup()
+	f, restore := withFakeDns()
+	defer restore()
+
+	s.Ddns = &DdnsConfig{Zone: "example.com"}
+	dt.AddBinding("fred", Binding{Ip: net.ParseIP("192.168.128.50"), CircuitId: "port1"})
+	options := dhcp.Options{dhcp.OptionRelayAgentInformation: []byte{1, 5, 'p', 'o', 'r', 't', '1'}}
+
+	old, _ := s.findOrGetInfo(dt, "aa:bb:cc:dd:ee:01", nil, nil, options)
+	s.publishLease(dt, old, "old-server")
+	f.changes = nil
+
+	s.findOrGetInfo(dt, "aa:bb:cc:dd:ee:02", nil, nil, options)
+	assert.Equal(t, len(f.changes), 1, "Old server's name should be removed")
+	assert.Equal(t, f.changes[0].Record, dnsRecord{ChangeType: "REMOVE", Content: "192.168.128.50", Name: "old-server", Type: "A"}, "A record is wrong")
+	assert.Nil(t, s.Leases["aa:bb:cc:dd:ee:01"], "Old server's lease should be gone")
+}
+
+func TestBindingValidate(t *testing.T) {
+	b := &Binding{Ip: net.ParseIP("192.168.128.50"), ClientId: "01:AA:BB:CC:DD:EE:FF", Hostname: "Node1", Domain: "Example.COM."}
+	assert.Nil(t, b.validate(), "Binding should be valid")
+	assert.Equal(t, b.ClientId, "01aabbccddeeff", "Client id should be normalized, but is %s", b.ClientId)
+	assert.Equal(t, b.Hostname, "node1", "Hostname should be lowercased, but is %s", b.Hostname)
+	assert.Equal(t, b.Domain, "example.com", "Domain should be normalized, but is %s", b.Domain)
+	assert.Equal(t, b.key(), "client-01aabbccddeeff", "Key should be client-01aabbccddeeff, but is %s", b.key())
+
+	assert.NotNil(t, (&Binding{Ip: net.ParseIP("192.168.128.50")}).validate(), "Binding without a key should fail")
+	assert.NotNil(t, (&Binding{Duid: "xyz"}).validate(), "Binding with a bad duid should fail")
+	assert.NotNil(t, (&Binding{Mac: "aa:bb:cc:dd:ee:ff", Hostname: "bad.name"}).validate(), "Binding with a bad hostname should fail")
+}
+
+func TestFindBindingByClientId(t *testing.T) {
+	dt, s := simpleSetup()
+
+	cid := &Binding{Ip: net.ParseIP("192.168.128.50"), ClientId: "01aabbccddeeff"}
+	duid := &Binding{Ip: net.ParseIP("192.168.128.51"), Duid: "0001000112345678"}
+	mac := &Binding{Ip: net.ParseIP("192.168.128.52"), Mac: "aa:bb:cc:dd:ee:ff"}
+	for _, b := range []*Binding{cid, duid, mac} {
+		assert.Nil(t, b.validate(), "Binding should be valid")
+		dt.AddBinding("fred", *b)
+	}
+
+	options := dhcp.Options{dhcp.OptionClientIdentifier: []byte{1, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}}
+	b := s.findBinding("aa:bb:cc:dd:ee:ff", options)
+	assert.NotNil(t, b, "Binding should not be nil")
+	assert.Equal(t, b.Ip.String(), "192.168.128.50", "Client id binding should win over MAC, but got %s", b.Ip.String())
+
+	// RFC 4361 client id: type 255, IAID, DUID.  A bonded host will
+	// send it from whichever NIC is up.
+	options = dhcp.Options{dhcp.OptionClientIdentifier: []byte{255, 0, 0, 0, 1, 0, 1, 0, 1, 0x12, 0x34, 0x56, 0x78}}
+	b = s.findBinding("aa:bb:cc:dd:ee:01", options)
+	assert.NotNil(t, b, "Binding should not be nil")
+	assert.Equal(t, b.Ip.String(), "192.168.128.51", "DUID binding should match, but got %s", b.Ip.String())
+
+	assert.Nil(t, s.findBinding("aa:bb:cc:dd:ee:01", dhcp.Options{dhcp.OptionClientIdentifier: []byte{1, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}}), "Other client id should not match")
+	assert.Equal(t, s.findBinding("aa:bb:cc:dd:ee:ff", nil), s.Bindings["aa:bb:cc:dd:ee:ff"], "MAC binding should still match")
+}
+
+func TestBuildOptionsPinnedName(t *testing.T) {
+	_, s := simpleSetup()
+	b := &Binding{Ip: net.ParseIP("192.168.128.50"), Mac: "aa:bb:cc:dd:ee:ff", Hostname: "node1", Domain: "example.com"}
+	l := &Lease{Ip: b.Ip, Mac: b.Mac}
+	p := dhcp.RequestPacket(dhcp.Request, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}, nil, []byte{1, 2, 3, 4}, false, nil)
+
+	opts, _ := s.buildOptions(l, b, nil, p)
+	assert.Equal(t, string(opts[dhcp.OptionHostName]), "node1", "Hostname should be pinned")
+	assert.Equal(t, string(opts[dhcp.OptionDomainName]), "example.com", "Domain should be pinned")
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/digitalrebar/digitalrebar/go/common/multi-tenancy"
+	"github.com/hashicorp/consul/api"
+)
+
+// AuditEntry is one change to a zone.  Before and After are the
+// records of every name and type the change touched, or the settings
+// for changes to the zone itself.
+type AuditEntry struct {
+	Zone           string        `json:"zone"`
+	Time           time.Time     `json:"time"`
+	User           string        `json:"user"` // From X-Authenticated-Username
+	TenantId       int           `json:"tenant_id"`
+	Action         string        `json:"action"` // PATCH, CREATE, UPDATE, DELETE or ROLLOVER
+	Serial         uint32        `json:"serial,omitempty"`
+	Before         []Record      `json:"before,omitempty"`
+	After          []Record      `json:"after,omitempty"`
+	SettingsBefore *ZoneSettings `json:"settings_before,omitempty"`
+	SettingsAfter  *ZoneSettings `json:"settings_after,omitempty"`
+}
+
+// AuditLogger keeps the changes made to zones.  Entries are only ever
+// appended.
+type AuditLogger interface {
+	Append(*AuditEntry) error
+	// History returns the entries for a zone, oldest first.
+	History(zone string) ([]*AuditEntry, error)
+}
+
+// FileAuditLog keeps the audit log as a file of JSON lines.
+type FileAuditLog struct {
+	sync.Mutex
+	path string
+}
+
+func NewFileAuditLog(path string) (*FileAuditLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return &FileAuditLog{path: path}, nil
+}
+
+func (fl *FileAuditLog) Append(entry *AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	fl.Lock()
+	defer fl.Unlock()
+	f, err := os.OpenFile(fl.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (fl *FileAuditLog) History(zone string) ([]*AuditEntry, error) {
+	fl.Lock()
+	defer fl.Unlock()
+	f, err := os.Open(fl.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	res := []*AuditEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		entry := &AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return nil, err
+		}
+		if entry.Zone == zone {
+			res = append(res, entry)
+		}
+	}
+	return res, scanner.Err()
+}
+
+// ConsulAuditLog keeps each entry in its own key, under a prefix for
+// the zone.
+type ConsulAuditLog struct {
+	store  *api.KV
+	prefix string
+}
+
+func NewConsulAuditLog(prefix string) (*ConsulAuditLog, error) {
+	client, err := api.NewClient(api.DefaultConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &ConsulAuditLog{store: client.KV(), prefix: prefix}, nil
+}
+
+func (cl *ConsulAuditLog) Append(entry *AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s/%s/%020d", cl.prefix, entry.Zone, entry.Time.UnixNano())
+	_, err = cl.store.Put(&api.KVPair{Key: key, Value: data}, nil)
+	return err
+}
+
+func (cl *ConsulAuditLog) History(zone string) ([]*AuditEntry, error) {
+	pairs, _, err := cl.store.List(cl.prefix+"/"+zone+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(kvPairsByKey(pairs))
+	res := make([]*AuditEntry, 0, len(pairs))
+	for _, pair := range pairs {
+		entry := &AuditEntry{}
+		if err := json.Unmarshal(pair.Value, entry); err != nil {
+			return nil, err
+		}
+		res = append(res, entry)
+	}
+	return res, nil
+}
+
+// recordKeys returns the name and type of every record, once each.
+func recordKeys(records []Record) [][2]string {
+	res := [][2]string{}
+	seen := map[[2]string]bool{}
+	for _, rec := range records {
+		k := [2]string{rec.Name, rec.Type}
+		if !seen[k] {
+			seen[k] = true
+			res = append(res, k)
+		}
+	}
+	return res
+}
+
+// rrsetRecords returns the records of a zone with the given names and
+// types.
+func (zd *ZoneData) rrsetRecords(zoneName string, keys [][2]string) []Record {
+	res := []Record{}
+	if zd == nil {
+		return res
+	}
+	for _, k := range keys {
+		if entry := zd.Entries[k[0]]; entry != nil {
+			for _, content := range entry.Types[k[1]] {
+				res = append(res, zoneRecord(zd, zoneName, k[0], k[1], content))
+			}
+		}
+	}
+	return res
+}
+
+// allRecords returns every record of a zone.
+func (zd *ZoneData) allRecords(zoneName string) []Record {
+	keys := [][2]string{}
+	for name, entry := range zd.Entries {
+		for t := range entry.Types {
+			keys = append(keys, [2]string{name, t})
+		}
+	}
+	sort.Sort(rrsetKeys(keys))
+	return zd.rrsetRecords(zoneName, keys)
+}
+
+type kvPairsByKey []*api.KVPair
+
+func (p kvPairsByKey) Len() int           { return len(p) }
+func (p kvPairsByKey) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p kvPairsByKey) Less(i, j int) bool { return p[i].Key < p[j].Key }
+
+// rrsetKeys orders name and type pairs by name, then type.
+type rrsetKeys [][2]string
+
+func (k rrsetKeys) Len() int      { return len(k) }
+func (k rrsetKeys) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k rrsetKeys) Less(i, j int) bool {
+	if k[i][0] != k[j][0] {
+		return k[i][0] < k[j][0]
+	}
+	return k[i][1] < k[j][1]
+}
+
+// audit appends an entry for a change made by the request.  Failing to
+// does not undo the change, so it is only logged.
+func (fe *Frontend) audit(r *rest.Request, zoneName, action string, zone *ZoneData, entry *AuditEntry) {
+	user := ""
+	if r != nil {
+		user = r.Header.Get("X-Authenticated-Username")
+	}
+	fe.auditAs(user, zoneName, action, zone, entry)
+}
+
+// auditAs appends an entry for a change made by user.
+func (fe *Frontend) auditAs(user, zoneName, action string, zone *ZoneData, entry *AuditEntry) {
+	if fe.auditLog == nil {
+		return
+	}
+	entry.Zone = zoneName
+	entry.Time = time.Now()
+	entry.Action = action
+	entry.User = user
+	if zone != nil {
+		entry.TenantId = zone.TenantId
+		entry.Serial = zone.Serial
+	}
+	if err := fe.auditLog.Append(entry); err != nil {
+		log.Printf("Failed to audit %s of %s by %s: %v", action, zoneName, entry.User, err)
+	}
+}
+
+// History function.  The history of a deleted zone can still be read
+// by whoever could read the zone.
+func (fe *Frontend) GetHistory(w rest.ResponseWriter, r *rest.Request) {
+	zoneName := r.PathParam("id")
+	capMap, err := multitenancy.NewCapabilityMap(r.Request)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if fe.auditLog == nil {
+		rest.Error(w, "No audit log", http.StatusNotFound)
+		return
+	}
+	entries, err := fe.auditLog.History(zoneName)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tenantId := -1
+	fe.ZoneInfo.Lock()
+	if zone := fe.ZoneInfo.Zones[zoneName]; zone != nil {
+		tenantId = zone.TenantId
+	} else if len(entries) > 0 {
+		tenantId = entries[len(entries)-1].TenantId
+	}
+	fe.ZoneInfo.Unlock()
+	if tenantId < 0 || !capMap.HasCapability(tenantId, "ZONE_READ") {
+		rest.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if s := r.URL.Query().Get("since"); s != "" {
+		since, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			rest.Error(w, "since must be an RFC3339 time", http.StatusBadRequest)
+			return
+		}
+		i := sort.Search(len(entries), func(i int) bool { return !entries[i].Time.Before(since) })
+		entries = entries[i:]
+	}
+	if l := r.URL.Query().Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			rest.Error(w, "limit must be a number", http.StatusBadRequest)
+			return
+		}
+		if len(entries) > limit {
+			entries = entries[len(entries)-limit:]
+		}
+	}
+	w.WriteJson(entries)
+}
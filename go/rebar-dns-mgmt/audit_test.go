@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dns-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	al, err := NewFileAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := al.History("example.com"); err != nil || len(entries) != 0 {
+		t.Errorf("Expected an empty history, but got %v %v", entries, err)
+	}
+	for _, zone := range []string{"example.com", "other.com", "example.com"} {
+		if err := al.Append(&AuditEntry{Zone: zone, Action: "PATCH", User: "fred"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Entries survive reopening the log.
+	if al, err = NewFileAuditLog(path); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := al.History("example.com")
+	if err != nil || len(entries) != 2 || entries[0].User != "fred" {
+		t.Errorf("Expected two entries for example.com, but got %v %v", entries, err)
+	}
+}
+
+func auditRequest(handler http.Handler, method, path, user, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, "http://127.0.0.1:6754"+path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Authenticated-Capability", allCaps)
+	req.Header.Set("X-Authenticated-Username", user)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func getHistory(t *testing.T, handler http.Handler, path, caps string) []*AuditEntry {
+	rec := doRequest(handler, "GET", path, caps, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected history from %s, but got %d %s", path, rec.Code, rec.Body.String())
+	}
+	entries := []*AuditEntry{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestHistoryApi(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dns-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fe, handler := testFrontend(t)
+	if rec := doRequest(handler, "GET", "/zones/example.com/history", allCaps, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected no history without an audit log, but got %d", rec.Code)
+	}
+	if fe.auditLog, err = NewFileAuditLog(filepath.Join(dir, "audit.log")); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	auditRequest(handler, "POST", "/zones", "alice", `{"name":"example.com","tenant_id":1}`)
+	auditRequest(handler, "PATCH", "/zones/example.com", "bob", `{"changetype":"ADD","name":"www","type":"A","content":"192.168.1.10"}`)
+	auditRequest(handler, "PATCH", "/zones/example.com/records", "carol", `{"records":[
+		{"changetype":"REMOVE","name":"www","type":"A","content":"192.168.1.10"},
+		{"changetype":"ADD","name":"www","type":"A","content":"192.168.1.20"}]}`)
+	// Changes that change nothing are not logged.
+	auditRequest(handler, "PATCH", "/zones/example.com", "carol", `{"changetype":"ADD","name":"www","type":"A","content":"192.168.1.20"}`)
+	auditRequest(handler, "PUT", "/zones/example.com", "dave", `{"default_ttl":600}`)
+
+	entries := getHistory(t, handler, "/zones/example.com/history", allCaps)
+	if len(entries) != 4 {
+		t.Fatalf("Expected four entries, but got %d", len(entries))
+	}
+	for i, want := range []struct{ user, action string }{{"alice", "CREATE"}, {"bob", "PATCH"}, {"carol", "PATCH"}, {"dave", "UPDATE"}} {
+		e := entries[i]
+		if e.User != want.user || e.Action != want.action || e.TenantId != 1 || e.Time.Before(start) || e.Serial == 0 {
+			t.Errorf("Expected %s by %s for tenant 1, but got %+v", want.action, want.user, e)
+		}
+	}
+	if p := entries[1]; len(p.Before) != 0 || len(p.After) != 1 || p.After[0].Content != "192.168.1.10" {
+		t.Errorf("Expected the added record after, but got %+v", p)
+	}
+	if p := entries[2]; len(p.Before) != 1 || p.Before[0].Content != "192.168.1.10" || len(p.After) != 1 || p.After[0].Content != "192.168.1.20" {
+		t.Errorf("Expected the old address before and the new one after, but got %+v", p)
+	}
+	if u := entries[3]; u.SettingsBefore != nil || u.SettingsAfter == nil || u.SettingsAfter.DefaultTTL != 600 {
+		t.Errorf("Expected the new settings, but got %+v", u)
+	}
+
+	if entries := getHistory(t, handler, "/zones/example.com/history?limit=1", allCaps); len(entries) != 1 || entries[0].Action != "UPDATE" {
+		t.Errorf("Expected only the latest entry, but got %+v", entries)
+	}
+	since := entries[2].Time.Format(time.RFC3339Nano)
+	if entries := getHistory(t, handler, "/zones/example.com/history?since="+since, allCaps); len(entries) != 2 {
+		t.Errorf("Expected the entries since %s, but got %+v", since, entries)
+	}
+	if rec := doRequest(handler, "GET", "/zones/example.com/history?limit=x", allCaps, ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a bad limit to be rejected, but got %d", rec.Code)
+	}
+	other := `{"2":{"parent":0,"capabilities":["ZONE_READ"]}}`
+	if rec := doRequest(handler, "GET", "/zones/example.com/history", other, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected another tenant not to see the history, but got %d", rec.Code)
+	}
+
+	// The history outlives the zone.
+	auditRequest(handler, "DELETE", "/zones/example.com", "erin", "")
+	entries = getHistory(t, handler, "/zones/example.com/history", allCaps)
+	if d := entries[len(entries)-1]; d.Action != "DELETE" || d.User != "erin" || len(d.Before) != 1 || d.Before[0].Content != "192.168.1.20" {
+		t.Errorf("Expected the deleted records, but got %+v", d)
+	}
+	if rec := doRequest(handler, "GET", "/zones/example.com/history", other, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected another tenant not to see a deleted zone's history, but got %d", rec.Code)
+	}
+	if rec := doRequest(handler, "GET", "/zones/nothing.com/history", allCaps, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected no history for an unknown zone, but got %d", rec.Code)
+	}
+}
@@ -7,41 +7,44 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"sort"
+	"strconv"
 	"text/template"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 type BindDnsInstance struct {
 	dns_backend_point
-	Templates  *template.Template
-	ServerName string
+	Templates    *template.Template
+	ServerName   string
+	TransferAddr string // Where to AXFR zones from to check for drift
 }
 
-func buildZone(name string, zoneData *ZoneData) Zone {
+func buildZone(zoneName string, zoneData *ZoneData) Zone {
 
 	records := make([]Record, 0, 100)
 	tenantId := 0
+	var settings *ZoneSettings
 
 	if zoneData != nil {
 		for name, entry := range zoneData.Entries {
 			for t, contents := range entry.Types {
 				for _, content := range contents {
-					record := Record{
-						Name:    name,
-						Content: content.Content,
-						Type:    t,
-					}
-					records = append(records, record)
+					records = append(records, zoneRecord(zoneData, zoneName, name, t, content))
 				}
 			}
 		}
 		tenantId = zoneData.TenantId
+		settings = zoneData.Settings
 	}
 
 	zone := Zone{
-		Name:     name,
+		Name:     zoneName,
 		Records:  records,
 		TenantId: tenantId,
+		Settings: settings,
 	}
 
 	return zone
@@ -49,8 +52,9 @@ func buildZone(name string, zoneData *ZoneData) Zone {
 
 func NewBindDnsInstance(serverName string) *BindDnsInstance {
 	return &BindDnsInstance{
-		Templates:  template.Must(template.ParseGlob("/etc/dns-mgmt.d/*.tmpl")),
-		ServerName: serverName,
+		Templates:    template.Must(template.ParseGlob("/etc/dns-mgmt.d/*.tmpl")),
+		ServerName:   serverName,
+		TransferAddr: "127.0.0.1:53",
 	}
 }
 
@@ -76,16 +80,20 @@ func (di *BindDnsInstance) GetZone(zones *ZoneTracker, id string) (Zone, *backen
 
 type bindZoneData struct {
 	Domain           string
+	Dir              string // Where the zone's files are
 	ServerName       string
 	Serial           string
+	Settings         *ZoneSettings // Resolved
 	Data             *ZoneData
 	ReverseZoneNames []string
+	Signed           []string // DNSKEY, NSEC and RRSIG records, when signed
 }
 
 type bindRZoneData struct {
 	Domain     string
 	ServerName string
 	Serial     string
+	Settings   *ZoneSettings // Resolved
 	Names      []string
 }
 
@@ -120,6 +128,36 @@ func makeRevName(t string, address string) string {
 	return buffer.String()
 }
 
+// signedLines signs the zone as db.tmpl renders it and returns the
+// records DNSSEC adds.
+func signedLines(zoneName string, zone *ZoneData, settings *ZoneSettings, serial string) ([]string, error) {
+	n, err := strconv.ParseUint(serial, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	origin := dns.CanonicalName(zoneName)
+	soa, rrs := zoneRRs(origin, zone, settings, uint32(n))
+	signed, err := zone.Dnssec.sign(origin, soa, rrs, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(signed))
+	for _, rr := range signed {
+		res = append(res, rr.String())
+	}
+	return res, nil
+}
+
+// signsZones says bind can serve signed zones.  They are signed
+// here, not by bind.
+func (di *BindDnsInstance) signsZones() bool {
+	return true
+}
+
+func (di *BindDnsInstance) servesViews() bool {
+	return true
+}
+
 func make_serial() string {
 	t := time.Now()
 	i := ((t.Year()-2015)*366+t.YearDay())*100000 + t.Hour()*24*60 + t.Minute()*60 + t.Second()
@@ -127,113 +165,213 @@ func make_serial() string {
 }
 
 // Patch function
-func (di *BindDnsInstance) PatchZone(zones *ZoneTracker, zoneName string, rec Record) (Zone, *backendError) {
+func (di *BindDnsInstance) PatchZone(zones *ZoneTracker, zoneName string, recs []Record) (Zone, *backendError) {
+	if err := di.writeZone(zones, zoneName); err != nil {
+		return Zone{}, err
+	}
+	return buildZone(zoneName, zones.Zones[zoneName]), nil
+}
 
-	// Rebuild include list
-	file, err := os.Create("/etc/bind/named.conf.rebar")
-	defer file.Close()
-	if err != nil {
-		return Zone{}, &backendError{err.Error(), http.StatusInternalServerError}
+// Create function
+func (di *BindDnsInstance) CreateZone(zones *ZoneTracker, zoneName string) (Zone, *backendError) {
+	if err := di.writeZone(zones, zoneName); err != nil {
+		return Zone{}, err
 	}
-	err = di.Templates.ExecuteTemplate(file, "zones_list.tmpl", zones)
-	if err != nil {
-		return Zone{}, &backendError{err.Error(), http.StatusInternalServerError}
+	return buildZone(zoneName, zones.Zones[zoneName]), nil
+}
+
+// Update function
+func (di *BindDnsInstance) UpdateZone(zones *ZoneTracker, zoneName string) (Zone, *backendError) {
+	if err := di.writeZone(zones, zoneName); err != nil {
+		return Zone{}, err
 	}
+	return buildZone(zoneName, zones.Zones[zoneName]), nil
+}
 
-	err = os.RemoveAll("/etc/bind/" + zoneName)
+// Delete function.  The zone is gone from the tracker, so writing it
+// removes its files.
+func (di *BindDnsInstance) DeleteZone(zones *ZoneTracker, zoneName string, data *ZoneData) *backendError {
+	return di.writeZone(zones, zoneName)
+}
+
+// liveRecords transfers the zone from bind.
+func (di *BindDnsInstance) liveRecords(zones *ZoneTracker, zoneName string) ([]dns.RR, *backendError) {
+	return axfrRecords(di.TransferAddr, zoneName)
+}
+
+// repairZone rewrites the zone files, which replaces any manual
+// edits.
+func (di *BindDnsInstance) repairZone(zones *ZoneTracker, zoneName string, drift *ZoneDrift) *backendError {
+	return di.writeZone(zones, zoneName)
+}
+
+// writeTemplate renders a template to a file.
+func (di *BindDnsInstance) writeTemplate(path, name string, data interface{}) *backendError {
+	file, err := os.Create(path)
 	if err != nil {
-		return Zone{}, &backendError{err.Error(), http.StatusInternalServerError}
+		return &backendError{err.Error(), http.StatusInternalServerError}
+	}
+	defer file.Close()
+	if err := di.Templates.ExecuteTemplate(file, name, data); err != nil {
+		return &backendError{err.Error(), http.StatusInternalServerError}
 	}
+	return nil
+}
 
-	if zones.Zones[zoneName] != nil {
-		revz := make([]string, 0, 100)
-		zone := zones.Zones[zoneName]
+type bindView struct {
+	Name         string
+	MatchClients []string
+	Includes     []string // Zone files, relative to /etc/bind
+}
 
-		err = os.Mkdir("/etc/bind/"+zoneName, 0755)
-		if err != nil {
-			return Zone{}, &backendError{err.Error(), http.StatusInternalServerError}
+type bindConfData struct {
+	Zones map[string]*ZoneData
+	Views []bindView // Empty when no zone has views
+}
+
+// bindConf works out the include list.  Once there are views every
+// zone has to be in one, so each view includes the version of every
+// zone its clients see, and clients that match no view get the
+// default view.
+func bindConf(zones *ZoneTracker) bindConfData {
+	conf := bindConfData{Zones: zones.Zones}
+	views := zoneViews(zones)
+	if len(views) == 0 {
+		return conf
+	}
+	names := make([]string, 0, len(zones.Zones))
+	for name := range zones.Zones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	views = append(views, ZoneView{Name: defaultView, MatchClients: []string{"any"}})
+	for _, v := range views {
+		bv := bindView{Name: v.Name, MatchClients: v.MatchClients}
+		for _, name := range names {
+			if zones.Zones[name].Settings.view(v.Name) != nil {
+				bv.Includes = append(bv.Includes, name+"/"+v.Name+"/zone."+name)
+			} else {
+				bv.Includes = append(bv.Includes, name+"/zone."+name)
+			}
 		}
+		conf.Views = append(conf.Views, bv)
+	}
+	return conf
+}
 
-		serial := make_serial()
+// writeZone rewrites the files for a zone and the include list, and
+// reloads bind.  A zone that is not in the tracker has its files
+// removed.  Each view of the zone gets its own files in a directory
+// named for it.
+func (di *BindDnsInstance) writeZone(zones *ZoneTracker, zoneName string) *backendError {
 
-		revparts := make(map[string](map[string][]string))
+	// Rebuild include list
+	if err := di.writeTemplate("/etc/bind/named.conf.rebar", "zones_list.tmpl", bindConf(zones)); err != nil {
+		return err
+	}
 
-		// Build reverse maps - find all IPs to Names
-		for name, entry := range zone.Entries {
-			for t, contents := range entry.Types {
-				for _, content := range contents {
-					if revparts[content.Content] == nil {
-						revparts[content.Content] = make(map[string][]string)
-					}
-					if revparts[content.Content][t] == nil {
-						revparts[content.Content][t] = make([]string, 0, 3)
-					}
-
-					revparts[content.Content][t] = append(revparts[content.Content][t], name+"."+zoneName)
-				}
+	err := os.RemoveAll("/etc/bind/" + zoneName)
+	if err != nil {
+		return &backendError{err.Error(), http.StatusInternalServerError}
+	}
+
+	if zone := zones.Zones[zoneName]; zone != nil {
+		serial := make_serial()
+		settings := zone.Settings.resolve(di.ServerName)
+		dir := "/etc/bind/" + zoneName
+		if err := di.writeZoneFiles(dir, zoneName, zone.viewData(""), settings, serial); err != nil {
+			return err
+		}
+		for _, v := range settings.Views {
+			if err := di.writeZoneFiles(dir+"/"+v.Name, zoneName, zone.viewData(v.Name), settings, serial); err != nil {
+				return err
 			}
 		}
+	}
 
-		for ip, m := range revparts {
-			for t, list := range m {
-				rvName := makeRevName(t, ip)
-				revz = append(revz, rvName)
+	// Restart bind
+	cmd := exec.Command("rndc", "reload")
+	err = cmd.Run()
+	if err != nil {
+		return &backendError{err.Error(), http.StatusInternalServerError}
+	}
 
-				rdata := bindRZoneData{
-					Domain:     rvName,
-					Serial:     serial,
-					ServerName: di.ServerName,
-					Names:      list,
-				}
+	return nil
+}
+
+// writeZoneFiles writes the files for one version of a zone, and its
+// reverse zones, into dir.
+func (di *BindDnsInstance) writeZoneFiles(dir, zoneName string, zone *ZoneData, settings *ZoneSettings, serial string) *backendError {
+	revz := make([]string, 0, 100)
+
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		return &backendError{err.Error(), http.StatusInternalServerError}
+	}
 
-				rfile, err := os.Create("/etc/bind/" + zoneName + "/rdb." + rvName)
-				defer rfile.Close()
-				if err != nil {
-					return Zone{}, &backendError{err.Error(), http.StatusInternalServerError}
+	revparts := make(map[string](map[string][]string))
+
+	// Build reverse maps - find all IPs to Names
+	entries := zone.Entries
+	if !*settings.AutoReverse {
+		entries = nil
+	}
+	for name, entry := range entries {
+		for t, contents := range entry.Types {
+			if t != "A" && t != "AAAA" {
+				continue
+			}
+			for _, content := range contents {
+				if revparts[content.Content] == nil {
+					revparts[content.Content] = make(map[string][]string)
 				}
-				err = di.Templates.ExecuteTemplate(rfile, "rdb.tmpl", rdata)
-				if err != nil {
-					return Zone{}, &backendError{err.Error(), http.StatusInternalServerError}
+				if revparts[content.Content][t] == nil {
+					revparts[content.Content][t] = make([]string, 0, 3)
 				}
-			}
-		}
 
-		// Make a database file.
-		zdata := bindZoneData{
-			Domain:           zoneName,
-			Serial:           serial,
-			ServerName:       di.ServerName,
-			Data:             zone,
-			ReverseZoneNames: revz,
+				revparts[content.Content][t] = append(revparts[content.Content][t], name+"."+zoneName)
+			}
 		}
+	}
 
-		zfile, err := os.Create("/etc/bind/" + zoneName + "/zone." + zoneName)
-		defer zfile.Close()
-		if err != nil {
-			return Zone{}, &backendError{err.Error(), http.StatusInternalServerError}
-		}
-		err = di.Templates.ExecuteTemplate(zfile, "zone.tmpl", zdata)
-		if err != nil {
-			return Zone{}, &backendError{err.Error(), http.StatusInternalServerError}
+	for ip, m := range revparts {
+		for t, list := range m {
+			rvName := makeRevName(t, ip)
+			revz = append(revz, rvName)
+
+			rdata := bindRZoneData{
+				Domain:     rvName,
+				Serial:     serial,
+				ServerName: di.ServerName,
+				Settings:   settings,
+				Names:      list,
+			}
+			if err := di.writeTemplate(dir+"/rdb."+rvName, "rdb.tmpl", rdata); err != nil {
+				return err
+			}
 		}
+	}
 
-		dfile, err := os.Create("/etc/bind/" + zoneName + "/db." + zoneName)
-		defer dfile.Close()
-		if err != nil {
-			return Zone{}, &backendError{err.Error(), http.StatusInternalServerError}
-		}
-		err = di.Templates.ExecuteTemplate(dfile, "db.tmpl", zdata)
+	// Make a database file.
+	zdata := bindZoneData{
+		Domain:           zoneName,
+		Dir:              dir,
+		Serial:           serial,
+		ServerName:       di.ServerName,
+		Settings:         settings,
+		Data:             zone,
+		ReverseZoneNames: revz,
+	}
+	if zone.Dnssec != nil {
+		signed, err := signedLines(zoneName, zone, settings, serial)
 		if err != nil {
-			return Zone{}, &backendError{err.Error(), http.StatusInternalServerError}
+			return &backendError{err.Error(), http.StatusInternalServerError}
 		}
+		zdata.Signed = signed
 	}
 
-	// Restart bind
-	cmd := exec.Command("rndc", "reload")
-	err = cmd.Run()
-	if err != nil {
-		return Zone{}, &backendError{err.Error(), http.StatusInternalServerError}
+	if err := di.writeTemplate(dir+"/zone."+zoneName, "zone.tmpl", zdata); err != nil {
+		return err
 	}
-
-	return buildZone(zoneName, zones.Zones[zoneName]), nil
+	return di.writeTemplate(dir+"/db."+zoneName, "db.tmpl", zdata)
 }
@@ -20,11 +20,28 @@ func (e *backendError) StatusCode() int {
 type dns_backend_point interface {
 	GetAllZones(*ZoneTracker) ([]Zone, *backendError)
 	GetZone(*ZoneTracker, string) (Zone, *backendError)
-	PatchZone(*ZoneTracker, string, Record) (Zone, *backendError)
+	// PatchZone is called after a set of records is changed in the
+	// tracker.
+	PatchZone(*ZoneTracker, string, []Record) (Zone, *backendError)
+	// CreateZone is called after a zone is added to the tracker.
+	CreateZone(*ZoneTracker, string) (Zone, *backendError)
+	// UpdateZone is called after the settings of a zone change.
+	UpdateZone(*ZoneTracker, string) (Zone, *backendError)
+	// DeleteZone is called after a zone is removed from the
+	// tracker, with the data it had.
+	DeleteZone(*ZoneTracker, string, *ZoneData) *backendError
 }
 
 type dns_frontend_point interface {
 	GetAllZones(rest.ResponseWriter, *rest.Request)
 	GetZone(rest.ResponseWriter, *rest.Request)
 	PatchZone(rest.ResponseWriter, *rest.Request)
+	PatchRecords(rest.ResponseWriter, *rest.Request)
+	CreateZone(rest.ResponseWriter, *rest.Request)
+	UpdateZone(rest.ResponseWriter, *rest.Request)
+	DeleteZone(rest.ResponseWriter, *rest.Request)
+	GetDnssec(rest.ResponseWriter, *rest.Request)
+	RolloverDnssec(rest.ResponseWriter, *rest.Request)
+	ReconcileZone(rest.ResponseWriter, *rest.Request)
+	GetHistory(rest.ResponseWriter, *rest.Request)
 }
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/digitalrebar/digitalrebar/go/common/multi-tenancy"
+	"github.com/miekg/dns"
+)
+
+/*
+ * DNSSEC
+ *
+ * Keys live in the ZoneData, so they are kept by whatever LoadSaver
+ * keeps the zones.  Zones are signed whenever they are rendered, which
+ * happens on every change, and maintainDnssec re-signs them before
+ * their signatures run out and moves keys through their rollovers.
+ *
+ * ZSKs roll over on a schedule by pre-publication: the new key is
+ * published a day before it starts signing, and the old one stays
+ * published for a day after it stops.  KSKs only roll over when asked,
+ * by double signature: both keys sign the DNSKEY set until the old one
+ * is retired two weeks later, which is how long there is to get the
+ * new DS record to the parent zone.
+ */
+
+const (
+	dnssecAlgorithm    = dns.ECDSAP256SHA256
+	signatureValidity  = 14 * 24 * time.Hour
+	resignInterval     = 7 * 24 * time.Hour
+	defaultZskLifetime = 90 // days
+	zskPrepublish      = 24 * time.Hour
+	zskRetire          = 24 * time.Hour
+	kskOverlap         = 14 * 24 * time.Hour
+	maintainInterval   = time.Hour
+)
+
+// DnssecKey is a signing key and its schedule.  A zero Retire or
+// Remove means not scheduled.
+type DnssecKey struct {
+	Ksk        bool
+	Algorithm  uint8
+	PublicKey  string // Base64, as in the DNSKEY record
+	PrivateKey string // BIND private key format
+	Created    time.Time
+	Publish    time.Time // In the DNSKEY set from
+	Activate   time.Time // Signs from
+	Retire     time.Time // Stops signing
+	Remove     time.Time // Leaves the DNSKEY set
+}
+
+// ZoneDnssec is the DNSSEC state of a signed zone.
+type ZoneDnssec struct {
+	Keys     []*DnssecKey
+	SignedAt time.Time // Last time signatures were refreshed
+}
+
+func newDnssecKey(ksk bool, publish, activate time.Time) (*DnssecKey, error) {
+	dk := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: ".", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET},
+		Flags:     dns.ZONE,
+		Protocol:  3,
+		Algorithm: dnssecAlgorithm,
+	}
+	if ksk {
+		dk.Flags |= dns.SEP
+	}
+	priv, err := dk.Generate(256)
+	if err != nil {
+		return nil, err
+	}
+	return &DnssecKey{
+		Ksk:        ksk,
+		Algorithm:  dk.Algorithm,
+		PublicKey:  dk.PublicKey,
+		PrivateKey: dk.PrivateKeyString(priv),
+		Created:    time.Now(),
+		Publish:    publish,
+		Activate:   activate,
+	}, nil
+}
+
+func newZoneDnssec(now time.Time) (*ZoneDnssec, error) {
+	ksk, err := newDnssecKey(true, now, now)
+	if err != nil {
+		return nil, err
+	}
+	zsk, err := newDnssecKey(false, now, now)
+	if err != nil {
+		return nil, err
+	}
+	return &ZoneDnssec{Keys: []*DnssecKey{ksk, zsk}, SignedAt: now}, nil
+}
+
+func (k *DnssecKey) dnskey(zone string, ttl uint32) *dns.DNSKEY {
+	dk := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: ttl},
+		Flags:     dns.ZONE,
+		Protocol:  3,
+		Algorithm: k.Algorithm,
+		PublicKey: k.PublicKey,
+	}
+	if k.Ksk {
+		dk.Flags |= dns.SEP
+	}
+	return dk
+}
+
+func (k *DnssecKey) published(now time.Time) bool {
+	return !now.Before(k.Publish) && (k.Remove.IsZero() || now.Before(k.Remove))
+}
+
+func (k *DnssecKey) active(now time.Time) bool {
+	return !now.Before(k.Activate) && (k.Retire.IsZero() || now.Before(k.Retire))
+}
+
+// state describes where the key is in its life.
+func (k *DnssecKey) state(now time.Time) string {
+	switch {
+	case now.Before(k.Publish):
+		return "created"
+	case now.Before(k.Activate):
+		return "published"
+	case k.active(now):
+		return "active"
+	case k.published(now):
+		return "retired"
+	}
+	return "removed"
+}
+
+// rolling says whether a rollover of that kind of key is under way.
+func (zs *ZoneDnssec) rolling(ksk bool, now time.Time) bool {
+	for _, k := range zs.Keys {
+		if k.Ksk == ksk && (now.Before(k.Activate) || !k.Retire.IsZero()) {
+			return true
+		}
+	}
+	return false
+}
+
+// rollover starts replacing the active keys of one kind.
+func (zs *ZoneDnssec) rollover(ksk bool, now time.Time) error {
+	if zs.rolling(ksk, now) {
+		return errors.New("A rollover is already in progress")
+	}
+	activate := now.Add(zskPrepublish)
+	if ksk {
+		activate = now
+	}
+	key, err := newDnssecKey(ksk, now, activate)
+	if err != nil {
+		return err
+	}
+	for _, k := range zs.Keys {
+		if k.Ksk != ksk || !k.active(now) {
+			continue
+		}
+		if ksk {
+			k.Retire = now.Add(kskOverlap)
+			k.Remove = k.Retire
+		} else {
+			k.Retire = activate
+			k.Remove = activate.Add(zskRetire)
+		}
+	}
+	zs.Keys = append(zs.Keys, key)
+	return nil
+}
+
+// maintain drops removed keys and starts ZSK rollovers that are due.
+// It returns true when the zone needs to be signed again, because the
+// keys changed or the signatures are getting old.
+func (zs *ZoneDnssec) maintain(now time.Time, zskLifetime time.Duration) bool {
+	resign := now.Sub(zs.SignedAt) >= resignInterval
+	keys := zs.Keys[:0]
+	for _, k := range zs.Keys {
+		for _, t := range []time.Time{k.Publish, k.Activate, k.Retire, k.Remove} {
+			if !t.IsZero() && t.After(zs.SignedAt) && !t.After(now) {
+				resign = true
+			}
+		}
+		if k.Remove.IsZero() || now.Before(k.Remove) {
+			keys = append(keys, k)
+		}
+	}
+	zs.Keys = keys
+	if !zs.rolling(false, now) {
+		for _, k := range zs.Keys {
+			if !k.Ksk && k.active(now) && !now.Before(k.Activate.Add(zskLifetime)) {
+				if err := zs.rollover(false, now); err != nil {
+					log.Printf("Failed to roll over ZSK: %v", err)
+				} else {
+					resign = true
+				}
+				break
+			}
+		}
+	}
+	if resign {
+		zs.SignedAt = now
+	}
+	return resign
+}
+
+// canonicalLess orders names the way RFC 4034 section 6.1 does: label
+// by label from the right, ignoring case.
+func canonicalLess(a, b string) bool {
+	al := dns.SplitDomainName(strings.ToLower(a))
+	bl := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(al)-1, len(bl)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if al[i] != bl[j] {
+			return al[i] < bl[j]
+		}
+	}
+	return len(al) < len(bl)
+}
+
+type canonicalNames []string
+
+func (n canonicalNames) Len() int           { return len(n) }
+func (n canonicalNames) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n canonicalNames) Less(i, j int) bool { return canonicalLess(n[i], n[j]) }
+
+type nsecsByOwner []*dns.NSEC
+
+func (n nsecsByOwner) Len() int           { return len(n) }
+func (n nsecsByOwner) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n nsecsByOwner) Less(i, j int) bool { return canonicalLess(n[i].Hdr.Name, n[j].Hdr.Name) }
+
+type rrTypes []uint16
+
+func (t rrTypes) Len() int           { return len(t) }
+func (t rrTypes) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t rrTypes) Less(i, j int) bool { return t[i] < t[j] }
+
+type signer struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+// signers returns the DNSKEY records to publish and the keys to sign
+// the DNSKEY set and the rest of the zone with.
+func (zs *ZoneDnssec) signers(zone string, ttl uint32, now time.Time) ([]dns.RR, []signer, []signer, error) {
+	dnskeys := []dns.RR{}
+	var ksks, zsks []signer
+	for _, k := range zs.Keys {
+		if !k.published(now) {
+			continue
+		}
+		dk := k.dnskey(zone, ttl)
+		dnskeys = append(dnskeys, dk)
+		if !k.active(now) {
+			continue
+		}
+		priv, err := dk.NewPrivateKey(k.PrivateKey)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		s, ok := priv.(crypto.Signer)
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("Key %d cannot sign", dk.KeyTag())
+		}
+		if k.Ksk {
+			ksks = append(ksks, signer{dk, s})
+		} else {
+			zsks = append(zsks, signer{dk, s})
+		}
+	}
+	if len(ksks) == 0 {
+		ksks = zsks
+	}
+	if len(zsks) == 0 {
+		zsks = ksks
+	}
+	if len(zsks) == 0 {
+		return nil, nil, nil, errors.New("No active keys")
+	}
+	return dnskeys, ksks, zsks, nil
+}
+
+// sign returns what DNSSEC adds to a zone: the DNSKEY set, the NSEC
+// chain, and signatures over all of it and the zone's own records.
+// zone must be a lowercase FQDN and rrs the records other than the
+// SOA, with lowercase owners.
+func (zs *ZoneDnssec) sign(zone string, soa *dns.SOA, rrs []dns.RR, now time.Time) ([]dns.RR, error) {
+	dnskeys, ksks, zsks, err := zs.signers(zone, soa.Hdr.Ttl, now)
+	if err != nil {
+		return nil, err
+	}
+
+	type setKey struct {
+		owner string
+		t     uint16
+	}
+	sets := make(map[setKey][]dns.RR)
+	types := make(map[string][]uint16)
+	add := func(rr dns.RR) {
+		k := setKey{rr.Header().Name, rr.Header().Rrtype}
+		if sets[k] == nil {
+			types[k.owner] = append(types[k.owner], k.t)
+		}
+		sets[k] = append(sets[k], rr)
+	}
+	add(soa)
+	for _, rr := range rrs {
+		add(rr)
+	}
+	for _, rr := range dnskeys {
+		add(rr)
+	}
+
+	owners := make([]string, 0, len(types))
+	for owner := range types {
+		owners = append(owners, owner)
+	}
+	sort.Sort(canonicalNames(owners))
+	res := append([]dns.RR{}, dnskeys...)
+	for i, owner := range owners {
+		bitmap := append([]uint16{dns.TypeNSEC, dns.TypeRRSIG}, types[owner]...)
+		sort.Sort(rrTypes(bitmap))
+		nsec := &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: soa.Minttl},
+			NextDomain: owners[(i+1)%len(owners)],
+			TypeBitMap: bitmap,
+		}
+		add(nsec)
+		res = append(res, nsec)
+	}
+
+	for k, rrset := range sets {
+		if k.t == dns.TypeNS && k.owner != zone {
+			// Delegations are signed by the child.
+			continue
+		}
+		keys := zsks
+		if k.t == dns.TypeDNSKEY {
+			keys = ksks
+		}
+		for _, s := range keys {
+			sig := &dns.RRSIG{
+				Hdr:        dns.RR_Header{Name: k.owner, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl},
+				Algorithm:  s.key.Algorithm,
+				Inception:  uint32(now.Add(-time.Hour).Unix()),
+				Expiration: uint32(now.Add(signatureValidity).Unix()),
+				KeyTag:     s.key.KeyTag(),
+				SignerName: zone,
+			}
+			if err := sig.Sign(s.priv, rrset); err != nil {
+				return nil, err
+			}
+			res = append(res, sig)
+		}
+	}
+	return res, nil
+}
+
+// DsRecord is a DS record for a KSK, to hand to the parent zone.
+type DsRecord struct {
+	KeyTag     uint16 `json:"key_tag"`
+	Algorithm  uint8  `json:"algorithm"`
+	DigestType uint8  `json:"digest_type"`
+	Digest     string `json:"digest"`
+	Record     string `json:"record"`
+}
+
+// DnssecKeyInfo is the public part of a key.
+type DnssecKeyInfo struct {
+	KeyTag    uint16    `json:"key_tag"`
+	Ksk       bool      `json:"ksk"`
+	Algorithm uint8     `json:"algorithm"`
+	State     string    `json:"state"`
+	PublicKey string    `json:"public_key"`
+	Publish   time.Time `json:"publish"`
+	Activate  time.Time `json:"activate"`
+	Retire    time.Time `json:"retire,omitempty"`
+	Remove    time.Time `json:"remove,omitempty"`
+}
+
+// DnssecStatus is what the API shows about a signed zone.
+type DnssecStatus struct {
+	Keys     []DnssecKeyInfo `json:"keys"`
+	DS       []DsRecord      `json:"ds"`
+	SignedAt time.Time       `json:"signed_at"`
+}
+
+func (zs *ZoneDnssec) status(zone string, ttl uint32, now time.Time) *DnssecStatus {
+	res := &DnssecStatus{Keys: []DnssecKeyInfo{}, DS: []DsRecord{}, SignedAt: zs.SignedAt}
+	for _, k := range zs.Keys {
+		dk := k.dnskey(zone, ttl)
+		res.Keys = append(res.Keys, DnssecKeyInfo{
+			KeyTag:    dk.KeyTag(),
+			Ksk:       k.Ksk,
+			Algorithm: k.Algorithm,
+			State:     k.state(now),
+			PublicKey: k.PublicKey,
+			Publish:   k.Publish,
+			Activate:  k.Activate,
+			Retire:    k.Retire,
+			Remove:    k.Remove,
+		})
+		if !k.Ksk || !k.published(now) {
+			continue
+		}
+		ds := dk.ToDS(dns.SHA256)
+		res.DS = append(res.DS, DsRecord{
+			KeyTag:     ds.KeyTag,
+			Algorithm:  ds.Algorithm,
+			DigestType: ds.DigestType,
+			Digest:     ds.Digest,
+			Record:     ds.String(),
+		})
+	}
+	return res
+}
+
+// syncDnssec makes the keys of the zone match its settings.  Turning
+// DNSSEC off throws the keys away, so the DS records should be removed
+// from the parent first.
+func (zd *ZoneData) syncDnssec(now time.Time) error {
+	if zd.Settings == nil || !zd.Settings.Dnssec {
+		zd.Dnssec = nil
+		return nil
+	}
+	if zd.Dnssec != nil {
+		return nil
+	}
+	zs, err := newZoneDnssec(now)
+	if err != nil {
+		return err
+	}
+	zd.Dnssec = zs
+	return nil
+}
+
+// dnssecSigner is implemented by backends that can serve signed zones.
+type dnssecSigner interface {
+	signsZones() bool
+}
+
+func (fe *Frontend) signsZones() bool {
+	s, ok := (*fe.Backend).(dnssecSigner)
+	return ok && s.signsZones()
+}
+
+// maintainDnssec moves keys along their schedules and re-signs zones
+// that need it.
+func (fe *Frontend) maintainDnssec(now time.Time) {
+	fe.ZoneInfo.Lock()
+	changed := []string{}
+	for name, zone := range fe.ZoneInfo.Zones {
+		if zone.Dnssec == nil {
+			continue
+		}
+		settings := zone.Settings.resolve("")
+		if zone.Dnssec.maintain(now, time.Duration(settings.ZskLifetime)*24*time.Hour) {
+			zone.recordChange(nil, nil)
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) > 0 {
+		fe.save_data()
+	}
+	fe.ZoneInfo.Unlock()
+
+	for _, name := range changed {
+		if _, err := (*fe.Backend).UpdateZone(fe.ZoneInfo, name); err != nil {
+			log.Printf("Failed to re-sign %s: %v", name, err)
+		}
+	}
+}
+
+func (fe *Frontend) runDnssec() {
+	for now := range time.Tick(maintainInterval) {
+		fe.maintainDnssec(now)
+	}
+}
+
+// DNSSEC status function
+func (fe *Frontend) GetDnssec(w rest.ResponseWriter, r *rest.Request) {
+	zoneName := r.PathParam("id")
+	capMap, err := multitenancy.NewCapabilityMap(r.Request)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fe.ZoneInfo.Lock()
+	defer fe.ZoneInfo.Unlock()
+	zone := fe.ZoneInfo.Zones[zoneName]
+	if zone == nil || !capMap.HasCapability(zone.TenantId, "ZONE_READ") {
+		rest.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if zone.Dnssec == nil {
+		rest.Error(w, "Zone is not signed", http.StatusNotFound)
+		return
+	}
+	settings := zone.Settings.resolve("")
+	w.WriteJson(zone.Dnssec.status(dns.Fqdn(zoneName), uint32(settings.DefaultTTL), time.Now()))
+}
+
+// DnssecRollover is the body of a rollover request.  Key is KSK or
+// ZSK.
+type DnssecRollover struct {
+	Key string `json:"key"`
+}
+
+// DNSSEC rollover function
+func (fe *Frontend) RolloverDnssec(w rest.ResponseWriter, r *rest.Request) {
+	if r.Body == nil {
+		rest.Error(w, "Must have body", http.StatusBadRequest)
+		return
+	}
+	req := DnssecRollover{}
+	if err := r.DecodeJsonPayload(&req); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var ksk bool
+	switch strings.ToUpper(req.Key) {
+	case "KSK":
+		ksk = true
+	case "ZSK":
+	default:
+		rest.Error(w, "Key must be KSK or ZSK", http.StatusBadRequest)
+		return
+	}
+	zoneName := r.PathParam("id")
+	capMap, err := multitenancy.NewCapabilityMap(r.Request)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fe.ZoneInfo.Lock()
+	zone := fe.ZoneInfo.Zones[zoneName]
+	if zone == nil || !capMap.HasCapability(zone.TenantId, "ZONE_READ") {
+		fe.ZoneInfo.Unlock()
+		rest.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if !capMap.HasCapability(zone.TenantId, "ZONE_UPDATE") {
+		fe.ZoneInfo.Unlock()
+		rest.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if zone.Dnssec == nil {
+		fe.ZoneInfo.Unlock()
+		rest.Error(w, "Zone is not signed", http.StatusNotFound)
+		return
+	}
+	now := time.Now()
+	if err := zone.Dnssec.rollover(ksk, now); err != nil {
+		fe.ZoneInfo.Unlock()
+		rest.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	zone.Dnssec.SignedAt = now
+	zone.recordChange(nil, nil)
+	fe.save_data()
+	fe.audit(r, zoneName, "ROLLOVER", zone, &AuditEntry{})
+	settings := zone.Settings.resolve("")
+	status := zone.Dnssec.status(dns.Fqdn(zoneName), uint32(settings.DefaultTTL), now)
+	fe.ZoneInfo.Unlock()
+
+	if _, derr := (*fe.Backend).UpdateZone(fe.ZoneInfo, zoneName); derr != nil {
+		rest.Error(w, derr.Error(), derr.StatusCode())
+		return
+	}
+	w.WriteJson(status)
+}
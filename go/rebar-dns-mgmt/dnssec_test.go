@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func signedZones(t *testing.T) *ZoneTracker {
+	zt := testZones()
+	zd := zt.Zones["example.com"]
+	zd.Entries["@"] = &ZoneEntry{Types: map[string][]ZoneContent{"MX": {{Content: "10 node1.example.com."}}}}
+	zs, err := newZoneDnssec(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	zd.Settings = &ZoneSettings{Dnssec: true}
+	zd.Dnssec = zs
+	return zt
+}
+
+// verifyZone checks that every RRset in a signed zone has a good
+// signature.
+func verifyZone(t *testing.T, rrs []dns.RR) {
+	type setKey struct {
+		owner string
+		t     uint16
+	}
+	sets := map[setKey][]dns.RR{}
+	sigs := []*dns.RRSIG{}
+	keys := map[uint16]*dns.DNSKEY{}
+	for _, rr := range rrs {
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		switch r := rr.(type) {
+		case *dns.RRSIG:
+			sigs = append(sigs, r)
+			continue
+		case *dns.DNSKEY:
+			keys[r.KeyTag()] = r
+		}
+		k := setKey{rr.Header().Name, rr.Header().Rrtype}
+		sets[k] = append(sets[k], rr)
+	}
+	signed := map[setKey]bool{}
+	for _, sig := range sigs {
+		k := setKey{sig.Hdr.Name, sig.TypeCovered}
+		key := keys[sig.KeyTag]
+		if key == nil {
+			t.Errorf("No key %d for %v", sig.KeyTag, sig)
+			continue
+		}
+		if err := sig.Verify(key, sets[k]); err != nil {
+			t.Errorf("Bad signature over %s %s: %v", k.owner, dns.TypeToString[k.t], err)
+		}
+		if !sig.ValidityPeriod(time.Now()) {
+			t.Errorf("Signature over %s %s is not valid now", k.owner, dns.TypeToString[k.t])
+		}
+		signed[k] = true
+	}
+	for k := range sets {
+		if !signed[k] {
+			t.Errorf("%s %s is not signed", k.owner, dns.TypeToString[k.t])
+		}
+	}
+}
+
+func TestDnssecSign(t *testing.T) {
+	zt := signedZones(t)
+	zd := zt.Zones["example.com"]
+	settings := zd.Settings.resolve("ns1.example.com")
+	soa, rrs := zoneRRs("example.com.", zd, settings, 10)
+	signed, err := zd.Dnssec.sign("example.com.", soa, rrs, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nsecs := 0
+	for _, rr := range signed {
+		if rr.Header().Rrtype == dns.TypeNSEC {
+			nsecs++
+		}
+	}
+	// example.com, node1 and www
+	if nsecs != 3 {
+		t.Errorf("Expected 3 NSEC records, but got %d", nsecs)
+	}
+	verifyZone(t, append(append([]dns.RR{soa}, rrs...), signed...))
+}
+
+func TestBindSignedTemplate(t *testing.T) {
+	tmpl, err := template.ParseFiles("../../containers/dns/dns-mgmt.d/db.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zt := signedZones(t)
+	zd := zt.Zones["example.com"]
+	settings := zd.Settings.resolve("ns1.example.com")
+	serial := make_serial()
+	signed, err := signedLines("example.com", zd, settings, serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	err = tmpl.ExecuteTemplate(buf, "db.tmpl", bindZoneData{
+		Domain:   "example.com",
+		Serial:   serial,
+		Settings: settings,
+		Data:     zd,
+		Signed:   signed,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zp := dns.NewZoneParser(buf, "example.com.", "db.example.com")
+	rrs := []dns.RR{}
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		t.Fatalf("Rendered zone does not parse: %v\n%s", err, buf.String())
+	}
+	verifyZone(t, rrs)
+}
+
+func TestDnssecRollover(t *testing.T) {
+	now := time.Now()
+	zs, _ := newZoneDnssec(now)
+	if err := zs.rollover(false, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := zs.rollover(false, now); err == nil {
+		t.Error("Expected a second ZSK rollover to be refused")
+	}
+	if len(zs.Keys) != 3 || zs.Keys[2].state(now) != "published" || zs.Keys[1].state(now) != "active" {
+		t.Fatalf("Expected a new published ZSK, but got %+v", zs.Keys)
+	}
+	later := now.Add(zskPrepublish + time.Hour)
+	if !zs.maintain(later, time.Duration(defaultZskLifetime)*24*time.Hour) {
+		t.Error("Expected the key change to need re-signing")
+	}
+	if zs.Keys[1].state(later) != "retired" || zs.Keys[2].state(later) != "active" {
+		t.Errorf("Expected the new ZSK to take over, but got %s and %s", zs.Keys[1].state(later), zs.Keys[2].state(later))
+	}
+	later = later.Add(zskRetire)
+	zs.maintain(later, time.Duration(defaultZskLifetime)*24*time.Hour)
+	if len(zs.Keys) != 2 {
+		t.Errorf("Expected the old ZSK to be removed, but have %d keys", len(zs.Keys))
+	}
+
+	// The ZSK is due again at the end of its lifetime.
+	later = zs.Keys[1].Activate.Add(time.Duration(defaultZskLifetime) * 24 * time.Hour)
+	zs.maintain(later, time.Duration(defaultZskLifetime)*24*time.Hour)
+	if len(zs.Keys) != 3 {
+		t.Errorf("Expected a scheduled ZSK rollover, but have %d keys", len(zs.Keys))
+	}
+
+	zs, _ = newZoneDnssec(now)
+	if err := zs.rollover(true, now); err != nil {
+		t.Fatal(err)
+	}
+	status := zs.status("example.com.", 3600, now)
+	if len(status.DS) != 2 {
+		t.Errorf("Expected DS records for both KSKs during the rollover, but got %v", status.DS)
+	}
+	status = zs.status("example.com.", 3600, now.Add(kskOverlap))
+	if len(status.DS) != 1 || status.DS[0].KeyTag != zs.Keys[2].dnskey("example.com.", 3600).KeyTag() {
+		t.Errorf("Expected only the new KSK after the overlap, but got %v", status.DS)
+	}
+}
+
+func TestNativeDnssec(t *testing.T) {
+	di, _ := NewNativeDnsInstance("ns1.example.com", nil, nil)
+	addr, stop := startNative(t, di, signedZones(t))
+	defer stop()
+
+	dnssecQuery := func(name string, qtype uint16) *dns.Msg {
+		m := &dns.Msg{}
+		m.SetQuestion(name, qtype)
+		m.SetEdns0(4096, true)
+		r, err := dns.Exchange(m, addr)
+		if err != nil {
+			t.Fatalf("Query for %s failed: %v", name, err)
+		}
+		return r
+	}
+
+	r := dnssecQuery("node1.example.com.", dns.TypeA)
+	if len(r.Answer) != 2 || r.Answer[1].Header().Rrtype != dns.TypeRRSIG {
+		t.Errorf("Expected A with RRSIG, but got %v", r)
+	}
+	r = query(t, addr, "node1.example.com.", dns.TypeA)
+	if len(r.Answer) != 1 {
+		t.Errorf("Expected no RRSIG without DO, but got %v", r)
+	}
+	r = dnssecQuery("example.com.", dns.TypeDNSKEY)
+	if len(r.Answer) != 3 {
+		t.Errorf("Expected 2 DNSKEYs and their RRSIG, but got %v", r)
+	}
+	r = dnssecQuery("missing.example.com.", dns.TypeA)
+	if r.Rcode != dns.RcodeNameError || len(r.Ns) != 4 {
+		t.Fatalf("Expected NXDOMAIN with SOA, NSEC and signatures, but got %v", r)
+	}
+	if nsec := r.Ns[2].(*dns.NSEC); nsec.Hdr.Name != "example.com." || nsec.NextDomain != "node1.example.com." {
+		t.Errorf("Expected the NSEC from the apex to cover missing, but got %v", nsec)
+	}
+	r = dnssecQuery("node1.example.com.", dns.TypeMX)
+	if len(r.Ns) != 4 || r.Ns[2].(*dns.NSEC).Hdr.Name != "node1.example.com." {
+		t.Errorf("Expected NODATA with the NSEC for node1, but got %v", r)
+	}
+}
+
+func TestDnssecApi(t *testing.T) {
+	fe, handler := testFrontend(t)
+	doRequest(handler, "POST", "/zones", allCaps, `{"name":"example.com","tenant_id":1}`)
+	if rec := doRequest(handler, "GET", "/zones/example.com/dnssec", allCaps, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected an unsigned zone to have no DNSSEC status, but got %d", rec.Code)
+	}
+	if rec := doRequest(handler, "PUT", "/zones/example.com", allCaps, `{"dnssec":true}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected DNSSEC to be turned on, but got %d %s", rec.Code, rec.Body.String())
+	}
+	rec := doRequest(handler, "GET", "/zones/example.com/dnssec", allCaps, "")
+	status := DnssecStatus{}
+	json.Unmarshal(rec.Body.Bytes(), &status)
+	if rec.Code != http.StatusOK || len(status.Keys) != 2 || len(status.DS) != 1 || !strings.Contains(status.DS[0].Record, "DS") {
+		t.Errorf("Expected 2 keys and a DS record, but got %d %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "PrivateKey") || strings.Contains(rec.Body.String(), "private") {
+		t.Error("Expected private keys to stay private")
+	}
+	if rec := doRequest(handler, "POST", "/zones/example.com/dnssec/rollover", allCaps, `{"key":"zsk"}`); rec.Code != http.StatusOK {
+		t.Errorf("Expected rollover to start, but got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(handler, "POST", "/zones/example.com/dnssec/rollover", allCaps, `{"key":"zsk"}`); rec.Code != http.StatusConflict {
+		t.Errorf("Expected a second rollover to conflict, but got %d", rec.Code)
+	}
+	if rec := doRequest(handler, "PUT", "/zones/example.com", allCaps, `{}`); rec.Code != http.StatusOK || fe.ZoneInfo.Zones["example.com"].Dnssec != nil {
+		t.Errorf("Expected DNSSEC to be turned off, but got %d", rec.Code)
+	}
+
+	var be dns_backend_point = &PowerDnsInstance{}
+	fe.Backend = &be
+	if rec := doRequest(handler, "PUT", "/zones/example.com", allCaps, `{"dnssec":true}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected PowerDNS to refuse DNSSEC, but got %d", rec.Code)
+	}
+}
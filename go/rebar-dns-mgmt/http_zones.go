@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// providerRRSet is an rrset as a hosted DNS service sees it.  Values
+// are record data in zone file form.  An rrset without values is
+// deleted.
+type providerRRSet struct {
+	Name   string // FQDN
+	Type   string
+	TTL    int
+	Values []string
+}
+
+// httpDnsProvider is the API of a hosted DNS service.  HttpDnsInstance
+// works out what to send, and the provider how to send it.
+type httpDnsProvider interface {
+	// authorize signs or adds credentials to a request.
+	authorize(req *http.Request, body []byte) error
+	// errorMessage pulls the message out of an error response.
+	errorMessage(body []byte) string
+	// findZone returns the provider's id for a zone, or "" if it
+	// has none.
+	findZone(di *HttpDnsInstance, zoneName string) (string, *backendError)
+	createZone(di *HttpDnsInstance, zoneName string) (string, *backendError)
+	// deleteZone removes the zone and everything in it.
+	deleteZone(di *HttpDnsInstance, zoneId string) *backendError
+	// rrsets lists what the provider serves for a zone.
+	rrsets(di *HttpDnsInstance, zoneId string) ([]providerRRSet, *backendError)
+	// change applies the rrsets to the zone as one change.
+	change(di *HttpDnsInstance, zoneId string, sets []providerRRSet) *backendError
+}
+
+// HttpDnsInstance publishes zones to a hosted DNS service over HTTP.
+// The provider keeps its own SOA, and its own NS records unless the
+// zone settings name nameservers.  Reverse zones are not managed.
+type HttpDnsInstance struct {
+	dns_backend_point
+	UrlBase  string
+	Provider httpDnsProvider
+	Client   *http.Client
+
+	idLock sync.Mutex
+	ids    map[string]string // zone name -> provider zone id
+}
+
+func NewHttpDnsInstance(urlBase string, provider httpDnsProvider) *HttpDnsInstance {
+	return &HttpDnsInstance{
+		UrlBase:  strings.TrimSuffix(urlBase, "/"),
+		Provider: provider,
+		Client:   &http.Client{},
+		ids:      make(map[string]string),
+	}
+}
+
+// doURL sends a request to the provider and returns the response body.
+func (di *HttpDnsInstance) doURL(action, path, contentType string, data []byte) ([]byte, *backendError) {
+	req, err := http.NewRequest(action, di.UrlBase+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, &backendError{err.Error(), http.StatusInternalServerError}
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if err := di.Provider.authorize(req, data); err != nil {
+		return nil, &backendError{err.Error(), http.StatusInternalServerError}
+	}
+	resp, err := di.Client.Do(req)
+	if err != nil {
+		return nil, &backendError{err.Error(), http.StatusInternalServerError}
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode > 399 {
+		msg := di.Provider.errorMessage(body)
+		if msg == "" {
+			msg = string(body)
+		}
+		return body, &backendError{msg, resp.StatusCode}
+	}
+	return body, nil
+}
+
+// zoneId returns the provider's id for a zone.
+func (di *HttpDnsInstance) zoneId(zoneName string) (string, *backendError) {
+	di.idLock.Lock()
+	id := di.ids[zoneName]
+	di.idLock.Unlock()
+	if id != "" {
+		return id, nil
+	}
+	id, err := di.Provider.findZone(di, zoneName)
+	if err != nil {
+		return "", err
+	}
+	if id == "" {
+		return "", &backendError{"Zone " + zoneName + " is not hosted by the DNS provider", http.StatusNotFound}
+	}
+	di.setZoneId(zoneName, id)
+	return id, nil
+}
+
+func (di *HttpDnsInstance) setZoneId(zoneName, id string) {
+	di.idLock.Lock()
+	defer di.idLock.Unlock()
+	if id == "" {
+		delete(di.ids, zoneName)
+	} else {
+		di.ids[zoneName] = id
+	}
+}
+
+// trackerRRSets groups what the tracker has for a zone into rrsets,
+// keyed by lowercase owner and type.  Providers take one TTL per
+// rrset, so the lowest is used.
+func trackerRRSets(zoneName string, zone *ZoneData) map[[2]string]*providerRRSet {
+	sets := map[[2]string]*providerRRSet{}
+	if zone == nil {
+		return sets
+	}
+	_, rrs := zoneRRs(dns.CanonicalName(zoneName), zone, zone.Settings.resolve(""), zone.Serial)
+	for _, rr := range rrs {
+		h := rr.Header()
+		k := [2]string{h.Name, dns.TypeToString[h.Rrtype]}
+		set := sets[k]
+		if set == nil {
+			set = &providerRRSet{Name: h.Name, Type: k[1], TTL: int(h.Ttl)}
+			sets[k] = set
+		}
+		if int(h.Ttl) < set.TTL {
+			set.TTL = int(h.Ttl)
+		}
+		set.Values = append(set.Values, rdata(rr))
+	}
+	return sets
+}
+
+// sortedRRSets returns sets in a stable order.
+func sortedRRSets(sets map[[2]string]*providerRRSet) []providerRRSet {
+	res := make([]providerRRSet, 0, len(sets))
+	for _, set := range sets {
+		sort.Strings(set.Values)
+		res = append(res, *set)
+	}
+	sort.Sort(rrSetsByName(res))
+	return res
+}
+
+type rrSetsByName []providerRRSet
+
+func (s rrSetsByName) Len() int      { return len(s) }
+func (s rrSetsByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s rrSetsByName) Less(i, j int) bool {
+	if s[i].Name != s[j].Name {
+		return s[i].Name < s[j].Name
+	}
+	return s[i].Type < s[j].Type
+}
+
+// sync sends every rrset the tracker has for a zone, and deletes the
+// rrsets named in extra that the tracker does not have.
+func (di *HttpDnsInstance) sync(zones *ZoneTracker, zoneName string, extra [][2]string) *backendError {
+	id, err := di.zoneId(zoneName)
+	if err != nil {
+		return err
+	}
+	sets := trackerRRSets(zoneName, zones.Zones[zoneName])
+	for _, k := range extra {
+		if sets[k] == nil {
+			sets[k] = &providerRRSet{Name: k[0], Type: k[1]}
+		}
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+	return di.Provider.change(di, id, sortedRRSets(sets))
+}
+
+// List function
+func (di *HttpDnsInstance) GetAllZones(zones *ZoneTracker) ([]Zone, *backendError) {
+	answer := make([]Zone, 0, 10)
+	for k, v := range zones.Zones {
+		answer = append(answer, buildZone(k, v))
+	}
+
+	return answer, nil
+}
+
+// Get function
+func (di *HttpDnsInstance) GetZone(zones *ZoneTracker, id string) (Zone, *backendError) {
+	zdata := zones.Zones[id]
+	if zdata == nil {
+		return Zone{}, &backendError{"Not Found", 404}
+	}
+
+	return buildZone(id, zdata), nil
+}
+
+// Patch function.  The rrsets of every changed name and type are
+// replaced in one change.  A zone the provider does not host yet was
+// made by this patch, so it is created there like any other new zone.
+func (di *HttpDnsInstance) PatchZone(zones *ZoneTracker, zoneName string, recs []Record) (Zone, *backendError) {
+	id, err := di.zoneId(zoneName)
+	if err != nil && err.StatusCode() == http.StatusNotFound && zones.Zones[zoneName] != nil {
+		return di.CreateZone(zones, zoneName)
+	}
+	if err != nil {
+		return Zone{}, err
+	}
+	all := trackerRRSets(zoneName, zones.Zones[zoneName])
+	sets := map[[2]string]*providerRRSet{}
+	for _, rec := range recs {
+		k := [2]string{dns.CanonicalName(ownerName(zoneName, rec.Name)), rec.Type}
+		if set := all[k]; set != nil {
+			sets[k] = set
+		} else {
+			sets[k] = &providerRRSet{Name: k[0], Type: k[1]}
+		}
+	}
+	if err := di.Provider.change(di, id, sortedRRSets(sets)); err != nil {
+		return Zone{}, err
+	}
+	return buildZone(zoneName, zones.Zones[zoneName]), nil
+}
+
+// Create function.  A zone the provider already hosts is adopted.
+func (di *HttpDnsInstance) CreateZone(zones *ZoneTracker, zoneName string) (Zone, *backendError) {
+	id, err := di.Provider.findZone(di, zoneName)
+	if err != nil {
+		return Zone{}, err
+	}
+	if id == "" {
+		if id, err = di.Provider.createZone(di, zoneName); err != nil {
+			return Zone{}, err
+		}
+	}
+	di.setZoneId(zoneName, id)
+	return di.UpdateZone(zones, zoneName)
+}
+
+// Update function.  Settings change the NS records and the TTL of
+// records without one, so every rrset is sent again.
+func (di *HttpDnsInstance) UpdateZone(zones *ZoneTracker, zoneName string) (Zone, *backendError) {
+	zone := zones.Zones[zoneName]
+	if zone == nil {
+		return Zone{}, &backendError{"Not Found", 404}
+	}
+	if err := di.sync(zones, zoneName, nil); err != nil {
+		return Zone{}, err
+	}
+	return buildZone(zoneName, zone), nil
+}
+
+// Delete function
+func (di *HttpDnsInstance) DeleteZone(zones *ZoneTracker, zoneName string, data *ZoneData) *backendError {
+	id, err := di.zoneId(zoneName)
+	if err != nil {
+		return err
+	}
+	if err := di.Provider.deleteZone(di, id); err != nil {
+		return err
+	}
+	di.setZoneId(zoneName, "")
+	return nil
+}
+
+// liveRecords reads the zone back from the provider.
+func (di *HttpDnsInstance) liveRecords(zones *ZoneTracker, zoneName string) ([]dns.RR, *backendError) {
+	id, err := di.zoneId(zoneName)
+	if err != nil {
+		return nil, err
+	}
+	sets, err := di.Provider.rrsets(di, id)
+	if err != nil {
+		return nil, err
+	}
+	rrs := []dns.RR{}
+	for _, set := range sets {
+		if set.Type == "SOA" {
+			continue
+		}
+		for _, v := range set.Values {
+			rr, perr := parseRR(zoneName, dns.Fqdn(set.Name), set.Type, v, set.TTL)
+			if perr != nil {
+				log.Printf("Skipping provider record %s %s %s in %s: %v", set.Name, set.Type, v, zoneName, perr)
+				continue
+			}
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs, nil
+}
+
+// repairZone sends every rrset again and deletes the extra ones.
+func (di *HttpDnsInstance) repairZone(zones *ZoneTracker, zoneName string, drift *ZoneDrift) *backendError {
+	extra := [][2]string{}
+	for _, n := range driftNames(drift) {
+		extra = append(extra, [2]string{dns.CanonicalName(n[0]), n[1]})
+	}
+	return di.sync(zones, zoneName, extra)
+}
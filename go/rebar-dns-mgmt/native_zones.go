@@ -0,0 +1,560 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// NativeDnsInstance serves the zones in the ZoneTracker itself, so
+// that no separate DNS server is needed.  It answers authoritatively
+// over UDP and TCP, synthesizes PTR records for A and AAAA records the
+// way the bind backend does, and hands zones to secondaries by AXFR
+// and IXFR.
+type NativeDnsInstance struct {
+	dns_backend_point
+	ServerName    string       // Name of this server in SOA and NS records
+	AllowTransfer []*net.IPNet // Who may AXFR and IXFR
+	Notify        []string     // Secondaries to NOTIFY when a zone changes
+
+	refreshLock sync.Mutex // Held while zones are rendered and signed
+	lock        sync.Mutex // Held while the index is swapped
+	index       *nativeIndex
+}
+
+func NewNativeDnsInstance(serverName string, allowTransfer, notify []string) (*NativeDnsInstance, error) {
+	di := &NativeDnsInstance{
+		ServerName: dns.Fqdn(serverName),
+		Notify:     notify,
+	}
+	for _, a := range allowTransfer {
+		if !strings.Contains(a, "/") {
+			if ip := net.ParseIP(a); ip != nil && ip.To4() != nil {
+				a += "/32"
+			} else {
+				a += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid transfer address %s: %v", a, err)
+		}
+		di.AllowTransfer = append(di.AllowTransfer, n)
+	}
+	return di, nil
+}
+
+// Serve answers DNS queries for zones on addr over both UDP and TCP.
+// It only returns if one of the servers fails.
+func (di *NativeDnsInstance) Serve(zones *ZoneTracker, addr string) error {
+	di.load(zones)
+	errs := make(chan error, 2)
+	for _, n := range []string{"udp", "tcp"} {
+		srv := &dns.Server{Addr: addr, Net: n, Handler: di}
+		go func() { errs <- srv.ListenAndServe() }()
+	}
+	return <-errs
+}
+
+// List function
+func (di *NativeDnsInstance) GetAllZones(zones *ZoneTracker) ([]Zone, *backendError) {
+	answer := make([]Zone, 0, 10)
+	for k, v := range zones.Zones {
+		answer = append(answer, buildZone(k, v))
+	}
+
+	return answer, nil
+}
+
+// Get function
+func (di *NativeDnsInstance) GetZone(zones *ZoneTracker, id string) (Zone, *backendError) {
+	zdata := zones.Zones[id]
+	if zdata == nil {
+		return Zone{}, &backendError{"Not Found", 404}
+	}
+
+	return buildZone(id, zdata), nil
+}
+
+// Patch function.  The records are already in the tracker, so all that
+// is left is telling the secondaries.
+func (di *NativeDnsInstance) PatchZone(zones *ZoneTracker, zoneName string, recs []Record) (Zone, *backendError) {
+	di.refresh(zones, zoneName)
+	go di.notify(zoneName)
+	return buildZone(zoneName, zones.Zones[zoneName]), nil
+}
+
+// Create function
+func (di *NativeDnsInstance) CreateZone(zones *ZoneTracker, zoneName string) (Zone, *backendError) {
+	di.refresh(zones, zoneName)
+	go di.notify(zoneName)
+	return buildZone(zoneName, zones.Zones[zoneName]), nil
+}
+
+// Update function.  This is also how zones get signed again when
+// their keys or signatures need it.
+func (di *NativeDnsInstance) UpdateZone(zones *ZoneTracker, zoneName string) (Zone, *backendError) {
+	di.refresh(zones, zoneName)
+	go di.notify(zoneName)
+	return buildZone(zoneName, zones.Zones[zoneName]), nil
+}
+
+// Delete function.  Secondaries are told so they refresh and find the
+// zone gone.
+func (di *NativeDnsInstance) DeleteZone(zones *ZoneTracker, zoneName string, data *ZoneData) *backendError {
+	di.refresh(zones, zoneName)
+	go di.notify(zoneName)
+	return nil
+}
+
+// signsZones says the native server can serve signed zones.
+func (di *NativeDnsInstance) signsZones() bool {
+	return true
+}
+
+func (di *NativeDnsInstance) notify(zoneName string) {
+	for _, target := range di.Notify {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(target, "53")
+		}
+		m := &dns.Msg{}
+		m.SetNotify(dns.Fqdn(zoneName))
+		if _, err := dns.Exchange(m, target); err != nil {
+			log.Printf("Failed to notify %s about %s: %v", target, zoneName, err)
+		}
+	}
+}
+
+// nativeZone is a zone rendered into resource records.
+type nativeZone struct {
+	name     string    // FQDN, lowercase
+	data     *ZoneData // A copy, so that queries never need the ZoneTracker lock
+	serial   uint32
+	settings *ZoneSettings // Resolved
+	soa      *dns.SOA
+	owners   map[string][]dns.RR // lowercase FQDN -> records
+	all      []dns.RR            // everything but the SOA, for AXFR
+	signed   bool
+	nsecs    []*dns.NSEC // In canonical order
+	ptrs     []dns.RR    // Synthesized from the zone's addresses
+}
+
+// nativeIndex is every zone rendered into resource records, along
+// with the PTR records synthesized from their addresses.  An index is
+// never changed once it is built; when a zone changes, a new index is
+// made that shares every other zone with the old one.
+type nativeIndex struct {
+	zones map[string]*nativeZone // lowercase FQDN -> zone
+	ptrs  map[string][]dns.RR    // lowercase reverse FQDN -> PTRs
+}
+
+func (di *NativeDnsInstance) buildZone(name string, data *ZoneData) *nativeZone {
+	zone := dns.CanonicalName(name)
+	settings := data.Settings.resolve(di.ServerName)
+	soa, rrs := zoneRRs(zone, data, settings, data.Serial)
+	nz := &nativeZone{
+		name:     zone,
+		data:     data,
+		serial:   data.Serial,
+		settings: settings,
+		soa:      soa,
+		owners:   make(map[string][]dns.RR),
+	}
+	nz.add(rrs)
+	if data.autoReverse() {
+		nz.reverse()
+	}
+	if data.Dnssec != nil {
+		signed, err := data.Dnssec.sign(zone, soa, rrs, time.Now())
+		if err != nil {
+			log.Printf("Serving %s unsigned: %v", zone, err)
+			return nz
+		}
+		nz.add(signed)
+		nz.signed = true
+		for _, rr := range signed {
+			if nsec, ok := rr.(*dns.NSEC); ok {
+				nz.nsecs = append(nz.nsecs, nsec)
+			}
+		}
+		sort.Sort(nsecsByOwner(nz.nsecs))
+	}
+	return nz
+}
+
+// sigs returns the signatures over the records of type t at owner.
+func (nz *nativeZone) sigs(owner string, t uint16) []dns.RR {
+	res := []dns.RR{}
+	for _, rr := range nz.owners[owner] {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == t {
+			res = append(res, sig)
+		}
+	}
+	return res
+}
+
+// nsecAt returns the NSEC that lists the types at name.
+func (nz *nativeZone) nsecAt(name string) *dns.NSEC {
+	for _, nsec := range nz.nsecs {
+		if nsec.Hdr.Name == name {
+			return nsec
+		}
+	}
+	return nil
+}
+
+// covering returns the NSEC that proves name does not exist.
+func (nz *nativeZone) covering(name string) *dns.NSEC {
+	if len(nz.nsecs) == 0 {
+		return nil
+	}
+	// The last NSEC wraps around to the apex, so it covers names
+	// past the end of the chain.
+	res := nz.nsecs[len(nz.nsecs)-1]
+	for _, nsec := range nz.nsecs {
+		if !canonicalLess(nsec.Hdr.Name, name) {
+			break
+		}
+		res = nsec
+	}
+	return res
+}
+
+// add puts records in the zone.
+func (nz *nativeZone) add(rrs []dns.RR) {
+	for _, rr := range rrs {
+		owner := rr.Header().Name
+		nz.owners[owner] = append(nz.owners[owner], rr)
+		nz.all = append(nz.all, rr)
+	}
+}
+
+// reverse synthesizes PTR records for the zone's A and AAAA records.
+func (nz *nativeZone) reverse() {
+	for owner, rrs := range nz.owners {
+		for _, rr := range rrs {
+			var ip net.IP
+			t := ""
+			switch a := rr.(type) {
+			case *dns.A:
+				ip, t = a.A, "A"
+			case *dns.AAAA:
+				ip, t = a.AAAA, "AAAA"
+			default:
+				continue
+			}
+			rev := dns.CanonicalName(makeRevName(t, ip.String()))
+			nz.ptrs = append(nz.ptrs, &dns.PTR{
+				Hdr: dns.RR_Header{Name: rev, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: rr.Header().Ttl},
+				Ptr: owner,
+			})
+		}
+	}
+}
+
+func newNativeIndex(zones map[string]*nativeZone) *nativeIndex {
+	idx := &nativeIndex{
+		zones: zones,
+		ptrs:  make(map[string][]dns.RR),
+	}
+	for _, nz := range zones {
+		for _, ptr := range nz.ptrs {
+			rev := ptr.Header().Name
+			idx.ptrs[rev] = append(idx.ptrs[rev], ptr)
+		}
+	}
+	return idx
+}
+
+// copyZoneData returns a copy of data that later changes to the
+// tracker do not touch.  The caller must hold the ZoneTracker lock.
+func copyZoneData(data *ZoneData) *ZoneData {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		log.Panicf("Failed to copy zone data: %v", err)
+	}
+	res := &ZoneData{}
+	if err := json.Unmarshal(buf, res); err != nil {
+		log.Panicf("Failed to copy zone data: %v", err)
+	}
+	return res
+}
+
+// load renders every zone in zones and starts serving them.
+func (di *NativeDnsInstance) load(zones *ZoneTracker) {
+	di.refreshLock.Lock()
+	defer di.refreshLock.Unlock()
+	idx := di.buildIndex(zones)
+	di.lock.Lock()
+	di.index = idx
+	di.lock.Unlock()
+}
+
+// buildIndex renders every zone.  Only copying the zones is done under
+// the ZoneTracker lock.
+func (di *NativeDnsInstance) buildIndex(zones *ZoneTracker) *nativeIndex {
+	zones.Lock()
+	copies := make(map[string]*ZoneData, len(zones.Zones))
+	for name, data := range zones.Zones {
+		copies[name] = copyZoneData(data)
+	}
+	zones.Unlock()
+	all := make(map[string]*nativeZone)
+	for name, data := range copies {
+		nz := di.buildZone(name, data)
+		all[nz.name] = nz
+	}
+	return newNativeIndex(all)
+}
+
+// refresh puts zoneName into the index as it now is in the tracker,
+// or takes it out if it is gone.  Only that zone is rendered and
+// signed again, from a copy taken under the ZoneTracker lock, so
+// neither queries nor API calls wait for the signing.  Refreshes are
+// done one at a time so that a slow one cannot undo a later one.
+func (di *NativeDnsInstance) refresh(zones *ZoneTracker, zoneName string) {
+	di.refreshLock.Lock()
+	defer di.refreshLock.Unlock()
+	if di.index == nil {
+		idx := di.buildIndex(zones)
+		di.lock.Lock()
+		di.index = idx
+		di.lock.Unlock()
+		return
+	}
+	zones.Lock()
+	var data *ZoneData
+	if zd := zones.Zones[zoneName]; zd != nil {
+		data = copyZoneData(zd)
+	}
+	zones.Unlock()
+
+	name := dns.CanonicalName(zoneName)
+	all := make(map[string]*nativeZone, len(di.index.zones)+1)
+	for k, nz := range di.index.zones {
+		if k != name {
+			all[k] = nz
+		}
+	}
+	if data != nil {
+		all[name] = di.buildZone(zoneName, data)
+	}
+	idx := newNativeIndex(all)
+	di.lock.Lock()
+	di.index = idx
+	di.lock.Unlock()
+}
+
+// currentIndex returns the index as of the last change.
+func (di *NativeDnsInstance) currentIndex() *nativeIndex {
+	di.lock.Lock()
+	defer di.lock.Unlock()
+	if di.index == nil {
+		return newNativeIndex(map[string]*nativeZone{})
+	}
+	return di.index
+}
+
+// findZone returns the zone that name is in, if we have one.
+func (idx *nativeIndex) findZone(name string) *nativeZone {
+	for {
+		if nz := idx.zones[name]; nz != nil {
+			return nz
+		}
+		i := strings.Index(name, ".")
+		if i == -1 || i == len(name)-1 {
+			return nil
+		}
+		name = name[i+1:]
+	}
+}
+
+func (di *NativeDnsInstance) transferAllowed(w dns.ResponseWriter) bool {
+	var ip net.IP
+	switch a := w.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+	for _, n := range di.AllowTransfer {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (di *NativeDnsInstance) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := &dns.Msg{}
+	if len(r.Question) != 1 || r.Opcode != dns.OpcodeQuery {
+		m.SetRcode(r, dns.RcodeNotImplemented)
+		w.WriteMsg(m)
+		return
+	}
+	q := r.Question[0]
+	qname := dns.CanonicalName(q.Name)
+
+	idx := di.currentIndex()
+	nz := idx.findZone(qname)
+	var journal []*ZoneDelta
+	incremental := false
+	if nz != nil && q.Qtype == dns.TypeIXFR && len(r.Ns) == 1 {
+		if soa, ok := r.Ns[0].(*dns.SOA); ok && !nz.signed {
+			// The journal does not have signatures, so signed
+			// zones always go out whole.
+			journal, incremental = nz.data.journalSince(soa.Serial)
+		}
+	}
+
+	if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+		di.transfer(w, r, nz, qname, journal, incremental)
+		return
+	}
+
+	m.SetReply(r)
+	m.Authoritative = true
+	if nz == nil {
+		ptrs := idx.ptrs[qname]
+		switch {
+		case len(ptrs) == 0:
+			m.Authoritative = false
+			m.Rcode = dns.RcodeRefused
+		case q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY:
+			m.Answer = ptrs
+		default:
+			// Each synthesized PTR is a zone of its own, like in bind.
+			m.Ns = []dns.RR{zoneSOA(qname, (&ZoneSettings{}).resolve(di.ServerName), 1)}
+		}
+		w.WriteMsg(m)
+		return
+	}
+
+	opt := r.IsEdns0()
+	dnssec := nz.signed && opt != nil && opt.Do()
+	rrs, found := nz.owners[qname]
+	if qname == nz.name {
+		rrs = append([]dns.RR{nz.soa}, rrs...)
+		found = true
+	}
+	answered := map[uint16]bool{}
+	for _, rr := range rrs {
+		t := rr.Header().Rrtype
+		if t == dns.TypeRRSIG && q.Qtype != dns.TypeRRSIG && q.Qtype != dns.TypeANY {
+			continue
+		}
+		if t == q.Qtype || q.Qtype == dns.TypeANY || t == dns.TypeCNAME {
+			m.Answer = append(m.Answer, rr)
+			answered[t] = true
+		}
+	}
+	if dnssec && q.Qtype != dns.TypeANY && q.Qtype != dns.TypeRRSIG {
+		for t := range answered {
+			m.Answer = append(m.Answer, nz.sigs(qname, t)...)
+		}
+	}
+	if !found {
+		m.Rcode = dns.RcodeNameError
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = []dns.RR{nz.soa}
+		if dnssec {
+			m.Ns = append(m.Ns, nz.sigs(nz.name, dns.TypeSOA)...)
+			var nsec *dns.NSEC
+			if found {
+				nsec = nz.nsecAt(qname)
+			} else {
+				nsec = nz.covering(qname)
+			}
+			if nsec != nil {
+				m.Ns = append(m.Ns, nsec)
+				m.Ns = append(m.Ns, nz.sigs(nsec.Hdr.Name, dns.TypeNSEC)...)
+			}
+		}
+	}
+	if opt != nil {
+		m.SetEdns0(4096, opt.Do())
+	}
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+		size := dns.MinMsgSize
+		if opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		m.Truncate(size)
+	}
+	w.WriteMsg(m)
+}
+
+// transfer answers AXFR and IXFR requests.  IXFR gets the changes
+// from the journal when it goes back far enough, and the whole zone
+// when it does not.
+func (di *NativeDnsInstance) transfer(w dns.ResponseWriter, r *dns.Msg, nz *nativeZone, qname string, journal []*ZoneDelta, incremental bool) {
+	m := &dns.Msg{}
+	if nz == nil || nz.name != qname || !di.transferAllowed(w) {
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	if udp && (r.Question[0].Qtype == dns.TypeAXFR || !incremental || len(journal) > 0) {
+		// Tell the client to come back over TCP.
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = []dns.RR{nz.soa}
+		w.WriteMsg(m)
+		return
+	}
+
+	rrs := []dns.RR{nz.soa}
+	switch {
+	case r.Question[0].Qtype == dns.TypeIXFR && incremental:
+		for _, d := range journal {
+			rrs = append(rrs, zoneSOA(nz.name, nz.settings, d.From))
+			rrs = append(rrs, di.journalRRs(nz, d.Removed)...)
+			rrs = append(rrs, zoneSOA(nz.name, nz.settings, d.Serial))
+			rrs = append(rrs, di.journalRRs(nz, d.Added)...)
+		}
+		if len(journal) > 0 {
+			rrs = append(rrs, nz.soa)
+		}
+	default:
+		rrs = append(rrs, nz.all...)
+		rrs = append(rrs, nz.soa)
+	}
+
+	// Big zones go out as several messages.
+	for len(rrs) > 0 {
+		n := 100
+		if n > len(rrs) {
+			n = len(rrs)
+		}
+		m = &dns.Msg{}
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = rrs[:n]
+		if err := w.WriteMsg(m); err != nil {
+			log.Printf("Transfer of %s to %s failed: %v", nz.name, w.RemoteAddr(), err)
+			return
+		}
+		rrs = rrs[n:]
+	}
+}
+
+func (di *NativeDnsInstance) journalRRs(nz *nativeZone, recs []Record) []dns.RR {
+	res := make([]dns.RR, 0, len(recs))
+	for _, rec := range recs {
+		rr, err := storedRR(nz.name, nz.data, rec.Name, rec.Type, ZoneContent{Content: rec.Content, TTL: rec.TTL})
+		if err != nil {
+			continue
+		}
+		res = append(res, rr)
+	}
+	return res
+}
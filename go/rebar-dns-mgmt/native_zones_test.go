@@ -0,0 +1,266 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startNative starts a native server for zones on a random local port
+// and returns its address.
+func startNative(t *testing.T, di *NativeDnsInstance, zones *ZoneTracker) (string, func()) {
+	di.load(zones)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := &dns.Server{PacketConn: pc, Handler: di}
+	tcp := &dns.Server{Listener: l, Handler: di}
+	for _, srv := range []*dns.Server{udp, tcp} {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ActivateAndServe()
+		<-started
+	}
+	return pc.LocalAddr().String(), func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	}
+}
+
+func testZones() *ZoneTracker {
+	zt := NewZoneTracker()
+	zd := NewZoneData()
+	zd.Serial = 100
+	zd.Entries["node1"] = &ZoneEntry{Types: map[string][]ZoneContent{"A": {{Content: "192.168.1.10"}}}}
+	zd.Entries["www"] = &ZoneEntry{Types: map[string][]ZoneContent{"CNAME": {{Content: "node1"}}}}
+	zt.Zones["example.com"] = zd
+	return zt
+}
+
+// addRecord adds a record the way PatchZone does.
+func addRecord(zd *ZoneData, name, t, content string) {
+	ze := zd.Entries[name]
+	if ze == nil {
+		ze = NewZoneEntry()
+		zd.Entries[name] = ze
+	}
+	ze.Types[t] = append(ze.Types[t], ZoneContent{Content: content})
+	zd.recordChange(nil, []Record{{Name: name, Type: t, Content: content}})
+}
+
+func query(t *testing.T, addr, name string, qtype uint16) *dns.Msg {
+	m := &dns.Msg{}
+	m.SetQuestion(name, qtype)
+	r, err := dns.Exchange(m, addr)
+	if err != nil {
+		t.Fatalf("Query for %s failed: %v", name, err)
+	}
+	return r
+}
+
+func TestNativeQuery(t *testing.T) {
+	di, _ := NewNativeDnsInstance("ns1.example.com", nil, nil)
+	addr, stop := startNative(t, di, testZones())
+	defer stop()
+
+	r := query(t, addr, "node1.example.com.", dns.TypeA)
+	if !r.Authoritative || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.168.1.10" {
+		t.Errorf("Expected authoritative 192.168.1.10, but got %v", r)
+	}
+
+	r = query(t, addr, "WWW.Example.COM.", dns.TypeA)
+	if len(r.Answer) != 1 || r.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Errorf("Expected CNAME for www, but got %v", r)
+	}
+
+	r = query(t, addr, "example.com.", dns.TypeSOA)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.SOA).Serial != 100 {
+		t.Errorf("Expected SOA with serial 100, but got %v", r)
+	}
+
+	r = query(t, addr, "missing.example.com.", dns.TypeA)
+	if r.Rcode != dns.RcodeNameError || len(r.Ns) != 1 {
+		t.Errorf("Expected NXDOMAIN with SOA, but got %v", r)
+	}
+
+	r = query(t, addr, "node1.example.com.", dns.TypeMX)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 || len(r.Ns) != 1 {
+		t.Errorf("Expected NODATA with SOA, but got %v", r)
+	}
+
+	r = query(t, addr, "10.1.168.192.in-addr.arpa.", dns.TypePTR)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.PTR).Ptr != "node1.example.com." {
+		t.Errorf("Expected synthesized PTR, but got %v", r)
+	}
+
+	r = query(t, addr, "other.org.", dns.TypeA)
+	if r.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected REFUSED for a zone we do not have, but got %v", r)
+	}
+}
+
+func TestNativeIndexRebuild(t *testing.T) {
+	zt := testZones()
+	other := NewZoneData()
+	other.Entries["host"] = &ZoneEntry{Types: map[string][]ZoneContent{"A": {{Content: "10.0.0.1"}}}}
+	zt.Zones["example.org"] = other
+	di, _ := NewNativeDnsInstance("ns1.example.com", nil, nil)
+	addr, stop := startNative(t, di, zt)
+	defer stop()
+
+	// Queries are answered from the index alone, so they do not
+	// wait for the tracker.
+	zt.Lock()
+	r := query(t, addr, "node1.example.com.", dns.TypeA)
+	zt.Unlock()
+	if len(r.Answer) != 1 {
+		t.Errorf("Expected an answer while the tracker is locked, but got %v", r)
+	}
+	before := di.currentIndex()
+	zt.Lock()
+	addRecord(zt.Zones["example.com"], "node2", "A", "192.168.1.11")
+	zt.Unlock()
+
+	// Queries do not rebuild the index, the change does.
+	r = query(t, addr, "node2.example.com.", dns.TypeA)
+	if r.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected new record to wait for the change, but got %v", r)
+	}
+	if _, err := di.PatchZone(zt, "example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	after := di.currentIndex()
+	if after.zones["example.org."] != before.zones["example.org."] {
+		t.Error("Expected the unchanged zone to be kept, but it was rebuilt")
+	}
+	if after.zones["example.com."] == before.zones["example.com."] {
+		t.Error("Expected the changed zone to be rebuilt")
+	}
+	if len(after.ptrs["11.1.168.192.in-addr.arpa."]) != 1 || len(after.ptrs["1.0.0.10.in-addr.arpa."]) != 1 {
+		t.Errorf("Expected reverse records for both zones, but got %v", after.ptrs)
+	}
+
+	r = query(t, addr, "node2.example.com.", dns.TypeA)
+	if len(r.Answer) != 1 {
+		t.Errorf("Expected new record to be served, but got %v", r)
+	}
+	r = query(t, addr, "example.com.", dns.TypeSOA)
+	if serial := r.Answer[0].(*dns.SOA).Serial; serial <= 100 {
+		t.Errorf("Expected serial to move past 100, but got %d", serial)
+	}
+
+	zt.Lock()
+	delete(zt.Zones, "example.org")
+	zt.Unlock()
+	di.DeleteZone(zt, "example.org", other)
+	if r = query(t, addr, "host.example.org.", dns.TypeA); r.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected deleted zone to be refused, but got %v", r)
+	}
+	if ptrs := di.currentIndex().ptrs["1.0.0.10.in-addr.arpa."]; len(ptrs) != 0 {
+		t.Errorf("Expected reverse records of the deleted zone to go, but got %v", ptrs)
+	}
+}
+
+func transfer(t *testing.T, addr string, m *dns.Msg) []dns.RR {
+	tr := &dns.Transfer{}
+	env, err := tr.In(m, addr)
+	if err != nil {
+		t.Fatalf("Transfer failed: %v", err)
+	}
+	res := []dns.RR{}
+	for e := range env {
+		if e.Error != nil {
+			t.Fatalf("Transfer failed: %v", e.Error)
+		}
+		res = append(res, e.RR...)
+	}
+	return res
+}
+
+func TestNativeAXFR(t *testing.T) {
+	di, _ := NewNativeDnsInstance("ns1.example.com", []string{"127.0.0.1"}, nil)
+	addr, stop := startNative(t, di, testZones())
+	defer stop()
+
+	m := &dns.Msg{}
+	m.SetAxfr("example.com.")
+	rrs := transfer(t, addr, m)
+	// SOA, NS, A, CNAME, SOA
+	if len(rrs) != 5 || rrs[0].Header().Rrtype != dns.TypeSOA || rrs[4].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("Expected 5 records framed by SOAs, but got %v", rrs)
+	}
+}
+
+func TestNativeAXFRRefused(t *testing.T) {
+	di, _ := NewNativeDnsInstance("ns1.example.com", []string{"10.0.0.0/8"}, nil)
+	addr, stop := startNative(t, di, testZones())
+	defer stop()
+
+	m := &dns.Msg{}
+	m.SetAxfr("example.com.")
+	env, err := (&dns.Transfer{}).In(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := <-env
+	if e.Error == nil {
+		t.Errorf("Expected transfer to be refused, but got %v", e.RR)
+	}
+}
+
+func TestNativeIXFR(t *testing.T) {
+	zt := testZones()
+	zd := zt.Zones["example.com"]
+	addRecord(zd, "node2", "A", "192.168.1.11")
+	mid := zd.Serial
+	addRecord(zd, "node3", "A", "192.168.1.12")
+
+	di, _ := NewNativeDnsInstance("ns1.example.com", []string{"127.0.0.0/8"}, nil)
+	addr, stop := startNative(t, di, zt)
+	defer stop()
+
+	m := &dns.Msg{}
+	m.SetIxfr("example.com.", mid, "ns1.example.com.", defaultMbox)
+	rrs := transfer(t, addr, m)
+	// SOA(new), SOA(mid), SOA(new), A node3, SOA(new)
+	if len(rrs) != 5 {
+		t.Fatalf("Expected an incremental transfer of 5 records, but got %v", rrs)
+	}
+	if rrs[1].(*dns.SOA).Serial != mid || rrs[3].(*dns.A).A.String() != "192.168.1.12" {
+		t.Errorf("Expected the change from %d adding node3, but got %v", mid, rrs)
+	}
+
+	// Too old for the journal, so the whole zone comes back.
+	m.SetIxfr("example.com.", 1, "ns1.example.com.", defaultMbox)
+	rrs = transfer(t, addr, m)
+	if len(rrs) != 7 {
+		t.Errorf("Expected a full transfer of 7 records, but got %v", rrs)
+	}
+}
+
+func TestJournalSince(t *testing.T) {
+	zd := NewZoneData()
+	addRecord(zd, "a", "A", "1.1.1.1")
+	first := zd.Journal[0].From
+	for i := 0; i < maxJournal+5; i++ {
+		addRecord(zd, "a", "A", "1.1.1.2")
+	}
+	if len(zd.Journal) != maxJournal {
+		t.Errorf("Expected journal to be trimmed to %d, but it is %d", maxJournal, len(zd.Journal))
+	}
+	if _, ok := zd.journalSince(first); ok {
+		t.Error("Expected trimmed serial to be missing from the journal")
+	}
+	if d, ok := zd.journalSince(zd.Serial); !ok || len(d) != 0 {
+		t.Error("Expected current serial to need no changes")
+	}
+	if d, ok := zd.journalSince(zd.Journal[maxJournal-2].From); !ok || len(d) != 2 {
+		t.Errorf("Expected 2 changes, but got %d", len(d))
+	}
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+
+	"github.com/miekg/dns"
 )
 
 type NsupdateDnsInstance struct {
@@ -39,21 +43,104 @@ func (di *NsupdateDnsInstance) GetZone(zones *ZoneTracker, id string) (Zone, *ba
 }
 
 // Patch function
-func (di *NsupdateDnsInstance) PatchZone(zones *ZoneTracker, zoneName string, rec Record) (Zone, *backendError) {
-	var command string
-
-	switch rec.ChangeType {
-	case "ADD":
-		command = "add"
-	case "REMOVE":
-		command = "delete"
-	default:
-		return Zone{}, &backendError{"Invalid Change Type", 400}
+func (di *NsupdateDnsInstance) PatchZone(zones *ZoneTracker, zoneName string, recs []Record) (Zone, *backendError) {
+	updates := make([]string, 0, len(recs))
+	for _, rec := range recs {
+		var command string
+
+		switch rec.ChangeType {
+		case "ADD":
+			command = "add"
+		case "REMOVE":
+			command = "delete"
+		default:
+			return Zone{}, &backendError{"Invalid Change Type", 400}
+		}
+
+		rr, perr := parseRR(zoneName, rec.Name, rec.Type, rec.Content, zones.Zones[zoneName].recordTTL(rec.TTL))
+		if perr != nil {
+			return Zone{}, &backendError{perr.Error(), 400}
+		}
+		updates = append(updates, command+" "+rr.String())
+	}
+	if err := di.send(zoneName, updates); err != nil {
+		return Zone{}, err
+	}
+
+	return buildZone(zoneName, zones.Zones[zoneName]), nil
+}
+
+// Create function.  The zone has to already be configured on the
+// server, so this just sets its SOA and NS records.
+func (di *NsupdateDnsInstance) CreateZone(zones *ZoneTracker, zoneName string) (Zone, *backendError) {
+	return di.UpdateZone(zones, zoneName)
+}
+
+// Update function.  Server is an address rather than a name, so the
+// SOA and NS records are only replaced when the settings name a
+// primary nameserver.
+func (di *NsupdateDnsInstance) UpdateZone(zones *ZoneTracker, zoneName string) (Zone, *backendError) {
+	zone := zones.Zones[zoneName]
+	if zone == nil {
+		return Zone{}, &backendError{"Not Found", 404}
+	}
+	settings := zone.Settings.resolve("")
+	if settings.PrimaryNS != "" {
+		origin := dns.Fqdn(zoneName)
+		ttl := settings.DefaultTTL
+		updates := []string{fmt.Sprintf("add %s %d IN SOA %s %s %d %d %d %d %d",
+			origin, ttl, settings.PrimaryNS, settings.Mbox, zone.Serial,
+			settings.Refresh, settings.Retry, settings.Expire, settings.Minimum)}
+		updates = append(updates, fmt.Sprintf("delete %s IN NS", origin))
+		for _, ns := range settings.Nameservers {
+			updates = append(updates, fmt.Sprintf("add %s %d IN NS %s", origin, ttl, ns))
+		}
+		if err := di.send(zoneName, updates); err != nil {
+			return Zone{}, err
+		}
+	}
+
+	return buildZone(zoneName, zone), nil
+}
+
+// Delete function.  This removes the records we managed.  The zone
+// itself stays configured on the server.
+func (di *NsupdateDnsInstance) DeleteZone(zones *ZoneTracker, zoneName string, data *ZoneData) *backendError {
+	updates := []string{}
+	for name, entry := range data.Entries {
+		for t := range entry.Types {
+			updates = append(updates, fmt.Sprintf("delete %s IN %s", ownerName(zoneName, name), t))
+		}
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	return di.send(zoneName, updates)
+}
+
+// liveRecords transfers the zone from the server.
+func (di *NsupdateDnsInstance) liveRecords(zones *ZoneTracker, zoneName string) ([]dns.RR, *backendError) {
+	return axfrRecords(net.JoinHostPort(di.Server, "53"), zoneName)
+}
+
+// repairZone removes the extra records and adds the missing ones in
+// one transaction.
+func (di *NsupdateDnsInstance) repairZone(zones *ZoneTracker, zoneName string, drift *ZoneDrift) *backendError {
+	updates := make([]string, 0, len(drift.Missing)+len(drift.Extra))
+	for _, rr := range drift.Extra {
+		updates = append(updates, "delete "+rr)
 	}
+	for _, rr := range drift.Missing {
+		updates = append(updates, "add "+rr)
+	}
+	return di.send(zoneName, updates)
+}
 
+// send runs the updates against the zone in one nsupdate transaction.
+func (di *NsupdateDnsInstance) send(zoneName string, updates []string) *backendError {
 	f, err := ioutil.TempFile("/tmp", "dnsupdate")
 	if err != nil {
-		return Zone{}, &backendError{"Server Error: " + err.Error(), 400}
+		return &backendError{"Server Error: " + err.Error(), 400}
 	}
 	defer f.Close()
 	defer os.Remove(f.Name())
@@ -62,15 +149,16 @@ func (di *NsupdateDnsInstance) PatchZone(zones *ZoneTracker, zoneName string, re
 
 	w.WriteString("server " + di.Server + "\n")
 	w.WriteString("zone " + zoneName + "\n")
-	w.WriteString("update " + command + " " + rec.Name + "3600 IN " + rec.Type + " " + rec.Content + "\n")
+	for _, update := range updates {
+		w.WriteString("update " + update + "\n")
+	}
 	w.WriteString("show\nsend\nquit\n")
 	w.Flush()
 
 	cmdName := "nsupdate"
 	cmdArgs := []string{f.Name()}
 	if _, err = exec.Command(cmdName, cmdArgs...).Output(); err != nil {
-		return Zone{}, &backendError{"Nsupdate command failed: " + err.Error(), 400}
+		return &backendError{"Nsupdate command failed: " + err.Error(), 400}
 	}
-
-	return buildZone(zoneName, zones.Zones[zoneName]), nil
+	return nil
 }
@@ -16,6 +16,9 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
 )
 
 /*
@@ -160,25 +163,67 @@ func (di *PowerDnsInstance) GetZone(zones *ZoneTracker, id string) (Zone, *backe
 }
 
 // Patch function
-func (di *PowerDnsInstance) PatchZone(zones *ZoneTracker, zoneName string, rec Record) (Zone, *backendError) {
+func (di *PowerDnsInstance) PatchZone(zones *ZoneTracker, zoneName string, changed []Record) (Zone, *backendError) {
+
+	// One rrset per name and type that changed, with what the
+	// tracker now has for it.
+	rrs := make([]PowerDnsRRSet, 0, len(changed))
+	seen := make(map[string]bool)
+	for _, rec := range changed {
+		key := rec.Name + " " + rec.Type
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		rrs = append(rrs, powerDnsRRSet(zones, zoneName, rec.Name, rec.Type))
+	}
+
+	rrsets := PowerDnsRRSets{
+		PowerDnsRRSets: rrs,
+	}
+
+	url := di.makeZoneUrl(&zoneName)
+	b, berr := json.Marshal(rrsets)
+	if berr != nil {
+		log.Panic(berr)
+	}
+	body, derr := di.doURL("PATCH", url, bytes.NewReader(b))
+	if derr != nil {
+		return Zone{}, derr
+	}
+
+	var pdz PowerDnsZone
+	err := json.Unmarshal(body, &pdz)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	data := marshalPowerDnsZoneToZone(pdz)
 
-	rrs := make([]PowerDnsRRSet, 0, 2)
+	return data, nil
+}
+
+// powerDnsRRSet builds the rrset for a name and type from the tracker.
+func powerDnsRRSet(zones *ZoneTracker, zoneName, name, rrType string) PowerDnsRRSet {
 	recs := make([]PowerDnsRecord, 0, 2)
+	owner := strings.TrimSuffix(ownerName(zoneName, name), ".")
 
 	if zones.Zones[zoneName] != nil &&
-		zones.Zones[zoneName].Entries[rec.Name] != nil &&
-		zones.Zones[zoneName].Entries[rec.Name].Types[rec.Type] != nil {
+		zones.Zones[zoneName].Entries[name] != nil &&
+		zones.Zones[zoneName].Entries[name].Types[rrType] != nil {
 
-		for _, zz := range zones.Zones[zoneName].Entries[rec.Name].Types[rec.Type] {
-			// If delete skip this part
+		zone := zones.Zones[zoneName]
+		for _, zz := range zone.Entries[name].Types[rrType] {
+			zz.TTL = zone.recordTTL(zz.TTL)
+			content, priority, ttl := powerDnsContent(zoneName, name, rrType, zz)
 			record := PowerDnsRecord{
-				Content:  zz.Content,
-				Name:     rec.Name + "." + zoneName,
-				Type:     rec.Type,
+				Content:  content,
+				Name:     owner,
+				Type:     rrType,
 				Disabled: false,
-				TTL:      3600,
-				Priority: 0,
-				SetPtr:   true,
+				TTL:      ttl,
+				Priority: priority,
+				SetPtr:   zone.autoReverse() && (rrType == "A" || rrType == "AAAA"),
 			}
 			recs = append(recs, record)
 		}
@@ -190,37 +235,188 @@ func (di *PowerDnsInstance) PatchZone(zones *ZoneTracker, zoneName string, rec R
 		action = "DELETE"
 	}
 
-	rrset := PowerDnsRRSet{
-		Name:            rec.Name + "." + zoneName,
-		Type:            rec.Type,
+	return PowerDnsRRSet{
+		Name:            owner,
+		Type:            rrType,
 		ChangeType:      action,
 		PowerDnsRecords: recs,
 	}
-	rrs = append(rrs, rrset)
+}
 
-	rrsets := PowerDnsRRSets{
-		PowerDnsRRSets: rrs,
+// settingsRRSets are the SOA and NS rrsets for the zone settings.
+// PowerDNS is not told a server name, so they are only sent when the
+// settings name a primary nameserver.
+func settingsRRSets(zoneName string, zone *ZoneData) []PowerDnsRRSet {
+	settings := zone.Settings.resolve("")
+	if settings.PrimaryNS == "" {
+		return nil
+	}
+	trim := func(n string) string { return strings.TrimSuffix(n, ".") }
+	soa := PowerDnsRecord{
+		Content: fmt.Sprintf("%s %s %d %d %d %d %d",
+			trim(settings.PrimaryNS), trim(settings.Mbox), zone.Serial,
+			settings.Refresh, settings.Retry, settings.Expire, settings.Minimum),
+		Name: zoneName,
+		Type: "SOA",
+		TTL:  settings.DefaultTTL,
+	}
+	ns := make([]PowerDnsRecord, 0, len(settings.Nameservers))
+	for _, server := range settings.Nameservers {
+		ns = append(ns, PowerDnsRecord{
+			Content: trim(server),
+			Name:    zoneName,
+			Type:    "NS",
+			TTL:     settings.DefaultTTL,
+		})
 	}
+	return []PowerDnsRRSet{
+		{Name: zoneName, Type: "SOA", ChangeType: "REPLACE", PowerDnsRecords: []PowerDnsRecord{soa}},
+		{Name: zoneName, Type: "NS", ChangeType: "REPLACE", PowerDnsRecords: ns},
+	}
+}
 
-	url := di.makeZoneUrl(&zoneName)
-	b, berr := json.Marshal(rrsets)
+// Create function
+func (di *PowerDnsInstance) CreateZone(zones *ZoneTracker, zoneName string) (Zone, *backendError) {
+	zone := zones.Zones[zoneName]
+	if zone == nil {
+		return Zone{}, &backendError{"Not Found", 404}
+	}
+	pdz := PowerDnsZone{
+		Name: zoneName,
+		Kind: "Native",
+	}
+	for _, server := range zone.Settings.resolve("").Nameservers {
+		pdz.Nameservers = append(pdz.Nameservers, strings.TrimSuffix(server, "."))
+	}
+	b, berr := json.Marshal(pdz)
 	if berr != nil {
 		log.Panic(berr)
 	}
-	body, derr := di.doURL("PATCH", url, bytes.NewReader(b))
+	if _, derr := di.doURL("POST", di.makeZoneUrl(nil), bytes.NewReader(b)); derr != nil {
+		return Zone{}, derr
+	}
+	return di.UpdateZone(zones, zoneName)
+}
+
+// Update function
+func (di *PowerDnsInstance) UpdateZone(zones *ZoneTracker, zoneName string) (Zone, *backendError) {
+	zone := zones.Zones[zoneName]
+	if zone == nil {
+		return Zone{}, &backendError{"Not Found", 404}
+	}
+	rrs := settingsRRSets(zoneName, zone)
+	if len(rrs) == 0 {
+		return di.GetZone(zones, zoneName)
+	}
+	b, berr := json.Marshal(PowerDnsRRSets{PowerDnsRRSets: rrs})
+	if berr != nil {
+		log.Panic(berr)
+	}
+	body, derr := di.doURL("PATCH", di.makeZoneUrl(&zoneName), bytes.NewReader(b))
 	if derr != nil {
 		return Zone{}, derr
 	}
 
 	var pdz PowerDnsZone
-	err := json.Unmarshal(body, &pdz)
-	if err != nil {
+	if err := json.Unmarshal(body, &pdz); err != nil {
 		log.Panic(err)
 	}
+	return marshalPowerDnsZoneToZone(pdz), nil
+}
 
-	data := marshalPowerDnsZoneToZone(pdz)
+// Delete function
+func (di *PowerDnsInstance) DeleteZone(zones *ZoneTracker, zoneName string, data *ZoneData) *backendError {
+	_, derr := di.doURL("DELETE", di.makeZoneUrl(&zoneName), nil)
+	return derr
+}
 
-	return data, nil
+// liveRecords reads the zone back from PowerDNS.
+func (di *PowerDnsInstance) liveRecords(zones *ZoneTracker, zoneName string) ([]dns.RR, *backendError) {
+	zone, err := di.GetZone(zones, zoneName)
+	if err != nil {
+		return nil, err
+	}
+	rrs := make([]dns.RR, 0, len(zone.Records))
+	for _, rec := range zone.Records {
+		if rec.Type == "SOA" {
+			continue
+		}
+		rr, perr := powerDnsRR(zoneName, rec)
+		if perr != nil {
+			log.Printf("Skipping PowerDNS record %s %s %s in %s: %v", rec.Name, rec.Type, rec.Content, zoneName, perr)
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// repairZone replaces every drifted rrset with what the tracker has.
+// The apex NS records come from the settings.
+func (di *PowerDnsInstance) repairZone(zones *ZoneTracker, zoneName string, drift *ZoneDrift) *backendError {
+	recs := []Record{}
+	settings := false
+	origin := dns.CanonicalName(zoneName)
+	for _, n := range driftNames(drift) {
+		if n[0] == origin && n[1] == "NS" {
+			settings = true
+			continue
+		}
+		recs = append(recs, Record{Name: entryName(zoneName, zones.Zones[zoneName], n[0]), Type: n[1]})
+	}
+	if len(recs) > 0 {
+		if _, err := di.PatchZone(zones, zoneName, recs); err != nil {
+			return err
+		}
+	}
+	if settings {
+		if _, err := di.UpdateZone(zones, zoneName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// powerDnsRR turns a record read from PowerDNS back into zone file
+// form, undoing what powerDnsContent does.
+func powerDnsRR(zoneName string, rec Record) (dns.RR, error) {
+	content := rec.Content
+	fields := strings.Fields(content)
+	switch rec.Type {
+	case "CNAME", "NS", "PTR":
+		content = dns.Fqdn(content)
+	case "MX", "SRV":
+		if len(fields) > 0 {
+			fields[len(fields)-1] = dns.Fqdn(fields[len(fields)-1])
+			content = strings.Join(fields, " ")
+		}
+	}
+	return parseRR(zoneName, dns.Fqdn(rec.Name), rec.Type, content, rec.TTL)
+}
+
+// powerDnsContent converts stored content to the form PowerDNS wants.
+// PowerDNS keeps MX and SRV priorities out of the content and leaves
+// the trailing dot off names.
+func powerDnsContent(zoneName, name, rrType string, zc ZoneContent) (string, int, int) {
+	rr, err := parseRR(zoneName, name, rrType, zc.Content, zc.TTL)
+	if err != nil {
+		return zc.Content, 0, defaultTTL
+	}
+	ttl := int(rr.Header().Ttl)
+	trim := func(n string) string { return strings.TrimSuffix(n, ".") }
+	switch r := rr.(type) {
+	case *dns.MX:
+		return trim(r.Mx), int(r.Preference), ttl
+	case *dns.SRV:
+		return fmt.Sprintf("%d %d %s", r.Weight, r.Port, trim(r.Target)), int(r.Priority), ttl
+	case *dns.CNAME:
+		return trim(r.Target), 0, ttl
+	case *dns.NS:
+		return trim(r.Ns), 0, ttl
+	case *dns.PTR:
+		return trim(r.Ptr), 0, ttl
+	}
+	return rdata(rr), 0, ttl
 }
 
 func marshalPowerDnsZonesToZones(pzs []PowerDnsZone) []Zone {
@@ -244,6 +440,11 @@ func marshalPowerDnsZoneToZone(pz PowerDnsZone) Zone {
 			Content: pzr.Content,
 			Type:    pzr.Type,
 			Name:    pzr.Name,
+			TTL:     pzr.TTL,
+		}
+		if pzr.Type == "MX" || pzr.Type == "SRV" {
+			rec.Priority = pzr.Priority
+			rec.Content = fmt.Sprintf("%d %s", pzr.Priority, pzr.Content)
 		}
 
 		r = append(r, rec)
@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/ant0ine/go-json-rest/rest"
 	"github.com/digitalrebar/digitalrebar/go/common/cert"
@@ -21,8 +22,13 @@ import (
 
 var dataDir, backingStore, hostString string
 var dnsType, dnsServer, dnsHostname, dnsPassword string
+var dnsListen, dnsAllowTransfer, dnsNotify string
+var dnsUrl, dnsAccessKey string
+var ddnsClients string
 var serverPort, dnsPort int
 var versionFlag bool
+var reconcileInterval time.Duration
+var reconcileRepair bool
 
 func init() {
 	flag.BoolVar(&versionFlag, "version", false, "Print version and exit")
@@ -32,12 +38,31 @@ func init() {
 	flag.IntVar(&serverPort, "serverPort", 6754, "Server Port")
 	// For NSUPDATE, Dns.Server is ip of server to update
 	// For PDNS, Dns.Server to access (localhost)
-	// For BIND, Dns.Server name (FQDN of DNS server)
-	flag.StringVar(&dnsType, "dnsType", "BIND", "Type of DNS server to manage: BIND, PDNS, NSUPDATE")
+	// For BIND and NATIVE, Dns.Server name (FQDN of DNS server)
+	// For ROUTE53, Dns.Url is the API endpoint and Dns.Password the secret key
+	flag.StringVar(&dnsType, "dnsType", "BIND", "Type of DNS server to manage: BIND, PDNS, NSUPDATE, NATIVE, ROUTE53")
 	flag.StringVar(&dnsServer, "dnsServer", "", "DNS Server access ip or address")
 	flag.StringVar(&dnsHostname, "dnsHostname", "", "DNS Hostname for defining server")
 	flag.IntVar(&dnsPort, "dnsPort", 6754, "DNS Port for accessing remote server")
 	flag.StringVar(&dnsPassword, "dnsPassword", "", "DNS Password for accessing remote server")
+	flag.StringVar(&dnsListen, "dnsListen", ":53", "Address to answer DNS queries on when NATIVE")
+	flag.StringVar(&dnsAllowTransfer, "dnsAllowTransfer", "", "Comma separated list of addresses or CIDRs allowed to AXFR/IXFR when NATIVE")
+	flag.StringVar(&dnsNotify, "dnsNotify", "", "Comma separated list of secondaries to NOTIFY when NATIVE")
+	flag.StringVar(&dnsUrl, "dnsUrl", "https://route53.amazonaws.com", "API endpoint of the DNS provider when ROUTE53")
+	flag.StringVar(&dnsAccessKey, "dnsAccessKey", "", "Access key for the DNS provider when ROUTE53, empty to not sign requests")
+	flag.DurationVar(&reconcileInterval, "reconcileInterval", 15*time.Minute, "How often to check the DNS server for drift, 0 to not check")
+	flag.StringVar(&ddnsClients, "ddnsClients", "rebar-dhcp", "Comma separated list of client certificate names allowed to publish records with PATCH /ddns/zones")
+	flag.BoolVar(&reconcileRepair, "reconcileRepair", false, "Repair drift found by the periodic check instead of just logging it")
+}
+
+func splitList(s string) []string {
+	res := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
 }
 
 func main() {
@@ -50,6 +75,7 @@ func main() {
 	log.Printf("Version: %s\n", version.REBAR_VERSION)
 
 	var be dns_backend_point
+	var native *NativeDnsInstance
 	var err error
 
 	if dnsType == "BIND" {
@@ -62,30 +88,59 @@ func main() {
 		}
 	} else if dnsType == "NSUPDATE" {
 		be = NewNsupdateDnsInstance(dnsServer)
+	} else if dnsType == "NATIVE" {
+		native, err = NewNativeDnsInstance(dnsServer, splitList(dnsAllowTransfer), splitList(dnsNotify))
+		if err != nil {
+			log.Fatal(err)
+		}
+		be = native
+	} else if dnsType == "ROUTE53" {
+		be = NewRoute53DnsInstance(dnsUrl, dnsAccessKey, dnsPassword)
 	} else {
 		log.Fatal("Failed to find type")
 	}
 	var bs LoadSaver
+	var audit AuditLogger
 	switch backingStore {
 	case "file":
 		bs, err = NewFileStore(dataDir + "/database.json")
+		if err == nil {
+			audit, err = NewFileAuditLog(dataDir + "/audit.log")
+		}
 	case "consul":
 		bs, err = NewConsulStore(dataDir)
+		if err == nil {
+			audit, err = NewConsulAuditLog(dataDir + "/audit")
+		}
 	default:
 		log.Fatalf("Unknown backing store type %s", backingStore)
 	}
+	if err != nil {
+		log.Fatalf("Failed to open the %s backing store: %v", backingStore, err)
+	}
 
 	fe := NewFrontend(&be, bs)
+	fe.auditLog = audit
+	fe.ddnsClients = map[string]bool{}
+	for _, name := range splitList(ddnsClients) {
+		fe.ddnsClients[name] = true
+	}
 
 	fe.load_data()
+	go fe.runDnssec()
+	if reconcileInterval > 0 {
+		go fe.runReconcile(reconcileInterval, reconcileRepair)
+	}
+
+	if native != nil {
+		go func() {
+			log.Fatal(native.Serve(fe.ZoneInfo, dnsListen))
+		}()
+	}
 
 	api := rest.NewApi()
 	api.Use(rest.DefaultDevStack...)
-	router, err := rest.MakeRouter(
-		rest.Get("/zones", fe.GetAllZones),
-		rest.Get("/zones/#id", fe.GetZone),
-		&rest.Route{"PATCH", "/zones/#id", fe.PatchZone},
-	)
+	router, err := fe.router()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/digitalrebar/digitalrebar/go/common/multi-tenancy"
+	"github.com/miekg/dns"
+)
+
+// driftChecker is implemented by backends whose DNS server can drift
+// away from the tracker, through manual edits or restarts.
+type driftChecker interface {
+	// liveRecords returns what the DNS server serves for a zone.
+	liveRecords(zones *ZoneTracker, zoneName string) ([]dns.RR, *backendError)
+	// repairZone makes the DNS server serve what the tracker has.
+	repairZone(zones *ZoneTracker, zoneName string, drift *ZoneDrift) *backendError
+}
+
+// ZoneDrift is the difference between the tracker and what the DNS
+// server serves for a zone.  Records are in zone file form.
+type ZoneDrift struct {
+	Zone      string    `json:"zone"`
+	InSync    bool      `json:"in_sync"`
+	Missing   []string  `json:"missing,omitempty"` // In the tracker but not served
+	Extra     []string  `json:"extra,omitempty"`   // Served but not in the tracker
+	Repaired  bool      `json:"repaired,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// ReconcileRequest is the body of a reconcile request.  Without
+// Repair, drift is only reported.
+type ReconcileRequest struct {
+	Repair bool `json:"repair"`
+}
+
+// driftIgnored says whether records of type t are left out of drift
+// checks.  The SOA serial and DNSSEC records change on their own.
+func driftIgnored(t uint16) bool {
+	switch t {
+	case dns.TypeSOA, dns.TypeDNSKEY, dns.TypeRRSIG, dns.TypeNSEC,
+		dns.TypeNSEC3, dns.TypeNSEC3PARAM, dns.TypeCDS, dns.TypeCDNSKEY:
+		return true
+	}
+	return false
+}
+
+// diffRRs compares what a zone should have with what is served.  The
+// apex NS records are only compared when the zone says what they
+// should be.
+func diffRRs(zone string, expected, live []dns.RR) (missing, extra []string) {
+	zone = dns.CanonicalName(zone)
+	key := func(rr dns.RR) string {
+		rr = dns.Copy(rr)
+		rr.Header().Name = dns.CanonicalName(rr.Header().Name)
+		return rr.String()
+	}
+	want := map[string]bool{}
+	apexNS := false
+	for _, rr := range expected {
+		if driftIgnored(rr.Header().Rrtype) {
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeNS && dns.CanonicalName(rr.Header().Name) == zone {
+			apexNS = true
+		}
+		want[key(rr)] = true
+	}
+	have := map[string]bool{}
+	for _, rr := range live {
+		if driftIgnored(rr.Header().Rrtype) {
+			continue
+		}
+		if !apexNS && rr.Header().Rrtype == dns.TypeNS && dns.CanonicalName(rr.Header().Name) == zone {
+			continue
+		}
+		k := key(rr)
+		have[k] = true
+		if !want[k] {
+			extra = append(extra, k)
+		}
+	}
+	for k := range want {
+		if !have[k] {
+			missing = append(missing, k)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	return missing, extra
+}
+
+// axfrRecords transfers a zone from the DNS server at addr.
+func axfrRecords(addr, zoneName string) ([]dns.RR, *backendError) {
+	m := &dns.Msg{}
+	m.SetAxfr(dns.Fqdn(zoneName))
+	t := &dns.Transfer{}
+	ch, err := t.In(m, addr)
+	if err != nil {
+		return nil, &backendError{"Zone transfer failed: " + err.Error(), http.StatusInternalServerError}
+	}
+	rrs := []dns.RR{}
+	for env := range ch {
+		if env.Error != nil {
+			return nil, &backendError{"Zone transfer failed: " + env.Error.Error(), http.StatusInternalServerError}
+		}
+		rrs = append(rrs, env.RR...)
+	}
+	return rrs, nil
+}
+
+// driftNames returns the owner and type of every drifted record, once
+// each.
+func driftNames(drift *ZoneDrift) [][2]string {
+	res := [][2]string{}
+	seen := map[[2]string]bool{}
+	for _, s := range append(append([]string{}, drift.Missing...), drift.Extra...) {
+		rr, err := dns.NewRR(s)
+		if err != nil || rr == nil {
+			continue
+		}
+		k := [2]string{rr.Header().Name, dns.TypeToString[rr.Header().Rrtype]}
+		if !seen[k] {
+			seen[k] = true
+			res = append(res, k)
+		}
+	}
+	return res
+}
+
+// entryName returns the tracker name for owner in a zone.
+func entryName(zoneName string, zd *ZoneData, owner string) string {
+	owner = dns.CanonicalName(owner)
+	if zd != nil {
+		for name := range zd.Entries {
+			if dns.CanonicalName(ownerName(zoneName, name)) == owner {
+				return name
+			}
+		}
+	}
+	origin := dns.CanonicalName(zoneName)
+	if owner == origin {
+		return "@"
+	}
+	return strings.TrimSuffix(owner, "."+origin)
+}
+
+// checkDrift compares a zone in the tracker with the DNS server, and
+// pushes the tracker's view to the server if asked to and they
+// differ.
+func (fe *Frontend) checkDrift(zoneName string, repair bool) (*ZoneDrift, *backendError) {
+	dc, ok := (*fe.Backend).(driftChecker)
+	if !ok {
+		return nil, &backendError{"Drift detection is not supported by this DNS backend", http.StatusBadRequest}
+	}
+	fe.ZoneInfo.Lock()
+	zone := fe.ZoneInfo.Zones[zoneName]
+	if zone == nil {
+		fe.ZoneInfo.Unlock()
+		return nil, &backendError{"Not Found", http.StatusNotFound}
+	}
+	// The server is asked as a client of the default view.
+	_, expected := zoneRRs(dns.CanonicalName(zoneName), zone.viewData(""), zone.Settings.resolve(""), zone.Serial)
+	fe.ZoneInfo.Unlock()
+
+	live, err := dc.liveRecords(fe.ZoneInfo, zoneName)
+	if err != nil {
+		return nil, err
+	}
+	drift := &ZoneDrift{Zone: zoneName, CheckedAt: time.Now()}
+	drift.Missing, drift.Extra = diffRRs(zoneName, expected, live)
+	drift.InSync = len(drift.Missing) == 0 && len(drift.Extra) == 0
+	if repair && !drift.InSync {
+		if err := dc.repairZone(fe.ZoneInfo, zoneName, drift); err != nil {
+			return drift, err
+		}
+		drift.Repaired = true
+	}
+	return drift, nil
+}
+
+// reconcileAll checks every zone for drift, logging what it finds.
+func (fe *Frontend) reconcileAll(repair bool) {
+	if _, ok := (*fe.Backend).(driftChecker); !ok {
+		return
+	}
+	fe.ZoneInfo.Lock()
+	names := make([]string, 0, len(fe.ZoneInfo.Zones))
+	for name := range fe.ZoneInfo.Zones {
+		names = append(names, name)
+	}
+	fe.ZoneInfo.Unlock()
+
+	for _, name := range names {
+		drift, err := fe.checkDrift(name, repair)
+		if err != nil {
+			log.Printf("Failed to check %s for drift: %v", name, err)
+			continue
+		}
+		if drift.InSync {
+			continue
+		}
+		log.Printf("Zone %s has drifted: missing %v, extra %v, repaired %v",
+			name, drift.Missing, drift.Extra, drift.Repaired)
+	}
+}
+
+func (fe *Frontend) runReconcile(interval time.Duration, repair bool) {
+	for range time.Tick(interval) {
+		fe.reconcileAll(repair)
+	}
+}
+
+// Reconcile function
+func (fe *Frontend) ReconcileZone(w rest.ResponseWriter, r *rest.Request) {
+	req := ReconcileRequest{}
+	if r.Body != nil && r.ContentLength != 0 {
+		if err := r.DecodeJsonPayload(&req); err != nil {
+			rest.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	zoneName := r.PathParam("id")
+	capMap, err := multitenancy.NewCapabilityMap(r.Request)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fe.ZoneInfo.Lock()
+	zone := fe.ZoneInfo.Zones[zoneName]
+	if zone == nil || !capMap.HasCapability(zone.TenantId, "ZONE_READ") {
+		fe.ZoneInfo.Unlock()
+		rest.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if req.Repair && !capMap.HasCapability(zone.TenantId, "ZONE_UPDATE") {
+		fe.ZoneInfo.Unlock()
+		rest.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	fe.ZoneInfo.Unlock()
+
+	drift, derr := fe.checkDrift(zoneName, req.Repair)
+	if derr != nil {
+		rest.Error(w, derr.Error(), derr.StatusCode())
+		return
+	}
+	w.WriteJson(drift)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestBindDrift(t *testing.T) {
+	di, _ := NewNativeDnsInstance("ns1.example.com", []string{"127.0.0.1"}, nil)
+	live := testZones()
+	addr, stop := startNative(t, di, live)
+	defer stop()
+
+	var be dns_backend_point = &BindDnsInstance{ServerName: "ns1.example.com", TransferAddr: addr}
+	fe := NewFrontend(&be, &memStore{})
+	fe.ZoneInfo = testZones()
+
+	drift, err := fe.checkDrift("example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !drift.InSync {
+		t.Errorf("Expected no drift, but got %+v", drift)
+	}
+
+	fe.ZoneInfo.Lock()
+	live.Zones["example.com"].Entries["node1"].Types["A"][0].Content = "192.168.1.11"
+	addRecord(live.Zones["example.com"], "new", "TXT", `"hand edited"`)
+	fe.ZoneInfo.Unlock()
+	di.UpdateZone(live, "example.com")
+	drift, err = fe.checkDrift("example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := []string{"node1.example.com.\t3600\tIN\tA\t192.168.1.10"}
+	extra := []string{"new.example.com.\t3600\tIN\tTXT\t\"hand edited\"", "node1.example.com.\t3600\tIN\tA\t192.168.1.11"}
+	if drift.InSync || drift.Repaired || !reflect.DeepEqual(drift.Missing, missing) || !reflect.DeepEqual(drift.Extra, extra) {
+		t.Errorf("Expected drift in node1 and new, but got %+v", drift)
+	}
+}
+
+func TestPowerDnsDrift(t *testing.T) {
+	var got PowerDnsRRSets
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PATCH" {
+			json.NewDecoder(r.Body).Decode(&got)
+		}
+		w.Write([]byte(`{"name":"example.com","records":[
+			{"name":"example.com","type":"SOA","ttl":3600,"content":"ns1.example.com hostmaster.example.com 1 2 3 4 5"},
+			{"name":"example.com","type":"NS","ttl":3600,"content":"ns1.example.com"},
+			{"name":"node1.example.com","type":"A","ttl":3600,"content":"192.168.1.10"},
+			{"name":"www.example.com","type":"CNAME","ttl":300,"content":"node1.example.com"},
+			{"name":"old.example.com","type":"A","ttl":3600,"content":"192.168.1.30"}]}`))
+	}))
+	defer srv.Close()
+
+	var be dns_backend_point = &PowerDnsInstance{UrlBase: srv.URL}
+	fe := NewFrontend(&be, &memStore{})
+	fe.ZoneInfo = testZones()
+	drift, err := fe.checkDrift("example.com", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := []string{"www.example.com.\t3600\tIN\tCNAME\tnode1.example.com."}
+	extra := []string{"old.example.com.\t3600\tIN\tA\t192.168.1.30", "www.example.com.\t300\tIN\tCNAME\tnode1.example.com."}
+	if !reflect.DeepEqual(drift.Missing, missing) || !reflect.DeepEqual(drift.Extra, extra) || !drift.Repaired {
+		t.Errorf("Expected repaired drift in www and old, but got %+v", drift)
+	}
+	if len(got.PowerDnsRRSets) != 2 {
+		t.Fatalf("Expected 2 rrsets to be repaired, but got %+v", got)
+	}
+	for _, rrs := range got.PowerDnsRRSets {
+		switch rrs.Name {
+		case "www.example.com":
+			if rrs.ChangeType != "REPLACE" || len(rrs.PowerDnsRecords) != 1 || rrs.PowerDnsRecords[0].TTL != 3600 {
+				t.Errorf("Expected www to be replaced, but got %+v", rrs)
+			}
+		case "old.example.com":
+			if rrs.ChangeType != "DELETE" {
+				t.Errorf("Expected old to be deleted, but got %+v", rrs)
+			}
+		default:
+			t.Errorf("Unexpected rrset %+v", rrs)
+		}
+	}
+}
+
+func TestReconcileApi(t *testing.T) {
+	_, handler := testFrontend(t)
+	doRequest(handler, "POST", "/zones", allCaps, `{"name":"example.com","tenant_id":1}`)
+	if rec := doRequest(handler, "POST", "/zones/missing.com/reconcile", allCaps, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown zone to be not found, but got %d", rec.Code)
+	}
+	readOnly := `{"1":{"parent":0,"capabilities":["ZONE_READ"]}}`
+	if rec := doRequest(handler, "POST", "/zones/example.com/reconcile", readOnly, `{"repair":true}`); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected repair to need ZONE_UPDATE, but got %d", rec.Code)
+	}
+	if rec := doRequest(handler, "POST", "/zones/example.com/reconcile", readOnly, ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected the native backend to not check for drift, but got %d", rec.Code)
+	}
+}
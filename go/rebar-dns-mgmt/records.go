@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// TTL for records that do not set one.
+const defaultTTL = 3600
+
+// Record types that can be managed.
+var recordTypes = map[string]bool{
+	"A":     true,
+	"AAAA":  true,
+	"CNAME": true,
+	"NS":    true,
+	"PTR":   true,
+	"MX":    true,
+	"SRV":   true,
+	"TXT":   true,
+	"CAA":   true,
+}
+
+// parseRR parses a record the way a zone file for zone would, so
+// names that are not fully qualified are relative to the zone.
+func parseRR(zone, name, rrType, content string, ttl int) (dns.RR, error) {
+	if name == "" {
+		name = "@"
+	}
+	if ttl == 0 {
+		ttl = defaultTTL
+	}
+	line := fmt.Sprintf("%s %d IN %s %s\n", name, ttl, rrType, content)
+	zp := dns.NewZoneParser(strings.NewReader(line), dns.Fqdn(zone), "")
+	rr, ok := zp.Next()
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if !ok || rr == nil {
+		return nil, fmt.Errorf("Empty %s record", rrType)
+	}
+	return rr, nil
+}
+
+// ownerName returns the FQDN of a record name in zone.
+func ownerName(zone, name string) string {
+	switch {
+	case name == "" || name == "@":
+		return dns.Fqdn(zone)
+	case dns.IsFqdn(name):
+		return name
+	}
+	return dns.Fqdn(name + "." + zone)
+}
+
+// rdata returns the data part of rr in zone file form.
+func rdata(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// canonicalContent returns content the way normalize would store it,
+// or content itself if it does not parse.
+func canonicalContent(zone, rrType, content string) string {
+	rr, err := parseRR(zone, "@", rrType, content, 0)
+	if err != nil {
+		return content
+	}
+	return rdata(rr)
+}
+
+// quoteTXT renders text as quoted character strings of at most 255
+// bytes each.
+func quoteTXT(text string) string {
+	b := []byte(text)
+	parts := []string{}
+	for len(parts) == 0 || len(b) > 0 {
+		n := len(b)
+		if n > 255 {
+			n = 255
+		}
+		var buf bytes.Buffer
+		buf.WriteByte('"')
+		for _, c := range b[:n] {
+			switch {
+			case c == '"' || c == '\\':
+				buf.WriteByte('\\')
+				buf.WriteByte(c)
+			case c < ' ' || c > '~':
+				fmt.Fprintf(&buf, "\\%03d", c)
+			default:
+				buf.WriteByte(c)
+			}
+		}
+		buf.WriteByte('"')
+		parts = append(parts, buf.String())
+		b = b[n:]
+	}
+	return strings.Join(parts, " ")
+}
+
+// unescapeTXT undoes the escaping the parser leaves in character
+// strings.
+func unescapeTXT(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			buf.WriteByte(s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigits(s[i+1:i+4]) {
+			n := int(s[i+1]-'0')*100 + int(s[i+2]-'0')*10 + int(s[i+3]-'0')
+			buf.WriteByte(byte(n))
+			i += 3
+			continue
+		}
+		buf.WriteByte(s[i+1])
+		i++
+	}
+	return buf.String()
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func checkRange(what string, v, max int) error {
+	if v < 0 || v > max {
+		return fmt.Errorf("%s must be between 0 and %d", what, max)
+	}
+	return nil
+}
+
+// contentFromFields builds the zone file form of a record from its
+// structured fields.
+func (rec *Record) contentFromFields() (string, error) {
+	switch rec.Type {
+	case "MX":
+		if err := checkRange("priority", rec.Priority, 65535); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d %s", rec.Priority, rec.Target), nil
+	case "SRV":
+		for _, f := range []struct {
+			name string
+			v    int
+		}{{"priority", rec.Priority}, {"weight", rec.Weight}, {"port", rec.Port}} {
+			if err := checkRange(f.name, f.v, 65535); err != nil {
+				return "", err
+			}
+		}
+		return fmt.Sprintf("%d %d %d %s", rec.Priority, rec.Weight, rec.Port, rec.Target), nil
+	case "PTR", "CNAME", "NS":
+		return rec.Target, nil
+	case "TXT":
+		return quoteTXT(rec.Value), nil
+	case "CAA":
+		if err := checkRange("flags", rec.Flags, 255); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d %s %s", rec.Flags, rec.Tag, quoteTXT(rec.Value)), nil
+	}
+	return "", nil
+}
+
+// expand fills in the structured fields of rec from rr.
+func (rec *Record) expand(rr dns.RR) {
+	rec.TTL = int(rr.Header().Ttl)
+	switch r := rr.(type) {
+	case *dns.MX:
+		rec.Priority, rec.Target = int(r.Preference), r.Mx
+	case *dns.SRV:
+		rec.Priority, rec.Weight, rec.Port, rec.Target = int(r.Priority), int(r.Weight), int(r.Port), r.Target
+	case *dns.PTR:
+		rec.Target = r.Ptr
+	case *dns.CNAME:
+		rec.Target = r.Target
+	case *dns.NS:
+		rec.Target = r.Ns
+	case *dns.TXT:
+		rec.Value = unescapeTXT(strings.Join(r.Txt, ""))
+	case *dns.CAA:
+		rec.Flags, rec.Tag, rec.Value = int(r.Flag), r.Tag, unescapeTXT(r.Value)
+	}
+}
+
+// normalize validates rec as a record in zone.  Content is built from
+// the structured fields if it is empty, and is rewritten in canonical
+// zone file form with names fully qualified.  Afterwards the
+// structured fields match Content.
+func (rec *Record) normalize(zone string) error {
+	rec.Type = strings.ToUpper(rec.Type)
+	if !recordTypes[rec.Type] {
+		return fmt.Errorf("Unsupported record type %s", rec.Type)
+	}
+	if rec.Name == "" {
+		return errors.New("Record must have a name")
+	}
+	if err := checkRange("ttl", rec.TTL, 2147483647); err != nil {
+		return err
+	}
+	if rec.Content == "" {
+		content, err := rec.contentFromFields()
+		if err != nil {
+			return fmt.Errorf("Invalid %s record: %v", rec.Type, err)
+		}
+		rec.Content = content
+	}
+	if strings.TrimSpace(rec.Content) == "" {
+		return fmt.Errorf("%s record must have content", rec.Type)
+	}
+	rr, err := parseRR(zone, rec.Name, rec.Type, rec.Content, rec.TTL)
+	if err != nil {
+		return fmt.Errorf("Invalid %s record: %v", rec.Type, err)
+	}
+	if caa, ok := rr.(*dns.CAA); ok {
+		switch caa.Tag {
+		case "issue", "issuewild", "iodef":
+		default:
+			return fmt.Errorf("Invalid CAA record: unknown tag %s", caa.Tag)
+		}
+	}
+	ttl := rec.TTL
+	rec.Content = rdata(rr)
+	rec.expand(rr)
+	rec.TTL = ttl
+	return nil
+}
+
+// zoneRecord turns stored content back into a Record with its
+// structured fields and TTL filled in.
+func zoneRecord(zd *ZoneData, zone, name, rrType string, content ZoneContent) Record {
+	rec := Record{
+		Name:    name,
+		Content: content.Content,
+		Type:    rrType,
+		TTL:     zd.recordTTL(content.TTL),
+		View:    content.View,
+	}
+	if rr, err := parseRR(zone, name, rrType, content.Content, rec.TTL); err == nil {
+		rec.expand(rr)
+	}
+	return rec
+}
+
+// zoneSOA builds the SOA for a zone from its resolved settings.
+func zoneSOA(zone string, settings *ZoneSettings, serial uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: uint32(settings.DefaultTTL)},
+		Ns:      settings.PrimaryNS,
+		Mbox:    settings.Mbox,
+		Serial:  serial,
+		Refresh: settings.Refresh,
+		Retry:   settings.Retry,
+		Expire:  settings.Expire,
+		Minttl:  settings.Minimum,
+	}
+}
+
+// storedRR parses a stored record.  Owner names come back lowercased
+// so they can be used as index keys.
+func storedRR(zone string, data *ZoneData, name, rrType string, content ZoneContent) (dns.RR, error) {
+	rr, err := parseRR(zone, name, rrType, content.Content, data.recordTTL(content.TTL))
+	if err != nil {
+		return nil, err
+	}
+	rr.Header().Name = dns.CanonicalName(rr.Header().Name)
+	return rr, nil
+}
+
+// zoneRRs renders a zone as its SOA and the rest of its records, the
+// NS records from the settings first.  zone must be a lowercase FQDN.
+func zoneRRs(zone string, data *ZoneData, settings *ZoneSettings, serial uint32) (*dns.SOA, []dns.RR) {
+	rrs := []dns.RR{}
+	for _, server := range settings.Nameservers {
+		rrs = append(rrs, &dns.NS{
+			Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: uint32(settings.DefaultTTL)},
+			Ns:  server,
+		})
+	}
+	for name, entry := range data.Entries {
+		for t, contents := range entry.Types {
+			for _, c := range contents {
+				rr, err := storedRR(zone, data, name, t, c)
+				if err != nil {
+					log.Printf("Skipping bad record %s %s %s in %s: %v", name, t, c.Content, zone, err)
+					continue
+				}
+				rrs = append(rrs, rr)
+			}
+		}
+	}
+	return zoneSOA(zone, settings, serial), rrs
+}
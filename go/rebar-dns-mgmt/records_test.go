@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestNormalizeFromFields(t *testing.T) {
+	rec := Record{Name: "@", Type: "mx", Priority: 10, Target: "mail"}
+	if err := rec.normalize("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Type != "MX" || rec.Content != "10 mail.example.com." {
+		t.Errorf("Expected MX 10 mail.example.com., but got %s %s", rec.Type, rec.Content)
+	}
+
+	rec = Record{Name: "_ldap._tcp", Type: "SRV", Priority: 1, Weight: 5, Port: 389, Target: "dc1.example.org.", TTL: 60}
+	if err := rec.normalize("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Content != "1 5 389 dc1.example.org." || rec.TTL != 60 {
+		t.Errorf("Expected SRV with TTL 60, but got %s %d", rec.Content, rec.TTL)
+	}
+
+	long := strings.Repeat("x", 300) + ` "quoted"`
+	rec = Record{Name: "txt", Type: "TXT", Value: long}
+	if err := rec.normalize("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Value != long {
+		t.Errorf("Expected TXT value to round trip, but got %q", rec.Value)
+	}
+
+	rec = Record{Name: "@", Type: "CAA", Tag: "issue", Value: "letsencrypt.org"}
+	if err := rec.normalize("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Content != `0 issue "letsencrypt.org"` {
+		t.Errorf("Expected CAA content, but got %s", rec.Content)
+	}
+}
+
+func TestNormalizeFromContent(t *testing.T) {
+	rec := Record{Name: "www", Type: "SRV", Content: "0   10 80 web"}
+	if err := rec.normalize("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Content != "0 10 80 web.example.com." || rec.Port != 80 || rec.Target != "web.example.com." {
+		t.Errorf("Expected canonical SRV with fields, but got %+v", rec)
+	}
+	if c := canonicalContent("example.com", "SRV", "0 10 80 web.example.com."); c != rec.Content {
+		t.Errorf("Expected canonical forms to match, but got %s", c)
+	}
+}
+
+func TestNormalizeInvalid(t *testing.T) {
+	bad := []Record{
+		{Name: "a", Type: "A", Content: "not-an-ip"},
+		{Name: "a", Type: "HINFO", Content: "x y"},
+		{Name: "a", Type: "MX", Target: "mail", Priority: 70000},
+		{Name: "a", Type: "CAA", Tag: "bogus", Value: "x"},
+		{Name: "a", Type: "PTR"},
+		{Name: "", Type: "A", Content: "1.2.3.4"},
+		{Name: "a", Type: "A", Content: "1.2.3.4", TTL: -1},
+	}
+	for _, rec := range bad {
+		if err := rec.normalize("example.com"); err == nil {
+			t.Errorf("Expected %+v to be rejected", rec)
+		}
+	}
+}
+
+func TestPowerDnsContent(t *testing.T) {
+	content, priority, ttl := powerDnsContent("example.com", "@", "MX", ZoneContent{Content: "10 mail.example.com.", TTL: 60})
+	if content != "mail.example.com" || priority != 10 || ttl != 60 {
+		t.Errorf("Expected split MX, but got %s %d %d", content, priority, ttl)
+	}
+	content, priority, ttl = powerDnsContent("example.com", "_sip._udp", "SRV", ZoneContent{Content: "1 2 5060 sip.example.com."})
+	if content != "2 5060 sip.example.com" || priority != 1 || ttl != defaultTTL {
+		t.Errorf("Expected split SRV, but got %s %d %d", content, priority, ttl)
+	}
+}
+
+func TestNativeRecordTTL(t *testing.T) {
+	zt := testZones()
+	zd := zt.Zones["example.com"]
+	zd.Entries["@"] = &ZoneEntry{Types: map[string][]ZoneContent{"MX": {{Content: "10 node1.example.com.", TTL: 120}}}}
+	di, _ := NewNativeDnsInstance("ns1.example.com", nil, nil)
+	addr, stop := startNative(t, di, zt)
+	defer stop()
+
+	r := query(t, addr, "example.com.", dns.TypeMX)
+	if len(r.Answer) != 1 || r.Answer[0].Header().Ttl != 120 || r.Answer[0].(*dns.MX).Mx != "node1.example.com." {
+		t.Errorf("Expected MX with TTL 120, but got %v", r)
+	}
+	r = query(t, addr, "www.example.com.", dns.TypeCNAME)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.CNAME).Target != "node1.example.com." {
+		t.Errorf("Expected relative CNAME target to be qualified, but got %v", r)
+	}
+}
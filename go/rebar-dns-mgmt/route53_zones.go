@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+/*
+ * Route53 API Structures
+ *
+ * These match the xml documents of the 2013-04-01 Route53 API that
+ * are needed to find, create and delete hosted zones and change their
+ * record sets.
+ */
+const route53Version = "/2013-04-01"
+const route53Namespace = "https://route53.amazonaws.com/doc/2013-04-01/"
+
+type Route53HostedZone struct {
+	Id   string `xml:"Id"`
+	Name string `xml:"Name"`
+}
+
+type Route53ListHostedZonesByNameResponse struct {
+	HostedZones []Route53HostedZone `xml:"HostedZones>HostedZone"`
+}
+
+type Route53CreateHostedZoneRequest struct {
+	XMLName         xml.Name `xml:"CreateHostedZoneRequest"`
+	Xmlns           string   `xml:"xmlns,attr"`
+	Name            string   `xml:"Name"`
+	CallerReference string   `xml:"CallerReference"`
+}
+
+type Route53CreateHostedZoneResponse struct {
+	HostedZone Route53HostedZone `xml:"HostedZone"`
+}
+
+type Route53ResourceRecordSet struct {
+	Name            string   `xml:"Name"`
+	Type            string   `xml:"Type"`
+	TTL             int      `xml:"TTL,omitempty"`
+	ResourceRecords []string `xml:"ResourceRecords>ResourceRecord>Value"`
+}
+
+type Route53Change struct {
+	Action            string                   `xml:"Action"` // CREATE, DELETE or UPSERT
+	ResourceRecordSet Route53ResourceRecordSet `xml:"ResourceRecordSet"`
+}
+
+type Route53ChangeResourceRecordSetsRequest struct {
+	XMLName xml.Name        `xml:"ChangeResourceRecordSetsRequest"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Changes []Route53Change `xml:"ChangeBatch>Changes>Change"`
+}
+
+type Route53ListResourceRecordSetsResponse struct {
+	ResourceRecordSets []Route53ResourceRecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+	IsTruncated        bool                       `xml:"IsTruncated"`
+	NextRecordName     string                     `xml:"NextRecordName"`
+	NextRecordType     string                     `xml:"NextRecordType"`
+}
+
+type Route53ErrorResponse struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// route53Provider talks to Route53, or anything that speaks its API.
+// Requests are signed with AWS signature version 4 when AccessKey is
+// set.
+type route53Provider struct {
+	AccessKey string
+	SecretKey string
+	Region    string
+}
+
+func NewRoute53DnsInstance(urlBase, accessKey, secretKey string) *HttpDnsInstance {
+	return NewHttpDnsInstance(urlBase, &route53Provider{
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Region:    "us-east-1",
+	})
+}
+
+func (p *route53Provider) authorize(req *http.Request, body []byte) error {
+	if p.AccessKey == "" {
+		return nil
+	}
+	signV4(req, body, p.AccessKey, p.SecretKey, p.Region, "route53", time.Now())
+	return nil
+}
+
+func (p *route53Provider) errorMessage(body []byte) string {
+	var e Route53ErrorResponse
+	if err := xml.Unmarshal(body, &e); err != nil || e.Code == "" {
+		return ""
+	}
+	return e.Code + ": " + e.Message
+}
+
+func (p *route53Provider) findZone(di *HttpDnsInstance, zoneName string) (string, *backendError) {
+	origin := dns.Fqdn(strings.ToLower(zoneName))
+	q := url.Values{"dnsname": {origin}, "maxitems": {"1"}}
+	body, err := di.doURL("GET", route53Version+"/hostedzonesbyname?"+q.Encode(), "", nil)
+	if err != nil {
+		return "", err
+	}
+	var resp Route53ListHostedZonesByNameResponse
+	if xerr := xml.Unmarshal(body, &resp); xerr != nil {
+		return "", &backendError{xerr.Error(), http.StatusInternalServerError}
+	}
+	for _, hz := range resp.HostedZones {
+		if strings.ToLower(dns.Fqdn(hz.Name)) == origin {
+			return strings.TrimPrefix(hz.Id, "/hostedzone/"), nil
+		}
+	}
+	return "", nil
+}
+
+func (p *route53Provider) createZone(di *HttpDnsInstance, zoneName string) (string, *backendError) {
+	b, _ := xml.Marshal(Route53CreateHostedZoneRequest{
+		Xmlns:           route53Namespace,
+		Name:            dns.Fqdn(zoneName),
+		CallerReference: fmt.Sprintf("rebar-%s-%d", zoneName, time.Now().UnixNano()),
+	})
+	body, err := di.doURL("POST", route53Version+"/hostedzone", "application/xml", b)
+	if err != nil {
+		return "", err
+	}
+	var resp Route53CreateHostedZoneResponse
+	if xerr := xml.Unmarshal(body, &resp); xerr != nil {
+		return "", &backendError{xerr.Error(), http.StatusInternalServerError}
+	}
+	return strings.TrimPrefix(resp.HostedZone.Id, "/hostedzone/"), nil
+}
+
+// deleteZone empties the zone first, as Route53 only deletes zones
+// holding nothing but their SOA and NS records.
+func (p *route53Provider) deleteZone(di *HttpDnsInstance, zoneId string) *backendError {
+	sets, err := p.list(di, zoneId)
+	if err != nil {
+		return err
+	}
+	changes := []Route53Change{}
+	apex := ""
+	for _, set := range sets {
+		if set.Type == "SOA" {
+			apex = set.Name
+		}
+	}
+	for _, set := range sets {
+		if set.Type == "SOA" || (set.Type == "NS" && set.Name == apex) {
+			continue
+		}
+		changes = append(changes, Route53Change{Action: "DELETE", ResourceRecordSet: set})
+	}
+	if err := p.send(di, zoneId, changes); err != nil {
+		return err
+	}
+	_, err = di.doURL("DELETE", route53Version+"/hostedzone/"+zoneId, "", nil)
+	return err
+}
+
+// list reads every record set of a zone, a page at a time.
+func (p *route53Provider) list(di *HttpDnsInstance, zoneId string) ([]Route53ResourceRecordSet, *backendError) {
+	res := []Route53ResourceRecordSet{}
+	q := url.Values{}
+	for {
+		path := route53Version + "/hostedzone/" + zoneId + "/rrset"
+		if len(q) > 0 {
+			path += "?" + q.Encode()
+		}
+		body, err := di.doURL("GET", path, "", nil)
+		if err != nil {
+			return nil, err
+		}
+		var resp Route53ListResourceRecordSetsResponse
+		if xerr := xml.Unmarshal(body, &resp); xerr != nil {
+			return nil, &backendError{xerr.Error(), http.StatusInternalServerError}
+		}
+		res = append(res, resp.ResourceRecordSets...)
+		if !resp.IsTruncated {
+			return res, nil
+		}
+		q = url.Values{"name": {resp.NextRecordName}, "type": {resp.NextRecordType}}
+	}
+}
+
+func (p *route53Provider) rrsets(di *HttpDnsInstance, zoneId string) ([]providerRRSet, *backendError) {
+	sets, err := p.list(di, zoneId)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]providerRRSet, 0, len(sets))
+	for _, set := range sets {
+		res = append(res, providerRRSet{
+			Name:   route53Name(set.Name),
+			Type:   set.Type,
+			TTL:    set.TTL,
+			Values: set.ResourceRecords,
+		})
+	}
+	return res, nil
+}
+
+// change upserts the rrsets with values.  Route53 only deletes an
+// rrset given exactly as it is, so the current ones are looked up
+// first, and ones that do not exist are skipped.
+func (p *route53Provider) change(di *HttpDnsInstance, zoneId string, sets []providerRRSet) *backendError {
+	changes := make([]Route53Change, 0, len(sets))
+	var current map[[2]string]Route53ResourceRecordSet
+	for _, set := range sets {
+		if len(set.Values) > 0 {
+			changes = append(changes, Route53Change{
+				Action: "UPSERT",
+				ResourceRecordSet: Route53ResourceRecordSet{
+					Name:            set.Name,
+					Type:            set.Type,
+					TTL:             set.TTL,
+					ResourceRecords: set.Values,
+				},
+			})
+			continue
+		}
+		if current == nil {
+			live, err := p.list(di, zoneId)
+			if err != nil {
+				return err
+			}
+			current = map[[2]string]Route53ResourceRecordSet{}
+			for _, c := range live {
+				current[[2]string{dns.CanonicalName(route53Name(c.Name)), c.Type}] = c
+			}
+		}
+		if c, ok := current[[2]string{dns.CanonicalName(set.Name), set.Type}]; ok {
+			changes = append(changes, Route53Change{Action: "DELETE", ResourceRecordSet: c})
+		}
+	}
+	return p.send(di, zoneId, changes)
+}
+
+// send makes the changes as one change batch, which Route53 applies
+// all or nothing.
+func (p *route53Provider) send(di *HttpDnsInstance, zoneId string, changes []Route53Change) *backendError {
+	if len(changes) == 0 {
+		return nil
+	}
+	b, _ := xml.Marshal(Route53ChangeResourceRecordSetsRequest{
+		Xmlns:   route53Namespace,
+		Changes: changes,
+	})
+	_, err := di.doURL("POST", route53Version+"/hostedzone/"+zoneId+"/rrset", "application/xml", b)
+	return err
+}
+
+// route53Name undoes the octal escape Route53 uses for * in names.
+func route53Name(name string) string {
+	return strings.Replace(name, `\052`, "*", -1)
+}
+
+// signV4 signs a request with AWS signature version 4.
+func signV4(req *http.Request, body []byte, accessKey, secretKey, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	query := strings.Replace(req.URL.Query().Encode(), "+", "%20", -1)
+	payload := sha256.Sum256(body)
+	canonical := strings.Join([]string{req.Method, path, query, canonicalHeaders, signedHeaders, hex.EncodeToString(payload[:])}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	key := mac([]byte("AWS4"+secretKey), date)
+	key = mac(key, region)
+	key = mac(key, service)
+	key = mac(key, "aws4_request")
+	signature := hex.EncodeToString(mac(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
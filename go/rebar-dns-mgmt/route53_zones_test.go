@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// route53Stub is just enough of the Route53 API to test against.
+type route53Stub struct {
+	sync.Mutex
+	name    string
+	sets    map[[2]string]Route53ResourceRecordSet // Nil until the zone is made
+	auth    []string
+	batches int
+}
+
+func (rs *route53Stub) sorted() []Route53ResourceRecordSet {
+	res := []Route53ResourceRecordSet{}
+	for _, set := range rs.sets {
+		res = append(res, set)
+	}
+	sort.Sort(route53SetsByName(res))
+	return res
+}
+
+type route53SetsByName []Route53ResourceRecordSet
+
+func (s route53SetsByName) Len() int      { return len(s) }
+func (s route53SetsByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s route53SetsByName) Less(i, j int) bool {
+	return s[i].Name+" "+s[i].Type < s[j].Name+" "+s[j].Type
+}
+
+func (rs *route53Stub) fail(w http.ResponseWriter, code, msg string) {
+	w.WriteHeader(http.StatusBadRequest)
+	b, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"ErrorResponse"`
+		Code    string   `xml:"Error>Code"`
+		Message string   `xml:"Error>Message"`
+	}{Code: code, Message: msg})
+	w.Write(b)
+}
+
+func (rs *route53Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rs.Lock()
+	defer rs.Unlock()
+	rs.auth = append(rs.auth, r.Header.Get("Authorization"))
+	path := strings.TrimPrefix(r.URL.Path, route53Version)
+	switch {
+	case r.Method == "GET" && path == "/hostedzonesbyname":
+		resp := Route53ListHostedZonesByNameResponse{}
+		if rs.sets != nil {
+			resp.HostedZones = append(resp.HostedZones, Route53HostedZone{Id: "/hostedzone/Z1", Name: rs.name})
+		}
+		b, _ := xml.Marshal(resp)
+		w.Write(b)
+	case r.Method == "POST" && path == "/hostedzone":
+		var req Route53CreateHostedZoneRequest
+		xml.NewDecoder(r.Body).Decode(&req)
+		rs.name = req.Name
+		rs.sets = map[[2]string]Route53ResourceRecordSet{
+			{req.Name, "SOA"}: {Name: req.Name, Type: "SOA", TTL: 900, ResourceRecords: []string{"ns-1.awsdns-1.com. awsdns-hostmaster.amazon.com. 1 7200 900 1209600 86400"}},
+			{req.Name, "NS"}:  {Name: req.Name, Type: "NS", TTL: 172800, ResourceRecords: []string{"ns-1.awsdns-1.com."}},
+		}
+		b, _ := xml.Marshal(Route53CreateHostedZoneResponse{HostedZone: Route53HostedZone{Id: "/hostedzone/Z1", Name: req.Name}})
+		w.WriteHeader(http.StatusCreated)
+		w.Write(b)
+	case r.Method == "GET" && path == "/hostedzone/Z1/rrset":
+		// Two to a page
+		all := rs.sorted()
+		start := 0
+		if name := r.URL.Query().Get("name"); name != "" {
+			for start < len(all) && all[start].Name+" "+all[start].Type < name+" "+r.URL.Query().Get("type") {
+				start++
+			}
+		}
+		resp := Route53ListResourceRecordSetsResponse{}
+		for i := start; i < len(all); i++ {
+			if len(resp.ResourceRecordSets) == 2 {
+				resp.IsTruncated = true
+				resp.NextRecordName, resp.NextRecordType = all[i].Name, all[i].Type
+				break
+			}
+			resp.ResourceRecordSets = append(resp.ResourceRecordSets, all[i])
+		}
+		b, _ := xml.Marshal(resp)
+		w.Write(b)
+	case r.Method == "POST" && path == "/hostedzone/Z1/rrset":
+		var req Route53ChangeResourceRecordSetsRequest
+		xml.NewDecoder(r.Body).Decode(&req)
+		next := map[[2]string]Route53ResourceRecordSet{}
+		for k, v := range rs.sets {
+			next[k] = v
+		}
+		for _, c := range req.Changes {
+			k := [2]string{c.ResourceRecordSet.Name, c.ResourceRecordSet.Type}
+			switch c.Action {
+			case "UPSERT":
+				next[k] = c.ResourceRecordSet
+			case "DELETE":
+				if !reflect.DeepEqual(next[k], c.ResourceRecordSet) {
+					rs.fail(w, "InvalidChangeBatch", "Tried to delete resource record set "+k[0]+" but the values provided do not match the current values")
+					return
+				}
+				delete(next, k)
+			}
+		}
+		rs.sets = next
+		rs.batches++
+		w.Write([]byte(`<ChangeResourceRecordSetsResponse><ChangeInfo><Status>PENDING</Status></ChangeInfo></ChangeResourceRecordSetsResponse>`))
+	case r.Method == "DELETE" && path == "/hostedzone/Z1":
+		if len(rs.sets) > 2 {
+			rs.fail(w, "HostedZoneNotEmpty", "The hosted zone contains resource records")
+			return
+		}
+		rs.sets = nil
+		w.Write([]byte(`<DeleteHostedZoneResponse/>`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (rs *route53Stub) values(name, t string) []string {
+	rs.Lock()
+	defer rs.Unlock()
+	return rs.sets[[2]string{name, t}].ResourceRecords
+}
+
+func TestRoute53Backend(t *testing.T) {
+	stub := &route53Stub{}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	zt := testZones()
+	di := NewRoute53DnsInstance(srv.URL, "AKID", "secret")
+	if _, err := di.CreateZone(zt, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if v := stub.values("www.example.com.", "CNAME"); !reflect.DeepEqual(v, []string{"node1.example.com."}) {
+		t.Errorf("Expected www to be published, but got %v", v)
+	}
+	if !strings.HasPrefix(stub.auth[0], "AWS4-HMAC-SHA256 Credential=AKID/") {
+		t.Errorf("Expected signed requests, but got %q", stub.auth[0])
+	}
+
+	zd := zt.Zones["example.com"]
+	addRecord(zd, "node1", "A", "192.168.1.20")
+	delete(zd.Entries, "www")
+	batches := stub.batches
+	_, err := di.PatchZone(zt, "example.com", []Record{
+		{ChangeType: "ADD", Name: "node1", Type: "A", Content: "192.168.1.20"},
+		{ChangeType: "REMOVE", Name: "www", Type: "CNAME", Content: "node1.example.com."},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stub.batches != batches+1 {
+		t.Errorf("Expected one change batch, but got %d", stub.batches-batches)
+	}
+	if v := stub.values("node1.example.com.", "A"); !reflect.DeepEqual(v, []string{"192.168.1.10", "192.168.1.20"}) {
+		t.Errorf("Expected node1 to have both addresses, but got %v", v)
+	}
+	if v := stub.values("www.example.com.", "CNAME"); v != nil {
+		t.Errorf("Expected www to be deleted, but got %v", v)
+	}
+
+	// Edits made in the console show up as drift.
+	stub.Lock()
+	stub.sets[[2]string{"node1.example.com.", "A"}] = Route53ResourceRecordSet{Name: "node1.example.com.", Type: "A", TTL: 60, ResourceRecords: []string{"10.0.0.1"}}
+	stub.sets[[2]string{"\\052.example.com.", "TXT"}] = Route53ResourceRecordSet{Name: "\\052.example.com.", Type: "TXT", TTL: 60, ResourceRecords: []string{`"stray"`}}
+	stub.Unlock()
+	var be dns_backend_point = di
+	fe := NewFrontend(&be, &memStore{})
+	fe.ZoneInfo = zt
+	drift, derr := fe.checkDrift("example.com", true)
+	if derr != nil {
+		t.Fatal(derr)
+	}
+	if len(drift.Missing) != 2 || len(drift.Extra) != 2 || !drift.Repaired {
+		t.Errorf("Expected drift in node1 and *, but got %+v", drift)
+	}
+	if drift, derr = fe.checkDrift("example.com", false); derr != nil || !drift.InSync {
+		t.Errorf("Expected the repair to work, but got %+v %v", drift, derr)
+	}
+
+	if err := di.DeleteZone(zt, "example.com", zd); err != nil {
+		t.Fatal(err)
+	}
+	if stub.sets != nil {
+		t.Errorf("Expected the hosted zone to be deleted, but have %v", stub.sets)
+	}
+}
+
+func TestRoute53MissingZone(t *testing.T) {
+	stub := &route53Stub{}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	di := NewRoute53DnsInstance(srv.URL, "", "")
+	recs := []Record{{ChangeType: "ADD", Name: "node1", Type: "A", Content: "192.168.1.10"}}
+	_, err := di.PatchZone(NewZoneTracker(), "example.com", recs)
+	if err == nil || err.StatusCode() != http.StatusNotFound {
+		t.Errorf("Expected a zone nobody has to be not found, but got %v", err)
+	}
+
+	// Adding the first record to a zone makes it, so the provider
+	// has to be told about the zone as well.
+	if _, err = di.PatchZone(testZones(), "example.com", recs); err != nil {
+		t.Fatal(err)
+	}
+	if stub.name != "example.com." {
+		t.Errorf("Expected the zone to be created at the provider, but got %q", stub.name)
+	}
+	if v := stub.values("node1.example.com.", "A"); !reflect.DeepEqual(v, []string{"192.168.1.10"}) {
+		t.Errorf("Expected node1 to be published, but got %v", v)
+	}
+	if v := stub.values("www.example.com.", "CNAME"); !reflect.DeepEqual(v, []string{"node1.example.com."}) {
+		t.Errorf("Expected the rest of the zone to be published, but got %v", v)
+	}
+}
+
+// From the get-vanilla case of the AWS signature version 4 test suite.
+func TestSignV4(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	now, _ := time.Parse("20060102T150405Z", "20150830T123600Z")
+	signV4(req, nil, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "service", now)
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Expected %s, but got %s", want, got)
+	}
+}
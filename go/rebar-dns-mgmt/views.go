@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ZoneView is a split-horizon view.  Clients whose address matches
+// MatchClients see the records tagged for the view in place of the
+// untagged records of the same name and type.  A view of the same name
+// means the same clients in every zone.
+type ZoneView struct {
+	Name         string   `json:"name"`
+	MatchClients []string `json:"match_clients"` // Addresses or CIDRs, ! to exclude
+}
+
+// The view clients that match no other view see.
+const defaultView = "default"
+
+var viewNameRE = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Address match list keywords bind knows.
+var matchKeywords = map[string]bool{
+	"any":       true,
+	"none":      true,
+	"localhost": true,
+	"localnets": true,
+}
+
+// validateViews checks the views of the settings.
+func (zs *ZoneSettings) validateViews() error {
+	seen := map[string]bool{}
+	for _, v := range zs.Views {
+		if !viewNameRE.MatchString(v.Name) {
+			return fmt.Errorf("View name %q must be letters, digits, - and _", v.Name)
+		}
+		if v.Name == defaultView {
+			return fmt.Errorf("View name %s is reserved", defaultView)
+		}
+		if seen[v.Name] {
+			return fmt.Errorf("View %s is listed twice", v.Name)
+		}
+		seen[v.Name] = true
+		if len(v.MatchClients) == 0 {
+			return fmt.Errorf("View %s must match some clients", v.Name)
+		}
+		for _, m := range v.MatchClients {
+			addr := strings.TrimPrefix(m, "!")
+			if matchKeywords[addr] || net.ParseIP(addr) != nil {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(addr); err != nil {
+				return fmt.Errorf("View %s: %s is not an address or CIDR", v.Name, m)
+			}
+		}
+	}
+	return nil
+}
+
+// view returns the named view, or nil.
+func (zs *ZoneSettings) view(name string) *ZoneView {
+	if zs == nil {
+		return nil
+	}
+	for i := range zs.Views {
+		if zs.Views[i].Name == name {
+			return &zs.Views[i]
+		}
+	}
+	return nil
+}
+
+// viewServer is implemented by backends that can serve views.
+type viewServer interface {
+	servesViews() bool
+}
+
+func (fe *Frontend) servesViews() bool {
+	s, ok := (*fe.Backend).(viewServer)
+	return ok && s.servesViews()
+}
+
+// checkViews makes sure views in settings for a zone mean the same as
+// views of the same name in other zones.  The caller holds the lock.
+func (fe *Frontend) checkViews(zoneName string, settings *ZoneSettings) error {
+	if settings == nil {
+		return nil
+	}
+	for _, v := range settings.Views {
+		for name, zone := range fe.ZoneInfo.Zones {
+			if name == zoneName || zone.Settings == nil {
+				continue
+			}
+			if other := zone.Settings.view(v.Name); other != nil && !reflect.DeepEqual(other.MatchClients, v.MatchClients) {
+				return fmt.Errorf("View %s matches different clients in zone %s", v.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkViewsUsed makes sure every view the records of the zone are
+// tagged with is in settings.
+func (zd *ZoneData) checkViewsUsed(settings *ZoneSettings) error {
+	for _, entry := range zd.Entries {
+		for _, contents := range entry.Types {
+			for _, c := range contents {
+				if c.View != "" && settings.view(c.View) == nil {
+					return fmt.Errorf("View %s is still used by records", c.View)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// viewData returns the zone as clients of a view see it.  Records
+// tagged for the view replace the untagged records of the same name
+// and type.  The default view only has untagged records.
+func (zd *ZoneData) viewData(view string) *ZoneData {
+	res := *zd
+	res.Entries = make(map[string]*ZoneEntry)
+	for name, entry := range zd.Entries {
+		ne := NewZoneEntry()
+		for t, contents := range entry.Types {
+			shared, tagged := []ZoneContent{}, []ZoneContent{}
+			for _, c := range contents {
+				switch c.View {
+				case "":
+					shared = append(shared, c)
+				case view:
+					tagged = append(tagged, c)
+				}
+			}
+			if len(tagged) > 0 {
+				ne.Types[t] = tagged
+			} else if len(shared) > 0 {
+				ne.Types[t] = shared
+			}
+		}
+		if len(ne.Types) > 0 {
+			res.Entries[name] = ne
+		}
+	}
+	return &res
+}
+
+// zoneViews returns the views of every zone, in name order.
+func zoneViews(zones *ZoneTracker) []ZoneView {
+	views := map[string]ZoneView{}
+	for _, zone := range zones.Zones {
+		if zone.Settings == nil {
+			continue
+		}
+		for _, v := range zone.Settings.Views {
+			views[v.Name] = v
+		}
+	}
+	res := make([]ZoneView, 0, len(views))
+	for _, v := range views {
+		res = append(res, v)
+	}
+	sort.Sort(viewsByName(res))
+	return res
+}
+
+type viewsByName []ZoneView
+
+func (v viewsByName) Len() int           { return len(v) }
+func (v viewsByName) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v viewsByName) Less(i, j int) bool { return v[i].Name < v[j].Name }
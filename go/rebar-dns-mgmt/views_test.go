@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+func viewZones() *ZoneTracker {
+	zt := testZones()
+	zd := zt.Zones["example.com"]
+	zd.Settings = &ZoneSettings{Views: []ZoneView{{Name: "admin", MatchClients: []string{"192.168.124.0/24"}}}}
+	zd.Entries["node1"].Types["A"] = append(zd.Entries["node1"].Types["A"], ZoneContent{Content: "192.168.124.10", View: "admin"})
+	zd.Entries["mgmt"] = &ZoneEntry{Types: map[string][]ZoneContent{"A": {{Content: "192.168.124.1", View: "admin"}}}}
+	zt.Zones["other.com"] = NewZoneData()
+	return zt
+}
+
+func TestViewData(t *testing.T) {
+	zd := viewZones().Zones["example.com"]
+	admin := zd.viewData("admin")
+	if a := admin.Entries["node1"].Types["A"]; len(a) != 1 || a[0].Content != "192.168.124.10" {
+		t.Errorf("Expected the admin address to replace the shared one, but got %v", a)
+	}
+	if admin.Entries["www"] == nil || admin.Entries["mgmt"] == nil {
+		t.Errorf("Expected shared and admin records in the admin view, but got %v", admin.Entries)
+	}
+	public := zd.viewData("")
+	if a := public.Entries["node1"].Types["A"]; len(a) != 1 || a[0].Content != "192.168.1.10" {
+		t.Errorf("Expected only the shared address by default, but got %v", a)
+	}
+	if public.Entries["mgmt"] != nil {
+		t.Error("Expected admin only records to be left out by default")
+	}
+}
+
+func renderTemplate(t *testing.T, name string, data interface{}) string {
+	tmpl, err := template.ParseFiles("../../containers/dns/dns-mgmt.d/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.ExecuteTemplate(buf, name, data); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestBindViews(t *testing.T) {
+	zt := viewZones()
+	conf := renderTemplate(t, "zones_list.tmpl", bindConf(zt))
+	for _, want := range []string{
+		"view \"admin\" {\n\tmatch-clients { 192.168.124.0/24; };\n\tinclude \"/etc/bind/named.conf.default-zones\";",
+		"\tinclude \"example.com/admin/zone.example.com\";\n\tinclude \"other.com/zone.other.com\";\n};",
+		"view \"default\" {\n\tmatch-clients { any; };",
+		"\tinclude \"example.com/zone.example.com\";\n\tinclude \"other.com/zone.other.com\";\n};",
+	} {
+		if !strings.Contains(conf, want) {
+			t.Errorf("Expected %q in\n%s", want, conf)
+		}
+	}
+	if strings.Index(conf, "view \"admin\"") > strings.Index(conf, "view \"default\"") {
+		t.Error("Expected the default view to come last")
+	}
+
+	delete(zt.Zones, "example.com")
+	conf = renderTemplate(t, "zones_list.tmpl", bindConf(zt))
+	if strings.Contains(conf, "view") || !strings.Contains(conf, "include \"/etc/bind/named.conf.consul\";\ninclude \"other.com/zone.other.com\";") {
+		t.Errorf("Expected plain includes without views, but got\n%s", conf)
+	}
+
+	zone := renderTemplate(t, "zone.tmpl", bindZoneData{Domain: "example.com", Dir: "/etc/bind/example.com/admin", ReverseZoneNames: []string{"10.124.168.192.in-addr.arpa"}})
+	if !strings.Contains(zone, `file "/etc/bind/example.com/admin/db.example.com"`) || !strings.Contains(zone, `file "/etc/bind/example.com/admin/rdb.10.124.168.192.in-addr.arpa"`) {
+		t.Errorf("Expected the view's files, but got\n%s", zone)
+	}
+}
+
+// viewNative is a native backend that takes views, so the API can be
+// tested without writing bind files.
+type viewNative struct {
+	*NativeDnsInstance
+}
+
+func (vn viewNative) servesViews() bool {
+	return true
+}
+
+func TestViewsApi(t *testing.T) {
+	_, handler := testFrontend(t)
+	if rec := doRequest(handler, "POST", "/zones", allCaps, `{"name":"example.com","tenant_id":1,"settings":{"views":[{"name":"admin","match_clients":["192.168.124.0/24"]}]}}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected the native backend to refuse views, but got %d", rec.Code)
+	}
+
+	di, _ := NewNativeDnsInstance("ns1.example.com", nil, nil)
+	var be dns_backend_point = viewNative{di}
+	fe := NewFrontend(&be, &memStore{})
+	di.load(fe.ZoneInfo)
+	router, _ := fe.router()
+	api := rest.NewApi()
+	api.SetApp(router)
+	handler = api.MakeHandler()
+
+	for _, bad := range []string{
+		`[{"name":"default","match_clients":["any"]}]`,
+		`[{"name":"bad name","match_clients":["any"]}]`,
+		`[{"name":"admin","match_clients":[]}]`,
+		`[{"name":"admin","match_clients":["192.168.124.0/33"]}]`,
+		`[{"name":"admin","match_clients":["any"]},{"name":"admin","match_clients":["any"]}]`,
+	} {
+		if rec := doRequest(handler, "POST", "/zones", allCaps, `{"name":"example.com","tenant_id":1,"settings":{"views":`+bad+`}}`); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected views %s to be rejected, but got %d", bad, rec.Code)
+		}
+	}
+	views := `[{"name":"admin","match_clients":["192.168.124.0/24","!192.168.124.1"]}]`
+	if rec := doRequest(handler, "POST", "/zones", allCaps, `{"name":"example.com","tenant_id":1,"settings":{"views":`+views+`}}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected zone with views, but got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(handler, "POST", "/zones", allCaps, `{"name":"other.com","tenant_id":1,"settings":{"views":[{"name":"admin","match_clients":["10.0.0.0/8"]}]}}`); rec.Code != http.StatusConflict {
+		t.Errorf("Expected a view matching different clients to conflict, but got %d", rec.Code)
+	}
+
+	rec := doRequest(handler, "PATCH", "/zones/example.com/records", allCaps, `{"records":[
+		{"changetype":"ADD","name":"node1","type":"A","content":"203.0.113.10"},
+		{"changetype":"ADD","name":"node1","type":"A","content":"203.0.113.10","view":"admin"}]}`)
+	zone := Zone{}
+	json.Unmarshal(rec.Body.Bytes(), &zone)
+	if rec.Code != http.StatusOK || len(zone.Records) != 2 {
+		t.Fatalf("Expected the same address in two views, but got %d %s", rec.Code, rec.Body.String())
+	}
+	if zone.Records[0].View == zone.Records[1].View {
+		t.Errorf("Expected one record tagged for the view, but got %+v", zone.Records)
+	}
+	if rec := doRequest(handler, "PATCH", "/zones/example.com", allCaps, `{"changetype":"ADD","name":"node2","type":"A","content":"203.0.113.11","view":"lab"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown view to be rejected, but got %d", rec.Code)
+	}
+	if rec := doRequest(handler, "PUT", "/zones/example.com", allCaps, `{}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a view in use to stay, but got %d", rec.Code)
+	}
+	doRequest(handler, "PATCH", "/zones/example.com", allCaps, `{"changetype":"REMOVE","name":"node1","type":"A","content":"203.0.113.10","view":"admin"}`)
+	if rec := doRequest(handler, "PUT", "/zones/example.com", allCaps, `{}`); rec.Code != http.StatusOK {
+		t.Errorf("Expected an unused view to be removed, but got %d %s", rec.Code, rec.Body.String())
+	}
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/ant0ine/go-json-rest/rest"
 	"github.com/digitalrebar/digitalrebar/go/common/multi-tenancy"
+	"github.com/miekg/dns"
 )
 
 /*
@@ -24,9 +29,107 @@ import (
  * update/create and get zone information and records
  */
 type Zone struct {
-	Name     string   `json:"name"`
-	Records  []Record `json:"records,omitempty"`
-	TenantId int      `json:"tenant_id"`
+	Name     string        `json:"name"`
+	Records  []Record      `json:"records,omitempty"`
+	TenantId int           `json:"tenant_id"`
+	Settings *ZoneSettings `json:"settings,omitempty"`
+}
+
+// ZoneSettings are the zone wide settings.  Anything left unset uses
+// the server default.
+type ZoneSettings struct {
+	PrimaryNS   string     `json:"primary_ns,omitempty"` // SOA MNAME, defaults to the server name
+	Mbox        string     `json:"mbox,omitempty"`       // SOA RNAME
+	Refresh     uint32     `json:"refresh,omitempty"`
+	Retry       uint32     `json:"retry,omitempty"`
+	Expire      uint32     `json:"expire,omitempty"`
+	Minimum     uint32     `json:"minimum,omitempty"`     // Negative caching TTL
+	Nameservers []string   `json:"nameservers,omitempty"` // NS records, defaults to PrimaryNS
+	DefaultTTL  int        `json:"default_ttl,omitempty"` // For records without a TTL
+	AutoReverse *bool      `json:"auto_reverse,omitempty"`
+	Dnssec      bool       `json:"dnssec,omitempty"`
+	ZskLifetime int        `json:"zsk_lifetime,omitempty"` // Days between ZSK rollovers
+	Views       []ZoneView `json:"views,omitempty"`        // Split-horizon views
+}
+
+// Defaults for zone settings, which match what the bind templates
+// have always used.
+const (
+	defaultRefresh = 86400
+	defaultRetry   = 7200
+	defaultExpire  = 2419200
+	defaultMinimum = 300
+	defaultMbox    = "support.localhost.localdomain."
+)
+
+// validate checks the settings and makes the names in them fully
+// qualified.
+func (zs *ZoneSettings) validate() error {
+	if zs.DefaultTTL < 0 {
+		return errors.New("default_ttl must not be negative")
+	}
+	if zs.ZskLifetime < 0 {
+		return errors.New("zsk_lifetime must not be negative")
+	}
+	if err := zs.validateViews(); err != nil {
+		return err
+	}
+	names := []*string{&zs.PrimaryNS, &zs.Mbox}
+	for i := range zs.Nameservers {
+		names = append(names, &zs.Nameservers[i])
+	}
+	for _, n := range names {
+		if *n == "" {
+			continue
+		}
+		if _, ok := dns.IsDomainName(*n); !ok {
+			return fmt.Errorf("%s is not a valid name", *n)
+		}
+		*n = dns.Fqdn(strings.ToLower(*n))
+	}
+	return nil
+}
+
+// resolve returns a copy of the settings with the defaults filled in.
+// serverName is the name of the DNS server being managed.
+func (zs *ZoneSettings) resolve(serverName string) *ZoneSettings {
+	res := &ZoneSettings{}
+	if zs != nil {
+		*res = *zs
+		res.Nameservers = append([]string{}, zs.Nameservers...)
+	}
+	if res.PrimaryNS == "" && serverName != "" {
+		res.PrimaryNS = dns.Fqdn(serverName)
+	}
+	if res.Mbox == "" {
+		res.Mbox = defaultMbox
+	}
+	if res.Refresh == 0 {
+		res.Refresh = defaultRefresh
+	}
+	if res.Retry == 0 {
+		res.Retry = defaultRetry
+	}
+	if res.Expire == 0 {
+		res.Expire = defaultExpire
+	}
+	if res.Minimum == 0 {
+		res.Minimum = defaultMinimum
+	}
+	if len(res.Nameservers) == 0 && res.PrimaryNS != "" {
+		res.Nameservers = []string{res.PrimaryNS}
+	}
+	if res.DefaultTTL == 0 {
+		res.DefaultTTL = defaultTTL
+	}
+	if res.ZskLifetime == 0 {
+		res.ZskLifetime = defaultZskLifetime
+	}
+	if res.AutoReverse == nil {
+		autoReverse := true
+		res.AutoReverse = &autoReverse
+	}
+	return res
 }
 
 type Record struct {
@@ -35,6 +138,24 @@ type Record struct {
 	Name       string `json:"name"`
 	Type       string `json:"type"`
 	TenantId   int    `json:"tenant_id"`
+	TTL        int    `json:"ttl,omitempty"`  // 0 uses the default
+	View       string `json:"view,omitempty"` // Empty for every view
+
+	// Structured forms of Content.  When Content is empty on a
+	// PATCH it is built from these.
+	Priority int    `json:"priority,omitempty"` // MX, SRV
+	Weight   int    `json:"weight,omitempty"`   // SRV
+	Port     int    `json:"port,omitempty"`     // SRV
+	Target   string `json:"target,omitempty"`   // MX, SRV, PTR, CNAME, NS
+	Flags    int    `json:"flags,omitempty"`    // CAA
+	Tag      string `json:"tag,omitempty"`      // CAA
+	Value    string `json:"value,omitempty"`    // TXT, CAA
+}
+
+// journalRecord strips the parts of a record that do not belong in
+// the zone journal.
+func journalRecord(rec Record) Record {
+	return Record{Name: rec.Name, Type: rec.Type, Content: rec.Content, TTL: rec.TTL, View: rec.View}
 }
 
 /*
@@ -44,7 +165,9 @@ type Record struct {
  * PDNS needs this to build aggregate requests
  */
 type ZoneContent struct {
-	Content string // IPv4, IPv6, name
+	Content string // Record data in zone file form
+	TTL     int    `json:",omitempty"`
+	View    string `json:",omitempty"`
 }
 type ZoneEntry struct {
 	Types map[string][]ZoneContent // type -> [{}, {}, {}]
@@ -59,6 +182,74 @@ func NewZoneEntry() *ZoneEntry {
 type ZoneData struct {
 	Entries  map[string]*ZoneEntry // name -> entry
 	TenantId int
+	Settings *ZoneSettings `json:",omitempty"`
+	Explicit bool          `json:",omitempty"` // Made by POST rather than by adding a record
+	Dnssec   *ZoneDnssec   `json:",omitempty"` // Keys, when the zone is signed
+	Serial   uint32        // SOA serial, bumped on every change
+	Journal  []*ZoneDelta  `json:",omitempty"` // Recent changes, oldest first, for IXFR
+}
+
+// ZoneDelta is the change that took a zone from one serial to the
+// next.
+type ZoneDelta struct {
+	From    uint32
+	Serial  uint32
+	Removed []Record `json:",omitempty"`
+	Added   []Record `json:",omitempty"`
+}
+
+// How many changes to keep per zone for incremental transfers.
+const maxJournal = 100
+
+// bumpSerial moves the serial forward.  Serials follow the clock when
+// it is ahead, so that a zone that is deleted and created again does
+// not go backwards.
+func (zd *ZoneData) bumpSerial() {
+	next := zd.Serial + 1
+	if now := uint32(time.Now().Unix()); int32(now-next) > 0 {
+		next = now
+	}
+	zd.Serial = next
+}
+
+// recordChange bumps the serial and journals the change.
+func (zd *ZoneData) recordChange(removed, added []Record) {
+	from := zd.Serial
+	zd.bumpSerial()
+	zd.Journal = append(zd.Journal, &ZoneDelta{From: from, Serial: zd.Serial, Removed: removed, Added: added})
+	if len(zd.Journal) > maxJournal {
+		zd.Journal = zd.Journal[len(zd.Journal)-maxJournal:]
+	}
+}
+
+// journalSince returns the changes made since serial, or false if the
+// journal does not go back that far.
+func (zd *ZoneData) journalSince(serial uint32) ([]*ZoneDelta, bool) {
+	if serial == zd.Serial {
+		return nil, true
+	}
+	for i, d := range zd.Journal {
+		if d.From == serial {
+			return zd.Journal[i:], true
+		}
+	}
+	return nil, false
+}
+
+// recordTTL returns the TTL to use for a record with the given TTL.
+func (zd *ZoneData) recordTTL(ttl int) int {
+	if ttl != 0 {
+		return ttl
+	}
+	if zd != nil && zd.Settings != nil && zd.Settings.DefaultTTL != 0 {
+		return zd.Settings.DefaultTTL
+	}
+	return defaultTTL
+}
+
+// autoReverse says whether reverse records are made for the zone.
+func (zd *ZoneData) autoReverse() bool {
+	return zd == nil || zd.Settings == nil || zd.Settings.AutoReverse == nil || *zd.Settings.AutoReverse
 }
 
 func NewZoneData() *ZoneData {
@@ -86,6 +277,10 @@ type Frontend struct {
 	Backend  *dns_backend_point
 	ZoneInfo *ZoneTracker
 	store    LoadSaver
+	auditLog AuditLogger // nil when changes are not audited
+	// ddnsClients are the names in the client certificates of the
+	// services allowed to use /ddns.
+	ddnsClients map[string]bool
 }
 
 func NewFrontend(backend *dns_backend_point, store LoadSaver) *Frontend {
@@ -96,6 +291,24 @@ func NewFrontend(backend *dns_backend_point, store LoadSaver) *Frontend {
 	}
 }
 
+// router builds the routes of the management API.
+func (fe *Frontend) router() (rest.App, error) {
+	return rest.MakeRouter(
+		rest.Get("/zones", fe.GetAllZones),
+		rest.Post("/zones", fe.CreateZone),
+		rest.Get("/zones/#id", fe.GetZone),
+		rest.Put("/zones/#id", fe.UpdateZone),
+		rest.Delete("/zones/#id", fe.DeleteZone),
+		&rest.Route{HttpMethod: "PATCH", PathExp: "/zones/#id", Func: fe.PatchZone},
+		&rest.Route{HttpMethod: "PATCH", PathExp: "/zones/#id/records", Func: fe.PatchRecords},
+		rest.Get("/zones/#id/dnssec", fe.GetDnssec),
+		rest.Post("/zones/#id/dnssec/rollover", fe.RolloverDnssec),
+		rest.Post("/zones/#id/reconcile", fe.ReconcileZone),
+		rest.Get("/zones/#id/history", fe.GetHistory),
+		&rest.Route{HttpMethod: "PATCH", PathExp: "/ddns/zones/#id", Func: fe.DdnsPatchZone},
+	)
+}
+
 /*
  * Data storage/retrieval functions
  */
@@ -103,6 +316,12 @@ func (fe *Frontend) load_data() {
 	if err := fe.store.Load(fe.ZoneInfo); err != nil {
 		log.Panic(err)
 	}
+	// Zones saved before serials were tracked start from the clock.
+	for _, zone := range fe.ZoneInfo.Zones {
+		if zone.Serial == 0 {
+			zone.bumpSerial()
+		}
+	}
 }
 
 func (fe *Frontend) save_data() {
@@ -154,47 +373,57 @@ func (fe *Frontend) GetZone(w rest.ResponseWriter, r *rest.Request) {
 	}
 }
 
-// Patch function
-func (fe *Frontend) PatchZone(w rest.ResponseWriter, r *rest.Request) {
-	record := Record{}
-	err := r.DecodeJsonPayload(&record)
-	if err != nil {
-		rest.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+// zoneChange collects what a set of changes removed from and added to
+// a zone, for the journal.  Changes that undo each other cancel out.
+type zoneChange struct {
+	removed []Record
+	added   []Record
+}
 
-	zoneName := r.PathParam("id")
-	tenantId := record.TenantId
+func sameRecord(a, b Record) bool {
+	return a.Name == b.Name && a.Type == b.Type && a.Content == b.Content && a.TTL == b.TTL && a.View == b.View
+}
 
-	capMap, err := multitenancy.NewCapabilityMap(r.Request)
-	if err != nil {
-		rest.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+func dropRecord(recs []Record, rec Record) ([]Record, bool) {
+	for i, r := range recs {
+		if sameRecord(r, rec) {
+			return append(recs[:i], recs[i+1:]...), true
+		}
 	}
-	fe.ZoneInfo.Lock()
-	zone := fe.ZoneInfo.Zones[zoneName]
-	if zone != nil {
-		tenantId = zone.TenantId
+	return recs, false
+}
+
+func (zc *zoneChange) remove(rec Record) {
+	var found bool
+	rec = journalRecord(rec)
+	if zc.added, found = dropRecord(zc.added, rec); !found {
+		zc.removed = append(zc.removed, rec)
 	}
-	if !capMap.HasCapability(tenantId, "ZONE_UPDATE") {
-		rest.Error(w, "Forbidden", http.StatusForbidden)
-		return
+}
+
+func (zc *zoneChange) add(rec Record) {
+	var found bool
+	rec = journalRecord(rec)
+	if zc.removed, found = dropRecord(zc.removed, rec); !found {
+		zc.added = append(zc.added, rec)
 	}
+}
+
+func (zc *zoneChange) empty() bool {
+	return len(zc.removed) == 0 && len(zc.added) == 0
+}
+
+// apply makes one validated ADD or REMOVE to the zone.  A REMOVE gets
+// the TTL of the record it removed.
+func (zd *ZoneData) apply(zoneName string, record *Record, change *zoneChange) {
 	switch record.ChangeType {
 	case "ADD":
-		// If no zone, create zone
-		if zone == nil {
-			zone = NewZoneData()
-			zone.TenantId = tenantId
-			fe.ZoneInfo.Zones[zoneName] = zone
-		}
-
 		// If no entry, create entry
-		zes := zone.Entries[record.Name]
+		zes := zd.Entries[record.Name]
 		// Make holder for name if not there
 		if zes == nil {
-			zone.Entries[record.Name] = NewZoneEntry()
-			zes = zone.Entries[record.Name]
+			zd.Entries[record.Name] = NewZoneEntry()
+			zes = zd.Entries[record.Name]
 		}
 
 		// Check if type exists, if not create it
@@ -205,63 +434,395 @@ func (fe *Frontend) PatchZone(w rest.ResponseWriter, r *rest.Request) {
 		}
 
 		// Check the list for content
-		for _, ze := range zt {
-			if ze.Content == record.Content {
-				// Already have data. Just return
-				goto output
+		for i, ze := range zt {
+			if ze.View == record.View && canonicalContent(zoneName, record.Type, ze.Content) == record.Content {
+				if ze.TTL != record.TTL {
+					// Same data with a new TTL
+					change.remove(Record{Name: record.Name, Type: record.Type, Content: record.Content, TTL: ze.TTL, View: ze.View})
+					change.add(*record)
+					zt[i].TTL = record.TTL
+				}
+				// Already have data.
+				return
 			}
 		}
 
 		// Add new entry
 		nze := ZoneContent{
 			Content: record.Content,
+			TTL:     record.TTL,
+			View:    record.View,
 		}
 		zes.Types[record.Type] = append(zt, nze)
-		fe.save_data()
+		change.add(*record)
 	case "REMOVE":
-		if zone == nil {
-			goto output
-		}
-		zes := zone.Entries[record.Name]
+		zes := zd.Entries[record.Name]
 		if zes == nil {
-			goto output
+			return
 		}
 		zt := zes.Types[record.Type]
-		if zt == nil {
-			goto output
-		}
-
 		for i, zc := range zt {
 			// Remove the entry from the slice
-			if zc.Content == record.Content {
+			if zc.View == record.View && canonicalContent(zoneName, record.Type, zc.Content) == record.Content {
+				record.TTL = zc.TTL
 				zt[i], zes.Types[record.Type] = zt[len(zt)-1], zt[:len(zt)-1]
 				if len(zes.Types[record.Type]) == 0 {
 					delete(zes.Types, record.Type)
 				}
 				if len(zes.Types) == 0 {
-					delete(zone.Entries, record.Name)
-				}
-				if len(zone.Entries) == 0 {
-					delete(fe.ZoneInfo.Zones, zoneName)
+					delete(zd.Entries, record.Name)
 				}
-				fe.save_data()
-				break
+				change.remove(*record)
+				return
+			}
+		}
+	}
+}
+
+// RecordBatch is a list of changes to make to a zone together.
+// TenantId is used if the zone has to be created.
+type RecordBatch struct {
+	Records  []Record `json:"records"`
+	TenantId int      `json:"tenant_id"`
+}
+
+// Patch function
+func (fe *Frontend) PatchZone(w rest.ResponseWriter, r *rest.Request) {
+	record := Record{}
+	err := r.DecodeJsonPayload(&record)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	capMap, err := multitenancy.NewCapabilityMap(r.Request)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fe.patchRecords(w, r, r.Header.Get("X-Authenticated-Username"), func(tenantId int) bool {
+		return capMap.HasCapability(tenantId, "ZONE_UPDATE")
+	}, record.TenantId, []Record{record})
+}
+
+// clientName returns the name in the client certificate of a request.
+// The server only accepts certificates signed by the internal root, so
+// it names one of our own services.
+func clientName(r *rest.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+// DdnsPatchZone changes a record for a service publishing names of its
+// own, like rebar-dhcp does for its leases.  The service is known by
+// its client certificate rather than by headers from the rev proxy,
+// and may only change zones of the tenant the record is for.
+func (fe *Frontend) DdnsPatchZone(w rest.ResponseWriter, r *rest.Request) {
+	name := clientName(r)
+	if !fe.ddnsClients[name] {
+		rest.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	record := Record{}
+	if err := r.DecodeJsonPayload(&record); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fe.patchRecords(w, r, name, func(tenantId int) bool {
+		return tenantId == record.TenantId
+	}, record.TenantId, []Record{record})
+}
+
+// Batch patch function.  The changes are all made or, if any of them
+// is invalid, none are, and the backend is updated once.
+func (fe *Frontend) PatchRecords(w rest.ResponseWriter, r *rest.Request) {
+	if r.Body == nil {
+		rest.Error(w, "Must have body", http.StatusBadRequest)
+		return
+	}
+	batch := RecordBatch{}
+	if err := r.DecodeJsonPayload(&batch); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(batch.Records) == 0 {
+		rest.Error(w, "No records to change", http.StatusBadRequest)
+		return
+	}
+	capMap, err := multitenancy.NewCapabilityMap(r.Request)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fe.patchRecords(w, r, r.Header.Get("X-Authenticated-Username"), func(tenantId int) bool {
+		return capMap.HasCapability(tenantId, "ZONE_UPDATE")
+	}, batch.TenantId, batch.Records)
+}
+
+// patchRecords makes the changes to a zone on behalf of user, if
+// allowed says user may change zones of the tenant owning it.
+func (fe *Frontend) patchRecords(w rest.ResponseWriter, r *rest.Request, user string, allowed func(tenantId int) bool, tenantId int, records []Record) {
+	zoneName := r.PathParam("id")
+	for i := range records {
+		record := &records[i]
+		err := record.normalize(zoneName)
+		if err == nil && record.ChangeType != "ADD" && record.ChangeType != "REMOVE" {
+			err = errors.New("Invalid action type")
+		}
+		if err != nil {
+			msg := err.Error()
+			if len(records) > 1 {
+				msg = fmt.Sprintf("Record %d: %s", i, msg)
 			}
+			rest.Error(w, msg, http.StatusBadRequest)
+			return
 		}
-	default:
+		if record.View != "" && !fe.servesViews() {
+			rest.Error(w, "Views are not supported by this DNS backend", http.StatusBadRequest)
+			return
+		}
+	}
+
+	fe.ZoneInfo.Lock()
+	zone := fe.ZoneInfo.Zones[zoneName]
+	if zone != nil {
+		tenantId = zone.TenantId
+	}
+	if !allowed(tenantId) {
 		fe.ZoneInfo.Unlock()
-		rest.Error(w, "Invalid action type", 400)
+		rest.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	for i, record := range records {
+		if record.View == "" {
+			continue
+		}
+		if zone == nil || zone.Settings.view(record.View) == nil {
+			fe.ZoneInfo.Unlock()
+			msg := "Unknown view " + record.View
+			if len(records) > 1 {
+				msg = fmt.Sprintf("Record %d: %s", i, msg)
+			}
+			rest.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+	}
+	keys := recordKeys(records)
+	before := zone.rrsetRecords(zoneName, keys)
+	change := &zoneChange{}
+	for i := range records {
+		if zone == nil && records[i].ChangeType == "ADD" {
+			// If no zone, create zone
+			zone = NewZoneData()
+			zone.TenantId = tenantId
+			fe.ZoneInfo.Zones[zoneName] = zone
+		}
+		if zone != nil {
+			zone.apply(zoneName, &records[i], change)
+		}
+	}
+	if !change.empty() {
+		// Zones made by adding records go away with their last record.
+		if len(zone.Entries) == 0 && !zone.Explicit {
+			delete(fe.ZoneInfo.Zones, zoneName)
+		}
+		zone.recordChange(change.removed, change.added)
+		fe.save_data()
+		fe.auditAs(user, zoneName, "PATCH", zone, &AuditEntry{Before: before, After: zone.rrsetRecords(zoneName, keys)})
+	}
+	fe.ZoneInfo.Unlock()
+
+	data, derr := (*fe.Backend).PatchZone(fe.ZoneInfo, zoneName, records)
+	if derr != nil {
+		rest.Error(w, derr.Error(), derr.StatusCode())
 		return
 	}
 
-output:
+	w.WriteJson(data)
+}
+
+// Create function
+func (fe *Frontend) CreateZone(w rest.ResponseWriter, r *rest.Request) {
+	if r.Body == nil {
+		rest.Error(w, "Must have body", http.StatusBadRequest)
+		return
+	}
+	zone := Zone{}
+	if err := r.DecodeJsonPayload(&zone); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	zoneName := strings.TrimSuffix(zone.Name, ".")
+	if _, ok := dns.IsDomainName(zoneName); !ok || zoneName == "" {
+		rest.Error(w, "Invalid zone name", http.StatusBadRequest)
+		return
+	}
+	if zone.Settings != nil {
+		if err := zone.Settings.validate(); err != nil {
+			rest.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if zone.Settings.Dnssec && !fe.signsZones() {
+			rest.Error(w, "DNSSEC is not supported by this DNS backend", http.StatusBadRequest)
+			return
+		}
+		if len(zone.Settings.Views) > 0 && !fe.servesViews() {
+			rest.Error(w, "Views are not supported by this DNS backend", http.StatusBadRequest)
+			return
+		}
+	}
+	capMap, err := multitenancy.NewCapabilityMap(r.Request)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !capMap.HasCapability(zone.TenantId, "ZONE_CREATE") {
+		rest.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	fe.ZoneInfo.Lock()
+	if fe.ZoneInfo.Zones[zoneName] != nil {
+		fe.ZoneInfo.Unlock()
+		rest.Error(w, "Zone already exists", http.StatusConflict)
+		return
+	}
+	if err := fe.checkViews(zoneName, zone.Settings); err != nil {
+		fe.ZoneInfo.Unlock()
+		rest.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	zd := NewZoneData()
+	zd.TenantId = zone.TenantId
+	zd.Settings = zone.Settings
+	zd.Explicit = true
+	if err := zd.syncDnssec(time.Now()); err != nil {
+		fe.ZoneInfo.Unlock()
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	zd.bumpSerial()
+	fe.ZoneInfo.Zones[zoneName] = zd
+	fe.save_data()
+	fe.audit(r, zoneName, "CREATE", zd, &AuditEntry{SettingsAfter: zd.Settings})
 	fe.ZoneInfo.Unlock()
 
-	data, derr := (*fe.Backend).PatchZone(fe.ZoneInfo, zoneName, record)
+	data, derr := (*fe.Backend).CreateZone(fe.ZoneInfo, zoneName)
 	if derr != nil {
 		rest.Error(w, derr.Error(), derr.StatusCode())
 		return
 	}
+	w.WriteJson(data)
+}
+
+// Update function.  This replaces the settings of the zone.
+func (fe *Frontend) UpdateZone(w rest.ResponseWriter, r *rest.Request) {
+	if r.Body == nil {
+		rest.Error(w, "Must have body", http.StatusBadRequest)
+		return
+	}
+	settings := &ZoneSettings{}
+	if err := r.DecodeJsonPayload(settings); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if settings.Dnssec && !fe.signsZones() {
+		rest.Error(w, "DNSSEC is not supported by this DNS backend", http.StatusBadRequest)
+		return
+	}
+	if len(settings.Views) > 0 && !fe.servesViews() {
+		rest.Error(w, "Views are not supported by this DNS backend", http.StatusBadRequest)
+		return
+	}
+	zoneName := r.PathParam("id")
+	capMap, err := multitenancy.NewCapabilityMap(r.Request)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fe.ZoneInfo.Lock()
+	zone := fe.ZoneInfo.Zones[zoneName]
+	if zone == nil {
+		fe.ZoneInfo.Unlock()
+		rest.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if !capMap.HasCapability(zone.TenantId, "ZONE_UPDATE") {
+		fe.ZoneInfo.Unlock()
+		if !capMap.HasCapability(zone.TenantId, "ZONE_READ") {
+			rest.Error(w, "Not Found", http.StatusNotFound)
+		} else {
+			rest.Error(w, "Forbidden", http.StatusForbidden)
+		}
+		return
+	}
+	if err := zone.checkViewsUsed(settings); err != nil {
+		fe.ZoneInfo.Unlock()
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := fe.checkViews(zoneName, settings); err != nil {
+		fe.ZoneInfo.Unlock()
+		rest.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	oldSettings := zone.Settings
+	zone.Settings = settings
+	if err := zone.syncDnssec(time.Now()); err != nil {
+		fe.ZoneInfo.Unlock()
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The SOA changed, so secondaries need a new serial.
+	zone.recordChange(nil, nil)
+	fe.save_data()
+	fe.audit(r, zoneName, "UPDATE", zone, &AuditEntry{SettingsBefore: oldSettings, SettingsAfter: settings})
+	fe.ZoneInfo.Unlock()
 
+	data, derr := (*fe.Backend).UpdateZone(fe.ZoneInfo, zoneName)
+	if derr != nil {
+		rest.Error(w, derr.Error(), derr.StatusCode())
+		return
+	}
 	w.WriteJson(data)
 }
+
+// Delete function.  This removes the zone and all its records.
+func (fe *Frontend) DeleteZone(w rest.ResponseWriter, r *rest.Request) {
+	zoneName := r.PathParam("id")
+	capMap, err := multitenancy.NewCapabilityMap(r.Request)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fe.ZoneInfo.Lock()
+	zone := fe.ZoneInfo.Zones[zoneName]
+	if zone == nil {
+		fe.ZoneInfo.Unlock()
+		rest.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if !capMap.HasCapability(zone.TenantId, "ZONE_DESTROY") {
+		fe.ZoneInfo.Unlock()
+		if !capMap.HasCapability(zone.TenantId, "ZONE_READ") {
+			rest.Error(w, "Not Found", http.StatusNotFound)
+		} else {
+			rest.Error(w, "Forbidden", http.StatusForbidden)
+		}
+		return
+	}
+	delete(fe.ZoneInfo.Zones, zoneName)
+	fe.save_data()
+	fe.audit(r, zoneName, "DELETE", zone, &AuditEntry{Before: zone.allRecords(zoneName), SettingsBefore: zone.Settings})
+	fe.ZoneInfo.Unlock()
+
+	if derr := (*fe.Backend).DeleteZone(fe.ZoneInfo, zoneName, zone); derr != nil {
+		rest.Error(w, derr.Error(), derr.StatusCode())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
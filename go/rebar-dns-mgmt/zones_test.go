@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/miekg/dns"
+)
+
+type memStore struct{}
+
+func (ms *memStore) Save(*ZoneTracker) error { return nil }
+func (ms *memStore) Load(*ZoneTracker) error { return nil }
+
+const allCaps = `{"1":{"parent":0,"capabilities":["ZONE_CREATE","ZONE_READ","ZONE_UPDATE","ZONE_DESTROY"]}}`
+
+func testFrontend(t *testing.T) (*Frontend, http.Handler) {
+	di, _ := NewNativeDnsInstance("ns1.example.com", nil, nil)
+	var be dns_backend_point = di
+	fe := NewFrontend(&be, &memStore{})
+	di.load(fe.ZoneInfo)
+	router, err := fe.router()
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := rest.NewApi()
+	api.SetApp(router)
+	return fe, api.MakeHandler()
+}
+
+func doRequest(handler http.Handler, method, path, caps, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, "http://127.0.0.1:6754"+path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Authenticated-Capability", caps)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestZoneLifecycle(t *testing.T) {
+	fe, handler := testFrontend(t)
+
+	rec := doRequest(handler, "POST", "/zones", allCaps, `{"name":"example.com.","tenant_id":1,"settings":{"nameservers":["ns1.example.com","ns2.example.com"],"default_ttl":600}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected create to work, but got %d %s", rec.Code, rec.Body.String())
+	}
+	zd := fe.ZoneInfo.Zones["example.com"]
+	if zd == nil || zd.Settings.Nameservers[1] != "ns2.example.com." {
+		t.Fatalf("Expected zone with qualified nameservers, but got %+v", zd)
+	}
+	if rec = doRequest(handler, "POST", "/zones", allCaps, `{"name":"example.com","tenant_id":1}`); rec.Code != http.StatusConflict {
+		t.Errorf("Expected duplicate create to conflict, but got %d", rec.Code)
+	}
+	if rec = doRequest(handler, "POST", "/zones", allCaps, `{"name":"bad..name"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected bad name to be rejected, but got %d", rec.Code)
+	}
+
+	rec = doRequest(handler, "PATCH", "/zones/example.com", allCaps, `{"changetype":"ADD","name":"node1","type":"A","content":"192.168.1.10","tenant_id":1}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected patch to work, but got %d %s", rec.Code, rec.Body.String())
+	}
+	zone := Zone{}
+	json.Unmarshal(rec.Body.Bytes(), &zone)
+	if len(zone.Records) != 1 || zone.Records[0].TTL != 600 {
+		t.Errorf("Expected record with the zone default TTL, but got %+v", zone.Records)
+	}
+
+	serial := zd.Serial
+	rec = doRequest(handler, "PUT", "/zones/example.com", allCaps, `{"primary_ns":"ns9.example.com","auto_reverse":false}`)
+	if rec.Code != http.StatusOK || zd.Serial == serial || *zd.Settings.AutoReverse {
+		t.Errorf("Expected settings to change with a new serial, but got %d %+v", rec.Code, zd.Settings)
+	}
+	di := (*fe.Backend).(*NativeDnsInstance)
+	fe.ZoneInfo.Lock()
+	idx := di.currentIndex()
+	fe.ZoneInfo.Unlock()
+	if soa := idx.zones["example.com."].soa; soa.Ns != "ns9.example.com." {
+		t.Errorf("Expected SOA to use the new primary, but got %v", soa)
+	}
+	if len(idx.ptrs) != 0 {
+		t.Errorf("Expected no reverse records, but got %v", idx.ptrs)
+	}
+	if ns := idx.zones["example.com."].owners["example.com."]; len(ns) != 1 || ns[0].(*dns.NS).Ns != "ns9.example.com." {
+		t.Errorf("Expected NS to follow the primary, but got %v", ns)
+	}
+
+	if rec = doRequest(handler, "DELETE", "/zones/example.com", allCaps, ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected delete to work, but got %d", rec.Code)
+	}
+	if fe.ZoneInfo.Zones["example.com"] != nil {
+		t.Error("Expected zone to be gone")
+	}
+	if rec = doRequest(handler, "DELETE", "/zones/example.com", allCaps, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected second delete to be not found, but got %d", rec.Code)
+	}
+}
+
+func TestZoneCapabilities(t *testing.T) {
+	_, handler := testFrontend(t)
+	readOnly := `{"1":{"parent":0,"capabilities":["ZONE_READ"]}}`
+
+	if rec := doRequest(handler, "POST", "/zones", readOnly, `{"name":"example.com","tenant_id":1}`); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected create without ZONE_CREATE to be forbidden, but got %d", rec.Code)
+	}
+	doRequest(handler, "POST", "/zones", allCaps, `{"name":"example.com","tenant_id":1}`)
+	if rec := doRequest(handler, "PUT", "/zones/example.com", readOnly, `{}`); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected update without ZONE_UPDATE to be forbidden, but got %d", rec.Code)
+	}
+	if rec := doRequest(handler, "DELETE", "/zones/example.com", "{}", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected delete of an unreadable zone to be not found, but got %d", rec.Code)
+	}
+	if rec := doRequest(handler, "PATCH", "/zones/example.com", allCaps, `{"changetype":"ADD","name":"x","type":"MX","content":"mail"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected invalid record to be rejected, but got %d", rec.Code)
+	}
+}
+
+func TestZoneSettingsResolve(t *testing.T) {
+	settings := (&ZoneSettings{}).resolve("ns1.example.com")
+	if settings.PrimaryNS != "ns1.example.com." || len(settings.Nameservers) != 1 ||
+		settings.DefaultTTL != defaultTTL || !*settings.AutoReverse || settings.Minimum != defaultMinimum {
+		t.Errorf("Expected defaults, but got %+v", settings)
+	}
+	if err := (&ZoneSettings{DefaultTTL: -1}).validate(); err == nil {
+		t.Error("Expected negative default TTL to be rejected")
+	}
+}
+
+func TestPatchRecordsBatch(t *testing.T) {
+	fe, handler := testFrontend(t)
+	doRequest(handler, "POST", "/zones", allCaps, `{"name":"example.com","tenant_id":1}`)
+	zd := fe.ZoneInfo.Zones["example.com"]
+	journal := len(zd.Journal)
+
+	rec := doRequest(handler, "PATCH", "/zones/example.com/records", allCaps, `{"records":[
+		{"changetype":"ADD","name":"node1","type":"A","content":"192.168.1.10"},
+		{"changetype":"ADD","name":"node2","type":"A","content":"192.168.1.11"},
+		{"changetype":"ADD","name":"node2","type":"TXT","value":"rack 4"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected batch to work, but got %d %s", rec.Code, rec.Body.String())
+	}
+	if len(zd.Entries) != 2 || len(zd.Journal) != journal+1 || len(zd.Journal[journal].Added) != 3 {
+		t.Errorf("Expected 3 records added in one change, but got %d entries and journal %v", len(zd.Entries), zd.Journal)
+	}
+
+	serial := zd.Serial
+	rec = doRequest(handler, "PATCH", "/zones/example.com/records", allCaps, `{"records":[
+		{"changetype":"REMOVE","name":"node1","type":"A","content":"192.168.1.10"},
+		{"changetype":"ADD","name":"node3","type":"A","content":"not-an-ip"}]}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "Record 1") {
+		t.Errorf("Expected batch to be rejected at record 1, but got %d %s", rec.Code, rec.Body.String())
+	}
+	if zd.Entries["node1"] == nil || zd.Serial != serial {
+		t.Error("Expected rejected batch to leave the zone alone")
+	}
+
+	rec = doRequest(handler, "PATCH", "/zones/example.com/records", allCaps, `{"records":[
+		{"changetype":"ADD","name":"tmp","type":"A","content":"192.168.1.99"},
+		{"changetype":"REMOVE","name":"tmp","type":"A","content":"192.168.1.99"}]}`)
+	if rec.Code != http.StatusOK || zd.Serial != serial {
+		t.Errorf("Expected changes that cancel out to leave the serial alone, but got %d", rec.Code)
+	}
+
+	rec = doRequest(handler, "PATCH", "/zones/example.com/records", allCaps, `{"records":[
+		{"changetype":"REMOVE","name":"node1","type":"A","content":"192.168.1.10"},
+		{"changetype":"REMOVE","name":"node2","type":"A","content":"192.168.1.11"},
+		{"changetype":"REMOVE","name":"node2","type":"TXT","value":"rack 4"}]}`)
+	if rec.Code != http.StatusOK || len(zd.Entries) != 0 {
+		t.Errorf("Expected all records removed, but got %d %v", rec.Code, zd.Entries)
+	}
+	if fe.ZoneInfo.Zones["example.com"] == nil {
+		t.Error("Expected a created zone to outlive its records")
+	}
+}
+
+// ddnsRequest makes a request to /ddns as a service holding a client
+// certificate for name, or without one if name is empty.
+func ddnsRequest(handler http.Handler, name, zone, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("PATCH", "https://127.0.0.1:6754/ddns/zones/"+zone, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if name != "" {
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+			&x509.Certificate{Subject: pkix.Name{CommonName: name}},
+		}}
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestDdnsPatchZone(t *testing.T) {
+	fe, handler := testFrontend(t)
+	fe.ddnsClients = map[string]bool{"rebar-dhcp": true}
+	doRequest(handler, "POST", "/zones", allCaps, `{"name":"example.com","tenant_id":1}`)
+	zd := fe.ZoneInfo.Zones["example.com"]
+	add := `{"changetype":"ADD","name":"node1","type":"A","content":"192.168.1.10","tenant_id":%d}`
+
+	rec := doRequest(handler, "PATCH", "/ddns/zones/example.com", allCaps, fmt.Sprintf(add, 1))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected capability headers without a certificate to be forbidden, but got %d", rec.Code)
+	}
+	if rec = ddnsRequest(handler, "rebar-client", "example.com", fmt.Sprintf(add, 1)); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected an unlisted certificate to be forbidden, but got %d", rec.Code)
+	}
+	if rec = ddnsRequest(handler, "rebar-dhcp", "example.com", fmt.Sprintf(add, 2)); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a record for another tenant to be forbidden, but got %d", rec.Code)
+	}
+	if len(zd.Entries) != 0 {
+		t.Fatalf("Expected forbidden changes to leave the zone alone, but got %v", zd.Entries)
+	}
+
+	if rec = ddnsRequest(handler, "rebar-dhcp", "example.com", fmt.Sprintf(add, 1)); rec.Code != http.StatusOK {
+		t.Fatalf("Expected rebar-dhcp to publish in its tenant's zone, but got %d %s", rec.Code, rec.Body.String())
+	}
+	if zd.Entries["node1"] == nil {
+		t.Errorf("Expected node1 to be added, but got %v", zd.Entries)
+	}
+	if rec = ddnsRequest(handler, "rebar-dhcp", "other.com", fmt.Sprintf(add, 2)); rec.Code != http.StatusOK {
+		t.Fatalf("Expected a missing zone to be made, but got %d %s", rec.Code, rec.Body.String())
+	}
+	if zd := fe.ZoneInfo.Zones["other.com"]; zd == nil || zd.TenantId != 2 {
+		t.Errorf("Expected other.com to belong to tenant 2, but got %+v", zd)
+	}
+}
+
+func TestPowerDnsBatch(t *testing.T) {
+	var got PowerDnsRRSets
+	patches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PATCH" {
+			patches++
+			json.NewDecoder(r.Body).Decode(&got)
+		}
+		w.Write([]byte(`{"name":"example.com"}`))
+	}))
+	defer srv.Close()
+
+	zt := testZones()
+	addRecord(zt.Zones["example.com"], "node1", "A", "192.168.1.20")
+	di := &PowerDnsInstance{UrlBase: srv.URL}
+	_, err := di.PatchZone(zt, "example.com", []Record{
+		{ChangeType: "ADD", Name: "node1", Type: "A", Content: "192.168.1.20"},
+		{ChangeType: "ADD", Name: "node1", Type: "A", Content: "192.168.1.10"},
+		{ChangeType: "REMOVE", Name: "gone", Type: "A", Content: "192.168.1.30"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patches != 1 || len(got.PowerDnsRRSets) != 2 {
+		t.Fatalf("Expected one PATCH with 2 rrsets, but got %d and %+v", patches, got)
+	}
+	if rrs := got.PowerDnsRRSets[0]; rrs.ChangeType != "REPLACE" || len(rrs.PowerDnsRecords) != 2 {
+		t.Errorf("Expected node1 to be replaced with 2 records, but got %+v", rrs)
+	}
+	if rrs := got.PowerDnsRRSets[1]; rrs.ChangeType != "DELETE" {
+		t.Errorf("Expected gone to be deleted, but got %+v", rrs)
+	}
+}